@@ -24,7 +24,7 @@ func (node DropStmt) Deparse(ctx Context) (string, error) {
 	out := []string{"DROP", ""}
 
 	if removeType, ok := dropStmtRemoveTypes[node.RemoveType]; !ok {
-		panic(fmt.Sprintf("cannot handle remove type [%s]", node.RemoveType.String()))
+		return "", fmt.Errorf("cannot handle remove type [%s]", node.RemoveType.String())
 	} else {
 		out[1] = removeType
 	}
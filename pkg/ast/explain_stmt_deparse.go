@@ -2,6 +2,55 @@
 
 package ast
 
+import (
+	"fmt"
+	"strings"
+)
+
 func (node ExplainStmt) Deparse(ctx Context) (string, error) {
-	panic("Not Implemented")
+	out := []string{"EXPLAIN"}
+	if options, err := node.DeparseOptions(); err != nil {
+		return "", err
+	} else if options != "" {
+		out = append(out, options)
+	}
+
+	if node.Query == nil {
+		return "", fmt.Errorf("explain statement does not have a query")
+	}
+
+	query, err := node.Query.Deparse(Context_None)
+	if err != nil {
+		return "", err
+	}
+	out = append(out, query)
+	return strings.Join(out, " "), nil
+}
+
+// DeparseOptions returns the parenthesized options of the explain statement, if there are no
+// options then an empty string is returned.
+func (node ExplainStmt) DeparseOptions() (string, error) {
+	if len(node.Options.Items) == 0 {
+		return "", nil
+	}
+
+	options := make([]string, 0, len(node.Options.Items))
+	for _, item := range node.Options.Items {
+		defElem, ok := item.(DefElem)
+		if !ok || defElem.Defname == nil {
+			return "", fmt.Errorf("couldn't deparse explain option: %T", item)
+		}
+
+		option := strings.ToUpper(*defElem.Defname)
+		if defElem.Arg != nil {
+			arg, err := defElem.Arg.Deparse(Context_Operator)
+			if err != nil {
+				return "", err
+			}
+			option = fmt.Sprintf("%s %s", option, arg)
+		}
+		options = append(options, option)
+	}
+
+	return fmt.Sprintf("(%s)", strings.Join(options, ", ")), nil
 }
@@ -0,0 +1,19 @@
+package ast
+
+import (
+	"testing"
+)
+
+func Test_ExplainStmt_Generic(t *testing.T) {
+	DoTest(t, DeparseTest{
+		Query:    `EXPLAIN SELECT 1`,
+		Expected: `EXPLAIN SELECT 1`,
+	})
+}
+
+func Test_ExplainStmt_Options(t *testing.T) {
+	DoTest(t, DeparseTest{
+		Query:    `EXPLAIN (ANALYZE, VERBOSE false, FORMAT json) SELECT 1`,
+		Expected: `EXPLAIN (ANALYZE, VERBOSE false, FORMAT json) SELECT 1`,
+	})
+}
@@ -2,6 +2,7 @@ package ast
 
 import (
 	"crypto/sha1"
+	"encoding/hex"
 	"hash"
 	"io"
 	"reflect"
@@ -87,6 +88,15 @@ func Deparse(node Node) (string, error) {
 	return node.Deparse(Context_None)
 }
 
+// Fingerprint returns the hex encoded fingerprint of the provided node. Constants and
+// placeholders are not included in the fingerprint, so queries that only differ by their
+// values will have the same fingerprint.
+func Fingerprint(node Node) string {
+	ctx := NewFingerprintHashContext()
+	node.Fingerprint(ctx, nil, "")
+	return hex.EncodeToString(ctx.Sum())
+}
+
 func deparseNodeList(nodes []Node, ctx Context) ([]string, error) {
 	out := make([]string, len(nodes))
 	for i, node := range nodes {
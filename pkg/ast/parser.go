@@ -11,6 +11,12 @@ func parseToJSON(input string) (result string, err error) {
 	return pgparser.ParseToJSON(input)
 }
 
+// Normalize replaces the constant values in the SQL statement with placeholders, statements that
+// only differ by their constants will be normalized to the same text.
+func Normalize(input string) (string, error) {
+	return pgparser.Normalize(input)
+}
+
 // Parse the given SQL statement into an AST (native Go structs)
 func Parse(input string) (tree SyntaxTree, err error) {
 	defer func() {
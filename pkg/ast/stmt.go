@@ -6,6 +6,30 @@ type Stmt interface {
 	Deparse(ctx Context) (string, error)
 }
 
+func (node AlterEnumStmt) StatementType() StmtType { return DDL }
+
+func (node AlterEnumStmt) StatementTag() string { return "ALTER TYPE" }
+
+func (node AlterSystemStmt) StatementType() StmtType { return Ack }
+
+func (node AlterSystemStmt) StatementTag() string { return "ALTER SYSTEM" }
+
+func (node AlterTableStmt) StatementType() StmtType { return DDL }
+
+func (node AlterTableStmt) StatementTag() string { return "ALTER TABLE" }
+
+func (node CompositeTypeStmt) StatementType() StmtType { return DDL }
+
+func (node CompositeTypeStmt) StatementTag() string { return "CREATE TYPE" }
+
+func (node CreateDomainStmt) StatementType() StmtType { return DDL }
+
+func (node CreateDomainStmt) StatementTag() string { return "CREATE DOMAIN" }
+
+func (node CreateEnumStmt) StatementType() StmtType { return DDL }
+
+func (node CreateEnumStmt) StatementTag() string { return "CREATE TYPE" }
+
 func (node CreateStmt) StatementType() StmtType { return DDL }
 
 func (node CreateStmt) StatementTag() string { return "CREATE TABLE" }
@@ -26,7 +50,26 @@ func (node DeleteStmt) StatementTag() string { return "DELETE" }
 
 func (node DropStmt) StatementType() StmtType { return DDL }
 
-func (node DropStmt) StatementTag() string { return "DROP TABLE" }
+func (node DropStmt) StatementTag() string {
+	switch node.RemoveType {
+	case OBJECT_INDEX:
+		return "DROP INDEX"
+	case OBJECT_TYPE:
+		return "DROP TYPE"
+	case OBJECT_DOMAIN:
+		return "DROP DOMAIN"
+	default:
+		return "DROP TABLE"
+	}
+}
+
+func (node ExplainStmt) StatementType() StmtType { return Rows }
+
+func (node ExplainStmt) StatementTag() string { return "EXPLAIN" }
+
+func (node IndexStmt) StatementType() StmtType { return DDL }
+
+func (node IndexStmt) StatementTag() string { return "CREATE INDEX" }
 
 func (node InsertStmt) StatementType() StmtType {
 	if node.ReturningList.Items != nil && len(node.ReturningList.Items) > 0 {
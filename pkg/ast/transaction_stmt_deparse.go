@@ -23,9 +23,68 @@ func (node TransactionStmt) Deparse(ctx Context) (string, error) {
 		}
 	} else {
 		if node.Options.Items != nil && len(node.Options.Items) > 0 {
+			modes := make([]string, 0)
+			for _, item := range node.Options.Items {
+				defElem, ok := item.(DefElem)
+				if !ok || defElem.Defname == nil {
+					return "", fmt.Errorf("couldn't deparse transaction option: %T", item)
+				}
 
+				switch *defElem.Defname {
+				case "savepoint_name":
+					name, err := defElem.Arg.Deparse(Context_None)
+					if err != nil {
+						return "", err
+					}
+					switch node.Kind {
+					case TRANS_STMT_ROLLBACK_TO:
+						out = append(out, "TO SAVEPOINT", name)
+					case TRANS_STMT_RELEASE:
+						out = append(out, "SAVEPOINT", name)
+					default:
+						out = append(out, name)
+					}
+				case "transaction_isolation":
+					constant, ok := defElem.Arg.(A_Const)
+					if !ok {
+						return "", fmt.Errorf("couldn't deparse transaction isolation: %T", defElem.Arg)
+					}
+					level, err := constant.Val.Deparse(Context_Operator)
+					if err != nil {
+						return "", err
+					}
+					modes = append(modes, fmt.Sprintf("ISOLATION LEVEL %s", strings.ToUpper(level)))
+				case "transaction_read_only":
+					if transactionOptionEnabled(defElem.Arg) {
+						modes = append(modes, "READ ONLY")
+					} else {
+						modes = append(modes, "READ WRITE")
+					}
+				case "transaction_deferrable":
+					if transactionOptionEnabled(defElem.Arg) {
+						modes = append(modes, "DEFERRABLE")
+					} else {
+						modes = append(modes, "NOT DEFERRABLE")
+					}
+				default:
+					return "", fmt.Errorf("couldn't deparse transaction option: %s", *defElem.Defname)
+				}
+			}
+
+			if len(modes) > 0 {
+				out = append(out, strings.Join(modes, ", "))
+			}
 		}
 	}
 
 	return strings.Join(out, " "), nil
 }
+
+func transactionOptionEnabled(arg Node) bool {
+	if constant, ok := arg.(A_Const); ok {
+		if integer, ok := constant.Val.(Integer); ok {
+			return integer.Ival != 0
+		}
+	}
+	return false
+}
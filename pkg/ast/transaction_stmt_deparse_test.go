@@ -33,3 +33,33 @@ func Test_TransactionStmt_TwoPhaseCommit(t *testing.T) {
 		Expected: `COMMIT PREPARED '1234'`,
 	})
 }
+
+func Test_TransactionStmt_Options(t *testing.T) {
+	DoTest(t, DeparseTest{
+		Query:    `begin isolation level serializable read only`,
+		Expected: `BEGIN ISOLATION LEVEL SERIALIZABLE, READ ONLY`,
+	})
+	DoTest(t, DeparseTest{
+		Query:    `start transaction isolation level repeatable read, read write, deferrable`,
+		Expected: `BEGIN ISOLATION LEVEL REPEATABLE READ, READ WRITE, DEFERRABLE`,
+	})
+}
+
+func Test_TransactionStmt_Savepoint(t *testing.T) {
+	DoTest(t, DeparseTest{
+		Query:    `savepoint my_savepoint`,
+		Expected: `SAVEPOINT "my_savepoint"`,
+	})
+	DoTest(t, DeparseTest{
+		Query:    `release savepoint my_savepoint`,
+		Expected: `RELEASE SAVEPOINT "my_savepoint"`,
+	})
+	DoTest(t, DeparseTest{
+		Query:    `release my_savepoint`,
+		Expected: `RELEASE SAVEPOINT "my_savepoint"`,
+	})
+	DoTest(t, DeparseTest{
+		Query:    `rollback to savepoint my_savepoint`,
+		Expected: `ROLLBACK TO SAVEPOINT "my_savepoint"`,
+	})
+}
@@ -16,6 +16,9 @@ var (
 	AutoJoin       bool
 	UseTmpDir      bool
 	StoreDirectory string
+	MetricsAddr    string
+	TraceFile      string
+	TraceCollector string
 	LogLevel       string
 )
 
@@ -31,7 +34,7 @@ var (
 	startCmd = &cobra.Command{
 		Use: "start",
 		Run: func(cmd *cobra.Command, args []string) {
-			StartDB(StoreDirectory, JoinAddr, PgListenAddr, UseTmpDir, AutoDataNode, AutoJoin)
+			StartDB(StoreDirectory, JoinAddr, PgListenAddr, MetricsAddr, TraceFile, TraceCollector, UseTmpDir, AutoDataNode, AutoJoin)
 		},
 	}
 )
@@ -44,6 +47,9 @@ func init() {
 	startCmd.Flags().BoolVarP(&AutoJoin, "auto-join", "A", false, "try to auto-join an existing cluster")
 	startCmd.Flags().BoolVarP(&UseTmpDir, "temp", "t", false, "use temp directory each time")
 	startCmd.Flags().StringVarP(&StoreDirectory, "store", "s", "data", "directory that will be used for Noah's key value store")
+	startCmd.Flags().StringVarP(&MetricsAddr, "metrics-listen", "M", "", "address that will serve prometheus metrics at /metrics, metrics are not served if this is blank")
+	startCmd.Flags().StringVar(&TraceFile, "trace-file", "", "file that traces of each statement will be written to as OTLP/JSON")
+	startCmd.Flags().StringVar(&TraceCollector, "trace-collector", "", "url of an OpenTelemetry collector that traces of each statement will be sent to, like http://localhost:4318")
 	startCmd.Flags().StringVarP(&LogLevel, "log", "l", "verbose", "log output level, valid values: trace, verbose, debug, info, warn, error, fatal")
 	rootCmd.AddCommand(startCmd)
 }
@@ -55,7 +61,7 @@ func Execute() {
 	}
 }
 
-func StartDB(storeDirectory, joinAddr, listenAddr string, useTempDir, autoDataNode, autoJoin bool) {
+func StartDB(storeDirectory, joinAddr, listenAddr, metricsAddr, traceFile, traceCollector string, useTempDir, autoDataNode, autoJoin bool) {
 	if useTempDir {
 		tempdir, err := ioutil.TempDir("", "noahdb")
 		if err != nil {
@@ -67,5 +73,5 @@ func StartDB(storeDirectory, joinAddr, listenAddr string, useTempDir, autoDataNo
 			os.RemoveAll(tempdir)
 		}()
 	}
-	top.NoahMain(storeDirectory, joinAddr, listenAddr, autoDataNode, autoJoin)
+	top.NoahMain(storeDirectory, joinAddr, listenAddr, metricsAddr, traceFile, traceCollector, autoDataNode, autoJoin)
 }
@@ -3,6 +3,7 @@ package commands
 import (
 	"fmt"
 	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/pgerror"
 	"github.com/elliotcourant/noahdb/pkg/pgproto"
 )
 
@@ -29,11 +30,17 @@ type CommandResult struct {
 	tag     string
 
 	noDataMessage bool
+
+	// txStatus is the transaction status that will be sent in a ReadyForQuery message. This
+	// should be 'I' when idle, 'T' when in a transaction block or 'E' when in a failed
+	// transaction block.
+	txStatus byte
 }
 
 func CreateSyncCommandResult(backend *pgproto.Backend) *CommandResult {
 	result := NewCommandResult(backend)
 	result.typ = readyForQuery
+	result.txStatus = 'I'
 	return result
 }
 
@@ -94,6 +101,18 @@ func (result *CommandResult) SetError(err error) {
 	result.err = err
 }
 
+// SetCommandTag overrides the tag that will be sent in the CommandComplete message, this is used
+// to include the number of rows affected by the statement.
+func (result *CommandResult) SetCommandTag(tag string) {
+	result.tag = tag
+}
+
+// SetTransactionStatus sets the status that will be sent to the client in the ReadyForQuery
+// message.
+func (result *CommandResult) SetTransactionStatus(status byte) {
+	result.txStatus = status
+}
+
 func (result *CommandResult) Err() error {
 	return result.err
 }
@@ -105,9 +124,17 @@ func (result *CommandResult) CloseWithErr(e error) error {
 	defer func() {
 		result.closed = true
 	}()
-	return result.backend.Send(&pgproto.ErrorResponse{
-		Message: e.Error(),
-	})
+	errorResponse := &pgproto.ErrorResponse{
+		Severity: "ERROR",
+		Code:     pgerror.CodeInternalError,
+		Message:  e.Error(),
+	}
+	if pgErr, ok := pgerror.GetPGCause(e); ok {
+		errorResponse.Code = pgErr.Code
+		errorResponse.Detail = pgErr.Detail
+		errorResponse.Hint = pgErr.Hint
+	}
+	return result.backend.Send(errorResponse)
 }
 
 func (result *CommandResult) SetNoDataMessage(msg bool) {
@@ -137,7 +164,7 @@ func (result *CommandResult) Close() error {
 			return result.backend.Send(&pgproto.CloseComplete{})
 		case readyForQuery:
 			return result.backend.Send(&pgproto.ReadyForQuery{
-				TxStatus: 'I',
+				TxStatus: result.txStatus,
 			})
 		case emptyQueryResponse:
 			return result.backend.Send(&pgproto.EmptyQueryResponse{})
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"github.com/elliotcourant/noahdb/pkg/ast"
 	"github.com/elliotcourant/noahdb/pkg/commands"
+	"github.com/elliotcourant/noahdb/pkg/pgproto"
 	"github.com/elliotcourant/noahdb/testutils"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"testing"
 )
 
@@ -164,3 +166,31 @@ func TestCommandResult_CloseWithErr(t *testing.T) {
 		CloseWithErr(fmt.Errorf("test"))
 	assert.NoError(t, err)
 }
+
+func TestCommandResult_SetCommandTag(t *testing.T) {
+	stmt, err := ast.Parse("UPDATE products SET sku = 'test'")
+	assert.NoError(t, err)
+	backend, output := testutils.CreateTestBackendWithOutput(t)
+	command := commands.CreateExecuteCommandResult(
+		backend,
+		stmt.Statements[0].(ast.RawStmt).Stmt.(ast.UpdateStmt))
+	command.SetCommandTag("UPDATE 37")
+	assert.NoError(t, command.Close())
+
+	frontend, err := pgproto.NewFrontend(output, ioutil.Discard)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	message, err := frontend.Receive()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Equal(t, &pgproto.CommandComplete{CommandTag: "UPDATE 37"}, message)
+}
+
+func TestCommandResult_SetTransactionStatus(t *testing.T) {
+	cmd := commands.CreateSyncCommandResult(testutils.CreateTestBackend(t))
+	cmd.SetTransactionStatus('E')
+	err := cmd.Close()
+	assert.NoError(t, err)
+}
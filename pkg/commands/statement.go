@@ -5,10 +5,18 @@ import (
 	"github.com/elliotcourant/noahdb/pkg/pgwirebase"
 	"github.com/elliotcourant/noahdb/pkg/types"
 	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
+	"time"
 )
 
 type ExecuteStatement struct {
 	Statement ast.Stmt
+
+	// Query is the text that the statement was parsed from.
+	Query string
+
+	// ParseStart is when the query started to be parsed and ParseDuration is how long it took.
+	ParseStart    time.Time
+	ParseDuration time.Duration
 }
 
 // Command Implements the command interface
@@ -24,6 +32,13 @@ type PrepareStatement struct {
 	RawTypeHints []types.OID
 
 	Statement ast.Stmt
+
+	// Query is the text that the statement was parsed from.
+	Query string
+
+	// ParseStart is when the query started to be parsed and ParseDuration is how long it took.
+	ParseStart    time.Time
+	ParseDuration time.Duration
 }
 
 // Command Implements the command interface
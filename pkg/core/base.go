@@ -3,6 +3,8 @@ package core
 import (
 	"github.com/elliotcourant/noahdb/pkg/core/static"
 	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/noahdb/pkg/logger"
+	"github.com/elliotcourant/noahdb/pkg/tracing"
 	"github.com/elliotcourant/timber"
 	"net"
 	"sync"
@@ -15,6 +17,45 @@ type base struct {
 	poolSync sync.RWMutex
 	pool     map[uint64]*poolItem
 
+	// maxPoolSize is the most connections that will be opened to a single data node shard, this
+	// is refreshed from the max_pool_size setting. Zero means there is no limit.
+	maxPoolSize int64
+
+	// poolRefresh is used to check the pools right away when the pool settings are changed.
+	poolRefresh chan struct{}
+
+	// cache holds the metadata that is read while planning statements, it is invalidated as
+	// changes are applied to the internal store.
+	cache *metadataCache
+
+	// fences are the write fences that this coordinator is enforcing, along with the writes that
+	// its sessions are running.
+	fences *writeFences
+
+	// statistics are the statistics of the statements that have been run on this coordinator.
+	statistics *statementStatistics
+
+	// metrics are served to be scraped by prometheus.
+	metrics *coordinatorMetrics
+
+	// slowQueryLog is the file that statements slower than the slow query threshold are
+	// written to.
+	slowQueryLog *logger.RotatingFile
+
+	// tracer records the spans of each statement, this is nil if traces are not being exported.
+	tracer *tracing.Tracer
+
+	// rebalancing is set while this coordinator is resuming tenant moves and shard splits.
+	rebalancing int32
+
+	// claims are the rebalance claims held by this coordinator. Every claim in the internal store
+	// is owned by a coordinator, so this keeps two goroutines on the same coordinator from doing
+	// the same work at once.
+	claims sync.Map
+
+	// repairing is set while this coordinator is repairing diverged data node shards.
+	repairing int32
+
 	joinCluster func() error
 }
 
@@ -60,6 +101,14 @@ func (ctx *base) CoordinatorID() uint64 {
 // Close shuts down the colony.
 func (ctx *base) Close() {
 	ctx.db.Close(false)
+	if ctx.slowQueryLog != nil {
+		if err := ctx.slowQueryLog.Close(); err != nil {
+			timber.Warningf("could not close slow query log: %v", err)
+		}
+	}
+	if err := ctx.tracer.Close(); err != nil {
+		timber.Warningf("could not close tracer: %v", err)
+	}
 }
 
 // IsLeader returns true if the current coordinator is the leader of the cluster.
@@ -99,6 +148,10 @@ func (ctx *base) Query(query string) (*frunk.QueryResponse, error) {
 	return ctx.db.Query(query)
 }
 
+func (ctx *base) Execute(request *frunk.ExecuteRequest) (*frunk.ExecuteResponse, error) {
+	return ctx.db.ExecuteEx(request)
+}
+
 func (ctx *base) isSetup() bool {
 	re, err := ctx.db.Query("SELECT data_node_id FROM data_nodes LIMIT 1;")
 	// If the error is nil then that means the table exists and the cluster has been
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/elliotcourant/noahdb/pkg/drivers/rpcer"
 	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/noahdb/pkg/tracing"
 	"github.com/elliotcourant/timber"
 	"github.com/hashicorp/raft"
 	"net"
@@ -14,15 +15,24 @@ import (
 )
 
 type ColonyConfig struct {
-	DataDirectory         string
-	JoinAddresses         []raft.Server
-	Transport             TransportWrapper
-	LocalPostgresAddress  string
-	LocalPostgresPort     int32
-	LocalPostgresUser     string
-	LocalPostgresPassword string
-	StartPool             bool
-	AutoJoin              bool
+	DataDirectory            string
+	JoinAddresses            []raft.Server
+	Transport                TransportWrapper
+	LocalPostgresAddress     string
+	LocalPostgresPort        int32
+	LocalPostgresUser        string
+	LocalPostgresPassword    string
+	LocalPostgresSSLMode     string
+	LocalPostgresSSLRootCert string
+	StartPool                bool
+	AutoJoin                 bool
+
+	// TraceFile is the path that traces are written to as OTLP/JSON.
+	TraceFile string
+
+	// TraceCollector is the URL of an OpenTelemetry collector that traces are sent to using
+	// OTLP/HTTP. Traces are not recorded if neither this nor the trace file are set.
+	TraceCollector string
 }
 
 type Accessors interface {
@@ -44,6 +54,10 @@ type Colony interface {
 
 	Query(string) (*frunk.QueryResponse, error)
 
+	// Execute applies changes to the internal store, this is used by the leader to apply changes
+	// that have been forwarded by other coordinators.
+	Execute(*frunk.ExecuteRequest) (*frunk.ExecuteResponse, error)
+
 	CoordinatorID() uint64
 	IsLeader() bool
 	Close()
@@ -55,6 +69,21 @@ type Colony interface {
 
 	Neighbors() ([]*frunk.Server, error)
 
+	// Metrics returns the metrics for this coordinator.
+	Metrics() MetricsContext
+
+	// Tracer returns the tracer for the statements run by this coordinator.
+	Tracer() *tracing.Tracer
+
+	// Statistics returns the statistics of the statements that have been run.
+	Statistics() StatisticsContext
+
+	// SlowQueries returns the log of statements that took longer than the slow query threshold.
+	SlowQueries() SlowQueryContext
+
+	// WriteFences returns the fences that block writes to tenants while they are being moved.
+	WriteFences() WriteFenceContext
+
 	InitColony(config ColonyConfig, log timber.Logger) error
 }
 
@@ -69,6 +98,11 @@ func (ctx *base) InitColony(config ColonyConfig, log timber.Logger) error {
 	}
 	id := fmt.Sprintf("%s:%d", hostname, config.Transport.Port())
 
+	tracer, err := newTracer(config, id)
+	if err != nil {
+		return err
+	}
+
 	fr := frunk.New(config.Transport.RaftTransport(), &frunk.StoreConfig{
 		DBConf: &frunk.DBConfig{
 			DSN:    "",
@@ -78,6 +112,19 @@ func (ctx *base) InitColony(config ColonyConfig, log timber.Logger) error {
 		ID:  id,
 	})
 
+	// The cache needs to be observing changes before the store is opened so that any changes
+	// replayed from the log are seen.
+	cache := newMetadataCache()
+	fr.RegisterExecuteObserver(cache.invalidate)
+	fences := newWriteFences()
+	fr.RegisterExecuteObserver(fences.observe)
+	settingsChanged := make(chan struct{}, 1)
+	fr.RegisterExecuteObserver(observeSettings(settingsChanged))
+	sslChanged := make(chan struct{}, 1)
+	fr.RegisterExecuteObserver(observeDataNodeSSL(sslChanged))
+	releasesChanged := make(chan struct{}, 1)
+	fr.RegisterExecuteObserver(observeDataNodeShardReleases(releasesChanged))
+
 	var potentialNeighbors []raft.Server
 	if config.AutoJoin {
 		potentialNeighbors, err = getAutoJoinAddresses()
@@ -138,11 +185,17 @@ func (ctx *base) InitColony(config ColonyConfig, log timber.Logger) error {
 	}
 
 	*ctx = base{
-		db:       fr,
-		trans:    config.Transport,
-		poolSync: sync.RWMutex{},
-		pool:     map[uint64]*poolItem{},
+		db:           fr,
+		cache:        cache,
+		fences:       fences,
+		statistics:   newStatementStatistics(),
+		slowQueryLog: newSlowQueryLog(config.DataDirectory),
+		tracer:       tracer,
+		trans:        config.Transport,
+		poolSync:     sync.RWMutex{},
+		pool:         map[uint64]*poolItem{},
 	}
+	ctx.metrics = newCoordinatorMetrics(ctx)
 
 	if config.StartPool {
 		ctx.Pool().StartPool()
@@ -211,29 +264,46 @@ WaitForSetup:
 
 	autoLocalPostgres(ctx, config)
 
+	go ctx.watchWriteFences()
+	go ctx.watchSettings(settingsChanged)
+	go ctx.watchDataNodeSSL(sslChanged)
+	go ctx.watchDataNodeShardReleases(releasesChanged)
+
+	ctx.watchLeadership()
+	if ctx.IsLeader() {
+		go ctx.resumeRebalancing()
+	}
+
+	go ctx.monitorReplication()
+	go ctx.checkDataNodeHealth()
+
 	return nil
 }
 
 func autoLocalPostgres(ctx *base, config ColonyConfig) {
 	if len(config.LocalPostgresAddress) > 0 && len(config.LocalPostgresUser) > 0 {
 		// Check to see if there is a local postgres instance we can use.
-		if _, err := ctx.DataNodes().NewDataNode(
+		dataNode, err := ctx.DataNodes().NewDataNode(
 			config.LocalPostgresAddress,
 			config.LocalPostgresPort,
 			config.LocalPostgresUser,
-			config.LocalPostgresPassword); err != nil {
+			config.LocalPostgresPassword)
+		if err != nil {
 			timber.Warningf("could not add local postgres instance: %v", err)
 			return
 		}
 
-		initialShards := 3
-		for i := 0; i < initialShards; i++ {
-			if _, err := ctx.Shards().NewShard(); err != nil {
-				panic(err)
+		if config.LocalPostgresSSLMode != "" || config.LocalPostgresSSLRootCert != "" {
+			if err := ctx.DataNodes().SetDataNodeSSL(
+				dataNode.DataNodeID,
+				config.LocalPostgresSSLMode,
+				config.LocalPostgresSSLRootCert); err != nil {
+				timber.Warningf("could not set ssl for local postgres instance: %v", err)
+				return
 			}
 		}
 
-		if err := ctx.Shards().BalanceOrphanShards(); err != nil {
+		if err := ctx.ensureNumberOfShards(); err != nil {
 			panic(err)
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
 	"github.com/elliotcourant/noahdb/pkg/frunk"
 	"github.com/readystock/goqu"
+	"strconv"
 )
 
 var (
@@ -23,8 +24,15 @@ type DataNodeContext interface {
 	GetDataNodeForDataNodeShard(uint64) (DataNode, error)
 	GetRandomDataNodeShardID() (uint64, error)
 	GetDataNodeShardIDs() ([]uint64, error)
+	GetSchemaDataNodeShardIDs() ([]uint64, error)
 	GetDataNodeShardIDsForShard(uint64) ([]uint64, error)
+	GetReadDataNodeShardIDsForShard(uint64) ([]uint64, error)
 	NewDataNode(address string, port int32, user string, password string) (DataNode, error)
+	SetDataNodeSSL(id uint64, sslMode string, sslRootCert string) error
+	DrainDataNode(id uint64) error
+	GetDataNodeShardMoves() ([]DataNodeShardMove, error)
+	ResumeDataNodeDrains() error
+	SetDataNodeHealth(id uint64, healthy bool) error
 }
 
 func (ctx *base) DataNodes() DataNodeContext {
@@ -47,6 +55,7 @@ func (ctx *dataNodeContext) NewDataNode(address string, port int32, user, passwo
 			"user":         user,
 			"password":     password,
 			"healthy":      true,
+			"draining":     false,
 		}).Sql
 	_, err = ctx.db.Exec(compiledSql)
 	return DataNode{
@@ -56,9 +65,35 @@ func (ctx *dataNodeContext) NewDataNode(address string, port int32, user, passwo
 		User:       user,
 		Password:   password,
 		Healthy:    true,
+		Draining:   false,
+		SSLMode:    SSLModeDisable,
 	}, err
 }
 
+// SetDataNodeSSL changes how coordinators use TLS when they connect to the data node. Each
+// coordinator closes its idle connections to the data node as the change is applied to its
+// internal store, see watchDataNodeSSL.
+func (ctx *dataNodeContext) SetDataNodeSSL(id uint64, sslMode, sslRootCert string) error {
+	if err := ValidateSSLMode(sslMode); err != nil {
+		return err
+	}
+
+	if sslMode == "" {
+		sslMode = SSLModeDisable
+	}
+
+	compiledSql := goqu.From("data_nodes").
+		Where(goqu.Ex{
+			"data_node_id": id,
+		}).
+		Update(goqu.Record{
+			"ssl_mode":      sslMode,
+			"ssl_root_cert": sslRootCert,
+		}).Sql
+	_, err := ctx.db.Exec(compiledSql)
+	return err
+}
+
 func (ctx *dataNodeContext) GetDataNode(id uint64) (DataNode, error) {
 	compiledQuery, _, _ := getDataNodesQuery.
 		Where(goqu.Ex{
@@ -88,16 +123,88 @@ func (ctx *dataNodeContext) GetDataNodes() ([]DataNode, error) {
 	return ctx.dataNodesFromRows(response)
 }
 
-func (ctx *dataNodeContext) GetDataNodeShardIDs() ([]uint64, error) {
-	compiledQuery, _, _ := goqu.
+// routableDataNodeShardsQuery returns a query for the data node shards that can receive queries.
+// Data node shards that are still being provisioned are excluded.
+func routableDataNodeShardsQuery() *goqu.Dataset {
+	return goqu.
 		From("data_nodes").
-		Select("data_node_shards.data_node_shard_id").
 		InnerJoin(
 			goqu.I("data_node_shards"),
 			goqu.On(goqu.I("data_node_shards.data_node_id").Eq(goqu.I("data_nodes.data_node_id")))).
+		LeftJoin(
+			goqu.I("data_node_shard_provisions"),
+			goqu.On(goqu.I("data_node_shard_provisions.data_node_shard_id").Eq(goqu.I("data_node_shards.data_node_shard_id")))).
+		LeftJoin(
+			goqu.I("diverged_data_node_shards"),
+			goqu.On(goqu.I("diverged_data_node_shards.data_node_shard_id").Eq(goqu.I("data_node_shards.data_node_shard_id")))).
 		Where(goqu.Ex{
 			"data_nodes.healthy": true,
-		}).
+			// Data node shards that are still being provisioned cannot receive queries yet.
+			"data_node_shard_provisions.data_node_shard_id": nil,
+		})
+}
+
+// schemaDataNodeShardsQuery returns a query for the IDs of the data node shards that should
+// receive changes to the schema. Logical replication does not copy changes to the schema, so
+// unlike writes these are sent to read only replicas as well.
+func schemaDataNodeShardsQuery() *goqu.Dataset {
+	return routableDataNodeShardsQuery().
+		Select("data_node_shards.data_node_shard_id").
+		Where(goqu.Or(
+			goqu.I("diverged_data_node_shards.state").IsNull(),
+			// A data node shard that is being repaired receives writes so that it can catch up.
+			goqu.I("diverged_data_node_shards.state").Eq(ReplicaState_Repairing)))
+}
+
+// writableDataNodeShardsQuery returns a query for the IDs of the data node shards that can
+// receive writes. Data node shards that have diverged from the other replicas of their shard and
+// read only replicas are excluded.
+func writableDataNodeShardsQuery() *goqu.Dataset {
+	return schemaDataNodeShardsQuery().
+		Where(goqu.Ex{
+			"data_node_shards.read_only": false,
+		})
+}
+
+// readableDataNodeShardsQuery returns a query for the IDs of the data node shards that can be
+// read from. A data node shard can only be read from if it has all of its shard's data, so data
+// node shards that are being copied to or repaired are excluded. Read only replicas are only
+// included if they were caught up with their primary the last time the leader measured the lag.
+func readableDataNodeShardsQuery() *goqu.Dataset {
+	return routableDataNodeShardsQuery().
+		Select("data_node_shards.data_node_shard_id").
+		LeftJoin(
+			goqu.I("data_node_shard_moves"),
+			goqu.On(goqu.I("data_node_shard_moves.target_data_node_shard_id").Eq(goqu.I("data_node_shards.data_node_shard_id")))).
+		LeftJoin(
+			goqu.I("caught_up_replicas"),
+			goqu.On(goqu.I("caught_up_replicas.data_node_shard_id").Eq(goqu.I("data_node_shards.data_node_shard_id")))).
+		Where(
+			goqu.Ex{
+				"diverged_data_node_shards.data_node_shard_id":    nil,
+				"data_node_shard_moves.target_data_node_shard_id": nil,
+			},
+			goqu.Or(
+				goqu.Ex{
+					"data_node_shards.read_only": false,
+				},
+				goqu.I("caught_up_replicas.data_node_shard_id").IsNotNull()))
+}
+
+func (ctx *dataNodeContext) GetDataNodeShardIDs() ([]uint64, error) {
+	compiledQuery, _, _ := writableDataNodeShardsQuery().
+		ToSql()
+	response, err := ctx.db.Query(compiledQuery)
+	if err != nil {
+		return nil, err
+	}
+	return idArray(response)
+}
+
+// GetSchemaDataNodeShardIDs returns all of the data node shards that changes to the schema should
+// be sent to.
+func (ctx *dataNodeContext) GetSchemaDataNodeShardIDs() ([]uint64, error) {
+	compiledQuery, _, _ := schemaDataNodeShardsQuery().
 		ToSql()
 	response, err := ctx.db.Query(compiledQuery)
 	if err != nil {
@@ -107,27 +214,24 @@ func (ctx *dataNodeContext) GetDataNodeShardIDs() ([]uint64, error) {
 }
 
 func (ctx *dataNodeContext) GetRandomDataNodeShardID() (uint64, error) {
-	compiledQuery, _, _ := goqu.
-		From("data_nodes").
-		Select("data_node_shards.data_node_shard_id").
-		InnerJoin(
-			goqu.I("data_node_shards"),
-			goqu.On(goqu.I("data_node_shards.data_node_id").Eq(goqu.I("data_nodes.data_node_id")))).
+	compiledQuery, _, _ := readableDataNodeShardsQuery().
 		InnerJoin(
 			goqu.I("shards"),
 			goqu.On(goqu.I("shards.shard_id").Eq(goqu.I("data_node_shards.shard_id")))).
 		Where(goqu.Ex{
-			"data_nodes.healthy": true,
-			"shards.state":       ShardState_Stable,
+			"shards.state": ShardState_Stable,
 		}).
 		Order(goqu.L("RANDOM()").Asc()).
-		Limit(1).
 		ToSql()
 	response, err := ctx.db.Query(compiledQuery)
 	if err != nil {
 		return 0, err
 	}
-	return count(response)
+	ids, err := idArray(response)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return ids[0], nil
 }
 
 func (ctx *dataNodeContext) GetDataNodesForShard(id uint64) ([]DataNode, error) {
@@ -146,17 +250,45 @@ func (ctx *dataNodeContext) GetDataNodesForShard(id uint64) ([]DataNode, error)
 	return ctx.dataNodesFromRows(response)
 }
 
+// GetDataNodeShardIDsForShard returns the data node shards for the shard that should receive
+// writes.
 func (ctx *dataNodeContext) GetDataNodeShardIDsForShard(id uint64) ([]uint64, error) {
-	compiledQuery, _, _ := goqu.
-		From("data_nodes").
-		Select("data_node_shards.data_node_shard_id").
-		InnerJoin(
-			goqu.I("data_node_shards"),
-			goqu.On(goqu.I("data_node_shards.data_node_id").Eq(goqu.I("data_nodes.data_node_id")))).
+	key := strconv.FormatUint(id, 10)
+	cached, version, ok := ctx.cache.dataNodeShards.get(key)
+	if ok {
+		return append([]uint64{}, cached.([]uint64)...), nil
+	}
+
+	ids, err := ctx.getDataNodeShardIDsForShard(id)
+	if err != nil {
+		return nil, err
+	}
+	ctx.cache.dataNodeShards.put(version, key, append([]uint64{}, ids...))
+	return ids, nil
+}
+
+func (ctx *dataNodeContext) getDataNodeShardIDsForShard(id uint64) ([]uint64, error) {
+	compiledQuery, _, _ := writableDataNodeShardsQuery().
+		Where(goqu.Ex{
+			"data_node_shards.shard_id": id,
+		}).
+		Order(goqu.I("data_node_shards.data_node_shard_id").Asc()).
+		ToSql()
+	response, err := ctx.db.Query(compiledQuery)
+	if err != nil {
+		return nil, err
+	}
+	return idArray(response)
+}
+
+// GetReadDataNodeShardIDsForShard returns the replicas of the shard that can be read from. Read
+// only replicas are only returned if they are not too far behind their primary.
+func (ctx *dataNodeContext) GetReadDataNodeShardIDsForShard(id uint64) ([]uint64, error) {
+	compiledQuery, _, _ := readableDataNodeShardsQuery().
 		Where(goqu.Ex{
-			"data_nodes.healthy":        true,
 			"data_node_shards.shard_id": id,
 		}).
+		Order(goqu.I("data_node_shards.data_node_shard_id").Asc()).
 		ToSql()
 	response, err := ctx.db.Query(compiledQuery)
 	if err != nil {
@@ -196,7 +328,10 @@ func (ctx *dataNodeContext) dataNodesFromRows(response *frunk.QueryResponse) ([]
 			&node.Port,
 			&node.User,
 			&node.Password,
-			&node.Healthy); err != nil {
+			&node.Healthy,
+			&node.Draining,
+			&node.SSLMode,
+			&node.SSLRootCert); err != nil {
 			return nil, err
 		}
 		nodes = append(nodes, node)
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	_ "github.com/lib/pq"
+)
+
+// dataNodeShardDatabaseName returns the name of the database on the data node that stores the
+// data node shard.
+func dataNodeShardDatabaseName(dataNodeShardId uint64) string {
+	return fmt.Sprintf("noahdb_%d", dataNodeShardId)
+}
+
+// dataNodeConnectionString returns the connection string for a database on the data node.
+func dataNodeConnectionString(dataNode DataNode, database string) string {
+	databaseLogin := url.User(dataNode.GetUser())
+	if dataNode.GetPassword() != "" {
+		databaseLogin = url.UserPassword(dataNode.GetUser(), dataNode.GetPassword())
+	}
+
+	parameters := url.Values{}
+	parameters.Set("sslmode", dataNodeSSLMode(dataNode))
+	if dataNode.GetSSLRootCert() != "" {
+		parameters.Set("sslrootcert", dataNode.GetSSLRootCert())
+	}
+
+	connectionString := url.URL{
+		Scheme:   "postgres",
+		User:     databaseLogin,
+		Host:     net.JoinHostPort(dataNode.GetAddress(), strconv.Itoa(int(dataNode.GetPort()))),
+		Path:     "/" + database,
+		RawQuery: parameters.Encode(),
+	}
+	return connectionString.String()
+}
+
+// openDataNodeDatabase opens a connection to a database on the provided data node. This is used
+// by administrative operations that need to work with a data node outside of the pool.
+func (ctx *base) openDataNodeDatabase(dataNode DataNode, database string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dataNodeConnectionString(dataNode, database))
+	if err != nil {
+		return nil, err
+	}
+
+	// sql.Open does not actually connect, we want to know now if the data node is reachable.
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// openDataNodeShard opens a connection to the database for the provided data node shard.
+func (ctx *base) openDataNodeShard(dataNodeShard DataNodeShard) (*sql.DB, error) {
+	dataNode, err := ctx.DataNodes().GetDataNode(dataNodeShard.DataNodeID)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.openDataNodeDatabase(dataNode, dataNodeShardDatabaseName(dataNodeShard.DataNodeShardID))
+}
@@ -0,0 +1,754 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/timber"
+	"github.com/lib/pq"
+	"github.com/readystock/goqu"
+	"strings"
+	"time"
+)
+
+const (
+	// dataNodeDrainConnectionTimeout is how long we will wait for sessions to release their
+	// connections to a data node shard that has been moved before the pool is closed.
+	dataNodeDrainConnectionTimeout = 30 * time.Second
+
+	dataNodeDrainConnectionInterval = 100 * time.Millisecond
+
+	// dataNodeShardReleaseTimeout is how long we will wait for every coordinator to close its pools
+	// for the data node shards that were removed from a data node. Each coordinator waits for its
+	// sessions to release their connections first.
+	dataNodeShardReleaseTimeout = 2 * dataNodeDrainConnectionTimeout
+)
+
+var (
+	getDataNodeShardMovesQuery = goqu.
+		From("data_node_shard_moves").
+		Select(
+			"source_data_node_shard_id",
+			"target_data_node_shard_id",
+			"state",
+			"keep_source")
+)
+
+// DrainDataNode removes a data node from the cluster. The data node is marked as draining so no
+// new shards will be placed on it, then each of its data node shards is moved to another data
+// node. Once all of the data node shards have been moved the data node is removed. If the data
+// node is already being drained then the drain is resumed.
+func (ctx *dataNodeContext) DrainDataNode(id uint64) error {
+	dataNode, err := ctx.GetDataNode(id)
+	if err != nil {
+		return err
+	}
+
+	if !dataNode.Draining {
+		dataNodes, err := ctx.GetDataNodes()
+		if err != nil {
+			return err
+		}
+
+		available := 0
+		for _, node := range dataNodes {
+			if node.DataNodeID != id && !node.Draining {
+				available++
+			}
+		}
+		if available == 0 {
+			return fmt.Errorf("data node [%d] cannot be drained, there are no other data nodes available", id)
+		}
+
+		compiledSql := goqu.
+			From("data_nodes").
+			Where(goqu.Ex{
+				"data_node_id": id,
+			}).
+			Update(goqu.Record{
+				"draining": true,
+			}).Sql
+		if _, err := ctx.db.Exec(compiledSql); err != nil {
+			return err
+		}
+	}
+
+	return ctx.drainDataNode(id)
+}
+
+// GetDataNodeShardMoves returns all of the data node shard moves that have not finished yet.
+func (ctx *dataNodeContext) GetDataNodeShardMoves() ([]DataNodeShardMove, error) {
+	return ctx.getDataNodeShardMoves()
+}
+
+// ResumeDataNodeDrains will continue draining any data nodes that were being drained when the
+// leader of the cluster changed.
+func (ctx *dataNodeContext) ResumeDataNodeDrains() error {
+	dataNodes, err := ctx.GetDataNodes()
+	if err != nil {
+		return err
+	}
+
+	for _, dataNode := range dataNodes {
+		if !dataNode.Draining {
+			continue
+		}
+
+		timber.Infof("resuming drain of data node [%d]", dataNode.DataNodeID)
+		if err := ctx.drainDataNode(dataNode.DataNodeID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ctx *dataNodeContext) drainDataNode(id uint64) error {
+	shards := &shardContext{ctx.base}
+	dataNodeShards, err := shards.GetDataNodeShards()
+	if err != nil {
+		return err
+	}
+
+	for _, dataNodeShard := range dataNodeShards {
+		if dataNodeShard.DataNodeID != id {
+			continue
+		}
+
+		move, err := ctx.startDataNodeShardMove(dataNodeShard, dataNodeShards, false)
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.moveDataNodeShard(move); err != nil {
+			return err
+		}
+	}
+
+	// All of the data node shards have been moved, the data node can be removed once no
+	// coordinator is connected to them anymore.
+	compiledSql := goqu.
+		From("data_nodes").
+		Where(goqu.Ex{
+			"data_node_id": id,
+		}).
+		Delete().Sql
+	if err := ctx.awaitDataNodeShardReleases(id, compiledSql); err != nil {
+		return err
+	}
+
+	timber.Infof("data node [%d] has been drained and removed", id)
+	return nil
+}
+
+// startDataNodeShardMove creates a new data node shard on the data node with the fewest shards
+// that does not already have a copy of the shard. If the data node shard is already being moved
+// then the existing move is returned. If keepSource is true then the data node shard is copied
+// to add a replica instead of being moved.
+func (ctx *dataNodeContext) startDataNodeShardMove(dataNodeShard DataNodeShard, dataNodeShards []DataNodeShard, keepSource bool) (DataNodeShardMove, error) {
+	moves, err := ctx.getDataNodeShardMoves(dataNodeShard.DataNodeShardID)
+	if err != nil {
+		return DataNodeShardMove{}, err
+	}
+
+	if len(moves) > 0 {
+		return moves[0], nil
+	}
+
+	targetDataNodeId, err := ctx.getDataNodeForReplica(dataNodeShard.ShardID, dataNodeShards)
+	if err != nil {
+		return DataNodeShardMove{}, err
+	}
+
+	if targetDataNodeId == 0 {
+		return DataNodeShardMove{}, fmt.Errorf(
+			"there are no data nodes available to move data node shard [%d] to", dataNodeShard.DataNodeShardID)
+	}
+
+	id, err := ctx.db.NextSequenceValueById(dataNodeShardIdSequencePath)
+	if err != nil {
+		return DataNodeShardMove{}, err
+	}
+
+	move := DataNodeShardMove{
+		SourceDataNodeShardID: dataNodeShard.DataNodeShardID,
+		TargetDataNodeShardID: id,
+		State:                 TenantMoveState_Copying,
+		KeepSource:            keepSource,
+	}
+
+	timber.Debugf("moving data node shard [%d] to data node [%d] as data node shard [%d]",
+		dataNodeShard.DataNodeShardID, targetDataNodeId, id)
+
+	newDataNodeShard := goqu.
+		From("data_node_shards").
+		Insert(goqu.Record{
+			"data_node_shard_id": id,
+			"data_node_id":       targetDataNodeId,
+			"shard_id":           dataNodeShard.ShardID,
+			"read_only":          dataNodeShard.ReadOnly,
+		}).Sql
+	newProvision := goqu.
+		From("data_node_shard_provisions").
+		Insert(goqu.Record{
+			"data_node_shard_id": id,
+			"state":              ProvisionState_Creating,
+			"force":              false,
+		}).Sql
+	newMove := goqu.
+		From("data_node_shard_moves").
+		Insert(goqu.Record{
+			"source_data_node_shard_id": move.SourceDataNodeShardID,
+			"target_data_node_shard_id": move.TargetDataNodeShardID,
+			"state":                     move.State,
+			"keep_source":               move.KeepSource,
+		}).Sql
+	if _, err := ctx.db.Exec(strings.Join([]string{newDataNodeShard, newProvision, newMove}, ";")); err != nil {
+		return DataNodeShardMove{}, err
+	}
+
+	return move, nil
+}
+
+// getDataNodeForReplica returns the data node with the fewest shards that does not already have a
+// copy of the shard. If there are no data nodes available then 0 is returned.
+func (ctx *dataNodeContext) getDataNodeForReplica(shardId uint64, dataNodeShards []DataNodeShard) (uint64, error) {
+	// Data nodes that already have a copy of this shard cannot be used.
+	excluded := map[uint64]bool{}
+	for _, item := range dataNodeShards {
+		if item.ShardID == shardId {
+			excluded[item.DataNodeID] = true
+		}
+	}
+
+	pressures, err := ctx.Shards().GetDataNodesPressure(0)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, pressure := range pressures {
+		if !excluded[pressure.DataNodeID] {
+			return pressure.DataNodeID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// moveDataNodeShard copies all of the sharded data from the source data node shard to the target.
+// The target is provisioned first, which copies the schema and the global tables. Once it has been
+// provisioned it receives the same writes as the source, the tenants' rows are copied and then
+// writes are blocked while the last changes are copied. Read only replicas are subscribed to the
+// shard's primary while they are provisioned, so their rows do not need to be copied. Finally the
+// source data node shard is removed. If the source was the primary for read only replicas then
+// they are subscribed to the target instead.
+func (ctx *dataNodeContext) moveDataNodeShard(move DataNodeShardMove) error {
+	claim, ok, err := ctx.claimRebalance(dataNodeShardMoveClaim(move.SourceDataNodeShardID))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("data node shard [%d] is already being moved by another coordinator", move.SourceDataNodeShardID)
+	}
+	defer claim.release()
+
+	shards := &shardContext{ctx.base}
+
+	provisions, err := shards.getDataNodeShardProvisions(move.TargetDataNodeShardID)
+	if err != nil {
+		return err
+	}
+	if len(provisions) > 0 {
+		if err := shards.provisionDataNodeShard(provisions[0]); err != nil {
+			return err
+		}
+	}
+
+	source, err := shards.getDataNodeShard(move.SourceDataNodeShardID)
+	if err != nil {
+		return err
+	}
+
+	target, err := shards.getDataNodeShard(move.TargetDataNodeShardID)
+	if err != nil {
+		return err
+	}
+
+	sourceDb, err := ctx.openDataNodeShard(source)
+	if err != nil {
+		return err
+	}
+	defer sourceDb.Close()
+
+	targetDb, err := ctx.openDataNodeShard(target)
+	if err != nil {
+		return err
+	}
+	defer targetDb.Close()
+
+	// Writes to the shard are blocked by a fence while the last of the rows are copied, the fence
+	// is lowered once the move is finished.
+	var fence writeFence
+	if source.ReadOnly {
+		// A read only replica receives its rows from the shard's primary. The new replica was
+		// subscribed while it was being provisioned so there is nothing to copy, the old
+		// replica's subscription is dropped so that the primary stops keeping changes for it.
+		if !move.KeepSource {
+			if err := shards.dropSubscription(sourceDb, source.DataNodeShardID); err != nil {
+				return err
+			}
+		}
+	} else if fence, err = ctx.copyDataNodeShard(&move, source, sourceDb, targetDb); err != nil {
+		return err
+	}
+
+	statements := []string{
+		goqu.
+			From("data_node_shard_moves").
+			Where(goqu.Ex{
+				"source_data_node_shard_id": move.SourceDataNodeShardID,
+			}).
+			Delete().Sql,
+	}
+
+	// When we are adding a replica the source data node shard stays where it is. Otherwise every
+	// coordinator closes its pool for the source once it has been removed.
+	if !move.KeepSource {
+		statements = append(statements, goqu.
+			From("data_node_shards").
+			Where(goqu.Ex{
+				"data_node_shard_id": move.SourceDataNodeShardID,
+			}).
+			Delete().Sql,
+			releaseDataNodeShardSql(source))
+	}
+
+	if fence.FenceID != 0 {
+		statements = append(statements, lowerWriteFenceSql(fence))
+	}
+
+	// The read only replicas are subscribed to the source, once the target is the primary they
+	// would no longer receive any changes. They are marked as diverged during the cut over so they
+	// are not read from until they have been subscribed to the target.
+	replicas := make([]DataNodeShard, 0)
+	if !move.KeepSource && !source.ReadOnly {
+		if replicas, err = ctx.getReadOnlyReplicas(source.ShardID); err != nil {
+			return err
+		}
+		for _, replica := range replicas {
+			statements = append(statements, fmt.Sprintf(
+				"INSERT INTO diverged_data_node_shards (data_node_shard_id, state) SELECT %d, %d "+
+					"WHERE NOT EXISTS (SELECT 1 FROM diverged_data_node_shards WHERE data_node_shard_id = %d)",
+				replica.DataNodeShardID, ReplicaState_Diverged, replica.DataNodeShardID))
+		}
+	}
+
+	// The source data node shard is removed and the fence is lowered together, so writes that
+	// were blocked are sent to the target instead. This is only applied if we still hold the
+	// claim on the move.
+	for i, statement := range statements {
+		statements[i] = fmt.Sprintf("%s AND %s", statement, claim.guard())
+	}
+	response, err := ctx.db.ExecuteEx(&frunk.ExecuteRequest{
+		Queries: statements,
+		Atomic:  true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := executeResponseError(response); err != nil {
+		return err
+	}
+	if len(response.Results) == 0 || response.Results[0].RowsAffected == 0 {
+		return fmt.Errorf("data node shard [%d] could not be cut over, the move was claimed by another coordinator", move.SourceDataNodeShardID)
+	}
+
+	if move.KeepSource {
+		timber.Infof("copied data node shard [%d] to data node shard [%d]", move.SourceDataNodeShardID, move.TargetDataNodeShardID)
+		return nil
+	}
+
+	if len(replicas) > 0 {
+		ctx.repointReplicas(source, sourceDb, replicas)
+	}
+
+	timber.Infof("moved data node shard [%d] to data node shard [%d]", move.SourceDataNodeShardID, move.TargetDataNodeShardID)
+	return nil
+}
+
+// copyDataNodeShard copies the tenants' rows from the source data node shard to the target. Once
+// the rows have been copied writes to the shard are blocked by a fence on every coordinator while
+// the last changes are copied. The fence is returned so it can be lowered once the move has
+// finished.
+func (ctx *dataNodeContext) copyDataNodeShard(move *DataNodeShardMove, source DataNodeShard, sourceDb, targetDb *sql.DB) (writeFence, error) {
+	shards := &shardContext{ctx.base}
+
+	tables, err := (&tenantContext{ctx.base}).getTenantMoveTables()
+	if err != nil {
+		return writeFence{}, err
+	}
+
+	syncShard := func() error {
+		// The tenants are retrieved each time in case any tenants were added to the shard.
+		tenants, err := shards.getShardTenants(source.ShardID)
+		if err != nil {
+			return err
+		}
+
+		for _, tenant := range tenants {
+			for _, table := range tables {
+				if err := syncTenantTable(sourceDb, targetDb, table, tenant.TenantID); err != nil {
+					return fmt.Errorf("could not copy table [%s] for tenant [%d]: %v", table.name, tenant.TenantID, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	if move.State == TenantMoveState_Copying {
+		timber.Debugf("copying data node shard [%d] to data node shard [%d]", move.SourceDataNodeShardID, move.TargetDataNodeShardID)
+		if err := syncShard(); err != nil {
+			return writeFence{}, err
+		}
+	}
+
+	// Block writes to the shard on every coordinator. If the move was interrupted while it was
+	// cutting over then the fence left behind by the last attempt is replaced.
+	cuttingOverSql := goqu.
+		From("data_node_shard_moves").
+		Where(goqu.Ex{
+			"source_data_node_shard_id": move.SourceDataNodeShardID,
+		}).
+		Update(goqu.Record{
+			"state": TenantMoveState_CuttingOver,
+		}).Sql
+	fence, err := ctx.raiseWriteFence(writeFence{
+		ShardID:         source.ShardID,
+		DataNodeShardID: source.DataNodeShardID,
+	}, cuttingOverSql)
+	if err != nil {
+		return writeFence{}, err
+	}
+	move.State = TenantMoveState_CuttingOver
+
+	// Once every coordinator has acknowledged the fence none of them are writing to the shard, the
+	// writes they were running when it was raised have finished. So nothing can change while the
+	// last of the rows are copied.
+	if err := ctx.awaitWriteFence(fence); err != nil {
+		ctx.abortDataNodeShardCutover(*move, fence)
+		return writeFence{}, err
+	}
+
+	timber.Debugf("cutting over data node shard [%d] to data node shard [%d]", move.SourceDataNodeShardID, move.TargetDataNodeShardID)
+	if err := syncShard(); err != nil {
+		ctx.abortDataNodeShardCutover(*move, fence)
+		return writeFence{}, err
+	}
+
+	return fence, nil
+}
+
+// abortDataNodeShardCutover unblocks writes to the shard when the cutover could not be finished,
+// the last of the rows will be copied again when the move is resumed.
+func (ctx *dataNodeContext) abortDataNodeShardCutover(move DataNodeShardMove, fence writeFence) {
+	copyingSql := goqu.
+		From("data_node_shard_moves").
+		Where(goqu.Ex{
+			"source_data_node_shard_id": move.SourceDataNodeShardID,
+		}).
+		Update(goqu.Record{
+			"state": TenantMoveState_Copying,
+		}).Sql
+	if _, err := ctx.db.Exec(strings.Join([]string{lowerWriteFenceSql(fence), copyingSql}, ";")); err != nil {
+		timber.Errorf("could not unblock writes to shard [%d]: %v", fence.ShardID, err)
+	}
+}
+
+// getReadOnlyReplicas returns the read only replicas of the shard.
+func (ctx *dataNodeContext) getReadOnlyReplicas(shardId uint64) ([]DataNodeShard, error) {
+	dataNodeShards, err := ctx.Shards().GetDataNodeShards()
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := make([]DataNodeShard, 0)
+	for _, dataNodeShard := range dataNodeShards {
+		if dataNodeShard.ShardID == shardId && dataNodeShard.ReadOnly {
+			replicas = append(replicas, dataNodeShard)
+		}
+	}
+	return replicas, nil
+}
+
+// repointReplicas removes the read only replicas' subscriptions to the primary that was moved, as
+// well as its publication and replication slots, then repairs the replicas. Repairing a read only
+// replica subscribes it to the shard's new primary.
+func (ctx *dataNodeContext) repointReplicas(source DataNodeShard, sourceDb *sql.DB, replicas []DataNodeShard) {
+	shards := &shardContext{ctx.base}
+	for _, replica := range replicas {
+		if err := func() error {
+			db, err := ctx.openDataNodeShard(replica)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			return shards.dropSubscription(db, replica.DataNodeShardID)
+		}(); err != nil {
+			// The subscription will be detached from the old primary when the replica is repaired.
+			timber.Warningf("could not drop the subscription for data node shard [%d]: %v", replica.DataNodeShardID, err)
+		}
+	}
+
+	for _, query := range []string{
+		fmt.Sprintf("DROP PUBLICATION IF EXISTS %s", pq.QuoteIdentifier(publicationName(source.DataNodeShardID))),
+		"SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE database = current_database() AND NOT active",
+	} {
+		if _, err := sourceDb.Exec(query); err != nil {
+			timber.Warningf("could not remove replication from data node shard [%d]: %v", source.DataNodeShardID, err)
+		}
+	}
+
+	go func() {
+		if err := shards.RepairDivergedDataNodeShards(); err != nil {
+			timber.Errorf("could not repair diverged data node shards: %v", err)
+		}
+	}()
+}
+
+// dataNodeShardMoveClaim is the key of the claim that is held while a data node shard is being
+// moved.
+func dataNodeShardMoveClaim(dataNodeShardId uint64) string {
+	return fmt.Sprintf("data_node_shard_move:%d", dataNodeShardId)
+}
+
+// waitForDataNodeShardConnections waits for the sessions on this coordinator to release their
+// connections to the data node shard.
+func (ctx *dataNodeContext) waitForDataNodeShardConnections(dataNodeShardId uint64) {
+	deadline := time.Now().Add(dataNodeDrainConnectionTimeout)
+	for ctx.Pool().ActiveConnections(dataNodeShardId) > 0 {
+		if time.Now().After(deadline) {
+			timber.Warningf("timed out waiting for %d connection(s) to data node shard [%d] to be released",
+				ctx.Pool().ActiveConnections(dataNodeShardId), dataNodeShardId)
+			return
+		}
+		time.Sleep(dataNodeDrainConnectionInterval)
+	}
+}
+
+// releaseDataNodeShardSql returns the statement that asks every coordinator to close its pool for
+// the data node shard, it should be applied together with removing the data node shard.
+func releaseDataNodeShardSql(dataNodeShard DataNodeShard) string {
+	return fmt.Sprintf(
+		"INSERT INTO data_node_shard_releases (data_node_shard_id, data_node_id) SELECT %d, %d "+
+			"WHERE NOT EXISTS (SELECT 1 FROM data_node_shard_releases WHERE data_node_shard_id = %d)",
+		dataNodeShard.DataNodeShardID, dataNodeShard.DataNodeID, dataNodeShard.DataNodeShardID)
+}
+
+// observeDataNodeShardReleases returns an observer for the internal store that signals the
+// channel whenever data node shards might have been released.
+func observeDataNodeShardReleases(changed chan<- struct{}) func(queries []string) {
+	return func(queries []string) {
+		// The entire store is replaced when a snapshot is restored.
+		touched := queries == nil
+		for _, query := range queries {
+			if strings.Contains(query, "data_node_shard_releases") {
+				touched = true
+				break
+			}
+		}
+
+		if !touched {
+			return
+		}
+
+		select {
+		case changed <- struct{}{}:
+		default:
+			// A change is already pending.
+		}
+	}
+}
+
+// watchDataNodeShardReleases runs on every coordinator and closes the pools for the data node
+// shards that were removed from the cluster. Each release is acknowledged once the pool has been
+// closed, that way the coordinator that removed the data node shard knows that no coordinator is
+// still connected to it.
+func (ctx *base) watchDataNodeShardReleases(changed <-chan struct{}) {
+	dataNodes := &dataNodeContext{ctx}
+	released := map[uint64]bool{}
+	for {
+		ids, err := dataNodes.getDataNodeShardReleases()
+		if err != nil {
+			timber.Errorf("could not retrieve released data node shards: %v", err)
+		} else {
+			current := map[uint64]bool{}
+			for _, id := range ids {
+				current[id] = true
+				if !released[id] {
+					go dataNodes.releaseDataNodeShard(id)
+				}
+			}
+			released = current
+		}
+
+		<-changed
+	}
+}
+
+// releaseDataNodeShard closes the pool for a data node shard that was removed once the sessions on
+// this coordinator have released their connections to it, then acknowledges the release.
+func (ctx *dataNodeContext) releaseDataNodeShard(dataNodeShardId uint64) {
+	// New queries will no longer be sent to the data node shard, but sessions that were already
+	// using it need to finish before we can close the pool.
+	ctx.waitForDataNodeShardConnections(dataNodeShardId)
+	ctx.Pool().ClosePool(dataNodeShardId)
+
+	// The release might be removed before the acknowledgement is applied, so it is only recorded
+	// if the release still exists.
+	compiledSql := fmt.Sprintf(
+		"INSERT INTO data_node_shard_release_acks (data_node_shard_id, coordinator_id) SELECT %d, %s "+
+			"WHERE EXISTS (SELECT 1 FROM data_node_shard_releases WHERE data_node_shard_id = %d) "+
+			"AND NOT EXISTS (SELECT 1 FROM data_node_shard_release_acks WHERE data_node_shard_id = %d AND coordinator_id = %s)",
+		dataNodeShardId, quoteText(ctx.db.ID()), dataNodeShardId, dataNodeShardId, quoteText(ctx.db.ID()))
+	if _, err := ctx.db.Exec(compiledSql); err != nil {
+		timber.Errorf("could not acknowledge the release of data node shard [%d]: %v", dataNodeShardId, err)
+	}
+}
+
+// awaitDataNodeShardReleases waits for every coordinator in the cluster to acknowledge the releases
+// of the data node shards that were removed from the data node. Once they have, none of them are
+// connected to those data node shards, so the releases are removed together with the provided
+// statements.
+func (ctx *dataNodeContext) awaitDataNodeShardReleases(dataNodeId uint64, statements ...string) error {
+	deadline := time.Now().Add(dataNodeShardReleaseTimeout)
+	for {
+		ids, err := ctx.getDataNodeShardReleases(dataNodeId)
+		if err != nil {
+			return err
+		}
+
+		if len(ids) == 0 {
+			break
+		}
+
+		servers, err := ctx.db.Nodes()
+		if err != nil {
+			return err
+		}
+
+		compiledSql, _, _ := goqu.
+			From("data_node_shard_release_acks").
+			Select("data_node_shard_id", "coordinator_id").
+			Where(goqu.Ex{
+				"data_node_shard_id": ids,
+			}).
+			ToSql()
+		response, err := ctx.db.Query(compiledSql)
+		if err != nil {
+			return err
+		}
+
+		acknowledged := map[string]int{}
+		rows := rqliter.NewRqlRows(response)
+		for rows.Next() {
+			dataNodeShardId, coordinatorId := uint64(0), ""
+			if err := rows.Scan(&dataNodeShardId, &coordinatorId); err != nil {
+				return err
+			}
+			acknowledged[coordinatorId]++
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		missing := make([]string, 0)
+		for _, server := range servers {
+			if acknowledged[server.ID] < len(ids) {
+				missing = append(missing, server.ID)
+			}
+		}
+
+		if len(missing) == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for coordinators %v to release the data node shards on data node [%d]",
+				missing, dataNodeId)
+		}
+
+		time.Sleep(dataNodeDrainConnectionInterval)
+	}
+
+	statements = append(statements, goqu.
+		From("data_node_shard_releases").
+		Where(goqu.Ex{
+			"data_node_id": dataNodeId,
+		}).
+		Delete().Sql)
+	response, err := ctx.db.ExecuteEx(&frunk.ExecuteRequest{
+		Queries: statements,
+		Atomic:  true,
+	})
+	if err != nil {
+		return err
+	}
+	return executeResponseError(response)
+}
+
+// getDataNodeShardReleases returns the IDs of the data node shards that were removed but might
+// still have pools on some of the coordinators. If data node IDs are provided then only the data
+// node shards that were on those data nodes are returned.
+func (ctx *dataNodeContext) getDataNodeShardReleases(dataNodeIds ...uint64) ([]uint64, error) {
+	query := goqu.
+		From("data_node_shard_releases").
+		Select("data_node_shard_id")
+	if len(dataNodeIds) > 0 {
+		query = query.Where(goqu.Ex{
+			"data_node_id": dataNodeIds,
+		})
+	}
+	compiledSql, _, _ := query.ToSql()
+	response, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+	return idArray(response)
+}
+
+func (ctx *dataNodeContext) getDataNodeShardMoves(sourceDataNodeShardIds ...uint64) ([]DataNodeShardMove, error) {
+	query := getDataNodeShardMovesQuery
+	if len(sourceDataNodeShardIds) > 0 {
+		query = query.Where(goqu.Ex{
+			"source_data_node_shard_id": sourceDataNodeShardIds,
+		})
+	}
+	compiledSql, _, _ := query.ToSql()
+	response, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.dataNodeShardMovesFromRows(response)
+}
+
+func (ctx *dataNodeContext) dataNodeShardMovesFromRows(response *frunk.QueryResponse) ([]DataNodeShardMove, error) {
+	rows := rqliter.NewRqlRows(response)
+	moves := make([]DataNodeShardMove, 0)
+	for rows.Next() {
+		move := DataNodeShardMove{}
+		if err := rows.Scan(
+			&move.SourceDataNodeShardID,
+			&move.TargetDataNodeShardID,
+			&move.State,
+			&move.KeepSource); err != nil {
+			return nil, err
+		}
+		moves = append(moves, move)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
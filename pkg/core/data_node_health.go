@@ -0,0 +1,393 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/timber"
+	"github.com/lib/pq"
+	"github.com/readystock/goqu"
+	"strings"
+	"time"
+)
+
+const (
+	// dataNodeHealthCheckInterval is how often the leader checks each of the data nodes.
+	dataNodeHealthCheckInterval = 5 * time.Second
+
+	// dataNodeHealthCheckTimeout is how long a data node has to respond to a health check.
+	dataNodeHealthCheckTimeout = 2 * time.Second
+
+	// dataNodeUnhealthyThreshold is the number of health checks in a row that must fail before a
+	// data node is marked as unhealthy, this way a single slow response will not cause a failover.
+	dataNodeUnhealthyThreshold = 3
+)
+
+// checkDataNodeHealth periodically checks whether each of the data nodes can be reached while
+// this coordinator is the leader.
+func (ctx *base) checkDataNodeHealth() {
+	dataNodes := &dataNodeContext{ctx}
+	failures := map[uint64]int{}
+	for {
+		time.Sleep(dataNodeHealthCheckInterval)
+		if !ctx.IsLeader() {
+			// If we become the leader again then we want to start counting from scratch.
+			failures = map[uint64]int{}
+			continue
+		}
+
+		if err := dataNodes.checkDataNodes(failures); err != nil {
+			timber.Errorf("could not check the health of the data nodes: %v", err)
+		}
+	}
+}
+
+func (ctx *dataNodeContext) checkDataNodes(failures map[uint64]int) error {
+	nodes, err := ctx.GetDataNodes()
+	if err != nil {
+		return err
+	}
+
+	for _, dataNode := range nodes {
+		healthy := true
+		if err := probeDataNode(dataNode); err != nil {
+			failures[dataNode.DataNodeID]++
+			timber.Warningf("health check %d of %d failed for data node [%d]: %v",
+				failures[dataNode.DataNodeID], dataNodeUnhealthyThreshold, dataNode.DataNodeID, err)
+			healthy = failures[dataNode.DataNodeID] < dataNodeUnhealthyThreshold
+		} else {
+			delete(failures, dataNode.DataNodeID)
+		}
+
+		if healthy == dataNode.Healthy {
+			continue
+		}
+
+		if err := ctx.SetDataNodeHealth(dataNode.DataNodeID, healthy); err != nil {
+			timber.Errorf("could not update the health of data node [%d]: %v", dataNode.DataNodeID, err)
+		}
+	}
+
+	return nil
+}
+
+// probeDataNode connects to the data node and runs a simple query.
+func probeDataNode(dataNode DataNode) error {
+	c, cancel := context.WithTimeout(context.Background(), dataNodeHealthCheckTimeout)
+	defer cancel()
+
+	connStr := fmt.Sprintf("%s&connect_timeout=%d",
+		dataNodeConnectionString(dataNode, "postgres"), int(dataNodeHealthCheckTimeout.Seconds()))
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	one := 0
+	return db.QueryRowContext(c, "SELECT 1").Scan(&one)
+}
+
+// SetDataNodeHealth marks the data node as healthy or unhealthy. Queries will not be sent to a
+// data node while it is unhealthy. If the data node was the primary for any shards then one of
+// the shard's replicas will be promoted, and any shard that does not have a healthy data node
+// shard left will be marked as unavailable.
+func (ctx *dataNodeContext) SetDataNodeHealth(id uint64, healthy bool) error {
+	dataNode, err := ctx.GetDataNode(id)
+	if err != nil {
+		return err
+	}
+
+	if dataNode.Healthy == healthy {
+		return nil
+	}
+
+	compiledSql := goqu.
+		From("data_nodes").
+		Where(goqu.Ex{
+			"data_node_id": id,
+		}).
+		Update(goqu.Record{
+			"healthy": healthy,
+		}).Sql
+	if _, err := ctx.db.Exec(compiledSql); err != nil {
+		return err
+	}
+
+	shards := &shardContext{ctx.base}
+	if healthy {
+		timber.Infof("data node [%d] is healthy", id)
+		if err := shards.updateShardAvailability(); err != nil {
+			return err
+		}
+
+		// The data node shards that missed writes while the data node was down can be repaired
+		// now that it can be reached again.
+		go func() {
+			if err := shards.RepairDivergedDataNodeShards(); err != nil {
+				timber.Errorf("could not repair diverged data node shards: %v", err)
+			}
+		}()
+		return nil
+	}
+
+	timber.Warningf("data node [%d] is unhealthy", id)
+	if err := ctx.failoverDataNode(id); err != nil {
+		return err
+	}
+
+	return shards.updateShardAvailability()
+}
+
+// failoverDataNode handles each of the data node shards on a data node that has become unhealthy.
+// With logical replication a primary on the data node is replaced by one of its read only
+// replicas, the replicas will catch up on their own when the data node is healthy again.
+// Otherwise the data node shards will miss writes while the data node is down, so they are marked
+// as diverged and will be repaired once the data node is healthy.
+func (ctx *dataNodeContext) failoverDataNode(id uint64) error {
+	mode, err := ctx.getReplicationMode()
+	if err != nil {
+		return err
+	}
+
+	shards := &shardContext{ctx.base}
+	dataNodeShards, err := shards.GetDataNodeShards()
+	if err != nil {
+		return err
+	}
+
+	diverged := make([]uint64, 0)
+	for _, dataNodeShard := range dataNodeShards {
+		if dataNodeShard.DataNodeID != id {
+			continue
+		}
+
+		if mode != ReplicationModeOptions_Logical {
+			diverged = append(diverged, dataNodeShard.DataNodeShardID)
+			continue
+		}
+
+		if dataNodeShard.ReadOnly {
+			// The replica's subscription will catch up when the data node is back.
+			continue
+		}
+
+		promoted, err := shards.promoteReplica(dataNodeShard, dataNodeShards)
+		if err != nil {
+			timber.Errorf("could not promote a replica of shard [%d]: %v", dataNodeShard.ShardID, err)
+			continue
+		}
+
+		if !promoted {
+			// There is nothing to fail over to, the primary will miss writes to the global tables.
+			diverged = append(diverged, dataNodeShard.DataNodeShardID)
+		}
+	}
+
+	// If no other data node shard can receive writes then nothing can be missed.
+	writable, err := ctx.GetDataNodeShardIDs()
+	if err != nil || len(writable) == 0 {
+		return err
+	}
+
+	return shards.markDataNodeShardsDiverged(diverged...)
+}
+
+// promoteReplica makes one of the read only replicas of the failed primary's shard the new
+// primary. The old primary and the other replicas were following the old primary, so they are
+// marked as diverged and will be subscribed to the new primary when they are repaired. False is
+// returned if the shard does not have a replica that can be promoted.
+func (ctx *shardContext) promoteReplica(failed DataNodeShard, dataNodeShards []DataNodeShard) (bool, error) {
+	nodes, err := ctx.DataNodes().GetDataNodes()
+	if err != nil {
+		return false, err
+	}
+	healthyNodes := map[uint64]bool{}
+	for _, node := range nodes {
+		healthyNodes[node.DataNodeID] = node.Healthy
+	}
+
+	provisions, err := ctx.getDataNodeShardProvisions()
+	if err != nil {
+		return false, err
+	}
+	provisioning := map[uint64]bool{}
+	for _, provision := range provisions {
+		provisioning[provision.DataNodeShardID] = true
+	}
+
+	divergedDataNodeShards, err := ctx.getDivergedDataNodeShards()
+	if err != nil {
+		return false, err
+	}
+	alreadyDiverged := map[uint64]bool{}
+	for _, item := range divergedDataNodeShards {
+		alreadyDiverged[item.DataNodeShardID] = true
+	}
+
+	caughtUp, err := ctx.getCaughtUpReplicas()
+	if err != nil {
+		return false, err
+	}
+
+	replicas := make([]DataNodeShard, 0)
+	candidate, found := DataNodeShard{}, false
+	for _, dataNodeShard := range dataNodeShards {
+		if dataNodeShard.ShardID != failed.ShardID || dataNodeShard.DataNodeShardID == failed.DataNodeShardID {
+			continue
+		}
+		replicas = append(replicas, dataNodeShard)
+
+		if !dataNodeShard.ReadOnly ||
+			!healthyNodes[dataNodeShard.DataNodeID] ||
+			provisioning[dataNodeShard.DataNodeShardID] ||
+			alreadyDiverged[dataNodeShard.DataNodeShardID] {
+			continue
+		}
+
+		// Prefer a replica that was caught up the last time the lag was measured.
+		if !found || (!caughtUp[candidate.DataNodeShardID] && caughtUp[dataNodeShard.DataNodeShardID]) {
+			candidate, found = dataNodeShard, true
+		}
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	timber.Warningf("promoting data node shard [%d] to be the primary for shard [%d]", candidate.DataNodeShardID, failed.ShardID)
+
+	// The old primary cannot be reached, so the replica's subscription is detached from its
+	// replication slot before it is dropped.
+	db, err := ctx.openDataNodeShard(candidate)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	if err := ctx.detachSubscription(db, candidate.DataNodeShardID); err != nil {
+		return false, err
+	}
+
+	statements := []string{
+		goqu.
+			From("data_node_shards").
+			Where(goqu.Ex{
+				"data_node_shard_id": candidate.DataNodeShardID,
+			}).
+			Update(goqu.Record{
+				"read_only": false,
+			}).Sql,
+		goqu.
+			From("data_node_shards").
+			Where(goqu.Ex{
+				"data_node_shard_id": failed.DataNodeShardID,
+			}).
+			Update(goqu.Record{
+				"read_only": true,
+			}).Sql,
+	}
+
+	diverged := []uint64{failed.DataNodeShardID}
+	for _, replica := range replicas {
+		if replica.DataNodeShardID != candidate.DataNodeShardID {
+			diverged = append(diverged, replica.DataNodeShardID)
+		}
+	}
+
+	if _, err := ctx.db.Exec(strings.Join(statements, ";")); err != nil {
+		return false, err
+	}
+
+	return true, ctx.markDataNodeShardsDiverged(diverged...)
+}
+
+// detachSubscription drops the subscription without dropping its replication slot on the
+// primary. This is used when the primary cannot be reached.
+func (ctx *shardContext) detachSubscription(db *sql.DB, dataNodeShardId uint64) error {
+	name := subscriptionName(dataNodeShardId)
+	subscribed := false
+	if err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM pg_subscription WHERE subname = $1)", name,
+	).Scan(&subscribed); err != nil {
+		return err
+	}
+
+	if !subscribed {
+		return nil
+	}
+
+	for _, query := range []string{
+		"ALTER SUBSCRIPTION %s DISABLE",
+		"ALTER SUBSCRIPTION %s SET (slot_name = NONE)",
+		"DROP SUBSCRIPTION %s",
+	} {
+		if _, err := db.Exec(fmt.Sprintf(query, pq.QuoteIdentifier(name))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markDataNodeShardsDiverged marks each of the data node shards as diverged if they are not
+// already. Diverged data node shards will not receive any queries until they are repaired.
+func (ctx *shardContext) markDataNodeShardsDiverged(dataNodeShardIds ...uint64) error {
+	if len(dataNodeShardIds) == 0 {
+		return nil
+	}
+
+	existing, err := ctx.getDivergedDataNodeShards(dataNodeShardIds...)
+	if err != nil {
+		return err
+	}
+	alreadyDiverged := map[uint64]bool{}
+	for _, item := range existing {
+		alreadyDiverged[item.DataNodeShardID] = true
+	}
+
+	records := make([]interface{}, 0, len(dataNodeShardIds))
+	for _, id := range dataNodeShardIds {
+		if alreadyDiverged[id] {
+			continue
+		}
+		records = append(records, goqu.Record{
+			"data_node_shard_id": id,
+			"state":              ReplicaState_Diverged,
+		})
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	compiledSql := goqu.
+		From("diverged_data_node_shards").
+		Insert(records...).Sql
+	_, err = ctx.db.Exec(compiledSql)
+	return err
+}
+
+// updateShardAvailability marks stable shards that do not have a data node shard that can receive
+// writes as unavailable, and marks unavailable shards that have one again as stable.
+func (ctx *shardContext) updateShardAvailability() error {
+	writable := fmt.Sprintf(`
+		SELECT 1
+		FROM data_node_shards d
+		INNER JOIN data_nodes n ON n.data_node_id = d.data_node_id
+		LEFT JOIN data_node_shard_provisions p ON p.data_node_shard_id = d.data_node_shard_id
+		LEFT JOIN diverged_data_node_shards v ON v.data_node_shard_id = d.data_node_shard_id
+		WHERE d.shard_id = shards.shard_id
+		AND n.healthy
+		AND NOT d.read_only
+		AND p.data_node_shard_id IS NULL
+		AND (v.state IS NULL OR v.state = %d)`,
+		ReplicaState_Repairing)
+	statements := []string{
+		fmt.Sprintf("UPDATE shards SET state = %d WHERE state = %d AND NOT EXISTS(%s)",
+			ShardState_Unavailable, ShardState_Stable, writable),
+		fmt.Sprintf("UPDATE shards SET state = %d WHERE state = %d AND EXISTS(%s)",
+			ShardState_Stable, ShardState_Unavailable, writable),
+	}
+	_, err := ctx.db.Exec(strings.Join(statements, ";"))
+	return err
+}
@@ -1,9 +1,13 @@
 package core_test
 
 import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/core"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
 	"github.com/elliotcourant/noahdb/testutils"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestDataNodeContext_GetRandomDataNode(t *testing.T) {
@@ -15,3 +19,515 @@ func TestDataNodeContext_GetRandomDataNode(t *testing.T) {
 		assert.NotEmpty(t, dataNode)
 	})
 }
+
+func TestDataNodeContext_DrainDataNode(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	existingNodes, err := colony.DataNodes().GetDataNodes()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Len(t, existingNodes, 1)
+
+	t.Run("cannot drain the only data node", func(t *testing.T) {
+		err := colony.DataNodes().DrainDataNode(existingNodes[0].DataNodeID)
+		assert.Error(t, err)
+	})
+
+	node, cleanupNode, err := testutils.NewDataNode(t)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer cleanupNode()
+
+	newNode, err := colony.DataNodes().NewDataNode(node.Address, node.Port, node.User, node.Password)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	shardsBefore, err := colony.Shards().GetDataNodeShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	t.Run("drain data node", func(t *testing.T) {
+		// The data node shards are moved in order, the last one is held so that the other moves
+		// don't use up the time that the coordinator will wait for it to be released.
+		heldId := uint64(0)
+		for _, dataNodeShard := range shardsBefore {
+			if dataNodeShard.DataNodeID == existingNodes[0].DataNodeID {
+				heldId = dataNodeShard.DataNodeShardID
+			}
+		}
+
+		// A session is still using one of the data node shards that are being moved, the data
+		// node should not be removed until the connection has been released.
+		conn, err := colony.Pool().GetConnectionForDataNodeShard(heldId)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		drained := make(chan error, 1)
+		go func() {
+			drained <- colony.DataNodes().DrainDataNode(existingNodes[0].DataNodeID)
+		}()
+
+		moved := func() bool {
+			dataNodeShards, err := colony.Shards().GetDataNodeShards()
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+			for _, dataNodeShard := range dataNodeShards {
+				if dataNodeShard.DataNodeID == existingNodes[0].DataNodeID {
+					return false
+				}
+			}
+			return true
+		}
+
+		deadline := time.Now().Add(time.Minute)
+		for !moved() {
+			if time.Now().After(deadline) {
+				t.Fatal("data node shards were not moved")
+			}
+			select {
+			case err := <-drained:
+				t.Fatalf("drain finished before the connection was released: %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		dataNodes, err := colony.DataNodes().GetDataNodes()
+		assert.NoError(t, err)
+		assert.Len(t, dataNodes, 2)
+
+		conn.Release()
+		err = <-drained
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		assert.Zero(t, colony.Pool().ActiveConnections(heldId))
+
+		dataNodes, err = colony.DataNodes().GetDataNodes()
+		assert.NoError(t, err)
+		assert.Len(t, dataNodes, 1)
+		assert.Equal(t, newNode.DataNodeID, dataNodes[0].DataNodeID)
+
+		shardsAfter, err := colony.Shards().GetDataNodeShards()
+		assert.NoError(t, err)
+		assert.Len(t, shardsAfter, len(shardsBefore))
+		for _, dataNodeShard := range shardsAfter {
+			assert.Equal(t, newNode.DataNodeID, dataNodeShard.DataNodeID)
+		}
+
+		moves, err := colony.DataNodes().GetDataNodeShardMoves()
+		assert.NoError(t, err)
+		assert.Empty(t, moves)
+	})
+}
+
+func TestDataNodeContext_SetDataNodeHealth(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	dataNodes, err := colony.DataNodes().GetDataNodes()
+	if !assert.NoError(t, err) || !assert.NotEmpty(t, dataNodes) {
+		panic("no data nodes")
+	}
+	dataNodeId := dataNodes[0].DataNodeID
+
+	shards, err := colony.Shards().GetShards()
+	assert.NoError(t, err)
+	stable := map[uint64]bool{}
+	for _, shard := range shards {
+		stable[shard.ShardID] = shard.State == core.ShardState_Stable
+	}
+
+	err = colony.DataNodes().SetDataNodeHealth(dataNodeId, false)
+	assert.NoError(t, err)
+
+	ids, err := colony.DataNodes().GetDataNodeShardIDs()
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	shards, err = colony.Shards().GetShards()
+	assert.NoError(t, err)
+	for _, shard := range shards {
+		if stable[shard.ShardID] {
+			assert.Equal(t, core.ShardState_Unavailable, shard.State)
+		}
+	}
+
+	// Nothing could be written while the only data node was down.
+	diverged, err := colony.Shards().GetDivergedDataNodeShards()
+	assert.NoError(t, err)
+	assert.Empty(t, diverged)
+
+	err = colony.DataNodes().SetDataNodeHealth(dataNodeId, true)
+	assert.NoError(t, err)
+
+	ids, err = colony.DataNodes().GetDataNodeShardIDs()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, ids)
+
+	shards, err = colony.Shards().GetShards()
+	assert.NoError(t, err)
+	for _, shard := range shards {
+		if stable[shard.ShardID] {
+			assert.Equal(t, core.ShardState_Stable, shard.State)
+		}
+	}
+}
+
+func TestDataNodeContext_SetDataNodeSSL(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	dataNodes, err := colony.DataNodes().GetDataNodes()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Equal(t, core.SSLModeDisable, dataNodes[0].SSLMode)
+
+	t.Run("set ssl mode", func(t *testing.T) {
+		err := colony.DataNodes().SetDataNodeSSL(dataNodes[0].DataNodeID, core.SSLModeRequire, "")
+		assert.NoError(t, err)
+
+		dataNode, err := colony.DataNodes().GetDataNode(dataNodes[0].DataNodeID)
+		assert.NoError(t, err)
+		assert.Equal(t, core.SSLModeRequire, dataNode.SSLMode)
+	})
+
+	t.Run("unsupported ssl mode", func(t *testing.T) {
+		err := colony.DataNodes().SetDataNodeSSL(dataNodes[0].DataNodeID, "prefer", "")
+		assert.Error(t, err)
+	})
+
+	t.Run("disable ssl", func(t *testing.T) {
+		err := colony.DataNodes().SetDataNodeSSL(dataNodes[0].DataNodeID, core.SSLModeDisable, "")
+		assert.NoError(t, err)
+
+		id, err := colony.DataNodes().GetRandomDataNodeShardID()
+		assert.NoError(t, err)
+
+		conn, err := colony.Pool().GetConnectionForDataNodeShard(id)
+		if assert.NoError(t, err) {
+			conn.Release()
+		}
+	})
+}
+
+// newReplicatedTestColony creates a colony with a second data node where each shard has a replica
+// on both data nodes.
+func newReplicatedTestColony(t *testing.T) (core.Colony, func()) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+
+	node, cleanupNode, err := testutils.NewDataNode(t)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = colony.DataNodes().NewDataNode(node.Address, node.Port, node.User, node.Password)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	err = colony.Setting().SetSetting(core.SettingKeyOptions_ReplicationMode, int64(core.ReplicationModeOptions_Query))
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	err = colony.Setting().SetSetting(core.SettingKeyOptions_ReplicationFactor, int64(2))
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		shards, err := colony.Shards().GetShards()
+		if err != nil {
+			return false
+		}
+		for _, shard := range shards {
+			if shard.State != core.ShardState_Stable {
+				continue
+			}
+			ids, err := colony.DataNodes().GetDataNodeShardIDsForShard(shard.ShardID)
+			if err != nil || len(ids) < 2 {
+				return false
+			}
+		}
+		return true
+	}, time.Minute, time.Second)
+
+	return colony, func() {
+		cleanupNode()
+		cleanup()
+	}
+}
+
+// makeReadOnlyReplica turns the newest replica of a stable shard into a read only replica, like it
+// would be with logical replication. The primary and the replica are returned.
+func makeReadOnlyReplica(t *testing.T, colony core.Colony) (core.DataNodeShard, core.DataNodeShard) {
+	shards, err := colony.Shards().GetShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	shardId := uint64(0)
+	for _, shard := range shards {
+		if shard.State == core.ShardState_Stable {
+			shardId = shard.ShardID
+			break
+		}
+	}
+
+	dataNodeShards, err := colony.Shards().GetDataNodeShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	replicas := make([]core.DataNodeShard, 0)
+	for _, dataNodeShard := range dataNodeShards {
+		if dataNodeShard.ShardID == shardId {
+			replicas = append(replicas, dataNodeShard)
+		}
+	}
+	if !assert.Len(t, replicas, 2) {
+		panic("shard does not have two replicas")
+	}
+
+	primary, replica := replicas[0], replicas[1]
+	if replica.DataNodeShardID < primary.DataNodeShardID {
+		primary, replica = replica, primary
+	}
+
+	executeInternal(t, colony, fmt.Sprintf(
+		"UPDATE data_node_shards SET read_only = 1 WHERE data_node_shard_id = %d", replica.DataNodeShardID))
+	replica.ReadOnly = true
+	return primary, replica
+}
+
+func executeInternal(t *testing.T, colony core.Colony, query string) {
+	response, err := colony.Execute(&frunk.ExecuteRequest{
+		Queries: []string{query},
+	})
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	for _, result := range response.Results {
+		if !assert.Empty(t, result.Error) {
+			panic(result.Error)
+		}
+	}
+}
+
+// Read only replicas are only read from while the leader has found them to be caught up with their
+// primary, every coordinator routes its reads using what the leader found.
+func TestDataNodeContext_ReadReplicaRouting(t *testing.T) {
+	leader, cleanupLeader := newReplicatedTestColony(t)
+	defer cleanupLeader()
+
+	follower, cleanupFollower := testutils.NewTestColony(t, leader.Addr().String())
+	defer cleanupFollower()
+
+	primary, replica := makeReadOnlyReplica(t, leader)
+
+	readIds := func() []uint64 {
+		ids, err := follower.DataNodes().GetReadDataNodeShardIDsForShard(primary.ShardID)
+		if err != nil {
+			return nil
+		}
+		return ids
+	}
+
+	t.Run("replica is not caught up", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]uint64{primary.DataNodeShardID}, readIds())
+		}, time.Minute, time.Second)
+	})
+
+	t.Run("replica is caught up", func(t *testing.T) {
+		executeInternal(t, leader, fmt.Sprintf(
+			"INSERT INTO caught_up_replicas (data_node_shard_id) VALUES (%d)", replica.DataNodeShardID))
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]uint64{primary.DataNodeShardID, replica.DataNodeShardID}, readIds())
+		}, time.Minute, time.Second)
+	})
+
+	// The replica is not subscribed to its primary, so when the leader measures the lag it will
+	// find that the replica is not connected.
+	t.Run("leader measures replica lag", func(t *testing.T) {
+		err := leader.Setting().SetSetting(core.SettingKeyOptions_ReplicationMode, int64(core.ReplicationModeOptions_Logical))
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]uint64{primary.DataNodeShardID}, readIds())
+		}, time.Minute, time.Second)
+	})
+}
+
+// When a primary is moved its read only replicas are not read from until they have been
+// subscribed to the new primary.
+func TestDataNodeContext_DrainPrimaryWithReplicas(t *testing.T) {
+	colony, cleanup := newReplicatedTestColony(t)
+	defer cleanup()
+
+	node, cleanupNode, err := testutils.NewDataNode(t)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer cleanupNode()
+
+	_, err = colony.DataNodes().NewDataNode(node.Address, node.Port, node.User, node.Password)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	primary, replica := makeReadOnlyReplica(t, colony)
+
+	err = colony.DataNodes().DrainDataNode(primary.DataNodeID)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	writeIds, err := colony.DataNodes().GetDataNodeShardIDsForShard(primary.ShardID)
+	assert.NoError(t, err)
+	if assert.Len(t, writeIds, 1) {
+		assert.NotEqual(t, primary.DataNodeShardID, writeIds[0])
+		assert.NotEqual(t, replica.DataNodeShardID, writeIds[0])
+	}
+
+	diverged, err := colony.Shards().GetDivergedDataNodeShards()
+	assert.NoError(t, err)
+	divergedIds := make([]uint64, 0, len(diverged))
+	for _, item := range diverged {
+		divergedIds = append(divergedIds, item.DataNodeShardID)
+	}
+	assert.Contains(t, divergedIds, replica.DataNodeShardID)
+
+	readIds, err := colony.DataNodes().GetReadDataNodeShardIDsForShard(primary.ShardID)
+	assert.NoError(t, err)
+	assert.NotContains(t, readIds, replica.DataNodeShardID)
+}
+
+// When a primary's data node fails one of its read only replicas becomes the primary, and the old
+// primary becomes a read only replica that is not used until it has been repaired.
+func TestDataNodeContext_FailoverToReplica(t *testing.T) {
+	colony, cleanup := newReplicatedTestColony(t)
+	defer cleanup()
+
+	primary, replica := makeReadOnlyReplica(t, colony)
+
+	err := colony.Setting().SetSetting(core.SettingKeyOptions_ReplicationMode, int64(core.ReplicationModeOptions_Logical))
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	t.Run("promote replica", func(t *testing.T) {
+		err := colony.DataNodes().SetDataNodeHealth(primary.DataNodeID, false)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		dataNodeShards, err := colony.Shards().GetDataNodeShards()
+		assert.NoError(t, err)
+		readOnly := map[uint64]bool{}
+		for _, dataNodeShard := range dataNodeShards {
+			readOnly[dataNodeShard.DataNodeShardID] = dataNodeShard.ReadOnly
+		}
+		assert.True(t, readOnly[primary.DataNodeShardID])
+		assert.False(t, readOnly[replica.DataNodeShardID])
+
+		diverged, err := colony.Shards().GetDivergedDataNodeShards()
+		assert.NoError(t, err)
+		divergedIds := make([]uint64, 0, len(diverged))
+		for _, item := range diverged {
+			divergedIds = append(divergedIds, item.DataNodeShardID)
+		}
+		assert.Contains(t, divergedIds, primary.DataNodeShardID)
+		assert.NotContains(t, divergedIds, replica.DataNodeShardID)
+	})
+
+	t.Run("route to new primary", func(t *testing.T) {
+		writeIds, err := colony.DataNodes().GetDataNodeShardIDsForShard(primary.ShardID)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{replica.DataNodeShardID}, writeIds)
+
+		readIds, err := colony.DataNodes().GetReadDataNodeShardIDsForShard(primary.ShardID)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{replica.DataNodeShardID}, readIds)
+
+		shards, err := colony.Shards().GetShards()
+		assert.NoError(t, err)
+		for _, shard := range shards {
+			if shard.ShardID == primary.ShardID {
+				assert.Equal(t, core.ShardState_Stable, shard.State)
+			}
+		}
+	})
+
+	// The old primary cannot be subscribed to the new primary by the test data nodes, so it stays
+	// diverged and is still not used once its data node is healthy again.
+	t.Run("old primary recovers", func(t *testing.T) {
+		err := colony.DataNodes().SetDataNodeHealth(primary.DataNodeID, true)
+		assert.NoError(t, err)
+
+		writeIds, err := colony.DataNodes().GetDataNodeShardIDsForShard(primary.ShardID)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{replica.DataNodeShardID}, writeIds)
+
+		readIds, err := colony.DataNodes().GetReadDataNodeShardIDsForShard(primary.ShardID)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{replica.DataNodeShardID}, readIds)
+	})
+}
+
+// Every coordinator closes its connections to a data node when its TLS settings change, not just
+// the coordinator that changed them.
+func TestDataNodeContext_SetDataNodeSSL_Follower(t *testing.T) {
+	leader, cleanupLeader := testutils.NewPgTestColony(t)
+	defer cleanupLeader()
+
+	follower, cleanupFollower := testutils.NewTestColony(t, leader.Addr().String())
+	defer cleanupFollower()
+
+	dataNodes, err := leader.DataNodes().GetDataNodes()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	id, err := follower.DataNodes().GetRandomDataNodeShardID()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	// Leave an idle connection in the follower's pool.
+	conn, err := follower.Pool().GetConnectionForDataNodeShard(id)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	conn.Release()
+
+	// The test data nodes do not support TLS, so once the follower's idle connection has been
+	// closed it cannot connect to the data node anymore.
+	err = leader.DataNodes().SetDataNodeSSL(dataNodes[0].DataNodeID, core.SSLModeRequire, "")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		conn, err := follower.Pool().GetConnectionForDataNodeShard(id)
+		if err != nil {
+			return true
+		}
+		conn.Release()
+		return false
+	}, time.Minute, time.Second)
+
+	err = leader.DataNodes().SetDataNodeSSL(dataNodes[0].DataNodeID, core.SSLModeDisable, "")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		conn, err := follower.Pool().GetConnectionForDataNodeShard(id)
+		if err != nil {
+			return false
+		}
+		conn.Release()
+		return true
+	}, time.Minute, time.Second)
+}
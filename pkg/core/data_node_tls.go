@@ -0,0 +1,217 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/pgproto"
+	"github.com/elliotcourant/timber"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+const (
+	SSLModeDisable    = "disable"
+	SSLModeRequire    = "require"
+	SSLModeVerifyCA   = "verify-ca"
+	SSLModeVerifyFull = "verify-full"
+)
+
+// ValidateSSLMode returns an error if the sslmode is not supported for connections to data
+// nodes. An empty sslmode is the same as disable.
+func ValidateSSLMode(sslMode string) error {
+	switch sslMode {
+	case "", SSLModeDisable, SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull:
+		return nil
+	default:
+		return fmt.Errorf("unsupported sslmode [%s]", sslMode)
+	}
+}
+
+// dataNodeSSLMode returns the sslmode that should be used to connect to the data node.
+func dataNodeSSLMode(dataNode DataNode) string {
+	if dataNode.GetSSLMode() == "" {
+		return SSLModeDisable
+	}
+	return dataNode.GetSSLMode()
+}
+
+// dataNodeTLSConfig returns the TLS config that should be used to connect to the data node. Nil is
+// returned if the data node does not use TLS. The sslmodes behave the same way they do in libpq,
+// including require verifying the certificate authority when a root certificate is provided.
+func dataNodeTLSConfig(dataNode DataNode) (*tls.Config, error) {
+	sslMode := dataNodeSSLMode(dataNode)
+	if err := ValidateSSLMode(sslMode); err != nil {
+		return nil, err
+	}
+
+	if sslMode == SSLModeDisable {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName: dataNode.GetAddress(),
+	}
+
+	var roots *x509.CertPool
+	if rootCert := dataNode.GetSSLRootCert(); rootCert != "" {
+		pem, err := ioutil.ReadFile(rootCert)
+		if err != nil {
+			return nil, fmt.Errorf("could not read root certificate for data node [%d]: %v", dataNode.DataNodeID, err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("could not parse root certificate [%s] for data node [%d]", rootCert, dataNode.DataNodeID)
+		}
+		config.RootCAs = roots
+	}
+
+	switch {
+	case sslMode == SSLModeVerifyFull:
+		// The standard verification checks the certificate chain and the host name.
+	case sslMode == SSLModeRequire && roots == nil:
+		config.InsecureSkipVerify = true
+	default:
+		// Only the certificate chain should be verified, not the host name. Go can only skip
+		// both, so the chain is verified manually.
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyCertificateChain(roots)
+	}
+
+	return config, nil
+}
+
+// verifyCertificateChain returns a function that verifies the certificate presented by the data
+// node was signed by one of the provided roots. If roots is nil then the system roots are used.
+func verifyCertificateChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("data node did not present a certificate")
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, rawCert := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCert)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		options := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			options.Intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(options)
+		return err
+	}
+}
+
+// startTLS asks the data node to upgrade the connection to TLS and performs the handshake.
+func startTLS(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	if _, err := conn.Write((&pgproto.SSLRequest{}).Encode(nil)); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	if response[0] != 'S' {
+		return nil, fmt.Errorf("data node does not support TLS")
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// observeDataNodeSSL returns an observer for the internal store that signals the channel whenever
+// the TLS settings of a data node might have changed.
+func observeDataNodeSSL(changed chan<- struct{}) func(queries []string) {
+	return func(queries []string) {
+		// The entire store is replaced when a snapshot is restored.
+		touched := queries == nil
+		for _, query := range queries {
+			if strings.Contains(query, "ssl_mode") {
+				touched = true
+				break
+			}
+		}
+
+		if !touched {
+			return
+		}
+
+		select {
+		case changed <- struct{}{}:
+		default:
+			// A change is already pending.
+		}
+	}
+}
+
+// watchDataNodeSSL runs on every coordinator and closes the pools for a data node when its TLS
+// settings change, so that new connections use the new settings.
+func (ctx *base) watchDataNodeSSL(changed <-chan struct{}) {
+	dataNodes := &dataNodeContext{ctx}
+	settings := map[uint64]string{}
+	load := func() map[uint64]string {
+		nodes, err := dataNodes.GetDataNodes()
+		if err != nil {
+			timber.Errorf("could not retrieve data node tls settings: %v", err)
+			return nil
+		}
+
+		current := map[uint64]string{}
+		for _, node := range nodes {
+			current[node.DataNodeID] = node.SSLMode + "/" + node.SSLRootCert
+		}
+		return current
+	}
+
+	if current := load(); current != nil {
+		settings = current
+	}
+
+	for range changed {
+		current := load()
+		if current == nil {
+			continue
+		}
+
+		changedNodes := map[uint64]bool{}
+		for id, setting := range current {
+			if previous, ok := settings[id]; ok && previous != setting {
+				changedNodes[id] = true
+			}
+		}
+		settings = current
+
+		if len(changedNodes) == 0 {
+			continue
+		}
+
+		dataNodeShards, err := ctx.Shards().GetDataNodeShards()
+		if err != nil {
+			timber.Errorf("could not retrieve data node shards to close pools: %v", err)
+			continue
+		}
+
+		for _, dataNodeShard := range dataNodeShards {
+			if changedNodes[dataNodeShard.DataNodeID] {
+				ctx.Pool().ClosePool(dataNodeShard.DataNodeShardID)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"github.com/elliotcourant/timber"
+	"github.com/hashicorp/raft"
+	"sync/atomic"
+)
+
+// watchLeadership observes leader changes in the cluster. When this coordinator becomes the
+// leader it will resume any rebalancing that the previous leader did not finish.
+func (ctx *base) watchLeadership() {
+	observations := make(chan raft.Observation, 8)
+	ctx.db.RegisterObserver(raft.NewObserver(observations, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	}))
+
+	go func() {
+		for range observations {
+			if ctx.IsLeader() {
+				go ctx.resumeRebalancing()
+			}
+		}
+	}()
+}
+
+// resumeRebalancing will continue any shard provisioning, tenant moves, shard splits, data node
+// drains or replica repairs that were interrupted. Only one resume will run at a time.
+func (ctx *base) resumeRebalancing() {
+	if !atomic.CompareAndSwapInt32(&ctx.rebalancing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&ctx.rebalancing, 0)
+
+	// Orphaned shards and data node shards that were being provisioned need to be finished
+	// before any tenants can be moved to them.
+	if err := ctx.Shards().BalanceOrphanShards(); err != nil {
+		timber.Errorf("could not resume provisioning shards: %v", err)
+	}
+
+	if err := ctx.Tenants().ResumeTenantMoves(); err != nil {
+		timber.Errorf("could not resume tenant moves: %v", err)
+	}
+
+	if err := ctx.Shards().ResumeShardSplits(); err != nil {
+		timber.Errorf("could not resume shard splits: %v", err)
+	}
+
+	if err := ctx.DataNodes().ResumeDataNodeDrains(); err != nil {
+		timber.Errorf("could not resume draining data nodes: %v", err)
+	}
+
+	if err := ctx.Shards().BalanceReplicas(); err != nil {
+		timber.Errorf("could not balance replicas: %v", err)
+	}
+
+	if err := ctx.Shards().RepairDivergedDataNodeShards(); err != nil {
+		timber.Errorf("could not repair diverged data node shards: %v", err)
+	}
+}
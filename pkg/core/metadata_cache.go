@@ -0,0 +1,314 @@
+package core
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// cacheRegion is a group of cached lookups that depend on the same internal tables. Each time
+// one of those tables is changed the entire region is cleared and its version is incremented.
+type cacheRegion struct {
+	sync.RWMutex
+	version uint64
+	entries map[string]interface{}
+}
+
+func newCacheRegion() *cacheRegion {
+	return &cacheRegion{
+		entries: map[string]interface{}{},
+	}
+}
+
+// get returns the cached value for the key. The version of the region is returned so that a
+// value that is read from the store can be put in the cache only if the region has not been
+// invalidated since.
+func (region *cacheRegion) get(key string) (interface{}, uint64, bool) {
+	region.RLock()
+	defer region.RUnlock()
+	value, ok := region.entries[key]
+	return value, region.version, ok
+}
+
+// put adds the value to the cache, if the region has been invalidated since the provided version
+// then the value might be stale and it will not be stored.
+func (region *cacheRegion) put(version uint64, key string, value interface{}) {
+	region.Lock()
+	defer region.Unlock()
+	if region.version != version {
+		return
+	}
+	region.entries[key] = value
+}
+
+// getVersion returns the current version of the region.
+func (region *cacheRegion) getVersion() uint64 {
+	region.RLock()
+	defer region.RUnlock()
+	return region.version
+}
+
+func (region *cacheRegion) invalidate() {
+	region.Lock()
+	defer region.Unlock()
+	region.version++
+	region.entries = map[string]interface{}{}
+}
+
+// metadataCache keeps the metadata that is needed to plan most statements in memory. The cache
+// is invalidated as changes are applied to the internal store by raft, so it is never behind
+// this coordinator's copy of the store.
+type metadataCache struct {
+	tables         *cacheRegion
+	columns        *cacheRegion
+	tenants        *cacheRegion
+	dataNodeShards *cacheRegion
+
+	// settings is needed because the slow query log reads its threshold and whether parameters
+	// are masked for every statement, without it each statement would query the store twice.
+	settings *cacheRegion
+
+	// schema does not have any entries, its version is incremented whenever the schema of the
+	// cluster changes so that statements prepared on data node connections are prepared again.
+	schema *cacheRegion
+
+	// dependencies are the regions that need to be invalidated when each internal table changes.
+	dependencies map[string][]*cacheRegion
+	regions      []*cacheRegion
+}
+
+func newMetadataCache() *metadataCache {
+	cache := &metadataCache{
+		tables:         newCacheRegion(),
+		columns:        newCacheRegion(),
+		tenants:        newCacheRegion(),
+		dataNodeShards: newCacheRegion(),
+		settings:       newCacheRegion(),
+		schema:         newCacheRegion(),
+	}
+
+	cache.regions = []*cacheRegion{
+		cache.tables,
+		cache.columns,
+		cache.tenants,
+		cache.dataNodeShards,
+		cache.settings,
+		cache.schema,
+	}
+
+	cache.dependencies = map[string][]*cacheRegion{
+		"schemas":                    {cache.tables, cache.columns, cache.schema},
+		"tables":                     {cache.tables, cache.columns, cache.schema},
+		"columns":                    {cache.columns, cache.schema},
+		"types":                      {cache.schema},
+		"schema_definitions":         {cache.schema},
+		"shards":                     {cache.tenants, cache.dataNodeShards},
+		"tenants":                    {cache.tenants},
+		"data_nodes":                 {cache.dataNodeShards},
+		"data_node_shards":           {cache.dataNodeShards},
+		"data_node_shard_provisions": {cache.dataNodeShards},
+		"diverged_data_node_shards":  {cache.dataNodeShards},
+		"settings":                   {cache.settings},
+	}
+
+	return cache
+}
+
+// invalidate is called as queries are applied to the internal store. Only the regions that
+// depend on the tables that are changed by the queries are cleared. If the queries are nil, or
+// if any of them is a write whose target cannot be determined, then everything is cleared.
+func (cache *metadataCache) invalidate(queries []string) {
+	changed := map[string]bool{}
+	for _, query := range queries {
+		tables, ok := changedTables(query)
+		if !ok {
+			queries = nil
+			break
+		}
+		for _, table := range tables {
+			changed[table] = true
+		}
+	}
+
+	if queries == nil {
+		for _, region := range cache.regions {
+			region.invalidate()
+		}
+		return
+	}
+
+	invalidated := map[*cacheRegion]bool{}
+	for table := range changed {
+		for _, region := range cache.dependencies[table] {
+			if !invalidated[region] {
+				invalidated[region] = true
+				region.invalidate()
+			}
+		}
+	}
+}
+
+// changedTables returns the internal tables that are written to by the statements in the query.
+// Only plain INSERT, REPLACE, UPDATE and DELETE statements are recognized, if the query contains
+// any other kind of write then false is returned and the caller should assume that anything
+// might have changed. Statements that only read are ignored.
+func changedTables(query string) ([]string, bool) {
+	tables := make([]string, 0, 1)
+	for _, statement := range tokenizeStatements(query) {
+		if len(statement) == 0 {
+			continue
+		}
+
+		var i int
+		next := func() (sqlToken, bool) {
+			if i >= len(statement) {
+				return sqlToken{}, false
+			}
+			i++
+			return statement[i-1], true
+		}
+		keyword := func(words ...string) bool {
+			token, ok := next()
+			if !ok || token.quoted {
+				return false
+			}
+			for _, word := range words {
+				if token.text == word {
+					return true
+				}
+			}
+			return false
+		}
+		skipConflict := func() {
+			// INSERT OR IGNORE INTO, UPDATE OR REPLACE and so on.
+			if i+1 < len(statement) && !statement[i].quoted && statement[i].text == "OR" {
+				i += 2
+			}
+		}
+
+		switch first, _ := next(); {
+		case first.quoted:
+			return nil, false
+		case first.text == "SELECT":
+			continue
+		case first.text == "INSERT":
+			skipConflict()
+			if !keyword("INTO") {
+				return nil, false
+			}
+		case first.text == "REPLACE":
+			if !keyword("INTO") {
+				return nil, false
+			}
+		case first.text == "UPDATE":
+			skipConflict()
+		case first.text == "DELETE":
+			if !keyword("FROM") {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+
+		name, ok := next()
+		if !ok || !name.identifier() {
+			return nil, false
+		}
+		// The table might be qualified with the name of the database.
+		if i+1 < len(statement) && !statement[i].quoted && !statement[i].literal && statement[i].text == "." {
+			if name = statement[i+1]; !name.identifier() {
+				return nil, false
+			}
+		}
+		tables = append(tables, strings.ToLower(name.text))
+	}
+	return tables, true
+}
+
+// sqlToken is a single word, quoted identifier, string literal or symbol of a SQLite statement.
+// Unquoted words are upper cased.
+type sqlToken struct {
+	text    string
+	quoted  bool
+	literal bool
+}
+
+func (token sqlToken) identifier() bool {
+	if token.literal || token.text == "" {
+		return false
+	}
+	if token.quoted {
+		return true
+	}
+	r := rune(token.text[0])
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// tokenizeStatements splits the query into the tokens of each statement. Comments are dropped
+// and semicolons within string literals or quoted identifiers do not end a statement.
+func tokenizeStatements(query string) [][]sqlToken {
+	statements := [][]sqlToken{nil}
+	current := func() *[]sqlToken {
+		return &statements[len(statements)-1]
+	}
+
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			i += 2
+			for i < len(runes) && !(runes[i] == '*' && i+1 < len(runes) && runes[i+1] == '/') {
+				i++
+			}
+			i += 2
+		case r == ';':
+			statements = append(statements, nil)
+			i++
+		case r == '\'' || r == '"' || r == '`' || r == '[':
+			closing := r
+			if r == '[' {
+				closing = ']'
+			}
+			var text strings.Builder
+			for i++; i < len(runes); i++ {
+				if runes[i] == closing {
+					// A doubled quote is an escaped quote.
+					if i+1 < len(runes) && runes[i+1] == closing && closing != ']' {
+						text.WriteRune(closing)
+						i++
+						continue
+					}
+					break
+				}
+				text.WriteRune(runes[i])
+			}
+			i++
+			*current() = append(*current(), sqlToken{
+				text:    text.String(),
+				quoted:  r != '\'',
+				literal: r == '\'',
+			})
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			*current() = append(*current(), sqlToken{
+				text: strings.ToUpper(string(runes[start:i])),
+			})
+		default:
+			*current() = append(*current(), sqlToken{
+				text: string(r),
+			})
+			i++
+		}
+	}
+	return statements
+}
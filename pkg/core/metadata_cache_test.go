@@ -0,0 +1,98 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMetadataCache_Invalidate(t *testing.T) {
+	t.Run("only dependent regions are cleared", func(t *testing.T) {
+		cache := newMetadataCache()
+		_, tablesVersion, _ := cache.tables.get("accounts")
+		cache.tables.put(tablesVersion, "accounts", []Table{{TableID: 1}})
+		_, tenantsVersion, _ := cache.tenants.get("1")
+		cache.tenants.put(tenantsVersion, "1", Tenant{TenantID: 1, ShardID: 2})
+
+		cache.invalidate([]string{`UPDATE "tenants" SET "shard_id"=3 WHERE ("tenant_id" = 1)`})
+
+		_, _, ok := cache.tenants.get("1")
+		assert.False(t, ok)
+		_, _, ok = cache.tables.get("accounts")
+		assert.True(t, ok)
+	})
+
+	t.Run("stale values are not stored", func(t *testing.T) {
+		cache := newMetadataCache()
+		_, version, _ := cache.tenants.get("1")
+
+		// The tenant is moved while the old shard is being read from the store.
+		cache.invalidate([]string{`INSERT INTO "tenant_moves" ("tenant_id") VALUES (1); UPDATE "tenants" SET "shard_id"=3`})
+		cache.tenants.put(version, "1", Tenant{TenantID: 1, ShardID: 2})
+
+		_, _, ok := cache.tenants.get("1")
+		assert.False(t, ok)
+	})
+
+	t.Run("schema changes invalidate prepared statements", func(t *testing.T) {
+		cache := newMetadataCache()
+		pool := &poolItem{schema: cache.schema}
+		generation := pool.statementGeneration()
+
+		cache.invalidate([]string{`UPDATE "tenants" SET "shard_id"=3 WHERE ("tenant_id" = 1)`})
+		assert.Equal(t, generation, pool.statementGeneration())
+
+		cache.invalidate([]string{`INSERT INTO "schema_definitions" ("definition") VALUES ('CREATE INDEX ...')`})
+		assert.NotEqual(t, generation, pool.statementGeneration())
+	})
+
+	t.Run("unrecognized writes clear everything", func(t *testing.T) {
+		cache := newMetadataCache()
+		_, tablesVersion, _ := cache.tables.get("accounts")
+		cache.tables.put(tablesVersion, "accounts", []Table{{TableID: 1}})
+		_, tenantsVersion, _ := cache.tenants.get("1")
+		cache.tenants.put(tenantsVersion, "1", Tenant{TenantID: 1, ShardID: 2})
+
+		cache.invalidate([]string{`WITH moved AS (SELECT 1) DELETE FROM "tenants"`})
+
+		_, _, ok := cache.tenants.get("1")
+		assert.False(t, ok)
+		_, _, ok = cache.tables.get("accounts")
+		assert.False(t, ok)
+	})
+
+	t.Run("statements within literals are ignored", func(t *testing.T) {
+		cache := newMetadataCache()
+		_, version, _ := cache.tables.get("accounts")
+		cache.tables.put(version, "accounts", []Table{{TableID: 1}})
+
+		cache.invalidate([]string{`INSERT OR IGNORE INTO "schema_definitions" ("definition") SELECT 'DROP TABLE tables; DELETE FROM tables' FROM "shards"`})
+
+		_, _, ok := cache.tables.get("accounts")
+		assert.True(t, ok)
+	})
+
+	t.Run("settings are only cleared by setting changes", func(t *testing.T) {
+		cache := newMetadataCache()
+		_, version, _ := cache.settings.get("1")
+		cache.settings.put(version, "1", Setting{SettingID: 1})
+
+		cache.invalidate([]string{`UPDATE "tenants" SET "shard_id"=3 WHERE ("tenant_id" = 1)`})
+		_, _, ok := cache.settings.get("1")
+		assert.True(t, ok)
+
+		cache.invalidate([]string{`UPDATE "settings" SET "int_value"=5 WHERE ("setting_id" = 1)`})
+		_, _, ok = cache.settings.get("1")
+		assert.False(t, ok)
+	})
+
+	t.Run("restore clears everything", func(t *testing.T) {
+		cache := newMetadataCache()
+		_, version, _ := cache.dataNodeShards.get("1")
+		cache.dataNodeShards.put(version, "1", []uint64{1, 2})
+
+		cache.invalidate(nil)
+
+		_, _, ok := cache.dataNodeShards.get("1")
+		assert.False(t, ok)
+	})
+}
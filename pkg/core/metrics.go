@@ -0,0 +1,240 @@
+package core
+
+import (
+	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/noahdb/pkg/metrics"
+	"github.com/elliotcourant/timber"
+	"github.com/readystock/goqu"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatementOutcome_Success = "success"
+	StatementOutcome_Error   = "error"
+)
+
+var (
+	// raftStateNames are the values of the state label of the raft state gauge, only the
+	// coordinator's current state has a value of 1.
+	raftStateNames = map[frunk.ClusterState]string{
+		frunk.Leader:    "leader",
+		frunk.Follower:  "follower",
+		frunk.Candidate: "candidate",
+		frunk.Shutdown:  "shutdown",
+		frunk.Unknown:   "unknown",
+	}
+
+	// raftIndexStats are the numeric stats from raft that are exposed as gauges.
+	raftIndexStats = []struct {
+		stat string
+		name string
+		help string
+	}{
+		{"term", "noahdb_raft_term", "The current raft term of this coordinator."},
+		{"commit_index", "noahdb_raft_commit_index", "The latest raft log index known to be committed."},
+		{"applied_index", "noahdb_raft_applied_index", "The latest raft log index applied to the internal store."},
+		{"last_log_index", "noahdb_raft_last_log_index", "The latest raft log index stored by this coordinator."},
+	}
+)
+
+type metricsContext struct {
+	*base
+}
+
+type MetricsContext interface {
+	// Registry returns the metrics of this coordinator so they can be served to be scraped.
+	Registry() *metrics.Registry
+
+	// ConnectionOpened is called when a client connects to the coordinator.
+	ConnectionOpened()
+
+	// ConnectionClosed is called when a client disconnects from the coordinator.
+	ConnectionClosed()
+
+	// ObserveStatement records a statement that was run by a client. The statement tag is used as
+	// the type of the statement, if err is not nil then the statement is counted as an error.
+	ObserveStatement(statementTag string, err error, planning, execution time.Duration)
+}
+
+func (ctx *base) Metrics() MetricsContext {
+	return &metricsContext{
+		ctx,
+	}
+}
+
+// coordinatorMetrics are the metrics that are updated as the coordinator is used, the rest of
+// the metrics are read from the colony each time the registry is scraped.
+type coordinatorMetrics struct {
+	registry *metrics.Registry
+
+	connections      *metrics.GaugeVec
+	connectionsTotal *metrics.CounterVec
+	statements       *metrics.CounterVec
+	planning         *metrics.HistogramVec
+	execution        *metrics.HistogramVec
+	poolWait         *metrics.HistogramVec
+}
+
+func newCoordinatorMetrics(ctx *base) *coordinatorMetrics {
+	registry := metrics.NewRegistry()
+	m := &coordinatorMetrics{
+		registry: registry,
+		connections: registry.NewGaugeVec(
+			"noahdb_connections",
+			"The number of clients currently connected to this coordinator."),
+		connectionsTotal: registry.NewCounterVec(
+			"noahdb_connections_total",
+			"The number of clients that have connected to this coordinator."),
+		statements: registry.NewCounterVec(
+			"noahdb_statements_total",
+			"The number of statements run on this coordinator by type and outcome.",
+			"type", "outcome"),
+		planning: registry.NewHistogramVec(
+			"noahdb_statement_planning_seconds",
+			"The time spent planning statements by type.",
+			nil, "type"),
+		execution: registry.NewHistogramVec(
+			"noahdb_statement_execution_seconds",
+			"The time spent executing planned statements by type.",
+			nil, "type"),
+		poolWait: registry.NewHistogramVec(
+			"noahdb_pool_wait_seconds",
+			"The time spent waiting for a connection to a data node shard.",
+			nil, "data_node_shard_id"),
+	}
+
+	registry.NewGaugeFunc(
+		"noahdb_pool_idle_connections",
+		"The number of idle connections in the pool for each data node shard.",
+		func(emit func(float64, ...string)) {
+			ctx.poolSync.RLock()
+			defer ctx.poolSync.RUnlock()
+			for id, pItem := range ctx.pool {
+				emit(float64(pItem.Size()), strconv.FormatUint(id, 10))
+			}
+		}, "data_node_shard_id")
+
+	registry.NewGaugeFunc(
+		"noahdb_pool_active_connections",
+		"The number of connections to each data node shard that are being used by sessions.",
+		func(emit func(float64, ...string)) {
+			ctx.poolSync.RLock()
+			defer ctx.poolSync.RUnlock()
+			for id, pItem := range ctx.pool {
+				emit(float64(atomic.LoadInt64(&pItem.active)), strconv.FormatUint(id, 10))
+			}
+		}, "data_node_shard_id")
+
+	registry.NewGaugeFunc(
+		"noahdb_raft_state",
+		"The raft state of this coordinator, the current state has a value of 1.",
+		func(emit func(float64, ...string)) {
+			current := ctx.State()
+			for state, name := range raftStateNames {
+				value := float64(0)
+				if state == current {
+					value = 1
+				}
+				emit(value, name)
+			}
+		}, "state")
+
+	for _, item := range raftIndexStats {
+		stat := item.stat
+		registry.NewGaugeFunc(item.name, item.help, func(emit func(float64, ...string)) {
+			if ctx.db == nil {
+				return
+			}
+			value, err := strconv.ParseUint(ctx.db.RaftStats()[stat], 10, 64)
+			if err != nil {
+				timber.Warningf("could not parse raft stat [%s] for metrics: %v", stat, err)
+				return
+			}
+			emit(float64(value))
+		})
+	}
+
+	registry.NewGaugeFunc(
+		"noahdb_shards",
+		"The number of shards in the cluster.",
+		ctx.countGauge("shards", "shard_id"))
+
+	registry.NewGaugeFunc(
+		"noahdb_tenants",
+		"The number of tenants in the cluster.",
+		ctx.countGauge("tenants", "tenant_id"))
+
+	return m
+}
+
+// countGauge returns a gauge collector that reports the number of rows in an internal table.
+func (ctx *base) countGauge(table, column string) metrics.GaugeCollector {
+	return func(emit func(float64, ...string)) {
+		if ctx.db == nil {
+			return
+		}
+		compiledSql, _, _ := goqu.
+			From(table).
+			Select(goqu.COUNT(column)).
+			ToSql()
+		response, err := ctx.db.Query(compiledSql)
+		if err != nil {
+			timber.Warningf("could not count %s for metrics: %v", table, err)
+			return
+		}
+		c, err := count(response)
+		if err != nil {
+			timber.Warningf("could not count %s for metrics: %v", table, err)
+			return
+		}
+		emit(float64(c))
+	}
+}
+
+// Registry returns the metrics of this coordinator, the colony must be initialized first.
+func (ctx *metricsContext) Registry() *metrics.Registry {
+	return ctx.metrics.registry
+}
+
+func (ctx *metricsContext) ConnectionOpened() {
+	if ctx.metrics == nil {
+		return
+	}
+	ctx.metrics.connections.Inc()
+	ctx.metrics.connectionsTotal.Inc()
+}
+
+func (ctx *metricsContext) ConnectionClosed() {
+	if ctx.metrics == nil {
+		return
+	}
+	ctx.metrics.connections.Dec()
+}
+
+func (ctx *metricsContext) ObserveStatement(statementTag string, err error, planning, execution time.Duration) {
+	if ctx.metrics == nil {
+		return
+	}
+	outcome := StatementOutcome_Success
+	if err != nil {
+		outcome = StatementOutcome_Error
+	}
+	ctx.metrics.statements.Inc(statementTag, outcome)
+	ctx.metrics.planning.ObserveDuration(planning, statementTag)
+
+	// Statements that fail to plan, or that are performed entirely by the coordinator while they
+	// are planned, are never executed.
+	if execution > 0 {
+		ctx.metrics.execution.ObserveDuration(execution, statementTag)
+	}
+}
+
+// observePoolWait records how long a session waited for a connection to a data node shard.
+func (ctx *base) observePoolWait(id uint64, wait time.Duration) {
+	if ctx.metrics == nil {
+		return
+	}
+	ctx.metrics.poolWait.ObserveDuration(wait, strconv.FormatUint(id, 10))
+}
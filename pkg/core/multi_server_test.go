@@ -1,6 +1,7 @@
 package core_test
 
 import (
+	"fmt"
 	"github.com/elliotcourant/noahdb/pkg/core"
 	"github.com/elliotcourant/noahdb/testutils"
 	"github.com/elliotcourant/timber"
@@ -69,8 +70,9 @@ func TestMultiServerWrite(t *testing.T) {
 		assert.NotEmpty(t, chunk)
 	})
 
+	// Changes made on a follower are forwarded to the leader, the follower waits until the change
+	// has been applied locally before returning.
 	t.Run("create a new schema", func(t *testing.T) {
-		t.Skip()
 		colony1, cleanup1 := testutils.NewTestColony(t)
 		defer cleanup1()
 
@@ -88,5 +90,45 @@ func TestMultiServerWrite(t *testing.T) {
 		assert.NotEmpty(t, followerSchema)
 		assert.True(t, followerSchema.SchemaID > 0)
 		assert.Equal(t, followerSchemaName, followerSchema.SchemaName)
+
+		exists, err := colony2.Schema().Exists(followerSchemaName)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		exists, err = colony1.Schema().Exists(followerSchemaName)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	// A follower keeps one connection to the leader for the changes it forwards, the changes
+	// made by concurrent sessions take turns using it.
+	t.Run("forward concurrent changes", func(t *testing.T) {
+		colony1, cleanup1 := testutils.NewTestColony(t)
+		defer cleanup1()
+
+		colony2, cleanup2 := testutils.NewTestColony(t, colony1.Addr().String())
+		defer cleanup2()
+
+		assert.True(t, colony1.IsLeader())
+		assert.False(t, colony2.IsLeader())
+
+		numberOfSchemas := 10
+		errs := make(chan error, numberOfSchemas)
+		for i := 0; i < numberOfSchemas; i++ {
+			go func(i int) {
+				_, err := colony2.Schema().NewSchema(fmt.Sprintf("forwarded_%d", i))
+				errs <- err
+			}(i)
+		}
+
+		for i := 0; i < numberOfSchemas; i++ {
+			assert.NoError(t, <-errs)
+		}
+
+		for i := 0; i < numberOfSchemas; i++ {
+			exists, err := colony1.Schema().Exists(fmt.Sprintf("forwarded_%d", i))
+			assert.NoError(t, err)
+			assert.True(t, exists)
+		}
 	})
 }
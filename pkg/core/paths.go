@@ -4,9 +4,11 @@ const (
 	dataNodeIdSequencePath      = "/data_nodes/id/"
 	dataNodeShardIdSequencePath = "/data_node_shards/id/"
 	schemaIdSequencePath        = "/schemas/id/"
+	definitionIdSequencePath    = "/schema_definitions/id/"
 	shardIdSequencePath         = "/shards/id/"
 	tenantIdSequencePath        = "/tenants/id/"
 	tableIdSequencePath         = "/tables/id/"
 	columnIdSequencePath        = "/columns/id/"
 	userIdSequencePath          = "/users/id/"
+	writeFenceIdSequencePath    = "/write_fences/id/"
 )
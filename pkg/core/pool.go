@@ -2,15 +2,27 @@ package core
 
 import (
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"github.com/elliotcourant/noahdb/pkg/pgproto"
 	"github.com/elliotcourant/timber"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// poolAcquireTimeout is how long a session will wait for a connection to a data node shard
+	// when the pool for that data node shard is already at max_pool_size.
+	poolAcquireTimeout  = 30 * time.Second
+	poolAcquireInterval = 50 * time.Millisecond
+
+	// dataNodeDialTimeout is how long we will wait for a data node to accept a new connection.
+	dataNodeDialTimeout = 10 * time.Second
+)
+
 type poolContext struct {
 	*base
 }
@@ -19,15 +31,57 @@ type poolItem struct {
 	id    uint64
 	mutex sync.Mutex
 	pool  []*frontendConnection
+
+	// generation is incremented whenever the statements prepared on the connections in this pool
+	// should no longer be used.
+	generation uint64
+
+	// schema is the cache region whose version changes each time the schema of the cluster is
+	// changed on any coordinator, statements prepared before the change are not used again.
+	schema *cacheRegion
+
+	// active is the number of connections from this pool that are currently being used.
+	active int64
 }
 
 func (p *poolItem) addConnection(frontend *pgproto.Frontend) {
 	p.releaseConnection(&frontendConnection{
-		Frontend: frontend,
-		pool:     p,
+		Frontend:   frontend,
+		pool:       p,
+		statements: newPreparedStatementCache(),
 	})
 }
 
+func (p *poolItem) invalidatePreparedStatements() {
+	atomic.AddUint64(&p.generation, 1)
+}
+
+// statementGeneration changes whenever the statements prepared on the connections in this pool
+// should no longer be used, either because the pool was invalidated or the schema was changed.
+func (p *poolItem) statementGeneration() uint64 {
+	generation := atomic.LoadUint64(&p.generation)
+	if p.schema != nil {
+		generation += p.schema.getVersion()
+	}
+	return generation
+}
+
+// checkOut marks the connection as being used, it will be counted as active until it is
+// released or closed.
+func (p *poolItem) checkOut(conn *frontendConnection) {
+	conn.checkedOut = true
+	atomic.AddInt64(&p.active, 1)
+}
+
+// checkIn is called when a connection is released or closed.
+func (p *poolItem) checkIn(conn *frontendConnection) {
+	if !conn.checkedOut {
+		return
+	}
+	conn.checkedOut = false
+	atomic.AddInt64(&p.active, -1)
+}
+
 func (p *poolItem) releaseConnection(conn *frontendConnection) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
@@ -61,7 +115,13 @@ type frontendConnection struct {
 	conn net.Conn
 	*pgproto.Frontend
 
-	pool *poolItem
+	pool       *poolItem
+	statements *preparedStatementCache
+	checkedOut bool
+
+	// dirty is set when something may have changed the state of the connection, it will be
+	// reset before it is returned to the pool.
+	dirty bool
 }
 
 func (f *frontendConnection) ID() uint64 {
@@ -72,24 +132,127 @@ func (f *frontendConnection) Release() {
 	if f.Frontend == nil {
 		return
 	}
+	if f.dirty {
+		// The next session to use this connection should not see anything left behind by this
+		// one. DISCARD ALL also deallocates every prepared statement, so the cache of the
+		// statements prepared on this connection needs to be cleared with it.
+		if err := f.Exec("DISCARD ALL"); err != nil {
+			timber.Warningf("could not reset connection to data node shard [%d], closing it: %v", f.pool.id, err)
+			f.Close()
+			return
+		}
+		f.statements.reset()
+		f.dirty = false
+	}
 	timber.Verbosef("releasing connection from data node shard [%d], pool size: %d", f.pool.id, len(f.pool.pool))
+	f.pool.checkIn(f)
 	f.pool.releaseConnection(f)
 }
 
 func (f *frontendConnection) Close() {
+	f.pool.checkIn(f)
 	f.conn.Close()
 	f.Frontend = nil
+	f.statements.reset()
+}
+
+func (f *frontendConnection) MarkDirty() {
+	f.dirty = true
+}
+
+func (f *frontendConnection) Exec(queries ...string) error {
+	for _, query := range queries {
+		if err := f.Send(&pgproto.Query{String: query}); err != nil {
+			return err
+		}
+	}
+
+	var execErr error
+	for remaining := len(queries); remaining > 0; {
+		msg, err := f.Receive()
+		if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case *pgproto.ErrorResponse:
+			if execErr == nil {
+				execErr = fmt.Errorf("from backend: %s", m.Message)
+			}
+		case *pgproto.ReadyForQuery:
+			remaining--
+		}
+	}
+	return execErr
+}
+
+func (f *frontendConnection) PrepareStatement(
+	fingerprint, query string, parameterTypes []uint32) (string, bool, []string) {
+	return f.statements.prepare(f.pool.statementGeneration(), fingerprint, query, parameterTypes)
+}
+
+func (f *frontendConnection) ForgetStatement(name string) {
+	f.statements.forget(name)
 }
 
 type PoolConnection interface {
 	frontendInterface
 	Release()
 	ID() uint64
+
+	// MarkDirty indicates that the session may have changed the state of the connection, such as
+	// by setting a variable or creating a temp table. The connection will be reset when it is
+	// released.
+	MarkDirty()
+
+	// Exec runs each of the queries on the connection and waits for all of them to finish. The
+	// first error returned by the data node is returned.
+	Exec(queries ...string) error
+
+	// PrepareStatement returns the name of the named statement on the data node for the provided
+	// query fingerprint and parameter types. If the statement has already been prepared on this
+	// connection then true is returned and only a Bind is needed. Otherwise the statement should
+	// be parsed after closing any of the returned stale statements.
+	PrepareStatement(fingerprint, query string, parameterTypes []uint32) (string, bool, []string)
+
+	// ForgetStatement removes the statement with the provided name from the connection's cache,
+	// this is used when the statement could not be prepared on the data node.
+	ForgetStatement(name string)
 }
 
 type PoolContext interface {
 	StartPool()
 	GetConnectionForDataNodeShard(id uint64) (PoolConnection, error)
+
+	// GetPoolMode returns when sessions should give their data node shard connections back to
+	// the pool.
+	GetPoolMode() (PoolModeOptions, error)
+
+	// InvalidatePreparedStatements will make sure that any statements that have been prepared on
+	// pooled connections are not used again. This is called on every coordinator as changes to
+	// the schema are applied to the internal store.
+	InvalidatePreparedStatements()
+
+	// ActiveConnections returns the number of connections to the data node shard that are
+	// currently being used by sessions on this coordinator.
+	ActiveConnections(id uint64) int64
+
+	// ClosePool closes all of the idle connections to the data node shard and removes its pool.
+	// This is used once a data node shard has been removed from the cluster.
+	ClosePool(id uint64)
+}
+
+// refreshPool wakes up the pool check so that changes to the pool settings are applied without
+// waiting for the refresh interval.
+func (ctx *base) refreshPool() {
+	if ctx.poolRefresh == nil {
+		return
+	}
+
+	select {
+	case ctx.poolRefresh <- struct{}{}:
+	default:
+		// A refresh is already pending.
+	}
 }
 
 func (ctx *base) Pool() PoolContext {
@@ -99,10 +262,27 @@ func (ctx *base) Pool() PoolContext {
 }
 
 func (ctx *poolContext) StartPool() {
-	desiredPoolSize := 5
+	ctx.poolRefresh = make(chan struct{}, 1)
+
+	loadSettings := func() poolSettings {
+		settings, err := ctx.getPoolSettings()
+		if err != nil {
+			timber.Errorf("could not retrieve pool settings, using defaults: %v", err)
+		}
+		atomic.StoreInt64(&ctx.maxPoolSize, int64(settings.maxSize))
+		return settings
+	}
+
 	go func() {
+		settings := loadSettings()
 		for {
-			time.Sleep(30 * time.Second)
+			// The pool is checked on an interval, or right away when the pool settings change.
+			select {
+			case <-time.After(settings.refreshInterval):
+			case <-ctx.poolRefresh:
+			}
+
+			settings = loadSettings()
 			if !ctx.IsLeader() {
 				continue
 			}
@@ -122,9 +302,15 @@ func (ctx *poolContext) StartPool() {
 
 				size := pool.Size()
 
-				if size == desiredPoolSize {
-					timber.Verbosef("data node shard [%d] pool full, size: %d", dataNodeShard.DataNodeShardID, size)
-					continue
+				// Connections that are being used by sessions count towards the max pool size,
+				// so the number of idle connections we can keep is whatever is left over.
+				maxIdle := settings.maxSize - int(atomic.LoadInt64(&pool.active))
+				if maxIdle < 0 {
+					maxIdle = 0
+				}
+				desiredPoolSize := settings.minSize
+				if desiredPoolSize > maxIdle {
+					desiredPoolSize = maxIdle
 				}
 
 				if size < desiredPoolSize {
@@ -139,14 +325,17 @@ func (ctx *poolContext) StartPool() {
 						// We've now created a new connection, release it to the pool for use.
 						conn.Release()
 					}
-				} else {
+				} else if size > maxIdle {
 					// If the pool is over flowing then grab some connections and throw them out.
-					for i := size; i > desiredPoolSize; i-- {
+					for i := size; i > maxIdle; i-- {
 						conn := pool.GetConnection()
 						if conn != nil {
 							conn.Close()
 						}
 					}
+				} else {
+					timber.Verbosef("data node shard [%d] pool full, size: %d", dataNodeShard.DataNodeShardID, size)
+					continue
 				}
 
 				timber.Verbosef("data node shard [%d] new pool size: %d", dataNodeShard.DataNodeShardID, pool.Size())
@@ -155,6 +344,14 @@ func (ctx *poolContext) StartPool() {
 	}()
 }
 
+func (ctx *poolContext) InvalidatePreparedStatements() {
+	ctx.poolSync.RLock()
+	defer ctx.poolSync.RUnlock()
+	for _, pItem := range ctx.pool {
+		pItem.invalidatePreparedStatements()
+	}
+}
+
 func (ctx *poolContext) getPoolForDataNodeShard(id uint64) (*poolItem, error) {
 	ctx.poolSync.RLock()
 	pItem, ok := ctx.pool[id]
@@ -162,9 +359,10 @@ func (ctx *poolContext) getPoolForDataNodeShard(id uint64) (*poolItem, error) {
 	if !ok {
 		timber.Tracef("data node shard [%d] is not in pool, creating connection", id)
 		pItem = &poolItem{
-			id:    id,
-			mutex: sync.Mutex{},
-			pool:  make([]*frontendConnection, 0),
+			id:     id,
+			mutex:  sync.Mutex{},
+			pool:   make([]*frontendConnection, 0),
+			schema: ctx.cache.schema,
 		}
 		ctx.poolSync.Lock()
 		ctx.pool[id] = pItem
@@ -185,11 +383,66 @@ func (ctx *poolContext) GetConnectionForDataNodeShard(id uint64) (PoolConnection
 	if err != nil {
 		return nil, err
 	}
-	poolConn := pItem.GetConnection()
-	if poolConn == nil {
-		return ctx.newConnection(id, pItem)
+	startTimestamp := time.Now()
+	deadline := startTimestamp.Add(poolAcquireTimeout)
+	for {
+		if poolConn := pItem.GetConnection(); poolConn != nil {
+			pItem.checkOut(poolConn.(*frontendConnection))
+			ctx.observePoolWait(id, time.Since(startTimestamp))
+			return poolConn, nil
+		}
+
+		// There are no idle connections, a new one can only be opened if the data node shard
+		// has not reached the max pool size. The slot is reserved before the connection is
+		// opened so that concurrent sessions cannot go over the limit.
+		maxSize := atomic.LoadInt64(&ctx.maxPoolSize)
+		active := atomic.LoadInt64(&pItem.active)
+		if maxSize <= 0 || (active < maxSize && atomic.CompareAndSwapInt64(&pItem.active, active, active+1)) {
+			conn, err := ctx.newConnection(id, pItem)
+			if err != nil {
+				if maxSize > 0 {
+					atomic.AddInt64(&pItem.active, -1)
+				}
+				return nil, err
+			}
+			if maxSize > 0 {
+				conn.checkedOut = true
+			} else {
+				pItem.checkOut(conn)
+			}
+			ctx.observePoolWait(id, time.Since(startTimestamp))
+			return conn, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for a connection to data node shard [%d], all %d connections are in use", id, maxSize)
+		}
+		time.Sleep(poolAcquireInterval)
+	}
+}
+
+func (ctx *poolContext) ActiveConnections(id uint64) int64 {
+	ctx.poolSync.RLock()
+	defer ctx.poolSync.RUnlock()
+	pItem, ok := ctx.pool[id]
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(&pItem.active)
+}
+
+func (ctx *poolContext) ClosePool(id uint64) {
+	ctx.poolSync.Lock()
+	pItem, ok := ctx.pool[id]
+	delete(ctx.pool, id)
+	ctx.poolSync.Unlock()
+	if !ok {
+		return
+	}
+
+	for conn := pItem.GetConnection(); conn != nil; conn = pItem.GetConnection() {
+		conn.Close()
 	}
-	return poolConn, nil
 }
 
 func (ctx *poolContext) newConnection(id uint64, pool *poolItem) (*frontendConnection, error) {
@@ -198,21 +451,38 @@ func (ctx *poolContext) newConnection(id uint64, pool *poolItem) (*frontendConne
 		return nil, err
 	}
 
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", dataNode.GetAddress(), dataNode.GetPort()))
+	tlsConfig, err := dataNodeTLSConfig(dataNode)
 	if err != nil {
-		timber.Errorf("could not resolve address for data node [%d]: %s", dataNode.DataNodeID, err.Error())
+		timber.Errorf("could not setup tls for data node [%d]: %s", dataNode.DataNodeID, err.Error())
 		return nil, err
 	}
 
-	conn, err := net.DialTCP("tcp", nil, addr)
+	dialer := net.Dialer{
+		Timeout: dataNodeDialTimeout,
+	}
+	tcpConn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", dataNode.GetAddress(), dataNode.GetPort()))
 	if err != nil {
 		timber.Errorf("could not connect to data node [%d]: %s", dataNode.DataNodeID, err.Error())
 		return nil, err
 	}
 
+	var conn net.Conn = tcpConn
+	var tlsState *tls.ConnectionState
+	if tlsConfig != nil {
+		tlsConn, err := startTLS(tcpConn, tlsConfig)
+		if err != nil {
+			timber.Errorf("could not start tls with data node [%d]: %s", dataNode.DataNodeID, err.Error())
+			tcpConn.Close()
+			return nil, err
+		}
+		state := tlsConn.ConnectionState()
+		conn, tlsState = tlsConn, &state
+	}
+
 	frontend, err := pgproto.NewFrontend(conn, conn)
 	if err != nil {
 		timber.Errorf("could not setup frontend for data node [%d]: %s", dataNode.DataNodeID, err.Error())
+		conn.Close()
 		return nil, err
 	}
 
@@ -224,10 +494,12 @@ func (ctx *poolContext) newConnection(id uint64, pool *poolItem) (*frontendConne
 		},
 	}); err != nil {
 		timber.Errorf("could not send startup message to data node [%d]: %s", dataNode.DataNodeID, err.Error())
+		conn.Close()
 		return nil, err
 	}
 
 	if err := func() error {
+		var scram *scramClient
 		for {
 			response, err := frontend.Receive()
 			if err != nil {
@@ -236,21 +508,58 @@ func (ctx *poolContext) newConnection(id uint64, pool *poolItem) (*frontendConne
 
 			switch msg := response.(type) {
 			case *pgproto.Authentication:
-				if msg.Type != pgproto.AuthTypeOk {
-					if msg.Type == pgproto.AuthTypeMD5Password {
-						md5s := func(s string) string {
-							h := md5.Sum([]byte(s))
-							return hex.EncodeToString(h[:])
-						}
-						secret := "md5" + md5s(md5s(dataNode.GetPassword()+dataNode.GetUser())+string(msg.Salt[:]))
-						if err := frontend.Send(&pgproto.PasswordMessage{
-							Password: secret,
-						}); err != nil {
-							return fmt.Errorf("could not authenticate: %v", err)
-						}
-					} else {
-						panic(fmt.Sprintf("cannot handle authentication type: %d", msg.Type))
+				switch msg.Type {
+				case pgproto.AuthTypeOk:
+				case pgproto.AuthTypeCleartextPassword:
+					if err := frontend.Send(&pgproto.PasswordMessage{
+						Password: dataNode.GetPassword(),
+					}); err != nil {
+						return fmt.Errorf("could not authenticate: %v", err)
+					}
+				case pgproto.AuthTypeMD5Password:
+					md5s := func(s string) string {
+						h := md5.Sum([]byte(s))
+						return hex.EncodeToString(h[:])
+					}
+					secret := "md5" + md5s(md5s(dataNode.GetPassword()+dataNode.GetUser())+string(msg.Salt[:]))
+					if err := frontend.Send(&pgproto.PasswordMessage{
+						Password: secret,
+					}); err != nil {
+						return fmt.Errorf("could not authenticate: %v", err)
+					}
+				case pgproto.AuthTypeSASL:
+					scram, err = newScramClient(msg.SASLAuthMechanisms, dataNode.GetUser(), dataNode.GetPassword(), tlsState)
+					if err != nil {
+						return fmt.Errorf("could not authenticate: %v", err)
+					}
+					if err := frontend.Send(&pgproto.SASLInitialResponse{
+						AuthMechanism: scram.mechanism,
+						Data:          scram.clientFirstMessage(),
+					}); err != nil {
+						return fmt.Errorf("could not authenticate: %v", err)
+					}
+				case pgproto.AuthTypeSASLContinue:
+					if scram == nil {
+						return fmt.Errorf("could not authenticate: unexpected SASL continue")
+					}
+					clientFinal, err := scram.clientFinalMessage(msg.SASLData)
+					if err != nil {
+						return fmt.Errorf("could not authenticate: %v", err)
+					}
+					if err := frontend.Send(&pgproto.SASLResponse{
+						Data: clientFinal,
+					}); err != nil {
+						return fmt.Errorf("could not authenticate: %v", err)
+					}
+				case pgproto.AuthTypeSASLFinal:
+					if scram == nil {
+						return fmt.Errorf("could not authenticate: unexpected SASL final")
+					}
+					if err := scram.verifyServerFinal(msg.SASLData); err != nil {
+						return fmt.Errorf("could not authenticate: %v", err)
 					}
+				default:
+					return fmt.Errorf("cannot handle authentication type: %d", msg.Type)
 				}
 			case *pgproto.ParameterStatus:
 			case *pgproto.ParameterDescription:
@@ -264,12 +573,14 @@ func (ctx *poolContext) newConnection(id uint64, pool *poolItem) (*frontendConne
 			}
 		}
 	}(); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
 	return &frontendConnection{
-		Frontend: frontend,
-		pool:     pool,
-		conn:     conn,
+		Frontend:   frontend,
+		pool:       pool,
+		conn:       conn,
+		statements: newPreparedStatementCache(),
 	}, nil
 }
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMinPoolSize         = 0
+	defaultMaxPoolSize         = 5
+	defaultPoolRefreshInterval = 30 * time.Second
+)
+
+// poolSettings are the settings that control how many connections are kept to each data node
+// shard.
+type poolSettings struct {
+	minSize         int
+	maxSize         int
+	refreshInterval time.Duration
+}
+
+// getPoolSettings reads the pool settings, any setting that is missing or invalid will use its
+// default value.
+func (ctx *base) getPoolSettings() (poolSettings, error) {
+	settings := poolSettings{
+		minSize:         defaultMinPoolSize,
+		maxSize:         defaultMaxPoolSize,
+		refreshInterval: defaultPoolRefreshInterval,
+	}
+
+	if value, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_MinPoolSize); err != nil {
+		return settings, err
+	} else if size, isInt := value.(int64); ok && isInt && size >= 0 {
+		settings.minSize = int(size)
+	}
+
+	if value, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_MaxPoolSize); err != nil {
+		return settings, err
+	} else if size, isInt := value.(int64); ok && isInt && size > 0 {
+		settings.maxSize = int(size)
+	}
+
+	if value, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_PoolRefreshInterval); err != nil {
+		return settings, err
+	} else if text, isText := value.(string); ok && isText {
+		interval, err := parseInterval(text)
+		if err != nil {
+			return settings, err
+		}
+		if interval > 0 {
+			settings.refreshInterval = interval
+		}
+	}
+
+	if settings.minSize > settings.maxSize {
+		settings.minSize = settings.maxSize
+	}
+
+	return settings, nil
+}
+
+// GetPoolMode returns when sessions should give their data node shard connections back to the
+// pool.
+func (ctx *poolContext) GetPoolMode() (PoolModeOptions, error) {
+	mode, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_PoolMode)
+	if err != nil || !ok {
+		return PoolModeOptions_TransactionPooling, err
+	}
+	modeValue, _ := mode.(int64)
+	return PoolModeOptions(modeValue), nil
+}
+
+// parseInterval parses a simple postgres interval such as "30 seconds" or "1 minute 30 seconds".
+// Go style durations like "30s" are also accepted.
+func parseInterval(interval string) (time.Duration, error) {
+	interval = strings.TrimSpace(strings.ToLower(interval))
+	if duration, err := time.ParseDuration(interval); err == nil {
+		return duration, nil
+	}
+
+	fields := strings.Fields(interval)
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return 0, fmt.Errorf("invalid interval [%s]", interval)
+	}
+
+	total := time.Duration(0)
+	for i := 0; i < len(fields); i += 2 {
+		quantity, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid interval [%s]: %v", interval, err)
+		}
+
+		var unit time.Duration
+		switch fields[i+1] {
+		case "ms", "msec", "msecs", "millisecond", "milliseconds":
+			unit = time.Millisecond
+		case "s", "sec", "secs", "second", "seconds":
+			unit = time.Second
+		case "m", "min", "mins", "minute", "minutes":
+			unit = time.Minute
+		case "h", "hour", "hours":
+			unit = time.Hour
+		case "d", "day", "days":
+			unit = 24 * time.Hour
+		default:
+			return 0, fmt.Errorf("invalid interval [%s]: unknown unit [%s]", interval, fields[i+1])
+		}
+
+		total += time.Duration(quantity * float64(unit))
+	}
+
+	return total, nil
+}
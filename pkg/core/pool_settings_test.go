@@ -0,0 +1,37 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseInterval(t *testing.T) {
+	t.Run("postgres interval", func(t *testing.T) {
+		interval, err := parseInterval("30 seconds")
+		assert.NoError(t, err)
+		assert.Equal(t, 30*time.Second, interval)
+	})
+
+	t.Run("multiple units", func(t *testing.T) {
+		interval, err := parseInterval("1 minute 30 seconds")
+		assert.NoError(t, err)
+		assert.Equal(t, 90*time.Second, interval)
+	})
+
+	t.Run("go duration", func(t *testing.T) {
+		interval, err := parseInterval("1m30s")
+		assert.NoError(t, err)
+		assert.Equal(t, 90*time.Second, interval)
+	})
+
+	t.Run("invalid unit", func(t *testing.T) {
+		_, err := parseInterval("30 fortnights")
+		assert.Error(t, err)
+	})
+
+	t.Run("missing unit", func(t *testing.T) {
+		_, err := parseInterval("30")
+		assert.Error(t, err)
+	})
+}
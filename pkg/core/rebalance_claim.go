@@ -0,0 +1,167 @@
+package core
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/timber"
+	"github.com/readystock/goqu"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rebalanceClaimTTL is how long a claim is kept without being renewed. If the coordinator that
+	// holds a claim goes away then another coordinator can take over the work once it expires.
+	rebalanceClaimTTL = 30 * time.Second
+
+	// rebalanceClaimRenewInterval is how often a claim is renewed while it is held.
+	rebalanceClaimRenewInterval = 10 * time.Second
+)
+
+// balanceOrphanShardsClaim is held while orphaned shards are being assigned to data nodes and
+// provisioned. Only one coordinator assigns and provisions data node shards at a time.
+const balanceOrphanShardsClaim = "balance_orphan_shards"
+
+// balanceReplicasClaim is held while replicas are being added, removed or converted.
+const balanceReplicasClaim = "balance_replicas"
+
+// rebalanceClaim is held by the coordinator that is performing a piece of rebalancing work. The
+// claim is recorded in the internal store so that two coordinators, like the leader resuming
+// rebalancing and a coordinator running noah.move_tenant, never perform the same work at once.
+type rebalanceClaim struct {
+	ctx   *base
+	key   string
+	owner string
+
+	releaseOnce sync.Once
+	done        chan struct{}
+}
+
+// claimRebalance will claim the work identified by the key for this coordinator. If another
+// coordinator holds an unexpired claim for the same work then false is returned. The claim is
+// renewed in the background until it is released.
+func (ctx *base) claimRebalance(key string) (*rebalanceClaim, bool, error) {
+	if _, held := ctx.claims.LoadOrStore(key, true); held {
+		return nil, false, nil
+	}
+
+	claim := &rebalanceClaim{
+		ctx:   ctx,
+		key:   key,
+		owner: ctx.db.ID(),
+		done:  make(chan struct{}),
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(rebalanceClaimTTL).UnixNano()
+
+	// The claim is created if it does not exist yet, and then taken if it belongs to us or has
+	// expired. Both are applied together so the update tells us whether we own the claim.
+	insertSql := fmt.Sprintf(
+		"INSERT INTO rebalance_claims (claim, coordinator_id, expires_at) SELECT %s, %s, %d "+
+			"WHERE NOT EXISTS (SELECT 1 FROM rebalance_claims WHERE claim = %s)",
+		quoteText(claim.key), quoteText(claim.owner), expiresAt, quoteText(claim.key))
+	updateSql := goqu.
+		From("rebalance_claims").
+		Where(
+			goqu.Ex{
+				"claim": claim.key,
+			},
+			goqu.Or(
+				goqu.Ex{
+					"coordinator_id": claim.owner,
+				},
+				goqu.I("expires_at").Lt(now.UnixNano()),
+			)).
+		Update(goqu.Record{
+			"coordinator_id": claim.owner,
+			"expires_at":     expiresAt,
+		}).Sql
+	response, err := ctx.db.ExecuteEx(&frunk.ExecuteRequest{
+		Queries: []string{insertSql, updateSql},
+		Atomic:  true,
+	})
+	if err != nil {
+		ctx.claims.Delete(key)
+		return nil, false, err
+	}
+	if err := executeResponseError(response); err != nil {
+		ctx.claims.Delete(key)
+		return nil, false, err
+	}
+
+	if len(response.Results) < 2 || response.Results[1].RowsAffected == 0 {
+		ctx.claims.Delete(key)
+		return nil, false, nil
+	}
+
+	go claim.renew()
+	return claim, true, nil
+}
+
+// guard returns a condition that is only true while this coordinator still holds the claim. It
+// is added to the statements that finish the work, this way a coordinator that lost its claim
+// can never finish work that another coordinator has taken over.
+func (claim *rebalanceClaim) guard() string {
+	return fmt.Sprintf(
+		"EXISTS (SELECT 1 FROM rebalance_claims WHERE claim = %s AND coordinator_id = %s)",
+		quoteText(claim.key), quoteText(claim.owner))
+}
+
+// release gives up the claim so that other coordinators can perform the work.
+func (claim *rebalanceClaim) release() {
+	claim.releaseOnce.Do(func() {
+		close(claim.done)
+		compiledSql := goqu.
+			From("rebalance_claims").
+			Where(goqu.Ex{
+				"claim":          claim.key,
+				"coordinator_id": claim.owner,
+			}).
+			Delete().Sql
+		if _, err := claim.ctx.db.Exec(compiledSql); err != nil {
+			timber.Warningf("could not release claim [%s]: %v", claim.key, err)
+		}
+		claim.ctx.claims.Delete(claim.key)
+	})
+}
+
+func (claim *rebalanceClaim) renew() {
+	ticker := time.NewTicker(rebalanceClaimRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-claim.done:
+			return
+		case <-ticker.C:
+			compiledSql := goqu.
+				From("rebalance_claims").
+				Where(goqu.Ex{
+					"claim":          claim.key,
+					"coordinator_id": claim.owner,
+				}).
+				Update(goqu.Record{
+					"expires_at": time.Now().Add(rebalanceClaimTTL).UnixNano(),
+				}).Sql
+			if _, err := claim.ctx.db.Exec(compiledSql); err != nil {
+				timber.Warningf("could not renew claim [%s]: %v", claim.key, err)
+			}
+		}
+	}
+}
+
+// executeResponseError returns the first error from the results of an execute request.
+func executeResponseError(response *frunk.ExecuteResponse) error {
+	for _, result := range response.Results {
+		if result.Error != "" {
+			return fmt.Errorf(result.Error)
+		}
+	}
+	return nil
+}
+
+// quoteText quotes a string so that it can be used as a literal in a query to the internal store.
+func quoteText(text string) string {
+	return "'" + strings.Replace(text, "'", "''", -1) + "'"
+}
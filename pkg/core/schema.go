@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
 	"github.com/readystock/goqu"
 	"strings"
 )
@@ -14,6 +15,8 @@ type SchemaContext interface {
 	GetSchemas() ([]Schema, error)
 	Exists(string) (bool, error)
 	NewSchema(string) (Schema, error)
+	NewDefinition(query string) error
+	GetDefinitions() ([]string, error)
 }
 
 func (ctx *base) Schema() SchemaContext {
@@ -67,6 +70,70 @@ func (ctx *schemaContext) NewSchema(name string) (schema Schema, err error) {
 	return schema, err
 }
 
+// NewDefinition stores a DDL statement that was executed on the data nodes. Definitions are
+// replayed in the order they were created when a new shard is provisioned.
+func (ctx *schemaContext) NewDefinition(query string) error {
+	id, err := ctx.db.NextSequenceValueById(definitionIdSequencePath)
+	if err != nil {
+		return err
+	}
+
+	sql := goqu.From("schema_definitions").
+		Insert(goqu.Record{
+			"definition_id": id,
+			"query":         query,
+		}).Sql
+	_, err = ctx.db.Exec(sql)
+	return err
+}
+
+// GetDefinitions returns all of the DDL statements that have been executed on the data nodes in
+// the order they were executed.
+func (ctx *schemaContext) GetDefinitions() ([]string, error) {
+	definitions, err := ctx.getDefinitions(0)
+	if err != nil {
+		return nil, err
+	}
+
+	queries := make([]string, len(definitions))
+	for i, definition := range definitions {
+		queries[i] = definition.Query
+	}
+	return queries, nil
+}
+
+// schemaDefinition is a DDL statement that was executed on the data nodes.
+type schemaDefinition struct {
+	DefinitionID uint64
+	Query        string
+}
+
+// getDefinitions returns the DDL statements that were executed on the data nodes after the
+// provided definition in the order they were executed.
+func (ctx *base) getDefinitions(afterDefinitionId uint64) ([]schemaDefinition, error) {
+	sql, _, _ := goqu.
+		From("schema_definitions").
+		Select("definition_id", "query").
+		Where(goqu.I("definition_id").Gt(afterDefinitionId)).
+		Order(goqu.I("definition_id").Asc()).
+		ToSql()
+	response, err := ctx.db.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := rqliter.NewRqlRows(response)
+	definitions := make([]schemaDefinition, 0)
+	for rows.Next() {
+		definition := schemaDefinition{}
+		if err := rows.Scan(&definition.DefinitionID, &definition.Query); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, rows.Err()
+}
+
 func (ctx *schemaContext) cleanSchemaName(name string) string {
 	return strings.TrimSpace(strings.ToLower(name))
 }
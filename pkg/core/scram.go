@@ -0,0 +1,227 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	scramSHA256     = "SCRAM-SHA-256"
+	scramSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// scramClient performs the client side of a SCRAM-SHA-256 exchange as described in RFC 5802 and
+// RFC 7677. When the connection uses TLS and the data node supports it, the exchange is bound to
+// the TLS connection with tls-server-end-point channel binding.
+type scramClient struct {
+	mechanism string
+	user      string
+	password  string
+
+	// gs2Header tells the server whether channel binding is being used.
+	gs2Header string
+
+	// channelBinding is the data the exchange is bound to, this is empty when channel binding is
+	// not being used.
+	channelBinding []byte
+
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// newScramClient picks the best of the mechanisms the data node supports. The TLS state should be
+// nil if the connection is not using TLS.
+func newScramClient(mechanisms []string, user, password string, tlsState *tls.ConnectionState) (*scramClient, error) {
+	client := &scramClient{
+		user:     user,
+		password: password,
+	}
+
+	supportsPlus, supportsScram := false, false
+	for _, mechanism := range mechanisms {
+		switch mechanism {
+		case scramSHA256Plus:
+			supportsPlus = true
+		case scramSHA256:
+			supportsScram = true
+		}
+	}
+
+	switch {
+	case tlsState != nil && supportsPlus:
+		channelBinding, err := tlsServerEndPoint(tlsState)
+		if err != nil {
+			return nil, err
+		}
+		client.mechanism = scramSHA256Plus
+		client.gs2Header = "p=tls-server-end-point,,"
+		client.channelBinding = channelBinding
+	case supportsScram:
+		client.mechanism = scramSHA256
+		client.gs2Header = "n,,"
+		if tlsState != nil {
+			// We support channel binding but the server does not, this is sent so the server
+			// can tell if the mechanism list was tampered with.
+			client.gs2Header = "y,,"
+		}
+	default:
+		return nil, fmt.Errorf("no supported SASL mechanism in %v", mechanisms)
+	}
+
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	client.clientNonce = base64.StdEncoding.EncodeToString(nonce)
+
+	return client, nil
+}
+
+// clientFirstMessage returns the message that starts the exchange.
+func (c *scramClient) clientFirstMessage() []byte {
+	c.clientFirstBare = fmt.Sprintf("n=%s,r=%s", scramEscapeUser(c.user), c.clientNonce)
+	return []byte(c.gs2Header + c.clientFirstBare)
+}
+
+// clientFinalMessage returns the proof that we know the password in response to the server's
+// first message.
+func (c *scramClient) clientFinalMessage(serverFirst []byte) ([]byte, error) {
+	attributes, err := scramAttributes(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+
+	serverNonce := attributes["r"]
+	if !strings.HasPrefix(serverNonce, c.clientNonce) || len(serverNonce) == len(c.clientNonce) {
+		return nil, fmt.Errorf("invalid SCRAM server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCRAM salt: %v", err)
+	}
+
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations <= 0 {
+		return nil, fmt.Errorf("invalid SCRAM iteration count [%s]", attributes["i"])
+	}
+
+	saltedPassword := scramSaltPassword([]byte(c.password), salt, iterations)
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	channelBinding := append([]byte(c.gs2Header), c.channelBinding...)
+	clientFinalWithoutProof := fmt.Sprintf("c=%s,r=%s",
+		base64.StdEncoding.EncodeToString(channelBinding), serverNonce)
+	authMessage := []byte(c.clientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof)
+
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	clientProof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		clientProof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverKey := scramHMAC(saltedPassword, []byte("Server Key"))
+	c.serverSignature = scramHMAC(serverKey, authMessage)
+
+	return []byte(fmt.Sprintf("%s,p=%s",
+		clientFinalWithoutProof, base64.StdEncoding.EncodeToString(clientProof))), nil
+}
+
+// verifyServerFinal makes sure that the server also knows the password.
+func (c *scramClient) verifyServerFinal(serverFinal []byte) error {
+	attributes, err := scramAttributes(serverFinal)
+	if err != nil {
+		return err
+	}
+
+	if serverErr, ok := attributes["e"]; ok {
+		return fmt.Errorf("SCRAM authentication failed: %s", serverErr)
+	}
+
+	serverSignature, err := base64.StdEncoding.DecodeString(attributes["v"])
+	if err != nil {
+		return fmt.Errorf("invalid SCRAM server signature: %v", err)
+	}
+
+	if c.serverSignature == nil || !hmac.Equal(serverSignature, c.serverSignature) {
+		return fmt.Errorf("SCRAM server signature does not match")
+	}
+
+	return nil
+}
+
+// scramAttributes parses a SCRAM message into its attributes.
+func scramAttributes(message []byte) (map[string]string, error) {
+	attributes := map[string]string{}
+	for _, attribute := range bytes.Split(message, []byte(",")) {
+		parts := bytes.SplitN(attribute, []byte("="), 2)
+		if len(parts) != 2 || len(parts[0]) != 1 {
+			return nil, fmt.Errorf("invalid SCRAM message [%s]", string(message))
+		}
+		attributes[string(parts[0])] = string(parts[1])
+	}
+	return attributes, nil
+}
+
+// scramEscapeUser escapes the characters that have a special meaning in SCRAM messages.
+func scramEscapeUser(user string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+}
+
+func scramHMAC(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// scramSaltPassword is PBKDF2 with HMAC-SHA-256. The derived key is the same length as the hash,
+// so only a single block is needed.
+func scramSaltPassword(password, salt []byte, iterations int) []byte {
+	blockIndex := make([]byte, 4)
+	binary.BigEndian.PutUint32(blockIndex, 1)
+
+	u := scramHMAC(password, append(append([]byte{}, salt...), blockIndex...))
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = scramHMAC(password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// tlsServerEndPoint returns the tls-server-end-point channel binding data for the connection as
+// described in RFC 5929. This is a hash of the certificate the data node presented.
+func tlsServerEndPoint(tlsState *tls.ConnectionState) ([]byte, error) {
+	if len(tlsState.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("data node did not present a certificate for channel binding")
+	}
+
+	certificate := tlsState.PeerCertificates[0]
+	var h hash.Hash
+	switch certificate.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = sha512.New()
+	default:
+		// MD5 and SHA-1 are replaced with SHA-256.
+		h = sha256.New()
+	}
+	h.Write(certificate.Raw)
+	return h.Sum(nil), nil
+}
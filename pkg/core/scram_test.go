@@ -0,0 +1,40 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestScramClient(t *testing.T) {
+	// This is the example exchange from RFC 7677.
+	client, err := newScramClient([]string{scramSHA256}, "user", "pencil", nil)
+	assert.NoError(t, err)
+	client.clientNonce = "rOprNGfwEbeRWgbNEkqO"
+
+	assert.Equal(t, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", string(client.clientFirstMessage()))
+
+	clientFinal, err := client.clientFinalMessage(
+		[]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	assert.NoError(t, err)
+	assert.Equal(t,
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		string(clientFinal))
+
+	assert.NoError(t, client.verifyServerFinal([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")))
+	assert.Error(t, client.verifyServerFinal([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")))
+	assert.Error(t, client.verifyServerFinal([]byte("e=invalid-proof")))
+}
+
+func TestScramClient_InvalidServerNonce(t *testing.T) {
+	client, err := newScramClient([]string{scramSHA256}, "user", "pencil", nil)
+	assert.NoError(t, err)
+	client.clientFirstMessage()
+
+	_, err = client.clientFinalMessage([]byte("r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	assert.Error(t, err)
+}
+
+func TestScramClient_UnsupportedMechanism(t *testing.T) {
+	_, err := newScramClient([]string{"SCRAM-SHA-1"}, "user", "pencil", nil)
+	assert.Error(t, err)
+}
@@ -1,9 +1,25 @@
 package core
 
 import (
+	"fmt"
 	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
 	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/noahdb/pkg/types"
+	"github.com/elliotcourant/timber"
 	"github.com/readystock/goqu"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// intervalTypeId is the type of settings that are stored as a postgres interval like
+	// "30 seconds".
+	intervalTypeId = 1186
+
+	// settingsRetryInterval is how long the leader will wait before applying the settings again
+	// when the replicas are already being balanced.
+	settingsRetryInterval = time.Second
 )
 
 type settingContext struct {
@@ -13,6 +29,8 @@ type settingContext struct {
 type SettingContext interface {
 	GetSetting(SettingKeyOptions) (Setting, bool, error)
 	GetSettingValue(key SettingKeyOptions) (interface{}, bool, error)
+	GetSettingByName(name string) (Setting, bool, error)
+	SetSetting(key SettingKeyOptions, value interface{}) error
 }
 
 func (ctx *base) Setting() SettingContext {
@@ -21,10 +39,315 @@ func (ctx *base) Setting() SettingContext {
 	}
 }
 
-//
-// func (ctx *settingContext) SetSetting(key SettingKeyOptions, value interface{}) error {
-// 	key.EnumDescriptor()
-// }
+// SetSetting changes the value of a setting for the entire cluster. The value is converted to the
+// type of the setting and validated before it is stored. Every coordinator sees the change as it
+// is applied to the internal store, see watchSettings.
+func (ctx *settingContext) SetSetting(key SettingKeyOptions, value interface{}) error {
+	setting, ok, err := ctx.GetSetting(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("setting [%s] does not exist", key)
+	}
+
+	record := goqu.Record{
+		"int_value":     nil,
+		"boolean_value": nil,
+		"text_value":    nil,
+	}
+	switch setting.TypeID {
+	case types.Int8OID:
+		intValue, err := settingIntValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for setting %s: %v", setting.SettingKey, err)
+		}
+		if err := validateIntSetting(key, intValue); err != nil {
+			return fmt.Errorf("invalid value for setting %s: %v", setting.SettingKey, err)
+		}
+		record["int_value"] = intValue
+	case types.BoolOID:
+		boolValue, err := settingBoolValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for setting %s: %v", setting.SettingKey, err)
+		}
+		record["boolean_value"] = boolValue
+	case types.TextOID, intervalTypeId:
+		textValue, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("invalid value for setting %s: expected text but found %T", setting.SettingKey, value)
+		}
+		if setting.TypeID == intervalTypeId {
+			if interval, err := parseInterval(textValue); err != nil {
+				return fmt.Errorf("invalid value for setting %s: %v", setting.SettingKey, err)
+			} else if interval <= 0 {
+				return fmt.Errorf("invalid value for setting %s: interval must be greater than zero", setting.SettingKey)
+			}
+		}
+		record["text_value"] = textValue
+	default:
+		return fmt.Errorf("setting %s has an unsupported type [%d]", setting.SettingKey, setting.TypeID)
+	}
+
+	switch key {
+	case SettingKeyOptions_NumberOfShards:
+		// The number of shards can only grow, shards cannot be merged back together.
+		shards, err := ctx.Shards().GetShards()
+		if err != nil {
+			return err
+		}
+		if record["int_value"].(int64) < int64(len(shards)) {
+			return fmt.Errorf("invalid value for setting %s: there are already %d shards", setting.SettingKey, len(shards))
+		}
+	case SettingKeyOptions_MinPoolSize, SettingKeyOptions_MaxPoolSize:
+		if err := ctx.validatePoolSize(key, record["int_value"].(int64)); err != nil {
+			return fmt.Errorf("invalid value for setting %s: %v", setting.SettingKey, err)
+		}
+	}
+
+	compiledSql := goqu.From("settings").
+		Where(goqu.Ex{
+			"setting_id": key,
+		}).
+		Update(record).Sql
+	_, err = ctx.db.Exec(compiledSql)
+	return err
+}
+
+// validatePoolSize makes sure that the minimum size of the pools is not larger than the maximum
+// size. A maximum size of zero means that the pools do not have a limit.
+func (ctx *settingContext) validatePoolSize(key SettingKeyOptions, value int64) error {
+	minSize, maxSize := value, value
+	other := SettingKeyOptions_MaxPoolSize
+	if key == SettingKeyOptions_MaxPoolSize {
+		other = SettingKeyOptions_MinPoolSize
+	}
+
+	otherValue, ok, err := ctx.GetSettingValue(other)
+	if err != nil || !ok {
+		return err
+	}
+	otherSize, _ := otherValue.(int64)
+	if key == SettingKeyOptions_MaxPoolSize {
+		minSize = otherSize
+	} else {
+		maxSize = otherSize
+	}
+
+	if maxSize > 0 && minSize > maxSize {
+		return fmt.Errorf("min_pool_size [%d] cannot be larger than max_pool_size [%d]", minSize, maxSize)
+	}
+	return nil
+}
+
+// clusterSettings are the settings that change how the shards are placed on the data nodes.
+type clusterSettings struct {
+	numberOfShards    int64
+	replicationFactor int
+	replicationMode   ReplicationModeOptions
+}
+
+func (ctx *base) getClusterSettings() (clusterSettings, error) {
+	settings := clusterSettings{}
+	if value, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_NumberOfShards); err != nil {
+		return settings, err
+	} else if ok {
+		settings.numberOfShards, _ = value.(int64)
+	}
+
+	mode, err := ctx.getReplicationMode()
+	if err != nil {
+		return settings, err
+	}
+	settings.replicationMode = mode
+
+	factor, err := ctx.getReplicationFactor()
+	if err != nil {
+		return settings, err
+	}
+	settings.replicationFactor = factor
+
+	return settings, nil
+}
+
+// observeSettings returns an observer for the internal store that signals the channel whenever
+// the settings might have changed.
+func observeSettings(changed chan<- struct{}) func(queries []string) {
+	return func(queries []string) {
+		// The entire store is replaced when a snapshot is restored.
+		touched := queries == nil
+		for _, query := range queries {
+			if strings.Contains(query, "settings") {
+				touched = true
+				break
+			}
+		}
+
+		if !touched {
+			return
+		}
+
+		select {
+		case changed <- struct{}{}:
+		default:
+			// A change is already pending.
+		}
+	}
+}
+
+// watchSettings runs on every coordinator and applies setting changes as they are replicated to
+// it. The pool settings belong to each coordinator so every coordinator refreshes its pools. The
+// settings that change where shards are placed are applied by the leader, if leadership changes
+// before they are applied then the new leader applies them when it resumes rebalancing.
+func (ctx *base) watchSettings(changed <-chan struct{}) {
+	apply := make(chan struct{}, 1)
+	go func() {
+		applied := clusterSettings{}
+		for range apply {
+			settings, err := ctx.getClusterSettings()
+			if err != nil {
+				timber.Errorf("could not retrieve cluster settings: %v", err)
+				continue
+			}
+
+			if settings == applied {
+				continue
+			}
+
+			if err := ctx.applyClusterSettings(); err != nil {
+				timber.Errorf("could not apply cluster settings: %v", err)
+				continue
+			}
+			applied = settings
+		}
+	}()
+
+	for range changed {
+		ctx.refreshPool()
+
+		if !ctx.IsLeader() {
+			continue
+		}
+
+		select {
+		case apply <- struct{}{}:
+		default:
+			// The settings will be read again before they are applied.
+		}
+	}
+}
+
+// applyClusterSettings changes the shards and their replicas to match the settings. This is run
+// by the leader whenever the settings change, and when a coordinator becomes the leader.
+func (ctx *base) applyClusterSettings() error {
+	if err := ctx.ensureNumberOfShards(); err != nil {
+		return err
+	}
+
+	// If the replicas are already being balanced, like when the leader is resuming rebalancing,
+	// then the settings might have been read before they were changed. So we wait for our turn.
+	for {
+		err := ctx.Shards().BalanceReplicas()
+		if err != errBalancingReplicas {
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		if !ctx.IsLeader() {
+			return nil
+		}
+		time.Sleep(settingsRetryInterval)
+	}
+
+	return ctx.Shards().RefreshSubscriptions()
+}
+
+// GetSettingByName returns the setting with the provided key, like max_pool_size.
+func (ctx *settingContext) GetSettingByName(name string) (Setting, bool, error) {
+	compiledSql, _, _ := goqu.
+		From("settings").
+		Select("*").
+		Where(goqu.Ex{
+			"setting_key": strings.ToLower(name),
+		}).
+		Limit(1).
+		ToSql()
+	rows, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return Setting{}, false, err
+	}
+	settings, err := ctx.settingsFromRows(rows)
+	if err != nil {
+		return Setting{}, false, err
+	}
+	if len(settings) == 0 {
+		return Setting{}, false, nil
+	}
+	return settings[0], true, nil
+}
+
+// validateIntSetting makes sure that the value is within the range that is allowed for the
+// setting.
+func validateIntSetting(key SettingKeyOptions, value int64) error {
+	switch key {
+	case SettingKeyOptions_ReplicationMode:
+		if _, ok := ReplicationModeOptions_name[int32(value)]; !ok {
+			return fmt.Errorf("unknown replication mode [%d]", value)
+		}
+	case SettingKeyOptions_PoolMode:
+		if _, ok := PoolModeOptions_name[int32(value)]; !ok {
+			return fmt.Errorf("unknown pool mode [%d]", value)
+		}
+	case SettingKeyOptions_SlowQueryThreshold:
+		// A threshold of -1 disables the slow query log, zero logs every statement.
+		if value < -1 {
+			return fmt.Errorf("value must be at least -1")
+		}
+	case SettingKeyOptions_ReplicationFactor, SettingKeyOptions_NumberOfShards:
+		if value < 1 {
+			return fmt.Errorf("value must be at least 1")
+		}
+	default:
+		if value < 0 {
+			return fmt.Errorf("value cannot be negative")
+		}
+	}
+	return nil
+}
+
+func settingIntValue(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case uint64:
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	default:
+		return 0, fmt.Errorf("expected an integer but found %T", value)
+	}
+}
+
+func settingBoolValue(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "on", "yes", "1", "t":
+			return true, nil
+		case "false", "off", "no", "0", "f":
+			return false, nil
+		}
+		return false, fmt.Errorf("expected a boolean but found [%s]", v)
+	default:
+		return false, fmt.Errorf("expected a boolean but found %T", value)
+	}
+}
 
 func (ctx *settingContext) GetSettingValue(key SettingKeyOptions) (interface{}, bool, error) {
 	val, ok, err := ctx.GetSetting(key)
@@ -53,7 +376,16 @@ func (ctx *settingContext) GetSettingValue(key SettingKeyOptions) (interface{},
 	return nil, ok, err
 }
 
+// GetSetting returns the setting with the provided key. Settings are read for every statement
+// that is run, so they are kept in the metadata cache until the settings table is changed.
 func (ctx *settingContext) GetSetting(key SettingKeyOptions) (Setting, bool, error) {
+	cacheKey := strconv.FormatInt(int64(key), 10)
+	cached, version, ok := ctx.cache.settings.get(cacheKey)
+	if ok {
+		setting, ok := cached.(Setting)
+		return setting, ok, nil
+	}
+
 	compiledSql, _, _ := goqu.
 		From("settings").
 		Select("*").
@@ -63,13 +395,20 @@ func (ctx *settingContext) GetSetting(key SettingKeyOptions) (Setting, bool, err
 		Limit(1).
 		ToSql()
 	rows, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return Setting{}, false, err
+	}
 	settings, err := ctx.settingsFromRows(rows)
 	if err != nil {
 		return Setting{}, false, err
 	}
 	if len(settings) == 0 {
+		// Settings that are missing are cached too, these are settings that were added after
+		// the cluster was created.
+		ctx.cache.settings.put(version, cacheKey, nil)
 		return Setting{}, false, nil
 	}
+	ctx.cache.settings.put(version, cacheKey, settings[0])
 	return settings[0], true, nil
 }
 
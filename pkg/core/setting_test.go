@@ -5,6 +5,7 @@ import (
 	"github.com/elliotcourant/noahdb/testutils"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestSettingContext_GetSetting(t *testing.T) {
@@ -28,3 +29,191 @@ func TestSettingContext_GetSetting(t *testing.T) {
 		assert.Equal(t, int64(5), setting)
 	})
 }
+
+func TestSettingContext_GetSettingValue_MaxReplicationLag(t *testing.T) {
+	colony, cleanup := testutils.NewTestColony(t)
+	defer cleanup()
+	setting, ok, err := colony.Setting().GetSettingValue(core.SettingKeyOptions_MaxReplicationLag)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(16777216), setting)
+}
+
+func TestSettingContext_GetSettingValue_PoolMode(t *testing.T) {
+	colony, cleanup := testutils.NewTestColony(t)
+	defer cleanup()
+	mode, err := colony.Pool().GetPoolMode()
+	assert.NoError(t, err)
+	assert.Equal(t, core.PoolModeOptions_TransactionPooling, mode)
+}
+
+func TestSettingContext_SetSetting(t *testing.T) {
+	colony, cleanup := testutils.NewTestColony(t)
+	defer cleanup()
+
+	t.Run("set integer", func(t *testing.T) {
+		err := colony.Setting().SetSetting(core.SettingKeyOptions_MaxPoolSize, "10")
+		assert.NoError(t, err)
+		value, ok, err := colony.Setting().GetSettingValue(core.SettingKeyOptions_MaxPoolSize)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(10), value)
+	})
+
+	t.Run("set interval", func(t *testing.T) {
+		err := colony.Setting().SetSetting(core.SettingKeyOptions_PoolRefreshInterval, "1 minute")
+		assert.NoError(t, err)
+		value, ok, err := colony.Setting().GetSettingValue(core.SettingKeyOptions_PoolRefreshInterval)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "1 minute", value)
+	})
+
+	t.Run("invalid type", func(t *testing.T) {
+		err := colony.Setting().SetSetting(core.SettingKeyOptions_MaxPoolSize, "lots")
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid interval", func(t *testing.T) {
+		err := colony.Setting().SetSetting(core.SettingKeyOptions_PoolRefreshInterval, "soon")
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid pool mode", func(t *testing.T) {
+		err := colony.Setting().SetSetting(core.SettingKeyOptions_PoolMode, int64(42))
+		assert.Error(t, err)
+	})
+
+	t.Run("set boolean", func(t *testing.T) {
+		err := colony.Setting().SetSetting(core.SettingKeyOptions_SlowQueryLogParameters, "on")
+		assert.NoError(t, err)
+		value, ok, err := colony.Setting().GetSettingValue(core.SettingKeyOptions_SlowQueryLogParameters)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, true, value)
+	})
+
+	t.Run("disable slow query log", func(t *testing.T) {
+		assert.NoError(t, colony.Setting().SetSetting(core.SettingKeyOptions_SlowQueryThreshold, int64(-1)))
+		assert.Error(t, colony.Setting().SetSetting(core.SettingKeyOptions_SlowQueryThreshold, int64(-2)))
+	})
+
+	t.Run("min pool size larger than max", func(t *testing.T) {
+		assert.Error(t, colony.Setting().SetSetting(core.SettingKeyOptions_MinPoolSize, int64(11)))
+		assert.NoError(t, colony.Setting().SetSetting(core.SettingKeyOptions_MinPoolSize, int64(2)))
+		assert.Error(t, colony.Setting().SetSetting(core.SettingKeyOptions_MaxPoolSize, int64(1)))
+	})
+
+	t.Run("get by name", func(t *testing.T) {
+		setting, ok, err := colony.Setting().GetSettingByName("max_pool_size")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, core.SettingKeyOptions_MaxPoolSize, setting.SettingID)
+	})
+}
+
+// The settings that change where the shards are placed are applied by the leader, even when they
+// are changed on another coordinator.
+func TestSettingContext_SetSetting_Replicas(t *testing.T) {
+	leader, cleanupLeader := testutils.NewPgTestColony(t)
+	defer cleanupLeader()
+
+	follower, cleanupFollower := testutils.NewTestColony(t, leader.Addr().String())
+	defer cleanupFollower()
+
+	assert.True(t, leader.IsLeader())
+	assert.False(t, follower.IsLeader())
+
+	node, cleanupNode, err := testutils.NewDataNode(t)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer cleanupNode()
+
+	_, err = leader.DataNodes().NewDataNode(node.Address, node.Port, node.User, node.Password)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	// replicasMatch returns true once every stable shard has the expected number of replicas, the
+	// expected number of them are writable and none of the writable replicas have diverged.
+	replicasMatch := func(replicas, writable int) func() bool {
+		return func() bool {
+			shards, err := follower.Shards().GetShards()
+			if err != nil {
+				return false
+			}
+
+			dataNodeShards, err := follower.Shards().GetDataNodeShards()
+			if err != nil {
+				return false
+			}
+
+			divergedDataNodeShards, err := follower.Shards().GetDivergedDataNodeShards()
+			if err != nil {
+				return false
+			}
+			diverged := map[uint64]bool{}
+			for _, item := range divergedDataNodeShards {
+				diverged[item.DataNodeShardID] = true
+			}
+
+			for _, shard := range shards {
+				if shard.State != core.ShardState_Stable {
+					continue
+				}
+
+				total, primaries := 0, 0
+				for _, dataNodeShard := range dataNodeShards {
+					if dataNodeShard.ShardID != shard.ShardID {
+						continue
+					}
+					total++
+					if !dataNodeShard.ReadOnly {
+						if diverged[dataNodeShard.DataNodeShardID] {
+							return false
+						}
+						primaries++
+					}
+				}
+
+				if total != replicas || primaries != writable {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	t.Run("increase replication factor", func(t *testing.T) {
+		err := follower.Setting().SetSetting(core.SettingKeyOptions_ReplicationMode, int64(core.ReplicationModeOptions_Query))
+		assert.NoError(t, err)
+		err = follower.Setting().SetSetting(core.SettingKeyOptions_ReplicationFactor, int64(2))
+		assert.NoError(t, err)
+		assert.Eventually(t, replicasMatch(2, 2), time.Minute, time.Second)
+	})
+
+	// The test data nodes do not allow logical replication, so the converted replicas cannot be
+	// subscribed to their primary. They are still made read only and will not be read from.
+	t.Run("convert to logical replication", func(t *testing.T) {
+		err := follower.Setting().SetSetting(core.SettingKeyOptions_ReplicationMode, int64(core.ReplicationModeOptions_Logical))
+		assert.NoError(t, err)
+		assert.Eventually(t, replicasMatch(2, 1), time.Minute, time.Second)
+	})
+
+	t.Run("convert to query replication", func(t *testing.T) {
+		err := follower.Setting().SetSetting(core.SettingKeyOptions_ReplicationMode, int64(core.ReplicationModeOptions_Query))
+		assert.NoError(t, err)
+		assert.Eventually(t, replicasMatch(2, 2), time.Minute, time.Second)
+
+		diverged, err := follower.Shards().GetDivergedDataNodeShards()
+		assert.NoError(t, err)
+		assert.Empty(t, diverged)
+	})
+
+	t.Run("decrease replication factor", func(t *testing.T) {
+		err := follower.Setting().SetSetting(core.SettingKeyOptions_ReplicationFactor, int64(1))
+		assert.NoError(t, err)
+		assert.Eventually(t, replicasMatch(1, 1), time.Minute, time.Second)
+	})
+}
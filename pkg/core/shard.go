@@ -6,11 +6,9 @@ import (
 	"github.com/elliotcourant/noahdb/pkg/frunk"
 	"github.com/elliotcourant/timber"
 	"gopkg.in/doug-martin/goqu.v5"
+	"strings"
 	// Use the postgres adapter for building queries.
-	"database/sql"
 	_ "gopkg.in/doug-martin/goqu.v5/adapters/postgres"
-
-	_ "github.com/lib/pq"
 )
 
 var (
@@ -51,6 +49,16 @@ type ShardContext interface {
 	BalanceOrphanShards() error
 	GetDataNodesPressure(max int) ([]DataNodePressure, error)
 	GetShardPressures(max int) ([]ShardPressure, error)
+	SplitShard(shardId uint64) (ShardSplit, error)
+	GetShardSplits() ([]ShardSplit, error)
+	ResumeShardSplits() error
+	GetDataNodeShardProvisions() ([]DataNodeShardProvision, error)
+	ForceProvisionDataNodeShard(dataNodeShardId uint64) error
+	BalanceReplicas() error
+	VerifyReplicas(healthyDataNodeShardId uint64, suspectDataNodeShardIds ...uint64) ([]uint64, error)
+	GetDivergedDataNodeShards() ([]DivergedDataNodeShard, error)
+	RepairDivergedDataNodeShards() error
+	RefreshSubscriptions() error
 }
 
 func (ctx *base) Shards() ShardContext {
@@ -81,10 +89,48 @@ func (ctx *shardContext) NewShard() (shard Shard, err error) {
 	return shard, nil
 }
 
+// ensureNumberOfShards creates new shards until the cluster has as many shards as the
+// number_of_shards setting. The new shards are then placed on data nodes.
+func (ctx *base) ensureNumberOfShards() error {
+	value, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_NumberOfShards)
+	if err != nil || !ok {
+		return err
+	}
+	numberOfShards, _ := value.(int64)
+
+	shards, err := ctx.Shards().GetShards()
+	if err != nil {
+		return err
+	}
+
+	for i := int64(len(shards)); i < numberOfShards; i++ {
+		if _, err := ctx.Shards().NewShard(); err != nil {
+			return err
+		}
+	}
+
+	return ctx.Shards().BalanceOrphanShards()
+}
+
 // BalanceOrphanShards looks at all of the shards in the cluster
 // that are not currently associated with a data node and assigns
-// them a data node. Then marks that shard as ready.
+// them to as many data nodes as the replication factor requires.
+// Each new data node shard is then provisioned, once provisioning
+// has finished the shard is marked as ready.
 func (ctx *shardContext) BalanceOrphanShards() error {
+	claim, ok, err := ctx.claimRebalance(balanceOrphanShardsClaim)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("orphaned shards are already being balanced by another coordinator")
+	}
+	defer claim.release()
+
+	return ctx.balanceOrphanShards()
+}
+
+func (ctx *shardContext) balanceOrphanShards() error {
 	orphanedShardsQuery, _, _ := goqu.
 		From("shards").
 		Select("shards.shard_id").
@@ -104,100 +150,97 @@ func (ctx *shardContext) BalanceOrphanShards() error {
 		return err
 	}
 	timber.Debugf("found %d orphaned shards", len(ids))
-	updateShardStateQuery := goqu.
-		From("shards").
-		Where(goqu.Ex{
-			"shard_id": ids,
-		}).
-		Update(goqu.Ex{
-			"state": ShardState_Balancing,
-		}).Sql
-	_, err = ctx.db.Exec(updateShardStateQuery)
-	if err != nil {
-		return err
-	}
-	pressures, err := ctx.GetDataNodesPressure(len(ids))
-
-	for i, shardId := range ids {
-		// Determine which node this shard should be assigned to.
-		pressureIndex := i % len(pressures)
-		dataNode := pressures[pressureIndex]
-		timber.Debugf("assigning shard [%d] to data node [%d]", shardId, dataNode.DataNodeID)
 
-		id, err := ctx.db.NextSequenceValueById(dataNodeShardIdSequencePath)
+	if len(ids) > 0 {
+		updateShardStateQuery := goqu.
+			From("shards").
+			Where(goqu.Ex{
+				"shard_id": ids,
+			}).
+			Update(goqu.Ex{
+				"state": ShardState_Balancing,
+			}).Sql
+		_, err = ctx.db.Exec(updateShardStateQuery)
 		if err != nil {
 			return err
 		}
-
-		newDataNodeShard := goqu.
-			From("data_node_shards").
-			Insert(goqu.Record{
-				"data_node_shard_id": id,
-				"data_node_id":       dataNode.DataNodeID,
-				"shard_id":           shardId,
-				"read_only":          false,
-			}).Sql
-		if _, err := ctx.db.Exec(newDataNodeShard); err != nil {
+		factor, err := ctx.getReplicationFactor()
+		if err != nil {
 			return err
 		}
 
-		dataNodeMeta, err := ctx.DataNodes().GetDataNode(dataNode.DataNodeID)
+		mode, err := ctx.getReplicationMode()
 		if err != nil {
-			timber.Criticalf("failed to retrieve metadata for data node [%d]: %v", dataNode.DataNodeID, err)
-			continue
-		}
-
-		dataNodeAddress := fmt.Sprintf("%s:%d", dataNodeMeta.GetAddress(), dataNodeMeta.GetPort())
-		timber.Debugf("trying to connect to data node [%d] at %s to init shards", dataNode.DataNodeID, dataNodeAddress)
-
-		databaseLogin := dataNodeMeta.GetUser()
-		if dataNodeMeta.Password != "" {
-			databaseLogin += ":" + dataNodeMeta.GetPassword()
+			return err
 		}
 
-		connStr := fmt.Sprintf("postgres://%s@%s/postgres?sslmode=disable", databaseLogin, dataNodeAddress)
-		db, err := sql.Open("postgres", connStr)
-		if err != nil {
-			timber.Criticalf("failed to connect to data node [%d] address %s: %v", dataNode.DataNodeID, dataNodeAddress, err)
-			continue
-		}
+		for _, shardId := range ids {
+			// The pressures are retrieved for each shard so that the shards are spread across the
+			// data nodes, each replica of the shard is placed on a different data node.
+			pressures, err := ctx.GetDataNodesPressure(factor)
+			if err != nil {
+				return err
+			}
+			if len(pressures) == 0 {
+				return fmt.Errorf("no data nodes available for orphaned shard [%d]", shardId)
+			}
+			if len(pressures) < factor {
+				timber.Warningf("shard [%d] will only have %d of %d replicas, there are not enough data nodes",
+					shardId, len(pressures), factor)
+			}
 
-		dbname := fmt.Sprintf("noahdb_%d", id)
+			// The data node shards and their provisioning state are created together, this way a
+			// data node shard will always be provisioned even if we are interrupted.
+			statements := make([]string, 0, len(pressures)*2)
+			for i, dataNode := range pressures {
+				timber.Debugf("assigning shard [%d] to data node [%d]", shardId, dataNode.DataNodeID)
 
-		kickActiveUsers := fmt.Sprintf(`
-		SELECT 
-			pg_terminate_backend(pg_stat_activity.pid)
-		FROM pg_stat_activity
-		WHERE pg_stat_activity.datname = '%s'
-		AND pid <> pg_backend_pid();`, dbname)
-		_, _ = db.Exec(kickActiveUsers)
+				id, err := ctx.db.NextSequenceValueById(dataNodeShardIdSequencePath)
+				if err != nil {
+					return err
+				}
 
-		deleteExistingShard := fmt.Sprintf("DROP DATABASE IF EXISTS noahdb_%d", id)
-		_, err = db.Exec(deleteExistingShard)
-		if err != nil {
-			timber.Criticalf("could not drop existing shard db: %v", err)
-			continue
+				newDataNodeShard := goqu.
+					From("data_node_shards").
+					Insert(goqu.Record{
+						"data_node_shard_id": id,
+						"data_node_id":       dataNode.DataNodeID,
+						"shard_id":           shardId,
+						// With logical replication the first data node shard is the primary and
+						// the others are read only replicas that subscribe to it.
+						"read_only": mode == ReplicationModeOptions_Logical && i > 0,
+					}).Sql
+				newProvision := goqu.
+					From("data_node_shard_provisions").
+					Insert(goqu.Record{
+						"data_node_shard_id": id,
+						"state":              ProvisionState_Creating,
+						"force":              false,
+					}).Sql
+				statements = append(statements, newDataNodeShard, newProvision)
+			}
+			if _, err := ctx.db.Exec(strings.Join(statements, ";")); err != nil {
+				return err
+			}
 		}
+	}
 
-		createShardQuery := fmt.Sprintf("CREATE DATABASE noahdb_%d", id)
-		_, err = db.Exec(createShardQuery)
-		if err != nil {
-			timber.Criticalf("failed to create data node shard [%d] on data node [%d] address %s: %v", id, dataNode.DataNodeID, dataNodeAddress, err)
-			continue
-		}
+	provisions, err := ctx.GetDataNodeShardProvisions()
+	if err != nil {
+		return err
+	}
 
-		updateShardStatus := goqu.
-			From("shards").
-			Where(goqu.Ex{
-				"shard_id": shardId,
-			}).
-			Update(goqu.Ex{
-				"state": ShardState_Stable,
-			}).Sql
-		if _, err := ctx.db.Exec(updateShardStatus); err != nil {
-			return err
+	for _, provision := range provisions {
+		err := ctx.provisionDataNodeShard(provision)
+		switch err {
+		case nil:
+		case errDataNodeShardProvisioning:
+			timber.Debugf("data node shard [%d] is being provisioned by another coordinator", provision.DataNodeShardID)
+		default:
+			timber.Criticalf("failed to provision data node shard [%d]: %v", provision.DataNodeShardID, err)
 		}
 	}
+
 	return nil
 }
 
@@ -246,6 +289,11 @@ func (ctx *shardContext) GetDataNodesPressure(max int) ([]DataNodePressure, erro
 		LeftJoin(
 			goqu.I("data_node_shards"),
 			goqu.On(goqu.I("data_node_shards.data_node_id").Eq(goqu.I("data_nodes.data_node_id")))).
+		Where(goqu.Ex{
+			// Data nodes that are being drained should not receive any new shards.
+			"data_nodes.draining": false,
+			"data_nodes.healthy":  true,
+		}).
 		GroupBy(goqu.I("data_nodes.data_node_id")).
 		Order(goqu.I("shards").Asc()).
 		Limit(uint(max)).
@@ -0,0 +1,710 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/timber"
+	"github.com/lib/pq"
+	"github.com/readystock/goqu"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	getDataNodeShardProvisionsQuery = goqu.
+		From("data_node_shard_provisions").
+		Select(
+			"data_node_shard_id",
+			"state",
+			"force")
+)
+
+// errDataNodeShardProvisioning is returned when another coordinator is already provisioning the
+// data node shard.
+var errDataNodeShardProvisioning = errors.New("data node shard is already being provisioned by another coordinator")
+
+// dataNodeShardOwnershipMarker is stored as the comment on a data node shard's database. It is
+// used to tell whether an existing database was created by noahdb for this data node shard.
+func dataNodeShardOwnershipMarker(dataNodeShardId uint64) string {
+	return fmt.Sprintf("noahdb:data_node_shard:%d", dataNodeShardId)
+}
+
+// dataNodeShardProvisionClaim is the key of the claim that is held while a data node shard is
+// being provisioned.
+func dataNodeShardProvisionClaim(dataNodeShardId uint64) string {
+	return fmt.Sprintf("data_node_shard_provision:%d", dataNodeShardId)
+}
+
+// dataNodeShardSeededMarker replaces the ownership marker once the schema and the global tables
+// have been copied to the database. It records the last schema definition that was applied, so
+// only the definitions created after it are applied when the data node shard is caught up.
+func dataNodeShardSeededMarker(dataNodeShardId, definitionId uint64) string {
+	return fmt.Sprintf("%s:seeded:%d", dataNodeShardOwnershipMarker(dataNodeShardId), definitionId)
+}
+
+// getSeededDefinitionID returns the last schema definition that was applied to the data node
+// shard's database. False is returned if the comment is not the data node shard's seeded marker.
+func getSeededDefinitionID(dataNodeShardId uint64, comment string) (uint64, bool) {
+	prefix := dataNodeShardOwnershipMarker(dataNodeShardId) + ":seeded:"
+	if !strings.HasPrefix(comment, prefix) {
+		return 0, false
+	}
+
+	definitionId, err := strconv.ParseUint(strings.TrimPrefix(comment, prefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return definitionId, true
+}
+
+// GetDataNodeShardProvisions returns all of the data node shards that have not finished being
+// provisioned.
+func (ctx *shardContext) GetDataNodeShardProvisions() ([]DataNodeShardProvision, error) {
+	return ctx.getDataNodeShardProvisions()
+}
+
+// ForceProvisionDataNodeShard will provision the data node shard even if its database already
+// exists on the data node and contains data that was not created by noahdb. The existing database
+// will be dropped.
+func (ctx *shardContext) ForceProvisionDataNodeShard(dataNodeShardId uint64) error {
+	provisions, err := ctx.getDataNodeShardProvisions(dataNodeShardId)
+	if err != nil {
+		return err
+	}
+
+	if len(provisions) == 0 {
+		return fmt.Errorf("data node shard [%d] is not being provisioned", dataNodeShardId)
+	}
+
+	provision := provisions[0]
+	provision.Force = true
+
+	compiledSql := goqu.
+		From("data_node_shard_provisions").
+		Where(goqu.Ex{
+			"data_node_shard_id": dataNodeShardId,
+		}).
+		Update(goqu.Record{
+			"force": true,
+		}).Sql
+	if _, err := ctx.db.Exec(compiledSql); err != nil {
+		return err
+	}
+
+	return ctx.provisionDataNodeShard(provision)
+}
+
+// provisionDataNodeShard runs each of the remaining provisioning steps for the data node shard.
+// The state is stored after each step so provisioning can be resumed from the last step that
+// finished. Every step can be run again safely.
+func (ctx *shardContext) provisionDataNodeShard(provision DataNodeShardProvision) error {
+	claim, ok, err := ctx.claimRebalance(dataNodeShardProvisionClaim(provision.DataNodeShardID))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errDataNodeShardProvisioning
+	}
+	defer claim.release()
+
+	// Another coordinator might have finished some of the steps before we took the claim, so
+	// provisioning continues from the state that is stored now.
+	provisions, err := ctx.getDataNodeShardProvisions(provision.DataNodeShardID)
+	if err != nil {
+		return err
+	}
+	if len(provisions) == 0 {
+		return nil
+	}
+	provision = provisions[0]
+
+	dataNodeShard, err := ctx.getDataNodeShard(provision.DataNodeShardID)
+	if err != nil {
+		return err
+	}
+
+	for {
+		timber.Debugf("provisioning data node shard [%d], state: %s", provision.DataNodeShardID, provision.State)
+
+		switch provision.State {
+		case ProvisionState_Creating:
+			if err := ctx.createDataNodeShardDatabase(dataNodeShard, provision.Force); err != nil {
+				return err
+			}
+			provision.State = ProvisionState_Seeding
+		case ProvisionState_Seeding:
+			if err := ctx.seedDataNodeShard(dataNodeShard); err != nil {
+				return err
+			}
+			provision.State = ProvisionState_Verifying
+			if dataNodeShard.ReadOnly {
+				// Read only replicas receive their rows from the shard's primary.
+				provision.State = ProvisionState_Subscribing
+			}
+		case ProvisionState_Subscribing:
+			if err := ctx.subscribeDataNodeShard(dataNodeShard); err != nil {
+				return err
+			}
+			provision.State = ProvisionState_Verifying
+		case ProvisionState_Verifying:
+			return ctx.finishDataNodeShardProvision(dataNodeShard)
+		default:
+			return fmt.Errorf("data node shard [%d] has an invalid provisioning state [%s]", provision.DataNodeShardID, provision.State)
+		}
+
+		compiledSql := goqu.
+			From("data_node_shard_provisions").
+			Where(goqu.Ex{
+				"data_node_shard_id": provision.DataNodeShardID,
+			}).
+			Update(goqu.Record{
+				"state": provision.State,
+			}).Sql
+		if _, err := ctx.db.Exec(compiledSql); err != nil {
+			return err
+		}
+	}
+}
+
+// createDataNodeShardDatabase creates the database for the data node shard. If the database
+// already exists and it was created by noahdb for this data node shard then it is used as is. An
+// existing database that is empty will be taken over, but a database that has tables in it will
+// only be dropped if force is true.
+func (ctx *shardContext) createDataNodeShardDatabase(dataNodeShard DataNodeShard, force bool) error {
+	dataNode, err := ctx.DataNodes().GetDataNode(dataNodeShard.DataNodeID)
+	if err != nil {
+		return err
+	}
+
+	db, err := ctx.openDataNodeDatabase(dataNode, "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dbname := dataNodeShardDatabaseName(dataNodeShard.DataNodeShardID)
+	marker := dataNodeShardOwnershipMarker(dataNodeShard.DataNodeShardID)
+	setMarker := fmt.Sprintf("COMMENT ON DATABASE %s IS %s", pq.QuoteIdentifier(dbname), pq.QuoteLiteral(marker))
+
+	comment := sql.NullString{}
+	err = db.QueryRow(
+		"SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1",
+		dbname).Scan(&comment)
+	_, seeded := getSeededDefinitionID(dataNodeShard.DataNodeShardID, comment.String)
+	switch {
+	case err == sql.ErrNoRows:
+		// The database does not exist yet.
+	case err != nil:
+		return err
+	case comment.String == marker || seeded:
+		// We already created this database, we might have been interrupted before we could move
+		// on to the next step.
+		timber.Debugf("database [%s] on data node [%d] is already owned by noahdb", dbname, dataNode.DataNodeID)
+		return nil
+	default:
+		hasTables, err := ctx.databaseHasTables(dataNode, dbname)
+		if err != nil {
+			return err
+		}
+
+		if !hasTables {
+			timber.Warningf("taking ownership of existing empty database [%s] on data node [%d]", dbname, dataNode.DataNodeID)
+			_, err = db.Exec(setMarker)
+			return err
+		}
+
+		if !force {
+			return fmt.Errorf(
+				"database [%s] already exists on data node [%d] and contains tables that were not created by noahdb, provisioning must be forced to replace it",
+				dbname, dataNode.DataNodeID)
+		}
+
+		timber.Warningf("provisioning was forced, dropping existing database [%s] on data node [%d]", dbname, dataNode.DataNodeID)
+
+		kickActiveUsers := `
+		SELECT 
+			pg_terminate_backend(pg_stat_activity.pid)
+		FROM pg_stat_activity
+		WHERE pg_stat_activity.datname = $1
+		AND pid <> pg_backend_pid();`
+		_, _ = db.Exec(kickActiveUsers, dbname)
+
+		if _, err := db.Exec(fmt.Sprintf("DROP DATABASE %s", pq.QuoteIdentifier(dbname))); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("CREATE DATABASE %s", pq.QuoteIdentifier(dbname))); err != nil {
+		return err
+	}
+
+	// If we are interrupted before the marker is set then the database will be empty, so it will
+	// be taken over when provisioning is resumed.
+	_, err = db.Exec(setMarker)
+	return err
+}
+
+// databaseHasTables returns true if the database has any tables outside of the system schemas.
+func (ctx *shardContext) databaseHasTables(dataNode DataNode, database string) (bool, error) {
+	db, err := ctx.openDataNodeDatabase(dataNode, database)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	hasTables := false
+	err = db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1
+			FROM pg_class c
+			INNER JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.relkind IN ('r', 'p')
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+			AND n.nspname NOT LIKE 'pg_toast%')`).Scan(&hasTables)
+	return hasTables, err
+}
+
+// seedDataNodeShard creates the current schema on a newly created data node shard and copies the
+// contents of the global and tenant tables from an existing healthy shard. Everything is done in
+// a single transaction along with updating the ownership marker, so if we are interrupted the
+// database is left empty and seeding can be started over.
+func (ctx *shardContext) seedDataNodeShard(dataNodeShard DataNodeShard) error {
+	dataNodeShardId := dataNodeShard.DataNodeShardID
+	target, err := ctx.openDataNodeShard(dataNodeShard)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	comment, err := getDatabaseComment(target)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := getSeededDefinitionID(dataNodeShardId, comment); ok {
+		timber.Debugf("data node shard [%d] has already been seeded", dataNodeShardId)
+		return nil
+	}
+
+	definitions, err := ctx.getDefinitions(0)
+	if err != nil {
+		return err
+	}
+
+	tables, err := ctx.getReplicatedTables()
+	if err != nil {
+		return err
+	}
+
+	// A read only replica only needs the schema, the rows will be copied by its subscription.
+	if dataNodeShard.ReadOnly {
+		tables = nil
+	}
+
+	tx, err := target.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.seedDataNodeShardTx(tx, dataNodeShard, definitions, tables); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ctx *shardContext) seedDataNodeShardTx(tx *sql.Tx, dataNodeShard DataNodeShard, definitions []schemaDefinition, tables []Table) error {
+	if err := applySchemaDefinitions(tx, dataNodeShard.DataNodeShardID, 0, definitions); err != nil {
+		return err
+	}
+
+	return ctx.copyReplicatedTables(tx, dataNodeShard.DataNodeShardID, tables)
+}
+
+// applySchemaDefinitions creates the schema definitions on the data node shard in the order they
+// were created, then records the last definition that was applied in the seeded marker.
+func applySchemaDefinitions(tx *sql.Tx, dataNodeShardId, definitionId uint64, definitions []schemaDefinition) error {
+	for _, definition := range definitions {
+		timber.Verbosef("{%d} seeding schema: %s", dataNodeShardId, definition.Query)
+		if _, err := tx.Exec(definition.Query); err != nil {
+			return fmt.Errorf("could not create schema on data node shard [%d]: %v", dataNodeShardId, err)
+		}
+		definitionId = definition.DefinitionID
+	}
+
+	_, err := tx.Exec(fmt.Sprintf("COMMENT ON DATABASE %s IS %s",
+		pq.QuoteIdentifier(dataNodeShardDatabaseName(dataNodeShardId)),
+		pq.QuoteLiteral(dataNodeShardSeededMarker(dataNodeShardId, definitionId))))
+	return err
+}
+
+// getDatabaseComment returns the comment on the database that the connection is using.
+func getDatabaseComment(db *sql.DB) (string, error) {
+	comment := sql.NullString{}
+	err := db.QueryRow(
+		"SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = current_database()",
+	).Scan(&comment)
+	return comment.String, err
+}
+
+// copyReplicatedTables copies the rows of the global and tenant tables from a healthy data node
+// shard to the data node shard that is being provisioned.
+func (ctx *shardContext) copyReplicatedTables(tx *sql.Tx, dataNodeShardId uint64, tables []Table) error {
+	if len(tables) == 0 {
+		return nil
+	}
+
+	// The new shard is not stable yet, so it will not be picked as the source of the data.
+	sourceId, err := ctx.DataNodes().GetRandomDataNodeShardID()
+	if err != nil {
+		return err
+	}
+
+	if sourceId == 0 {
+		// If there are no other healthy shards then there is nothing to copy.
+		timber.Warningf("no healthy shards to copy global tables from for data node shard [%d]", dataNodeShardId)
+		return nil
+	}
+
+	source, err := ctx.getDataNodeShard(sourceId)
+	if err != nil {
+		return err
+	}
+
+	sourceDb, err := ctx.openDataNodeShard(source)
+	if err != nil {
+		return err
+	}
+	defer sourceDb.Close()
+
+	for _, table := range tables {
+		timber.Debugf("copying table [%s] from data node shard [%d] to data node shard [%d]",
+			table.TableName, sourceId, dataNodeShardId)
+		if err := copyTable(sourceDb, tx, table.TableName); err != nil {
+			return fmt.Errorf("could not copy table [%s] to data node shard [%d]: %v", table.TableName, dataNodeShardId, err)
+		}
+	}
+	return nil
+}
+
+// finishDataNodeShardProvision catches the data node shard up with the writes that were sent to
+// every shard since it was seeded, then marks it as provisioned. Those writes are blocked by a
+// fence on every coordinator in the meantime. The fence is lowered together with the provisioning
+// state being removed, so the writes that were blocked are sent to the new data node shard too.
+func (ctx *shardContext) finishDataNodeShardProvision(dataNodeShard DataNodeShard) error {
+	// If we were interrupted while catching up then the fence left behind is replaced.
+	fence, err := ctx.raiseWriteFence(writeFence{
+		DataNodeShardID: dataNodeShard.DataNodeShardID,
+	})
+	if err != nil {
+		return err
+	}
+
+	definitionId, err := ctx.catchUpDataNodeShard(dataNodeShard, fence)
+	if err == nil {
+		err = ctx.completeDataNodeShardProvision(dataNodeShard, fence, definitionId)
+	}
+
+	if err != nil {
+		if _, lowerErr := ctx.db.Exec(lowerWriteFenceSql(fence)); lowerErr != nil {
+			timber.Errorf("could not unblock writes to every shard: %v", lowerErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// catchUpDataNodeShard applies the schema definitions that were created since the data node shard
+// was seeded and replaces the rows of the global and tenant tables with the current rows once every
+// coordinator has acknowledged the fence, then verifies the data node shard's schema. Read only
+// replicas receive their rows from their subscription. The last schema definition that was applied
+// is returned.
+func (ctx *shardContext) catchUpDataNodeShard(dataNodeShard DataNodeShard, fence writeFence) (uint64, error) {
+	if err := ctx.awaitWriteFence(fence); err != nil {
+		return 0, err
+	}
+
+	target, err := ctx.openDataNodeShard(dataNodeShard)
+	if err != nil {
+		return 0, err
+	}
+	defer target.Close()
+
+	comment, err := getDatabaseComment(target)
+	if err != nil {
+		return 0, err
+	}
+
+	definitionId, ok := getSeededDefinitionID(dataNodeShard.DataNodeShardID, comment)
+	if !ok {
+		return 0, fmt.Errorf("data node shard [%d] has not been seeded", dataNodeShard.DataNodeShardID)
+	}
+
+	// The schema and the tables are read again now that they can't be changed until the fence
+	// is lowered.
+	definitions, err := ctx.getDefinitions(definitionId)
+	if err != nil {
+		return 0, err
+	}
+	if len(definitions) > 0 {
+		definitionId = definitions[len(definitions)-1].DefinitionID
+	}
+
+	tables, err := ctx.getReplicatedTables()
+	if err != nil {
+		return 0, err
+	}
+
+	if dataNodeShard.ReadOnly {
+		tables = nil
+	}
+
+	tx, err := target.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := ctx.catchUpDataNodeShardTx(tx, dataNodeShard, definitionId, definitions, tables); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return definitionId, ctx.verifyDataNodeShard(dataNodeShard)
+}
+
+func (ctx *shardContext) catchUpDataNodeShardTx(tx *sql.Tx, dataNodeShard DataNodeShard, definitionId uint64, definitions []schemaDefinition, tables []Table) error {
+	if err := applySchemaDefinitions(tx, dataNodeShard.DataNodeShardID, definitionId, definitions); err != nil {
+		return err
+	}
+
+	// Nothing is stored in the sharded tables until the data node shard has been provisioned, so
+	// the rows can be removed as long as tables that reference other tables are emptied first.
+	for i := len(tables) - 1; i >= 0; i-- {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s", pq.QuoteIdentifier(tables[i].TableName))); err != nil {
+			return fmt.Errorf("could not clear table [%s] on data node shard [%d]: %v",
+				tables[i].TableName, dataNodeShard.DataNodeShardID, err)
+		}
+	}
+
+	return ctx.copyReplicatedTables(tx, dataNodeShard.DataNodeShardID, tables)
+}
+
+// verifyDataNodeShard makes sure that every table and column the coordinator knows about exists on
+// the data node shard before it is marked as stable.
+func (ctx *shardContext) verifyDataNodeShard(dataNodeShard DataNodeShard) error {
+	tables, err := ctx.Tables().GetTables()
+	if err != nil {
+		return err
+	}
+
+	db, err := ctx.openDataNodeShard(dataNodeShard)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, table := range tables {
+		if table.TableType == TableType_Noah {
+			continue
+		}
+
+		existing, err := getDataNodeShardColumns(db, table.TableName)
+		if err != nil {
+			return err
+		}
+
+		if len(existing) == 0 {
+			return fmt.Errorf("table [%s] is missing on data node shard [%d]", table.TableName, dataNodeShard.DataNodeShardID)
+		}
+
+		columns, err := ctx.Tables().GetColumns(table.TableID)
+		if err != nil {
+			return err
+		}
+
+		for _, column := range columns {
+			if !existing[column.ColumnName] {
+				return fmt.Errorf("column [%s] of table [%s] is missing on data node shard [%d]",
+					column.ColumnName, table.TableName, dataNodeShard.DataNodeShardID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getDataNodeShardColumns returns the names of the columns of the table on a data node shard. If
+// the table does not exist then no columns are returned.
+func getDataNodeShardColumns(db *sql.DB, tableName string) (map[string]bool, error) {
+	rows, err := db.Query(
+		"SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1",
+		tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		name := ""
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// completeDataNodeShardProvision removes the provisioning state for the data node shard and lowers
+// the fence that was blocking the writes sent to every shard. The provisioning state is only
+// removed if no schema definitions were created after the last one that was applied to the data
+// node shard. If there are no other data node shards for the shard still being provisioned then the
+// shard is marked as stable. The target of a shard split stays balancing until the split has
+// finished.
+func (ctx *shardContext) completeDataNodeShardProvision(dataNodeShard DataNodeShard, fence writeFence, definitionId uint64) error {
+	deleteProvisionSql := fmt.Sprintf(`
+		DELETE FROM data_node_shard_provisions
+		WHERE data_node_shard_id = %d
+		AND NOT EXISTS(
+			SELECT 1
+			FROM schema_definitions
+			WHERE definition_id > %d)`,
+		dataNodeShard.DataNodeShardID,
+		definitionId)
+	updateShardSql := fmt.Sprintf(`
+		UPDATE shards SET state = %d
+		WHERE shard_id = %d
+		AND state = %d
+		AND NOT EXISTS(
+			SELECT 1
+			FROM data_node_shard_provisions p
+			INNER JOIN data_node_shards d ON d.data_node_shard_id = p.data_node_shard_id
+			WHERE d.shard_id = %d)
+		AND NOT EXISTS(
+			SELECT 1
+			FROM shard_splits
+			WHERE target_shard_id = %d)`,
+		ShardState_Stable,
+		dataNodeShard.ShardID,
+		ShardState_Balancing,
+		dataNodeShard.ShardID,
+		dataNodeShard.ShardID)
+	response, err := ctx.db.ExecuteEx(&frunk.ExecuteRequest{
+		Queries: []string{deleteProvisionSql, updateShardSql, lowerWriteFenceSql(fence)},
+		Atomic:  true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := executeResponseError(response); err != nil {
+		return err
+	}
+	if len(response.Results) == 0 || response.Results[0].RowsAffected == 0 {
+		return fmt.Errorf("the schema changed while data node shard [%d] was being provisioned, it will be caught up again",
+			dataNodeShard.DataNodeShardID)
+	}
+
+	timber.Infof("provisioned data node shard [%d] for shard [%d]", dataNodeShard.DataNodeShardID, dataNodeShard.ShardID)
+	return nil
+}
+
+// getReplicatedTables returns the tables that have the same rows on every shard, in the order that
+// they were created so that foreign keys can be satisfied when they are copied.
+func (ctx *shardContext) getReplicatedTables() ([]Table, error) {
+	tables := make([]Table, 0)
+	for _, tableType := range []TableType{TableType_Tenant, TableType_Global} {
+		typeTables, err := ctx.Tables().GetTablesByType(tableType)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, typeTables...)
+	}
+
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].TableID < tables[j].TableID
+	})
+
+	return tables, nil
+}
+
+// copyTable copies all of the rows in the table from the source to the target, the table on the
+// target should be empty. Writes to global and tenant tables are not sent to a data node shard
+// while it is being provisioned, so the rows are copied again once those writes are fenced.
+func copyTable(source *sql.DB, target *sql.Tx, tableName string) error {
+	name := pq.QuoteIdentifier(tableName)
+
+	var rows sql.NullString
+	if err := source.QueryRow(fmt.Sprintf(
+		"SELECT json_agg(t) FROM %s t", name)).Scan(&rows); err != nil {
+		return err
+	}
+
+	// The table is empty.
+	if !rows.Valid {
+		return nil
+	}
+
+	_, err := target.Exec(fmt.Sprintf(
+		"INSERT INTO %s SELECT * FROM json_populate_recordset(NULL::%s, $1)",
+		name, name), rows.String)
+	return err
+}
+
+func (ctx *shardContext) getDataNodeShard(dataNodeShardId uint64) (DataNodeShard, error) {
+	dataNodeShards, err := ctx.GetDataNodeShards()
+	if err != nil {
+		return DataNodeShard{}, err
+	}
+
+	for _, dataNodeShard := range dataNodeShards {
+		if dataNodeShard.DataNodeShardID == dataNodeShardId {
+			return dataNodeShard, nil
+		}
+	}
+
+	return DataNodeShard{}, fmt.Errorf("data node shard [%d] does not exist", dataNodeShardId)
+}
+
+func (ctx *shardContext) getDataNodeShardProvisions(dataNodeShardIds ...uint64) ([]DataNodeShardProvision, error) {
+	query := getDataNodeShardProvisionsQuery
+	if len(dataNodeShardIds) > 0 {
+		query = query.Where(goqu.Ex{
+			"data_node_shard_id": dataNodeShardIds,
+		})
+	}
+	compiledSql, _, _ := query.ToSql()
+	response, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.dataNodeShardProvisionsFromRows(response)
+}
+
+func (ctx *shardContext) dataNodeShardProvisionsFromRows(response *frunk.QueryResponse) ([]DataNodeShardProvision, error) {
+	rows := rqliter.NewRqlRows(response)
+	provisions := make([]DataNodeShardProvision, 0)
+	for rows.Next() {
+		provision := DataNodeShardProvision{}
+		if err := rows.Scan(
+			&provision.DataNodeShardID,
+			&provision.State,
+			&provision.Force); err != nil {
+			return nil, err
+		}
+		provisions = append(provisions, provision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return provisions, nil
+}
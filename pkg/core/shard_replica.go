@@ -0,0 +1,825 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/timber"
+	"github.com/lib/pq"
+	"github.com/readystock/goqu"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicaRepairMaxPasses is the number of times we will copy the differences from a healthy
+	// replica before giving up. Writes are still sent to a replica while it is being repaired so
+	// each pass may find a few more rows that need to be copied.
+	replicaRepairMaxPasses = 10
+
+	// replicaCompareAttempts is the number of times a table is compared before a replica is
+	// considered to have diverged. Writes are still being sent to both replicas while they are
+	// compared, so a single comparison may see a write on one replica before it reaches the other.
+	replicaCompareAttempts = 5
+
+	replicaCompareInterval = 200 * time.Millisecond
+)
+
+var (
+	getDivergedDataNodeShardsQuery = goqu.
+		From("diverged_data_node_shards").
+		Select(
+			"data_node_shard_id",
+			"state")
+)
+
+var errBalancingReplicas = errors.New("replicas are already being balanced by another coordinator")
+
+// getReplicationFactor returns the number of data nodes that each shard should be placed on. If
+// replication is disabled then each shard will only be placed on a single data node.
+func (ctx *base) getReplicationFactor() (int, error) {
+	mode, err := ctx.getReplicationMode()
+	if err != nil {
+		return 0, err
+	}
+	if mode == ReplicationModeOptions_None {
+		return 1, nil
+	}
+
+	factor, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_ReplicationFactor)
+	if err != nil {
+		return 0, err
+	}
+	if factorValue, _ := factor.(int64); ok && factorValue > 1 {
+		return int(factorValue), nil
+	}
+	return 1, nil
+}
+
+// BalanceReplicas makes sure that each stable shard has a data node shard on as many data nodes
+// as the replication factor requires. New replicas are copied from one of the shard's existing
+// replicas, or subscribed to the shard's primary when logical replication is enabled. If there are
+// not enough data nodes then the shard is left with fewer replicas. Shards with more replicas than
+// the replication factor have their extra replicas removed, and replicas that do not match the
+// replication mode are converted. Only one coordinator balances the replicas at a time.
+func (ctx *shardContext) BalanceReplicas() error {
+	claim, ok, err := ctx.claimRebalance(balanceReplicasClaim)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errBalancingReplicas
+	}
+	defer claim.release()
+
+	dataNodes := &dataNodeContext{ctx.base}
+
+	moves, err := dataNodes.getDataNodeShardMoves()
+	if err != nil {
+		return err
+	}
+
+	// Finish adding any replicas that were being copied when we were interrupted.
+	for _, move := range moves {
+		if !move.KeepSource {
+			continue
+		}
+
+		if err := dataNodes.moveDataNodeShard(move); err != nil {
+			return err
+		}
+	}
+
+	factor, err := ctx.getReplicationFactor()
+	if err != nil {
+		return err
+	}
+
+	mode, err := ctx.getReplicationMode()
+	if err != nil {
+		return err
+	}
+
+	shards, err := ctx.GetShards()
+	if err != nil {
+		return err
+	}
+
+	busy, err := ctx.getBusyDataNodeShards()
+	if err != nil {
+		return err
+	}
+
+	// Extra replicas are removed before the replicas are converted, that way we do not convert
+	// replicas that are about to be removed.
+	for _, shard := range shards {
+		if shard.State != ShardState_Stable {
+			continue
+		}
+
+		if err := ctx.removeExtraReplicas(shard.ShardID, factor, busy); err != nil {
+			return err
+		}
+	}
+
+	converted, err := ctx.convertReplicas(mode, busy)
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		if shard.State != ShardState_Stable {
+			continue
+		}
+
+		dataNodeShards, err := ctx.GetDataNodeShards()
+		if err != nil {
+			return err
+		}
+
+		replicas := make([]DataNodeShard, 0)
+		for _, dataNodeShard := range dataNodeShards {
+			if dataNodeShard.ShardID == shard.ShardID {
+				replicas = append(replicas, dataNodeShard)
+			}
+		}
+
+		if len(replicas) == 0 || len(replicas) >= factor {
+			continue
+		}
+
+		readable, err := dataNodes.GetReadDataNodeShardIDsForShard(shard.ShardID)
+		if err != nil {
+			return err
+		}
+		if len(readable) == 0 {
+			timber.Warningf("shard [%d] has no healthy replicas to copy from", shard.ShardID)
+			continue
+		}
+
+		source, err := ctx.getDataNodeShard(readable[0])
+		if err != nil {
+			return err
+		}
+
+		for i := len(replicas); i < factor; i++ {
+			if mode == ReplicationModeOptions_Logical {
+				// Logical replicas copy their rows from the primary themselves.
+				if err := ctx.addLogicalReplica(shard.ShardID, dataNodeShards); err != nil {
+					timber.Warningf("shard [%d] has %d of %d replicas, could not add replica: %v",
+						shard.ShardID, i, factor, err)
+					break
+				}
+			} else {
+				move, err := dataNodes.startDataNodeShardMove(source, dataNodeShards, true)
+				if err != nil {
+					timber.Warningf("shard [%d] has %d of %d replicas, could not add replica: %v",
+						shard.ShardID, i, factor, err)
+					break
+				}
+
+				if err := dataNodes.moveDataNodeShard(move); err != nil {
+					return err
+				}
+			}
+
+			if dataNodeShards, err = ctx.GetDataNodeShards(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if converted {
+		// The converted replicas are subscribed to their primary, or have the writes they missed
+		// copied to them, as they are repaired.
+		return ctx.RepairDivergedDataNodeShards()
+	}
+
+	return nil
+}
+
+// getBusyDataNodeShards returns the data node shards that are being provisioned or moved. These
+// are left alone while the replicas are balanced.
+func (ctx *shardContext) getBusyDataNodeShards() (map[uint64]bool, error) {
+	provisions, err := ctx.getDataNodeShardProvisions()
+	if err != nil {
+		return nil, err
+	}
+
+	moves, err := (&dataNodeContext{ctx.base}).getDataNodeShardMoves()
+	if err != nil {
+		return nil, err
+	}
+
+	busy := map[uint64]bool{}
+	for _, provision := range provisions {
+		busy[provision.DataNodeShardID] = true
+	}
+	for _, move := range moves {
+		busy[move.SourceDataNodeShardID] = true
+		busy[move.TargetDataNodeShardID] = true
+	}
+	return busy, nil
+}
+
+// removeExtraReplicas removes replicas of the shard until it only has as many as the replication
+// factor requires. Diverged replicas are removed first, then read only replicas, then the newest
+// replicas. The shard will always keep at least one data node shard that can receive writes.
+// Like a drain the database on the data node is left in place.
+func (ctx *shardContext) removeExtraReplicas(shardId uint64, factor int, busy map[uint64]bool) error {
+	dataNodeShards, err := ctx.GetDataNodeShards()
+	if err != nil {
+		return err
+	}
+
+	divergedDataNodeShards, err := ctx.getDivergedDataNodeShards()
+	if err != nil {
+		return err
+	}
+	diverged := map[uint64]bool{}
+	for _, item := range divergedDataNodeShards {
+		diverged[item.DataNodeShardID] = true
+	}
+
+	replicas, writable := make([]DataNodeShard, 0), 0
+	for _, dataNodeShard := range dataNodeShards {
+		if dataNodeShard.ShardID != shardId {
+			continue
+		}
+		replicas = append(replicas, dataNodeShard)
+		if !dataNodeShard.ReadOnly && !diverged[dataNodeShard.DataNodeShardID] {
+			writable++
+		}
+	}
+
+	if len(replicas) <= factor {
+		return nil
+	}
+
+	sort.Slice(replicas, func(i, j int) bool {
+		left, right := replicas[i], replicas[j]
+		if diverged[left.DataNodeShardID] != diverged[right.DataNodeShardID] {
+			return diverged[left.DataNodeShardID]
+		}
+		if left.ReadOnly != right.ReadOnly {
+			return left.ReadOnly
+		}
+		return left.DataNodeShardID > right.DataNodeShardID
+	})
+
+	remaining := len(replicas)
+	for _, replica := range replicas {
+		if remaining <= factor {
+			break
+		}
+
+		if busy[replica.DataNodeShardID] {
+			continue
+		}
+
+		primary := !replica.ReadOnly && !diverged[replica.DataNodeShardID]
+		if primary && writable <= 1 {
+			continue
+		}
+
+		if err := ctx.removeReplica(replica); err != nil {
+			timber.Warningf("shard [%d] has %d of %d replicas, could not remove data node shard [%d]: %v",
+				shardId, remaining, factor, replica.DataNodeShardID, err)
+			continue
+		}
+
+		remaining--
+		if primary {
+			writable--
+		}
+	}
+
+	return nil
+}
+
+// removeReplica removes the data node shard from the cluster. A read only replica's subscription
+// is dropped first so that its primary stops keeping changes for it.
+func (ctx *shardContext) removeReplica(replica DataNodeShard) error {
+	if replica.ReadOnly {
+		if err := func() error {
+			db, err := ctx.openDataNodeShard(replica)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			return ctx.dropSubscription(db, replica.DataNodeShardID)
+		}(); err != nil {
+			return err
+		}
+	}
+
+	timber.Infof("removing data node shard [%d], shard [%d] has more replicas than it needs", replica.DataNodeShardID, replica.ShardID)
+
+	statements := make([]string, 0, 4)
+	for _, table := range []string{"diverged_data_node_shards", "data_node_shard_provisions", "data_node_shards"} {
+		statements = append(statements, goqu.
+			From(table).
+			Where(goqu.Ex{
+				"data_node_shard_id": replica.DataNodeShardID,
+			}).
+			Delete().Sql)
+	}
+	statements = append(statements, releaseDataNodeShardSql(replica))
+	response, err := ctx.db.ExecuteEx(&frunk.ExecuteRequest{
+		Queries: statements,
+		Atomic:  true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := executeResponseError(response); err != nil {
+		return err
+	}
+
+	// New queries will no longer be sent to the data node shard, but sessions that were already
+	// using it need to finish on every coordinator before the pools are closed.
+	return (&dataNodeContext{ctx.base}).awaitDataNodeShardReleases(replica.DataNodeID)
+}
+
+// convertReplicas changes the existing replicas to match the replication mode. With logical
+// replication each shard has a single primary that receives the writes and the other replicas are
+// read only, otherwise every replica receives the writes. The converted replicas are marked as
+// diverged, repairing them will subscribe them to their primary or copy the writes they missed.
+// True is returned if any replicas were converted.
+func (ctx *shardContext) convertReplicas(mode ReplicationModeOptions, busy map[uint64]bool) (bool, error) {
+	dataNodeShards, err := ctx.GetDataNodeShards()
+	if err != nil {
+		return false, err
+	}
+
+	divergedDataNodeShards, err := ctx.getDivergedDataNodeShards()
+	if err != nil {
+		return false, err
+	}
+	diverged := map[uint64]bool{}
+	for _, item := range divergedDataNodeShards {
+		diverged[item.DataNodeShardID] = true
+	}
+
+	readOnly := mode == ReplicationModeOptions_Logical
+	convert := make([]DataNodeShard, 0)
+	if readOnly {
+		// Each shard keeps one of its writable replicas as the primary, one that has not diverged
+		// is preferred.
+		primaries := map[uint64]DataNodeShard{}
+		for _, dataNodeShard := range dataNodeShards {
+			if dataNodeShard.ReadOnly || busy[dataNodeShard.DataNodeShardID] {
+				continue
+			}
+
+			primary, ok := primaries[dataNodeShard.ShardID]
+			if !ok || (diverged[primary.DataNodeShardID] && !diverged[dataNodeShard.DataNodeShardID]) {
+				primaries[dataNodeShard.ShardID] = dataNodeShard
+			}
+		}
+
+		for _, dataNodeShard := range dataNodeShards {
+			primary, ok := primaries[dataNodeShard.ShardID]
+			if !ok || dataNodeShard.ReadOnly || busy[dataNodeShard.DataNodeShardID] ||
+				dataNodeShard.DataNodeShardID == primary.DataNodeShardID {
+				continue
+			}
+			convert = append(convert, dataNodeShard)
+		}
+	} else {
+		for _, dataNodeShard := range dataNodeShards {
+			if dataNodeShard.ReadOnly && !busy[dataNodeShard.DataNodeShardID] {
+				convert = append(convert, dataNodeShard)
+			}
+		}
+	}
+
+	converted := false
+	for _, replica := range convert {
+		if err := ctx.convertReplica(replica, readOnly); err != nil {
+			timber.Errorf("could not convert data node shard [%d]: %v", replica.DataNodeShardID, err)
+			continue
+		}
+		converted = true
+	}
+
+	return converted, nil
+}
+
+// convertReplica makes the replica read only or writable. The replica is marked as diverged first
+// so that it does not receive any queries until it has been repaired.
+func (ctx *shardContext) convertReplica(replica DataNodeShard, readOnly bool) error {
+	if err := ctx.markDataNodeShardsDiverged(replica.DataNodeShardID); err != nil {
+		return err
+	}
+
+	if !readOnly {
+		// The replica will receive writes directly once it has been repaired, so it must stop
+		// receiving them from its primary.
+		db, err := ctx.openDataNodeShard(replica)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		if err := ctx.dropSubscription(db, replica.DataNodeShardID); err != nil {
+			return err
+		}
+	}
+
+	if readOnly {
+		timber.Infof("converting data node shard [%d] to a read only replica", replica.DataNodeShardID)
+	} else {
+		timber.Infof("converting data node shard [%d] to a writable replica", replica.DataNodeShardID)
+	}
+
+	compiledSql := goqu.
+		From("data_node_shards").
+		Where(goqu.Ex{
+			"data_node_shard_id": replica.DataNodeShardID,
+		}).
+		Update(goqu.Record{
+			"read_only": readOnly,
+		}).Sql
+	_, err := ctx.db.Exec(compiledSql)
+	return err
+}
+
+// VerifyReplicas compares the suspected data node shards against a data node shard that is known
+// to be healthy. This is used when a write succeeded on some replicas but failed on others. The
+// global tables are compared for every data node shard, the sharded tables are only compared when
+// both data node shards are replicas of the same shard. Any data node shard that does not match
+// is marked as diverged and will not be read from until it has been repaired. The IDs of the data
+// node shards that diverged are returned.
+func (ctx *shardContext) VerifyReplicas(healthyDataNodeShardId uint64, suspectDataNodeShardIds ...uint64) ([]uint64, error) {
+	healthy, err := ctx.getDataNodeShard(healthyDataNodeShardId)
+	if err != nil {
+		return nil, err
+	}
+
+	replicatedTables, err := ctx.getReplicatedTables()
+	if err != nil {
+		return nil, err
+	}
+
+	shardedTables, err := ctx.Tables().GetTablesByType(TableType_Sharded)
+	if err != nil {
+		return nil, err
+	}
+
+	healthyDb, err := ctx.openDataNodeShard(healthy)
+	if err != nil {
+		return nil, err
+	}
+	defer healthyDb.Close()
+
+	diverged := make([]uint64, 0)
+	for _, suspectId := range suspectDataNodeShardIds {
+		if suspectId == healthyDataNodeShardId {
+			continue
+		}
+
+		matches, err := func() (bool, error) {
+			suspect, err := ctx.getDataNodeShard(suspectId)
+			if err != nil {
+				return false, err
+			}
+
+			tables := replicatedTables
+			if suspect.ShardID == healthy.ShardID {
+				tables = append(append(make([]Table, 0), replicatedTables...), shardedTables...)
+			}
+
+			suspectDb, err := ctx.openDataNodeShard(suspect)
+			if err != nil {
+				return false, err
+			}
+			defer suspectDb.Close()
+
+			for _, table := range tables {
+				matches, err := compareTable(healthyDb, suspectDb, table.TableName)
+				if err != nil || !matches {
+					return false, err
+				}
+			}
+			return true, nil
+		}()
+		if err != nil {
+			// If we cannot read from the replica then we cannot be sure it has the write.
+			timber.Errorf("could not verify data node shard [%d]: %v", suspectId, err)
+		}
+		if !matches {
+			diverged = append(diverged, suspectId)
+		}
+	}
+
+	if len(diverged) == 0 {
+		return diverged, nil
+	}
+
+	for _, id := range diverged {
+		timber.Warningf("data node shard [%d] has diverged from data node shard [%d]", id, healthyDataNodeShardId)
+	}
+
+	if err := ctx.markDataNodeShardsDiverged(diverged...); err != nil {
+		return nil, err
+	}
+
+	if ctx.IsLeader() {
+		go func() {
+			if err := ctx.RepairDivergedDataNodeShards(); err != nil {
+				timber.Errorf("could not repair diverged data node shards: %v", err)
+			}
+		}()
+	}
+
+	return diverged, nil
+}
+
+// GetDivergedDataNodeShards returns the data node shards that are not in sync with the other
+// replicas of their shard.
+func (ctx *shardContext) GetDivergedDataNodeShards() ([]DivergedDataNodeShard, error) {
+	return ctx.getDivergedDataNodeShards()
+}
+
+// RepairDivergedDataNodeShards copies the differences from a healthy replica to each diverged
+// data node shard. Once a data node shard matches the healthy replica it can be read from again.
+// Only one repair will run at a time.
+func (ctx *shardContext) RepairDivergedDataNodeShards() error {
+	if !atomic.CompareAndSwapInt32(&ctx.repairing, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&ctx.repairing, 0)
+
+	divergedDataNodeShards, err := ctx.getDivergedDataNodeShards()
+	if err != nil {
+		return err
+	}
+
+	for _, diverged := range divergedDataNodeShards {
+		if err := ctx.repairDataNodeShard(diverged); err != nil {
+			timber.Errorf("could not repair data node shard [%d]: %v", diverged.DataNodeShardID, err)
+		}
+	}
+
+	return nil
+}
+
+func (ctx *shardContext) repairDataNodeShard(diverged DivergedDataNodeShard) error {
+	replica, err := ctx.getDataNodeShard(diverged.DataNodeShardID)
+	if err != nil {
+		return err
+	}
+
+	dataNode, err := ctx.DataNodes().GetDataNode(replica.DataNodeID)
+	if err != nil {
+		return err
+	}
+	if !dataNode.Healthy {
+		timber.Debugf("data node shard [%d] cannot be repaired until data node [%d] is healthy", replica.DataNodeShardID, dataNode.DataNodeID)
+		return nil
+	}
+
+	if diverged.State == ReplicaState_Diverged {
+		// The replica needs to receive writes while it is being repaired, otherwise it would
+		// never catch up with the other replicas.
+		diverged.State = ReplicaState_Repairing
+		compiledSql := goqu.
+			From("diverged_data_node_shards").
+			Where(goqu.Ex{
+				"data_node_shard_id": diverged.DataNodeShardID,
+			}).
+			Update(goqu.Record{
+				"state": diverged.State,
+			}).Sql
+		if _, err := ctx.db.Exec(compiledSql); err != nil {
+			return err
+		}
+	}
+
+	if replica.ReadOnly {
+		if err := ctx.resubscribeDataNodeShard(replica); err != nil {
+			return err
+		}
+		return ctx.completeDataNodeShardRepair(replica)
+	}
+
+	// The replicated tables are copied first so that foreign keys can be satisfied.
+	tables, err := ctx.getReplicatedTables()
+	if err != nil {
+		return err
+	}
+
+	sourceId := uint64(0)
+	readable, err := (&dataNodeContext{ctx.base}).GetReadDataNodeShardIDsForShard(replica.ShardID)
+	if err != nil {
+		return err
+	}
+	if len(readable) > 0 {
+		sourceId = readable[0]
+		shardedTables, err := ctx.Tables().GetTablesByType(TableType_Sharded)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, shardedTables...)
+	} else {
+		// If this is the only copy of the shard then its sharded rows can't have diverged, but it
+		// may have missed writes to the replicated tables.
+		if sourceId, err = ctx.DataNodes().GetRandomDataNodeShardID(); err != nil {
+			return err
+		}
+		if sourceId == 0 {
+			return fmt.Errorf("there are no healthy data node shards to repair data node shard [%d] from", replica.DataNodeShardID)
+		}
+	}
+
+	source, err := ctx.getDataNodeShard(sourceId)
+	if err != nil {
+		return err
+	}
+
+	syncTables, err := ctx.getSyncTables(tables)
+	if err != nil {
+		return err
+	}
+
+	sourceDb, err := ctx.openDataNodeShard(source)
+	if err != nil {
+		return err
+	}
+	defer sourceDb.Close()
+
+	replicaDb, err := ctx.openDataNodeShard(replica)
+	if err != nil {
+		return err
+	}
+	defer replicaDb.Close()
+
+	timber.Infof("repairing data node shard [%d] from data node shard [%d]", replica.DataNodeShardID, source.DataNodeShardID)
+	for pass := 0; pass < replicaRepairMaxPasses; pass++ {
+		changed := false
+		for _, table := range syncTables {
+			tableChanged, err := syncTableRows(sourceDb, replicaDb, table, "TRUE")
+			if err != nil {
+				return fmt.Errorf("could not repair table [%s]: %v", table.name, err)
+			}
+			changed = changed || tableChanged
+		}
+
+		if !changed {
+			return ctx.completeDataNodeShardRepair(replica)
+		}
+	}
+
+	return fmt.Errorf("data node shard [%d] was still changing after %d passes", diverged.DataNodeShardID, replicaRepairMaxPasses)
+}
+
+// resubscribeDataNodeShard rebuilds a read only replica that was following a primary that has
+// been replaced. All of its rows are removed and it is subscribed to the shard's current primary,
+// which copies all of the primary's rows again.
+func (ctx *shardContext) resubscribeDataNodeShard(replica DataNodeShard) error {
+	tables, err := ctx.Tables().GetTables()
+	if err != nil {
+		return err
+	}
+
+	db, err := ctx.openDataNodeShard(replica)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	timber.Infof("resubscribing data node shard [%d] to the primary of shard [%d]", replica.DataNodeShardID, replica.ShardID)
+
+	// The primary the replica was following may not be reachable.
+	if err := ctx.detachSubscription(db, replica.DataNodeShardID); err != nil {
+		return err
+	}
+
+	// If this data node shard used to be the primary then its publication and any replication
+	// slots that other replicas were using are no longer needed.
+	if _, err := db.Exec(fmt.Sprintf("DROP PUBLICATION IF EXISTS %s",
+		pq.QuoteIdentifier(publicationName(replica.DataNodeShardID)))); err != nil {
+		return err
+	}
+	if _, err := db.Exec(
+		"SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE database = current_database() AND NOT active",
+	); err != nil {
+		return err
+	}
+
+	if len(tables) > 0 {
+		names := make([]string, len(tables))
+		for i, table := range tables {
+			names[i] = pq.QuoteIdentifier(table.TableName)
+		}
+		if _, err := db.Exec(fmt.Sprintf("TRUNCATE %s CASCADE", strings.Join(names, ", "))); err != nil {
+			return err
+		}
+	}
+
+	return ctx.subscribeDataNodeShard(replica)
+}
+
+// completeDataNodeShardRepair allows the data node shard to be read from again.
+func (ctx *shardContext) completeDataNodeShardRepair(replica DataNodeShard) error {
+	compiledSql := goqu.
+		From("diverged_data_node_shards").
+		Where(goqu.Ex{
+			"data_node_shard_id": replica.DataNodeShardID,
+		}).
+		Delete().Sql
+	if _, err := ctx.db.Exec(compiledSql); err != nil {
+		return err
+	}
+
+	timber.Infof("repaired data node shard [%d]", replica.DataNodeShardID)
+	return ctx.updateShardAvailability()
+}
+
+// tableChecksum is the number of rows in a table and a hash of all of them.
+type tableChecksum struct {
+	count int64
+	hash  string
+}
+
+// compareTable returns true if the table has the same rows in both databases. The right side is
+// checksummed between two checksums of the left side, if it matches either of them then a write
+// that was running at the same time cannot be mistaken for a difference. The table is compared a
+// few times before false is returned, this gives writes that have only reached one of the
+// databases time to reach the other.
+func compareTable(left, right *sql.DB, tableName string) (bool, error) {
+	query := fmt.Sprintf(
+		"SELECT count(*), coalesce(md5(string_agg(md5(t::text), '' ORDER BY md5(t::text))), '') FROM %s t",
+		pq.QuoteIdentifier(tableName))
+	checksum := func(db *sql.DB) (tableChecksum, error) {
+		sum := tableChecksum{}
+		err := db.QueryRow(query).Scan(&sum.count, &sum.hash)
+		return sum, err
+	}
+
+	for attempt := 0; attempt < replicaCompareAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(replicaCompareInterval)
+		}
+
+		before, err := checksum(left)
+		if err != nil {
+			return false, err
+		}
+
+		other, err := checksum(right)
+		if err != nil {
+			return false, err
+		}
+
+		after, err := checksum(left)
+		if err != nil {
+			return false, err
+		}
+
+		if other == before || other == after {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (ctx *shardContext) getDivergedDataNodeShards(dataNodeShardIds ...uint64) ([]DivergedDataNodeShard, error) {
+	query := getDivergedDataNodeShardsQuery
+	if len(dataNodeShardIds) > 0 {
+		query = query.Where(goqu.Ex{
+			"data_node_shard_id": dataNodeShardIds,
+		})
+	}
+	compiledSql, _, _ := query.ToSql()
+	response, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.divergedDataNodeShardsFromRows(response)
+}
+
+func (ctx *shardContext) divergedDataNodeShardsFromRows(response *frunk.QueryResponse) ([]DivergedDataNodeShard, error) {
+	rows := rqliter.NewRqlRows(response)
+	divergedDataNodeShards := make([]DivergedDataNodeShard, 0)
+	for rows.Next() {
+		diverged := DivergedDataNodeShard{}
+		if err := rows.Scan(
+			&diverged.DataNodeShardID,
+			&diverged.State); err != nil {
+			return nil, err
+		}
+		divergedDataNodeShards = append(divergedDataNodeShards, diverged)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return divergedDataNodeShards, nil
+}
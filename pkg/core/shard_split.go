@@ -0,0 +1,418 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/timber"
+	"github.com/lib/pq"
+	"github.com/readystock/goqu"
+	"sort"
+)
+
+var (
+	getShardSplitsQuery = goqu.
+		From("shard_splits").
+		Select(
+			"source_shard_id",
+			"target_shard_id")
+)
+
+// tenantWeight is used to decide which tenants should be moved when a shard is split.
+type tenantWeight struct {
+	tenantId uint64
+	weight   int64
+}
+
+// SplitShard creates a new shard and moves roughly half of the source shard's data to it. Tenants
+// are weighed by the number of rows they have in sharded tables. While the split is in progress
+// both shards are marked as balancing so that new tenants are not placed on them. If the shard is
+// already being split then that split is resumed.
+func (ctx *shardContext) SplitShard(shardId uint64) (ShardSplit, error) {
+	// The split is claimed before anything else so that the leader resuming splits and another
+	// coordinator running noah.split_shard can't split the same shard at the same time.
+	claim, ok, err := ctx.claimRebalance(shardSplitClaim(shardId))
+	if err != nil {
+		return ShardSplit{}, err
+	}
+	if !ok {
+		return ShardSplit{}, fmt.Errorf("shard [%d] is already being split by another coordinator", shardId)
+	}
+	defer claim.release()
+
+	splits, err := ctx.getShardSplits(shardId)
+	if err != nil {
+		return ShardSplit{}, err
+	}
+
+	if len(splits) > 0 {
+		return splits[0], ctx.splitShard(claim, splits[0])
+	}
+
+	shards, err := ctx.GetShards()
+	if err != nil {
+		return ShardSplit{}, err
+	}
+
+	sourceIsStable := false
+	for _, shard := range shards {
+		if shard.ShardID == shardId {
+			sourceIsStable = shard.State == ShardState_Stable
+			break
+		}
+	}
+	if !sourceIsStable {
+		return ShardSplit{}, fmt.Errorf("shard [%d] does not exist or is not stable", shardId)
+	}
+
+	tenants, err := ctx.getShardTenants(shardId)
+	if err != nil {
+		return ShardSplit{}, err
+	}
+	if len(tenants) < 2 {
+		return ShardSplit{}, fmt.Errorf("shard [%d] needs at least 2 tenants to be split", shardId)
+	}
+
+	targetShardId, err := ctx.db.NextSequenceValueById(shardIdSequencePath)
+	if err != nil {
+		return ShardSplit{}, err
+	}
+
+	split := ShardSplit{
+		SourceShardID: shardId,
+		TargetShardID: targetShardId,
+	}
+
+	// The target shard is created along with the split, that way there is never a shard that
+	// does not belong to a split if we are interrupted. It starts out balancing so that new
+	// tenants are not placed on it while it is being provisioned or split.
+	insertShardSql := goqu.
+		From("shards").
+		Insert(goqu.Record{
+			"shard_id": split.TargetShardID,
+			"state":    ShardState_Balancing,
+		}).Sql
+	insertSplitSql := goqu.
+		From("shard_splits").
+		Insert(goqu.Record{
+			"source_shard_id": split.SourceShardID,
+			"target_shard_id": split.TargetShardID,
+		}).Sql
+	response, err := ctx.db.ExecuteEx(&frunk.ExecuteRequest{
+		Queries: []string{
+			insertShardSql,
+			insertSplitSql,
+			ctx.updateShardStateSql(ShardState_Balancing, split.SourceShardID),
+		},
+		Atomic: true,
+	})
+	if err != nil {
+		return ShardSplit{}, err
+	}
+	if err := executeResponseError(response); err != nil {
+		return ShardSplit{}, err
+	}
+
+	return split, ctx.splitShard(claim, split)
+}
+
+// GetShardSplits returns all of the shard splits that have not finished yet.
+func (ctx *shardContext) GetShardSplits() ([]ShardSplit, error) {
+	return ctx.getShardSplits()
+}
+
+// ResumeShardSplits will continue any shard splits that were interrupted, like when the leader of
+// the cluster changes in the middle of a split.
+func (ctx *shardContext) ResumeShardSplits() error {
+	splits, err := ctx.getShardSplits()
+	if err != nil {
+		return err
+	}
+
+	for _, split := range splits {
+		claim, ok, err := ctx.claimRebalance(shardSplitClaim(split.SourceShardID))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			timber.Debugf("shard [%d] is being split by another coordinator", split.SourceShardID)
+			continue
+		}
+
+		timber.Infof("resuming split of shard [%d] into shard [%d]", split.SourceShardID, split.TargetShardID)
+		err = ctx.splitShard(claim, split)
+		claim.release()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shardSplitClaim is the key of the claim that is held while a shard is being split.
+func shardSplitClaim(shardId uint64) string {
+	return fmt.Sprintf("shard_split:%d", shardId)
+}
+
+func (ctx *shardContext) splitShard(claim *rebalanceClaim, split ShardSplit) error {
+	// The target shard will not have a data node shard if we were interrupted before it could be
+	// provisioned. Shards that have already been provisioned are ignored.
+	if err := ctx.BalanceOrphanShards(); err != nil {
+		return err
+	}
+
+	targets, err := ctx.GetWriteDataNodeShards(split.TargetShardID)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("shard [%d] could not be provisioned", split.TargetShardID)
+	}
+
+	for _, target := range targets {
+		provisions, err := ctx.getDataNodeShardProvisions(target.DataNodeShardID)
+		if err != nil {
+			return err
+		}
+		if len(provisions) > 0 {
+			return fmt.Errorf("data node shard [%d] for shard [%d] has not finished provisioning",
+				target.DataNodeShardID, split.TargetShardID)
+		}
+	}
+
+	tenants := &tenantContext{ctx.base}
+
+	// Finish any tenant moves that were interrupted before we decide what else needs to move.
+	moves, err := tenants.GetTenantMoves()
+	if err != nil {
+		return err
+	}
+	for _, move := range moves {
+		if move.SourceShardID != split.SourceShardID || move.TargetShardID != split.TargetShardID {
+			continue
+		}
+		if err := tenants.moveTenantToShard(move.TenantID, move.TargetShardID, ShardState_Balancing); err != nil {
+			return err
+		}
+	}
+
+	tenantIds, err := ctx.getTenantsToSplit(split)
+	if err != nil {
+		return err
+	}
+
+	for _, tenantId := range tenantIds {
+		timber.Debugf("moving tenant [%d] to shard [%d] for split", tenantId, split.TargetShardID)
+		if err := tenants.moveTenantToShard(tenantId, split.TargetShardID, ShardState_Balancing); err != nil {
+			return err
+		}
+	}
+
+	// The split is only finished if we still hold the claim, otherwise another coordinator has
+	// taken over the split.
+	deleteSplitSql := goqu.
+		From("shard_splits").
+		Where(goqu.Ex{
+			"source_shard_id": split.SourceShardID,
+		}).
+		Delete().Sql
+	response, err := ctx.db.ExecuteEx(&frunk.ExecuteRequest{
+		Queries: []string{
+			fmt.Sprintf("%s AND %s", deleteSplitSql, claim.guard()),
+			fmt.Sprintf("%s AND %s",
+				ctx.updateShardStateSql(ShardState_Stable, split.SourceShardID, split.TargetShardID), claim.guard()),
+		},
+		Atomic: true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := executeResponseError(response); err != nil {
+		return err
+	}
+	if len(response.Results) == 0 || response.Results[0].RowsAffected == 0 {
+		return fmt.Errorf("split of shard [%d] could not be finished, the split was claimed by another coordinator", split.SourceShardID)
+	}
+
+	timber.Infof("split shard [%d] into shard [%d], moved %d tenant(s)",
+		split.SourceShardID, split.TargetShardID, len(tenantIds))
+	return nil
+}
+
+// getTenantsToSplit returns the tenants on the source shard that should be moved so that the
+// source and the target shard each hold about half of the data. Tenants that were already moved to
+// the target are included in the target's half, so the result is the same when a split is resumed.
+func (ctx *shardContext) getTenantsToSplit(split ShardSplit) ([]uint64, error) {
+	tables, err := (&tenantContext{ctx.base}).getTenantMoveTables()
+	if err != nil {
+		return nil, err
+	}
+
+	sourceWeights, err := ctx.getTenantWeights(split.SourceShardID, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	targetWeights, err := ctx.getTenantWeights(split.TargetShardID, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	total, targetTotal := int64(0), int64(0)
+	for _, tenant := range sourceWeights {
+		total += tenant.weight
+	}
+	for _, tenant := range targetWeights {
+		total += tenant.weight
+		targetTotal += tenant.weight
+	}
+
+	// Place the heaviest tenants first, any tenant that would push the target past half of the
+	// data stays on the source shard.
+	sort.Slice(sourceWeights, func(i, j int) bool {
+		if sourceWeights[i].weight == sourceWeights[j].weight {
+			return sourceWeights[i].tenantId < sourceWeights[j].tenantId
+		}
+		return sourceWeights[i].weight > sourceWeights[j].weight
+	})
+
+	half := total / 2
+	tenantIds := make([]uint64, 0)
+	for _, tenant := range sourceWeights {
+		if targetTotal+tenant.weight > half {
+			continue
+		}
+		targetTotal += tenant.weight
+		tenantIds = append(tenantIds, tenant.tenantId)
+	}
+
+	return tenantIds, nil
+}
+
+// getTenantWeights returns the weight of each tenant on the provided shard. The weight is the
+// number of rows the tenant has in all of the sharded tables plus one, so that tenants without
+// any data are still spread between the shards.
+func (ctx *shardContext) getTenantWeights(shardId uint64, tables []tenantMoveTable) ([]tenantWeight, error) {
+	tenants, err := ctx.getShardTenants(shardId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tenants) == 0 {
+		return []tenantWeight{}, nil
+	}
+
+	rowCounts := map[uint64]int64{}
+	if len(tables) > 0 {
+		dataNodeShards, err := ctx.GetWriteDataNodeShards(shardId)
+		if err != nil {
+			return nil, err
+		}
+		if len(dataNodeShards) == 0 {
+			return nil, fmt.Errorf("no writable data node shards for shard [%d]", shardId)
+		}
+
+		db, err := ctx.openDataNodeShard(dataNodeShards[0])
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		for _, table := range tables {
+			if err := getTenantRowCounts(db, table, rowCounts); err != nil {
+				return nil, fmt.Errorf("could not count rows in table [%s] on shard [%d]: %v", table.name, shardId, err)
+			}
+		}
+	}
+
+	weights := make([]tenantWeight, len(tenants))
+	for i, tenant := range tenants {
+		weights[i] = tenantWeight{
+			tenantId: tenant.TenantID,
+			weight:   rowCounts[tenant.TenantID] + 1,
+		}
+	}
+
+	return weights, nil
+}
+
+// getTenantRowCounts adds the number of rows each tenant has in the provided table to rowCounts.
+func getTenantRowCounts(db *sql.DB, table tenantMoveTable, rowCounts map[uint64]int64) error {
+	rows, err := db.Query(fmt.Sprintf(
+		"SELECT %s, count(*) FROM %s GROUP BY %s",
+		pq.QuoteIdentifier(table.shardKey),
+		pq.QuoteIdentifier(table.name),
+		pq.QuoteIdentifier(table.shardKey)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tenantId, rowCount := uint64(0), int64(0)
+		if err := rows.Scan(&tenantId, &rowCount); err != nil {
+			return err
+		}
+		rowCounts[tenantId] += rowCount
+	}
+	return rows.Err()
+}
+
+func (ctx *shardContext) getShardTenants(shardId uint64) ([]Tenant, error) {
+	compiledSql, _, _ := getTenantsQuery.
+		Where(goqu.Ex{
+			"shard_id": shardId,
+		}).
+		ToSql()
+	response, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+	return (&tenantContext{ctx.base}).tenantsFromRows(response)
+}
+
+func (ctx *shardContext) updateShardStateSql(state ShardState, shardIds ...uint64) string {
+	return goqu.
+		From("shards").
+		Where(goqu.Ex{
+			"shard_id": shardIds,
+		}).
+		Update(goqu.Record{
+			"state": state,
+		}).Sql
+}
+
+func (ctx *shardContext) getShardSplits(sourceShardIds ...uint64) ([]ShardSplit, error) {
+	query := getShardSplitsQuery
+	if len(sourceShardIds) > 0 {
+		query = query.Where(goqu.Ex{
+			"source_shard_id": sourceShardIds,
+		})
+	}
+	compiledSql, _, _ := query.ToSql()
+	response, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.shardSplitsFromRows(response)
+}
+
+func (ctx *shardContext) shardSplitsFromRows(response *frunk.QueryResponse) ([]ShardSplit, error) {
+	rows := rqliter.NewRqlRows(response)
+	splits := make([]ShardSplit, 0)
+	for rows.Next() {
+		split := ShardSplit{}
+		if err := rows.Scan(
+			&split.SourceShardID,
+			&split.TargetShardID); err != nil {
+			return nil, err
+		}
+		splits = append(splits, split)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return splits, nil
+}
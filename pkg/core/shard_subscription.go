@@ -0,0 +1,467 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/timber"
+	"github.com/lib/pq"
+	"github.com/readystock/goqu"
+	"strings"
+	"time"
+)
+
+const (
+	// replicationMonitorInterval is how often the lag of each read only replica is measured.
+	replicationMonitorInterval = 5 * time.Second
+
+	// subscriptionSyncTimeout is how long we will wait for a new subscription to copy the
+	// existing rows from the primary before provisioning is retried.
+	subscriptionSyncTimeout = 10 * time.Minute
+
+	subscriptionSyncInterval = 500 * time.Millisecond
+
+	// defaultMaxReplicationLag is used when the max_replication_lag setting is missing.
+	defaultMaxReplicationLag = 16 * 1024 * 1024
+)
+
+// publicationName is the name of the publication that is created on a shard's primary.
+func publicationName(dataNodeShardId uint64) string {
+	return fmt.Sprintf("noahdb_publication_%d", dataNodeShardId)
+}
+
+// subscriptionName is the name of the subscription that is created on a read only replica. It is
+// also used as the application name of the replica's connection to the primary.
+func subscriptionName(dataNodeShardId uint64) string {
+	return fmt.Sprintf("noahdb_subscription_%d", dataNodeShardId)
+}
+
+// getReplicationMode returns how writes are copied to each of a shard's replicas.
+func (ctx *base) getReplicationMode() (ReplicationModeOptions, error) {
+	mode, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_ReplicationMode)
+	if err != nil || !ok {
+		return ReplicationModeOptions_None, err
+	}
+	modeValue, _ := mode.(int64)
+	return ReplicationModeOptions(modeValue), nil
+}
+
+// RefreshSubscriptions makes sure that each read only replica is receiving changes for all of
+// the tables that exist on its primary. This needs to happen after tables are created.
+func (ctx *shardContext) RefreshSubscriptions() error {
+	mode, err := ctx.getReplicationMode()
+	if err != nil || mode != ReplicationModeOptions_Logical {
+		return err
+	}
+
+	dataNodeShards, err := ctx.GetDataNodeShards()
+	if err != nil {
+		return err
+	}
+
+	provisions, err := ctx.getDataNodeShardProvisions()
+	if err != nil {
+		return err
+	}
+	provisioning := map[uint64]bool{}
+	for _, provision := range provisions {
+		provisioning[provision.DataNodeShardID] = true
+	}
+
+	for _, dataNodeShard := range dataNodeShards {
+		if !dataNodeShard.ReadOnly || provisioning[dataNodeShard.DataNodeShardID] {
+			continue
+		}
+
+		if err := func() error {
+			db, err := ctx.openDataNodeShard(dataNodeShard)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			_, err = db.Exec(fmt.Sprintf("ALTER SUBSCRIPTION %s REFRESH PUBLICATION",
+				pq.QuoteIdentifier(subscriptionName(dataNodeShard.DataNodeShardID))))
+			return err
+		}(); err != nil {
+			timber.Errorf("could not refresh subscription for data node shard [%d]: %v", dataNodeShard.DataNodeShardID, err)
+		}
+	}
+
+	return nil
+}
+
+// addLogicalReplica creates a new read only replica of the shard on the data node with the fewest
+// shards and provisions it. The replica's rows are copied by its subscription to the primary.
+func (ctx *shardContext) addLogicalReplica(shardId uint64, dataNodeShards []DataNodeShard) error {
+	dataNodeId, err := (&dataNodeContext{ctx.base}).getDataNodeForReplica(shardId, dataNodeShards)
+	if err != nil {
+		return err
+	}
+
+	if dataNodeId == 0 {
+		return fmt.Errorf("there are no data nodes available for a replica of shard [%d]", shardId)
+	}
+
+	id, err := ctx.db.NextSequenceValueById(dataNodeShardIdSequencePath)
+	if err != nil {
+		return err
+	}
+
+	timber.Debugf("adding replica of shard [%d] on data node [%d] as data node shard [%d]", shardId, dataNodeId, id)
+
+	provision := DataNodeShardProvision{
+		DataNodeShardID: id,
+		State:           ProvisionState_Creating,
+		Force:           false,
+	}
+
+	newDataNodeShard := goqu.
+		From("data_node_shards").
+		Insert(goqu.Record{
+			"data_node_shard_id": id,
+			"data_node_id":       dataNodeId,
+			"shard_id":           shardId,
+			"read_only":          true,
+		}).Sql
+	newProvision := goqu.
+		From("data_node_shard_provisions").
+		Insert(goqu.Record{
+			"data_node_shard_id": provision.DataNodeShardID,
+			"state":              provision.State,
+			"force":              provision.Force,
+		}).Sql
+	if _, err := ctx.db.Exec(strings.Join([]string{newDataNodeShard, newProvision}, ";")); err != nil {
+		return err
+	}
+
+	return ctx.provisionDataNodeShard(provision)
+}
+
+// subscribeDataNodeShard subscribes a read only replica to the publication on its shard's
+// primary, the publication is created if it does not exist yet. This will wait for the
+// subscription to finish copying the rows that already exist on the primary.
+func (ctx *shardContext) subscribeDataNodeShard(replica DataNodeShard) error {
+	primary, err := ctx.getPrimaryDataNodeShard(replica.ShardID)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.createPublication(primary); err != nil {
+		return err
+	}
+
+	primaryNode, err := ctx.DataNodes().GetDataNode(primary.DataNodeID)
+	if err != nil {
+		return err
+	}
+
+	db, err := ctx.openDataNodeShard(replica)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	name := subscriptionName(replica.DataNodeShardID)
+	subscribed := false
+	if err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM pg_subscription WHERE subname = $1)", name,
+	).Scan(&subscribed); err != nil {
+		return err
+	}
+
+	if !subscribed {
+		// The root certificate is a path on the coordinators, so the replica cannot verify the
+		// primary's certificate. It still uses TLS if the primary requires it.
+		sslMode := SSLModeRequire
+		if dataNodeSSLMode(primaryNode) == SSLModeDisable {
+			sslMode = SSLModeDisable
+		}
+
+		connInfo := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=%s",
+			connInfoValue(primaryNode.GetAddress()),
+			primaryNode.GetPort(),
+			connInfoValue(dataNodeShardDatabaseName(primary.DataNodeShardID)),
+			connInfoValue(primaryNode.GetUser()),
+			connInfoValue(primaryNode.GetPassword()),
+			connInfoValue(sslMode))
+
+		timber.Debugf("subscribing data node shard [%d] to data node shard [%d]", replica.DataNodeShardID, primary.DataNodeShardID)
+		if _, err := db.Exec(fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s",
+			pq.QuoteIdentifier(name),
+			pq.QuoteLiteral(connInfo),
+			pq.QuoteIdentifier(publicationName(primary.DataNodeShardID)))); err != nil {
+			return err
+		}
+	}
+
+	// The replica should not be read from until it has all of the primary's rows.
+	deadline := time.Now().Add(subscriptionSyncTimeout)
+	for {
+		syncing := 0
+		if err := db.QueryRow(`
+			SELECT count(*)
+			FROM pg_subscription_rel r
+			INNER JOIN pg_subscription s ON s.oid = r.srsubid
+			WHERE s.subname = $1 AND r.srsubstate NOT IN ('r', 's')`, name,
+		).Scan(&syncing); err != nil {
+			return err
+		}
+
+		if syncing == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("data node shard [%d] is still copying %d table(s) from its primary", replica.DataNodeShardID, syncing)
+		}
+
+		time.Sleep(subscriptionSyncInterval)
+	}
+}
+
+// createPublication creates a publication of all of the tables on the shard's primary.
+func (ctx *shardContext) createPublication(primary DataNodeShard) error {
+	db, err := ctx.openDataNodeShard(primary)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	name := publicationName(primary.DataNodeShardID)
+	published := false
+	if err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM pg_publication WHERE pubname = $1)", name,
+	).Scan(&published); err != nil {
+		return err
+	}
+
+	if published {
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES", pq.QuoteIdentifier(name)))
+	return err
+}
+
+// dropSubscription removes a read only replica's subscription, this also removes the replication
+// slot on the primary.
+func (ctx *shardContext) dropSubscription(db *sql.DB, dataNodeShardId uint64) error {
+	name := subscriptionName(dataNodeShardId)
+	subscribed := false
+	if err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM pg_subscription WHERE subname = $1)", name,
+	).Scan(&subscribed); err != nil {
+		return err
+	}
+
+	if !subscribed {
+		return nil
+	}
+
+	_, err := db.Exec(fmt.Sprintf("DROP SUBSCRIPTION %s", pq.QuoteIdentifier(name)))
+	return err
+}
+
+// getPrimaryDataNodeShard returns the data node shard that receives the writes for the shard.
+func (ctx *shardContext) getPrimaryDataNodeShard(shardId uint64) (DataNodeShard, error) {
+	primaries, err := ctx.GetWriteDataNodeShards(shardId)
+	if err != nil {
+		return DataNodeShard{}, err
+	}
+
+	if len(primaries) == 0 {
+		return DataNodeShard{}, fmt.Errorf("shard [%d] does not have a primary", shardId)
+	}
+
+	provisions, err := ctx.getDataNodeShardProvisions(primaries[0].DataNodeShardID)
+	if err != nil {
+		return DataNodeShard{}, err
+	}
+
+	if len(provisions) > 0 {
+		return DataNodeShard{}, fmt.Errorf("the primary for shard [%d] has not been provisioned yet", shardId)
+	}
+
+	return primaries[0], nil
+}
+
+// monitorReplication periodically measures how far behind their primary each read only replica is
+// while this coordinator is the leader. The replicas that are caught up are stored so that every
+// coordinator routes its reads the same way.
+func (ctx *base) monitorReplication() {
+	for {
+		time.Sleep(replicationMonitorInterval)
+		if !ctx.IsLeader() {
+			continue
+		}
+
+		if err := ctx.updateReplicationLag(); err != nil {
+			timber.Errorf("could not measure replication lag: %v", err)
+		}
+	}
+}
+
+func (ctx *base) updateReplicationLag() error {
+	mode, err := ctx.getReplicationMode()
+	if err != nil {
+		return err
+	}
+
+	caughtUp := map[uint64]bool{}
+	if mode != ReplicationModeOptions_Logical {
+		// Without logical replication there are no read only replicas to read from.
+		return ctx.storeCaughtUpReplicas(caughtUp)
+	}
+
+	// New tables are not replicated until the subscriptions have been refreshed.
+	shards := &shardContext{ctx}
+	if err := shards.RefreshSubscriptions(); err != nil {
+		timber.Errorf("could not refresh subscriptions: %v", err)
+	}
+
+	maxLag := int64(defaultMaxReplicationLag)
+	if value, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_MaxReplicationLag); err != nil {
+		return err
+	} else if ok {
+		maxLag, _ = value.(int64)
+	}
+
+	dataNodeShards, err := shards.GetDataNodeShards()
+	if err != nil {
+		return err
+	}
+
+	replicas := map[uint64][]uint64{}
+	for _, dataNodeShard := range dataNodeShards {
+		if dataNodeShard.ReadOnly {
+			replicas[dataNodeShard.ShardID] = append(replicas[dataNodeShard.ShardID], dataNodeShard.DataNodeShardID)
+		}
+	}
+
+	for _, primary := range dataNodeShards {
+		if primary.ReadOnly || len(replicas[primary.ShardID]) == 0 {
+			continue
+		}
+
+		lag, err := ctx.getReplicationLag(primary)
+		if err != nil {
+			timber.Warningf("could not measure replication lag for data node shard [%d]: %v", primary.DataNodeShardID, err)
+			continue
+		}
+
+		for _, replicaId := range replicas[primary.ShardID] {
+			// Replicas that are not connected to the primary are not caught up.
+			if replicaLag, ok := lag[subscriptionName(replicaId)]; ok && replicaLag <= maxLag {
+				caughtUp[replicaId] = true
+			}
+		}
+	}
+
+	return ctx.storeCaughtUpReplicas(caughtUp)
+}
+
+// storeCaughtUpReplicas replaces the read only replicas that are caught up with their primary.
+// Only the replicas that changed are written, most of the time nothing is written at all.
+func (ctx *base) storeCaughtUpReplicas(caughtUp map[uint64]bool) error {
+	existing, err := ctx.getCaughtUpReplicas()
+	if err != nil {
+		return err
+	}
+
+	behind, statements := make([]uint64, 0), make([]string, 0)
+	for id := range existing {
+		if !caughtUp[id] {
+			behind = append(behind, id)
+		}
+	}
+	if len(behind) > 0 {
+		statements = append(statements, goqu.
+			From("caught_up_replicas").
+			Where(goqu.Ex{
+				"data_node_shard_id": behind,
+			}).
+			Delete().Sql)
+	}
+
+	for id := range caughtUp {
+		if !existing[id] {
+			statements = append(statements, goqu.
+				From("caught_up_replicas").
+				Insert(goqu.Record{
+					"data_node_shard_id": id,
+				}).Sql)
+		}
+	}
+
+	if len(statements) == 0 {
+		return nil
+	}
+
+	response, err := ctx.db.ExecuteEx(&frunk.ExecuteRequest{
+		Queries: statements,
+		Atomic:  true,
+	})
+	if err != nil {
+		return err
+	}
+	return executeResponseError(response)
+}
+
+// getCaughtUpReplicas returns the read only replicas that were caught up with their primary the
+// last time the leader measured the lag.
+func (ctx *base) getCaughtUpReplicas() (map[uint64]bool, error) {
+	compiledSql, _, _ := goqu.
+		From("caught_up_replicas").
+		Select("data_node_shard_id").
+		ToSql()
+	response, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := idArray(response)
+	if err != nil {
+		return nil, err
+	}
+
+	caughtUp := map[uint64]bool{}
+	for _, id := range ids {
+		caughtUp[id] = true
+	}
+	return caughtUp, nil
+}
+
+// getReplicationLag returns the number of bytes that each subscriber is behind the primary, keyed
+// by the subscriber's application name.
+func (ctx *base) getReplicationLag(primary DataNodeShard) (map[string]int64, error) {
+	db, err := ctx.openDataNodeShard(primary)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(
+		"SELECT application_name, pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn) FROM pg_stat_replication")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lag := map[string]int64{}
+	for rows.Next() {
+		name, bytes := "", sql.NullFloat64{}
+		if err := rows.Scan(&name, &bytes); err != nil {
+			return nil, err
+		}
+		if bytes.Valid {
+			lag[name] = int64(bytes.Float64)
+		}
+	}
+	return lag, rows.Err()
+}
+
+// connInfoValue quotes a value for a libpq connection string.
+func connInfoValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
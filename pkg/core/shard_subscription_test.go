@@ -0,0 +1,13 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConnInfoValue(t *testing.T) {
+	assert.Equal(t, `'localhost'`, connInfoValue("localhost"))
+	assert.Equal(t, `''`, connInfoValue(""))
+	assert.Equal(t, `'it\'s'`, connInfoValue("it's"))
+	assert.Equal(t, `'back\\slash'`, connInfoValue(`back\slash`))
+}
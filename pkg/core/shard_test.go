@@ -1,6 +1,10 @@
 package core_test
 
 import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/core"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
 	"github.com/elliotcourant/noahdb/testutils"
 	"github.com/elliotcourant/timber"
 	"github.com/stretchr/testify/assert"
@@ -91,3 +95,525 @@ func TestShardContext_BalanceOrphanedShards(t *testing.T) {
 		}
 	})
 }
+
+func TestShardContext_SplitShard(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	shards, err := colony.Shards().GetShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.NotEmpty(t, shards)
+
+	numberOfTenants := 10
+	tenantIds := make([]uint64, numberOfTenants)
+	for i := 0; i < numberOfTenants; i++ {
+		tenantIds[i] = uint64(i + 1)
+	}
+
+	_, err = colony.Tenants().NewTenants(tenantIds...)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	tenants, err := colony.Tenants().GetTenants()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	sourceShardId := tenants[0].ShardID
+	tenantsBefore := 0
+	for _, tenant := range tenants {
+		if tenant.ShardID == sourceShardId {
+			tenantsBefore++
+		}
+	}
+
+	split, err := colony.Shards().SplitShard(sourceShardId)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Equal(t, sourceShardId, split.SourceShardID)
+	assert.NotEqual(t, sourceShardId, split.TargetShardID)
+
+	tenants, err = colony.Tenants().GetTenants()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	source, target := 0, 0
+	for _, tenant := range tenants {
+		switch tenant.ShardID {
+		case split.SourceShardID:
+			source++
+		case split.TargetShardID:
+			target++
+		}
+	}
+	assert.Equal(t, tenantsBefore, source+target)
+	assert.Equal(t, tenantsBefore/2, target)
+
+	splits, err := colony.Shards().GetShardSplits()
+	assert.NoError(t, err)
+	assert.Empty(t, splits)
+
+	shards, err = colony.Shards().GetShards()
+	assert.NoError(t, err)
+	for _, shard := range shards {
+		if shard.ShardID == split.SourceShardID || shard.ShardID == split.TargetShardID {
+			assert.Equal(t, core.ShardState_Stable, shard.State)
+		}
+	}
+}
+
+func TestShardContext_SplitShard_Provisioning(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	_, err := colony.Tenants().NewTenants(1, 2, 3, 4)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	tenants, err := colony.Tenants().GetTenants()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	sourceShardId := tenants[0].ShardID
+
+	target, err := colony.Shards().NewShard()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	// This is what a split looks like if we were interrupted before its target was provisioned.
+	_, err = colony.Execute(&frunk.ExecuteRequest{
+		Queries: []string{
+			fmt.Sprintf(`UPDATE shards SET state = %d WHERE shard_id IN (%d, %d)`,
+				core.ShardState_Balancing, sourceShardId, target.ShardID),
+			fmt.Sprintf(`INSERT INTO shard_splits (source_shard_id, target_shard_id) VALUES (%d, %d)`,
+				sourceShardId, target.ShardID),
+		},
+		Atomic: true,
+	})
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	getState := func(shardId uint64) core.ShardState {
+		shards, err := colony.Shards().GetShards()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		for _, shard := range shards {
+			if shard.ShardID == shardId {
+				return shard.State
+			}
+		}
+		return core.ShardState_New
+	}
+
+	// The target is provisioned but it should not receive new tenants until the split finishes.
+	err = colony.Shards().BalanceOrphanShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Equal(t, core.ShardState_Balancing, getState(target.ShardID))
+
+	err = colony.Shards().ResumeShardSplits()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Equal(t, core.ShardState_Stable, getState(sourceShardId))
+	assert.Equal(t, core.ShardState_Stable, getState(target.ShardID))
+}
+
+func TestShardContext_ProvisionDataNodeShard(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	newShard, err := colony.Shards().NewShard()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	err = colony.Shards().BalanceOrphanShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	provisions, err := colony.Shards().GetDataNodeShardProvisions()
+	assert.NoError(t, err)
+	assert.Empty(t, provisions)
+
+	shards, err := colony.Shards().GetShards()
+	assert.NoError(t, err)
+	for _, shard := range shards {
+		if shard.ShardID == newShard.ShardID {
+			assert.Equal(t, core.ShardState_Stable, shard.State)
+		}
+	}
+
+	dataNodeShards, err := colony.Shards().GetWriteDataNodeShards(newShard.ShardID)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Len(t, dataNodeShards, 1)
+
+	// Running the balance again should not touch the shard that was just provisioned.
+	err = colony.Shards().BalanceOrphanShards()
+	assert.NoError(t, err)
+
+	err = colony.Shards().ForceProvisionDataNodeShard(dataNodeShards[0].DataNodeShardID)
+	assert.Error(t, err)
+}
+
+func TestShardContext_ProvisionForeignDatabase(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	dataNodes, err := colony.DataNodes().GetDataNodes()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	if !assert.Len(t, dataNodes, 1) {
+		panic("expected a single data node")
+	}
+	dataNode := dataNodes[0]
+
+	postgres, err := sql.Open("postgres", fmt.Sprintf("postgres://%s:%s@%s:%d/postgres?sslmode=disable",
+		dataNode.GetUser(), dataNode.GetPassword(), dataNode.GetAddress(), dataNode.GetPort()))
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer postgres.Close()
+
+	// createForeignDatabase creates a database with a table in it where the next data node shard
+	// will be provisioned, as if it had been created by something other than noahdb.
+	createForeignDatabase := func(t *testing.T) (uint64, *sql.DB) {
+		dataNodeShards, err := colony.Shards().GetDataNodeShards()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		dataNodeShardId := uint64(0)
+		for _, dataNodeShard := range dataNodeShards {
+			if dataNodeShard.DataNodeShardID > dataNodeShardId {
+				dataNodeShardId = dataNodeShard.DataNodeShardID
+			}
+		}
+		dataNodeShardId++
+
+		database := fmt.Sprintf("noahdb_%d", dataNodeShardId)
+		_, err = postgres.Exec(fmt.Sprintf("CREATE DATABASE %s", database))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		foreign, err := sql.Open("postgres", fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable",
+			dataNode.GetUser(), dataNode.GetPassword(), dataNode.GetAddress(), dataNode.GetPort(), database))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		_, err = foreign.Exec("CREATE TABLE not_noah (id BIGINT PRIMARY KEY)")
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		return dataNodeShardId, foreign
+	}
+
+	// provisionShard creates a new shard and assigns it to the data node, the provisioning that
+	// has not finished is returned.
+	provisionShard := func(t *testing.T) []core.DataNodeShardProvision {
+		_, err := colony.Shards().NewShard()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		// Provisioning failures are logged, the provisioning is left to be resumed.
+		err = colony.Shards().BalanceOrphanShards()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		provisions, err := colony.Shards().GetDataNodeShardProvisions()
+		assert.NoError(t, err)
+		return provisions
+	}
+
+	t.Run("refuse foreign database and resume", func(t *testing.T) {
+		dataNodeShardId, foreign := createForeignDatabase(t)
+		defer foreign.Close()
+
+		provisions := provisionShard(t)
+		if !assert.Len(t, provisions, 1) {
+			panic("foreign database was not refused")
+		}
+		assert.Equal(t, dataNodeShardId, provisions[0].DataNodeShardID)
+		assert.Equal(t, core.ProvisionState_Creating, provisions[0].State)
+
+		// The table is still in the foreign database.
+		_, err := foreign.Exec("SELECT id FROM not_noah")
+		assert.NoError(t, err)
+
+		// Once the foreign table is gone the database is empty, so resuming will take it over.
+		_, err = foreign.Exec("DROP TABLE not_noah")
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		err = colony.Shards().BalanceOrphanShards()
+		assert.NoError(t, err)
+
+		provisions, err = colony.Shards().GetDataNodeShardProvisions()
+		assert.NoError(t, err)
+		assert.Empty(t, provisions)
+	})
+
+	t.Run("force foreign database", func(t *testing.T) {
+		dataNodeShardId, foreign := createForeignDatabase(t)
+		foreign.Close()
+
+		provisions := provisionShard(t)
+		if !assert.Len(t, provisions, 1) {
+			panic("foreign database was not refused")
+		}
+		assert.Equal(t, dataNodeShardId, provisions[0].DataNodeShardID)
+
+		err := colony.Shards().ForceProvisionDataNodeShard(dataNodeShardId)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		provisions, err = colony.Shards().GetDataNodeShardProvisions()
+		assert.NoError(t, err)
+		assert.Empty(t, provisions)
+
+		// The foreign database was replaced by the data node shard.
+		exists := false
+		err = postgres.QueryRow(fmt.Sprintf(
+			"SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = 'noahdb_%d')", dataNodeShardId)).Scan(&exists)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		dataNodeShard, err := sql.Open("postgres", fmt.Sprintf("postgres://%s:%s@%s:%d/noahdb_%d?sslmode=disable",
+			dataNode.GetUser(), dataNode.GetPassword(), dataNode.GetAddress(), dataNode.GetPort(), dataNodeShardId))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		defer dataNodeShard.Close()
+
+		_, err = dataNodeShard.Exec("SELECT id FROM not_noah")
+		assert.Error(t, err)
+	})
+}
+
+func TestShardContext_ProvisionDataNodeShard_CatchUp(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE colors (id BIGSERIAL PRIMARY KEY, name TEXT)`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO colors (name) VALUES ('red')`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	newShard, err := colony.Shards().NewShard()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	err = colony.Shards().BalanceOrphanShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	dataNodeShards, err := colony.Shards().GetWriteDataNodeShards(newShard.ShardID)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	if !assert.Len(t, dataNodeShards, 1) {
+		panic("expected a single data node shard")
+	}
+	dataNodeShardId := dataNodeShards[0].DataNodeShardID
+
+	dataNode, err := colony.DataNodes().GetDataNode(dataNodeShards[0].DataNodeID)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	target, err := sql.Open("postgres", fmt.Sprintf("postgres://%s:%s@%s:%d/noahdb_%d?sslmode=disable",
+		dataNode.GetUser(), dataNode.GetPassword(), dataNode.GetAddress(), dataNode.GetPort(), dataNodeShardId))
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer target.Close()
+
+	// verifying puts the data node shard back to the last step of provisioning, as if we were
+	// interrupted after it was seeded. It stops receiving writes to the global tables.
+	verifying := func(t *testing.T) {
+		_, err := colony.Execute(&frunk.ExecuteRequest{
+			Queries: []string{
+				fmt.Sprintf(`INSERT INTO data_node_shard_provisions (data_node_shard_id, state, force) VALUES (%d, %d, 0)`,
+					dataNodeShardId, core.ProvisionState_Verifying),
+			},
+		})
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+	}
+
+	getProvisions := func(t *testing.T) []core.DataNodeShardProvision {
+		provisions, err := colony.Shards().GetDataNodeShardProvisions()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		return provisions
+	}
+
+	t.Run("writes made while provisioning are caught up", func(t *testing.T) {
+		verifying(t)
+
+		_, err := db.Exec(`INSERT INTO colors (name) VALUES ('blue')`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		count := 0
+		err = target.QueryRow(`SELECT count(*) FROM colors`).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		err = colony.Shards().BalanceOrphanShards()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		assert.Empty(t, getProvisions(t))
+
+		err = target.QueryRow(`SELECT count(*) FROM colors`).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("missing columns are not provisioned", func(t *testing.T) {
+		_, err := target.Exec(`ALTER TABLE colors DROP COLUMN name`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		verifying(t)
+
+		// Provisioning failures are logged, the provisioning is left to be resumed.
+		err = colony.Shards().BalanceOrphanShards()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		assert.Len(t, getProvisions(t), 1)
+
+		// The writes that were blocked while the data node shard was caught up are not blocked
+		// anymore.
+		_, err = db.Exec(`INSERT INTO colors (name) VALUES ('green')`)
+		assert.NoError(t, err)
+
+		_, err = target.Exec(`ALTER TABLE colors ADD COLUMN name TEXT`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		err = colony.Shards().BalanceOrphanShards()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		assert.Empty(t, getProvisions(t))
+
+		count := 0
+		err = target.QueryRow(`SELECT count(*) FROM colors WHERE name IS NOT NULL`).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, count)
+	})
+
+	t.Run("schema changes made while provisioning are caught up", func(t *testing.T) {
+		verifying(t)
+
+		_, err := db.Exec(`ALTER TABLE colors ADD COLUMN hex TEXT`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		_, err = db.Exec(`INSERT INTO colors (name, hex) VALUES ('white', '#ffffff')`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		_, err = target.Exec(`SELECT hex FROM colors`)
+		assert.Error(t, err)
+
+		err = colony.Shards().BalanceOrphanShards()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		assert.Empty(t, getProvisions(t))
+
+		hex := ""
+		err = target.QueryRow(`SELECT hex FROM colors WHERE name = 'white'`).Scan(&hex)
+		assert.NoError(t, err)
+		assert.Equal(t, "#ffffff", hex)
+	})
+}
+
+func TestShardContext_VerifyReplicas(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	newShard, err := colony.Shards().NewShard()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	err = colony.Shards().BalanceOrphanShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	dataNodeShards, err := colony.Shards().GetDataNodeShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	healthyId, suspectId := uint64(0), uint64(0)
+	for _, dataNodeShard := range dataNodeShards {
+		if dataNodeShard.ShardID == newShard.ShardID {
+			suspectId = dataNodeShard.DataNodeShardID
+		} else if healthyId == 0 {
+			healthyId = dataNodeShard.DataNodeShardID
+		}
+	}
+	if !assert.NotZero(t, healthyId) || !assert.NotZero(t, suspectId) {
+		panic("could not find data node shards to compare")
+	}
+
+	// Both data node shards were seeded with the same global tables.
+	diverged, err := colony.Shards().VerifyReplicas(healthyId, suspectId)
+	assert.NoError(t, err)
+	assert.Empty(t, diverged)
+
+	divergedDataNodeShards, err := colony.Shards().GetDivergedDataNodeShards()
+	assert.NoError(t, err)
+	assert.Empty(t, divergedDataNodeShards)
+
+	readIds, err := colony.DataNodes().GetReadDataNodeShardIDsForShard(newShard.ShardID)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{suspectId}, readIds)
+}
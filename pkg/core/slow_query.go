@@ -0,0 +1,179 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/logger"
+	"github.com/elliotcourant/timber"
+	"path/filepath"
+	"time"
+)
+
+const (
+	slowQueryLogFileName   = "slow_query.log"
+	slowQueryLogMaxSize    = 64 * 1024 * 1024
+	slowQueryLogMaxBackups = 5
+
+	// defaultSlowQueryThreshold is used when the slow_query_threshold setting is missing.
+	defaultSlowQueryThreshold = time.Second
+)
+
+// SlowQueryStages are how long each stage of a statement took. Connections are acquired and
+// tasks are dispatched to each data node shard at the same time, so those stages are the longest
+// that any of the data node shards took.
+type SlowQueryStages struct {
+	Planning              time.Duration
+	Expansion             time.Duration
+	ConnectionAcquisition time.Duration
+	Dispatch              time.Duration
+	Execution             time.Duration
+}
+
+// SlowQuery is a statement that took longer than the slow query threshold.
+type SlowQuery struct {
+	Timestamp time.Time
+	Duration  time.Duration
+	User      string
+	Query     string
+
+	// Parameters are the values bound to the statement, this is nil when parameters are masked.
+	Parameters []string
+
+	TenantIDs []uint64
+	ShardIDs  []uint64
+	Error     error
+	Stages    SlowQueryStages
+}
+
+type slowQueryEntry struct {
+	Timestamp  string               `json:"timestamp"`
+	Duration   float64              `json:"duration_ms"`
+	User       string               `json:"user"`
+	Query      string               `json:"query"`
+	Parameters []string             `json:"parameters,omitempty"`
+	TenantIDs  []uint64             `json:"tenant_ids"`
+	ShardIDs   []uint64             `json:"shard_ids"`
+	Error      string               `json:"error,omitempty"`
+	Stages     slowQueryStagesEntry `json:"stages"`
+}
+
+type slowQueryStagesEntry struct {
+	Planning              float64 `json:"planning_ms"`
+	Expansion             float64 `json:"expansion_ms"`
+	ConnectionAcquisition float64 `json:"connection_acquisition_ms"`
+	Dispatch              float64 `json:"dispatch_ms"`
+	Execution             float64 `json:"execution_ms"`
+}
+
+type slowQueryContext struct {
+	*base
+}
+
+type SlowQueryContext interface {
+	// Threshold returns how long a statement needs to take before it is written to the slow query
+	// log. If the slow query log is disabled then false is returned.
+	Threshold() (time.Duration, bool)
+
+	// LogParameters returns true if the values of the parameters bound to statements should be
+	// written to the slow query log. Parameters are masked by default.
+	LogParameters() bool
+
+	// Log writes the statement to the slow query log as a single line of JSON.
+	Log(query SlowQuery) error
+
+	// Path returns the path of the current slow query log file.
+	Path() string
+}
+
+func (ctx *base) SlowQueries() SlowQueryContext {
+	return &slowQueryContext{
+		ctx,
+	}
+}
+
+func newSlowQueryLog(dataDirectory string) *logger.RotatingFile {
+	return logger.NewRotatingFile(
+		filepath.Join(dataDirectory, slowQueryLogFileName),
+		slowQueryLogMaxSize,
+		slowQueryLogMaxBackups)
+}
+
+func (ctx *slowQueryContext) Threshold() (time.Duration, bool) {
+	if ctx.slowQueryLog == nil {
+		return 0, false
+	}
+
+	threshold := int64(defaultSlowQueryThreshold / time.Millisecond)
+	if value, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_SlowQueryThreshold); err != nil {
+		timber.Warningf("could not read slow query threshold: %v", err)
+	} else if ok {
+		if configured, isInt := value.(int64); isInt {
+			threshold = configured
+		} else {
+			timber.Warningf("slow query threshold [%v] is not an integer, using the default of %s",
+				value, defaultSlowQueryThreshold)
+		}
+	}
+
+	if threshold < 0 {
+		return 0, false
+	}
+
+	return time.Duration(threshold) * time.Millisecond, true
+}
+
+func (ctx *slowQueryContext) LogParameters() bool {
+	value, ok, err := ctx.Setting().GetSettingValue(SettingKeyOptions_SlowQueryLogParameters)
+	if err != nil {
+		timber.Warningf("could not read slow query parameter setting: %v", err)
+		return false
+	}
+	logParameters, _ := value.(bool)
+	return ok && logParameters
+}
+
+func (ctx *slowQueryContext) Log(query SlowQuery) error {
+	if ctx.slowQueryLog == nil {
+		return fmt.Errorf("slow query log is not open")
+	}
+
+	entry := slowQueryEntry{
+		Timestamp:  query.Timestamp.UTC().Format(time.RFC3339Nano),
+		Duration:   milliseconds(query.Duration),
+		User:       query.User,
+		Query:      query.Query,
+		Parameters: query.Parameters,
+		TenantIDs:  append([]uint64{}, query.TenantIDs...),
+		ShardIDs:   append([]uint64{}, query.ShardIDs...),
+		Stages: slowQueryStagesEntry{
+			Planning:              milliseconds(query.Stages.Planning),
+			Expansion:             milliseconds(query.Stages.Expansion),
+			ConnectionAcquisition: milliseconds(query.Stages.ConnectionAcquisition),
+			Dispatch:              milliseconds(query.Stages.Dispatch),
+			Execution:             milliseconds(query.Stages.Execution),
+		},
+	}
+	if query.Error != nil {
+		entry.Error = query.Error.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = ctx.slowQueryLog.Write(append(line, '\n'))
+	return err
+}
+
+func (ctx *slowQueryContext) Path() string {
+	if ctx.slowQueryLog == nil {
+		return ""
+	}
+	return ctx.slowQueryLog.Path()
+}
+
+// milliseconds converts the duration to fractional milliseconds.
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
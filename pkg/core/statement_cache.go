@@ -0,0 +1,136 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hashicorp/golang-lru/simplelru"
+	"hash/crc32"
+	"sync"
+)
+
+const (
+	// preparedStatementCacheSize is the maximum number of named statements that will be kept on
+	// a single data node connection.
+	preparedStatementCacheSize = 128
+)
+
+type preparedStatement struct {
+	name           string
+	query          string
+	parameterTypes []uint32
+}
+
+// preparedStatementCache keeps track of the named statements that have been prepared on a single
+// data node connection. Statements are keyed by the fingerprint of the query along with a
+// checksum of its text and the types of its parameters. Fingerprints do not include constants,
+// so queries that only differ by their literals still need to be different statements on the
+// data node.
+type preparedStatementCache struct {
+	sync.Mutex
+
+	// generation is the generation of the pool when the cache was last used, if the pool's
+	// generation changes (like after DDL) then all of the statements in the cache are discarded.
+	generation uint64
+	statements *simplelru.LRU
+
+	// stale are the names of statements that have been evicted or invalidated but might still
+	// exist on the data node. These need to be closed before they can be prepared again.
+	stale []string
+}
+
+func newPreparedStatementCache() *preparedStatementCache {
+	cache := &preparedStatementCache{
+		stale: make([]string, 0),
+	}
+	cache.statements, _ = simplelru.NewLRU(preparedStatementCacheSize, func(key interface{}, value interface{}) {
+		cache.stale = append(cache.stale, value.(preparedStatement).name)
+	})
+	return cache
+}
+
+// prepare returns the name of the statement for the provided fingerprint, query and parameter
+// types. If the statement has already been prepared on the connection then true will be returned.
+// Otherwise the statement is added to the cache and any statements that should be closed on the
+// data node before the new statement is parsed are returned.
+func (cache *preparedStatementCache) prepare(
+	generation uint64, fingerprint, query string, parameterTypes []uint32) (string, bool, []string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if cache.generation != generation {
+		cache.statements.Purge()
+		cache.generation = generation
+	}
+
+	// The name is also the key of the statement in the cache.
+	name := preparedStatementName(fingerprint, query, parameterTypes)
+
+	if item, ok := cache.statements.Get(name); ok {
+		// Two different queries could still have the same checksum. We only want to reuse the
+		// statement if the query and the types of its parameters are actually the same.
+		if statement := item.(preparedStatement); statement.query == query &&
+			equalParameterTypes(statement.parameterTypes, parameterTypes) {
+			return name, true, nil
+		}
+		cache.statements.Remove(name)
+	}
+
+	cache.statements.Add(name, preparedStatement{
+		name:           name,
+		query:          query,
+		parameterTypes: append([]uint32{}, parameterTypes...),
+	})
+
+	// A statement with the same name might still exist on the data node, it is not an error to
+	// close a statement that does not exist, so we always close the name before parsing it.
+	stale := make([]string, 0, len(cache.stale)+1)
+	for _, staleName := range cache.stale {
+		if staleName != name {
+			stale = append(stale, staleName)
+		}
+	}
+	cache.stale = make([]string, 0)
+	return name, false, append(stale, name)
+}
+
+// forget removes the statement with the provided name from the cache, this should be used when
+// the statement could not be prepared on the data node.
+func (cache *preparedStatementCache) forget(name string) {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.statements.Remove(name)
+}
+
+// reset discards all of the statements in the cache without closing them, this should only be
+// used when the session on the data node has been reset or closed.
+func (cache *preparedStatementCache) reset() {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.statements.Purge()
+	cache.stale = make([]string, 0)
+}
+
+// preparedStatementName returns the name of the statement on the data node. The name is the
+// fingerprint followed by a checksum of the query and its parameter types, this way the name
+// still fits within the 63 characters allowed by PostgreSQL.
+func preparedStatementName(fingerprint, query string, parameterTypes []uint32) string {
+	buf := make([]byte, len(query), len(query)+4*len(parameterTypes))
+	copy(buf, query)
+	for _, oid := range parameterTypes {
+		buf = append(buf, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], oid)
+	}
+	return fmt.Sprintf("noah_%s_%08x", fingerprint, crc32.ChecksumIEEE(buf))
+}
+
+func equalParameterTypes(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestPreparedStatementCache_Prepare(t *testing.T) {
+	t.Run("prepare then reuse", func(t *testing.T) {
+		cache := newPreparedStatementCache()
+		name, prepared, stale := cache.prepare(0, "abc", "SELECT $1", nil)
+		assert.False(t, prepared)
+		assert.Equal(t, preparedStatementName("abc", "SELECT $1", nil), name)
+		assert.Equal(t, []string{name}, stale)
+
+		reused, prepared, stale := cache.prepare(0, "abc", "SELECT $1", nil)
+		assert.True(t, prepared)
+		assert.Equal(t, name, reused)
+		assert.Empty(t, stale)
+	})
+
+	t.Run("different literals same fingerprint", func(t *testing.T) {
+		cache := newPreparedStatementCache()
+		one, prepared, _ := cache.prepare(0, "abc", "SELECT 1", nil)
+		assert.False(t, prepared)
+		two, prepared, stale := cache.prepare(0, "abc", "SELECT 2", nil)
+		assert.False(t, prepared)
+		assert.NotEqual(t, one, two)
+
+		// Preparing the second query does not evict the first.
+		assert.Equal(t, []string{two}, stale)
+		_, prepared, _ = cache.prepare(0, "abc", "SELECT 1", nil)
+		assert.True(t, prepared)
+		_, prepared, _ = cache.prepare(0, "abc", "SELECT 2", nil)
+		assert.True(t, prepared)
+	})
+
+	t.Run("new generation", func(t *testing.T) {
+		cache := newPreparedStatementCache()
+		name, _, _ := cache.prepare(0, "abc", "SELECT 1", nil)
+		_, prepared, stale := cache.prepare(1, "abc", "SELECT 1", nil)
+		assert.False(t, prepared)
+		assert.Equal(t, []string{name}, stale)
+	})
+
+	t.Run("different parameter types", func(t *testing.T) {
+		cache := newPreparedStatementCache()
+		textName, prepared, _ := cache.prepare(0, "abc", "SELECT $1", []uint32{25})
+		assert.False(t, prepared)
+		intName, prepared, _ := cache.prepare(0, "abc", "SELECT $1", []uint32{20})
+		assert.False(t, prepared)
+		assert.NotEqual(t, textName, intName)
+
+		// Fingerprints are SHA-1 hashes.
+		longName := preparedStatementName(strings.Repeat("f", 40), "SELECT $1", []uint32{20})
+		assert.True(t, len(longName) <= 63)
+
+		name, prepared, _ := cache.prepare(0, "abc", "SELECT $1", []uint32{25})
+		assert.True(t, prepared)
+		assert.Equal(t, textName, name)
+	})
+
+	t.Run("forget", func(t *testing.T) {
+		cache := newPreparedStatementCache()
+		name, _, _ := cache.prepare(0, "abc", "SELECT 1", nil)
+		cache.forget(name)
+		_, prepared, _ := cache.prepare(0, "abc", "SELECT 1", nil)
+		assert.False(t, prepared)
+	})
+
+	t.Run("evicted statements are closed", func(t *testing.T) {
+		cache := newPreparedStatementCache()
+		for i := 0; i < preparedStatementCacheSize; i++ {
+			cache.prepare(0, string(rune('a'+i%26))+string(rune('a'+i/26)), "SELECT 1", nil)
+		}
+		name, _, stale := cache.prepare(0, "new", "SELECT 1", nil)
+		assert.Equal(t, []string{preparedStatementName("aa", "SELECT 1", nil), name}, stale)
+	})
+}
@@ -0,0 +1,363 @@
+package core
+
+import (
+	"container/heap"
+	"github.com/elliotcourant/noahdb/pkg/drivers/rpcer"
+	"github.com/elliotcourant/noahdb/pkg/util"
+	"github.com/elliotcourant/timber"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxStatementStatistics is the most statements that a coordinator will keep statistics for.
+	// Once this is reached the statement that has been called the least is removed to make room.
+	maxStatementStatistics = 5000
+)
+
+// StatementStatistics is the aggregate of every execution of a normalized statement. Statements
+// that only differ by their constant values share the same fingerprint.
+type StatementStatistics struct {
+	Fingerprint string
+	Query       string
+	Calls       uint64
+	Errors      uint64
+	Rows        uint64
+	TotalTime   time.Duration
+	MaxTime     time.Duration
+
+	// ShardIDs are the shards that the statement has been sent to.
+	ShardIDs []uint64
+}
+
+// MeanTime returns the average time it took to run the statement.
+func (statistics StatementStatistics) MeanTime() time.Duration {
+	if statistics.Calls == 0 {
+		return 0
+	}
+	return statistics.TotalTime / time.Duration(statistics.Calls)
+}
+
+// StatementExecution is a single execution of a statement that will be added to its statistics.
+type StatementExecution struct {
+	Fingerprint string
+	ShardIDs    []uint64
+	Rows        uint64
+	Duration    time.Duration
+	Error       error
+}
+
+type statisticsContext struct {
+	*base
+}
+
+type StatisticsContext interface {
+	// RecordStatement adds the execution to the statistics of its statement. The query is only
+	// called the first time that the statement is seen, it should return the normalized text
+	// of the statement.
+	RecordStatement(execution StatementExecution, query func() string)
+
+	// GetLocalStatementStatistics returns the statistics of the statements run on this
+	// coordinator.
+	GetLocalStatementStatistics() []StatementStatistics
+
+	// GetStatementStatistics returns the statistics of the statements run on every coordinator
+	// in the cluster, statements with the same fingerprint are combined.
+	GetStatementStatistics() ([]StatementStatistics, error)
+
+	// ResetLocalStatementStatistics clears the statistics on this coordinator. If a fingerprint
+	// is provided then only that statement is cleared. The number of statements cleared is
+	// returned.
+	ResetLocalStatementStatistics(fingerprint string) uint64
+
+	// ResetStatementStatistics clears the statistics on every coordinator in the cluster.
+	ResetStatementStatistics(fingerprint string) (uint64, error)
+}
+
+func (ctx *base) Statistics() StatisticsContext {
+	return &statisticsContext{
+		ctx,
+	}
+}
+
+type statementStatisticsEntry struct {
+	StatementStatistics
+	shards map[uint64]struct{}
+
+	// index is the position of the entry in the eviction heap.
+	index int
+}
+
+// snapshot copies the statistics of the entry, the lock must be held.
+func (entry *statementStatisticsEntry) snapshot() StatementStatistics {
+	statistics := entry.StatementStatistics
+	statistics.ShardIDs = make([]uint64, 0, len(entry.shards))
+	for shardId := range entry.shards {
+		statistics.ShardIDs = append(statistics.ShardIDs, shardId)
+	}
+	return statistics
+}
+
+func (entry *statementStatisticsEntry) statistics() StatementStatistics {
+	statistics := entry.snapshot()
+	sortShardIds(statistics.ShardIDs)
+	return statistics
+}
+
+func sortShardIds(shardIds []uint64) {
+	sort.Slice(shardIds, func(i, j int) bool {
+		return shardIds[i] < shardIds[j]
+	})
+}
+
+// statementStatisticsHeap orders the entries by the number of times they have been called, the
+// entry that has been called the least is the first to be evicted.
+type statementStatisticsHeap []*statementStatisticsEntry
+
+func (h statementStatisticsHeap) Len() int { return len(h) }
+
+func (h statementStatisticsHeap) Less(i, j int) bool { return h[i].Calls < h[j].Calls }
+
+func (h statementStatisticsHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *statementStatisticsHeap) Push(item interface{}) {
+	entry := item.(*statementStatisticsEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *statementStatisticsHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// statementStatistics holds the statistics for the statements run on this coordinator, they are
+// only kept in memory.
+type statementStatistics struct {
+	sync.Mutex
+	entries map[string]*statementStatisticsEntry
+	order   statementStatisticsHeap
+}
+
+func newStatementStatistics() *statementStatistics {
+	return &statementStatistics{
+		entries: map[string]*statementStatisticsEntry{},
+		order:   statementStatisticsHeap{},
+	}
+}
+
+func (ctx *statisticsContext) RecordStatement(execution StatementExecution, query func() string) {
+	if ctx.statistics == nil || execution.Fingerprint == "" {
+		return
+	}
+
+	// Formatting the statement can be slow, so it is done without holding the lock. Another
+	// session might add the statement in the meantime, in which case the text is not used.
+	ctx.statistics.Lock()
+	_, ok := ctx.statistics.entries[execution.Fingerprint]
+	ctx.statistics.Unlock()
+	text := ""
+	if !ok {
+		text = query()
+	}
+
+	ctx.statistics.Lock()
+	defer ctx.statistics.Unlock()
+	entry, ok := ctx.statistics.entries[execution.Fingerprint]
+	if !ok {
+		if len(ctx.statistics.entries) >= maxStatementStatistics {
+			ctx.statistics.evict()
+		}
+		entry = &statementStatisticsEntry{
+			StatementStatistics: StatementStatistics{
+				Fingerprint: execution.Fingerprint,
+				Query:       text,
+			},
+			shards: map[uint64]struct{}{},
+		}
+		ctx.statistics.entries[execution.Fingerprint] = entry
+		heap.Push(&ctx.statistics.order, entry)
+	}
+
+	entry.Calls++
+	entry.Rows += execution.Rows
+	entry.TotalTime += execution.Duration
+	if execution.Duration > entry.MaxTime {
+		entry.MaxTime = execution.Duration
+	}
+	if execution.Error != nil {
+		entry.Errors++
+	}
+	for _, shardId := range execution.ShardIDs {
+		entry.shards[shardId] = struct{}{}
+	}
+	heap.Fix(&ctx.statistics.order, entry.index)
+}
+
+// evict removes the statement that has been called the least, the lock must be held.
+func (statistics *statementStatistics) evict() {
+	entry := heap.Pop(&statistics.order).(*statementStatisticsEntry)
+	delete(statistics.entries, entry.Fingerprint)
+}
+
+func (ctx *statisticsContext) GetLocalStatementStatistics() []StatementStatistics {
+	if ctx.statistics == nil {
+		return []StatementStatistics{}
+	}
+
+	// The statistics are copied while the lock is held and sorted once it has been released.
+	ctx.statistics.Lock()
+	result := make([]StatementStatistics, 0, len(ctx.statistics.entries))
+	for _, entry := range ctx.statistics.entries {
+		result = append(result, entry.snapshot())
+	}
+	ctx.statistics.Unlock()
+
+	for _, statistics := range result {
+		sortShardIds(statistics.ShardIDs)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Fingerprint < result[j].Fingerprint
+	})
+	return result
+}
+
+func (ctx *statisticsContext) GetStatementStatistics() ([]StatementStatistics, error) {
+	merged := map[string]*statementStatisticsEntry{}
+	add := func(statistics StatementStatistics) {
+		entry, ok := merged[statistics.Fingerprint]
+		if !ok {
+			entry = &statementStatisticsEntry{
+				StatementStatistics: StatementStatistics{
+					Fingerprint: statistics.Fingerprint,
+					Query:       statistics.Query,
+				},
+				shards: map[uint64]struct{}{},
+			}
+			merged[statistics.Fingerprint] = entry
+		}
+		entry.Calls += statistics.Calls
+		entry.Errors += statistics.Errors
+		entry.Rows += statistics.Rows
+		entry.TotalTime += statistics.TotalTime
+		if statistics.MaxTime > entry.MaxTime {
+			entry.MaxTime = statistics.MaxTime
+		}
+		for _, shardId := range statistics.ShardIDs {
+			entry.shards[shardId] = struct{}{}
+		}
+	}
+
+	for _, statistics := range ctx.GetLocalStatementStatistics() {
+		add(statistics)
+	}
+
+	err := ctx.forEachNeighbor(func(driver *rpcer.RpcDriver) error {
+		statements, err := driver.GetStatementStatistics()
+		if err != nil {
+			return err
+		}
+		for _, statement := range statements {
+			add(StatementStatistics{
+				Fingerprint: statement.Fingerprint,
+				Query:       statement.Query,
+				Calls:       statement.Calls,
+				Errors:      statement.Errors,
+				Rows:        statement.Rows,
+				TotalTime:   time.Duration(statement.TotalTime),
+				MaxTime:     time.Duration(statement.MaxTime),
+				ShardIDs:    statement.ShardIDs,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]StatementStatistics, 0, len(merged))
+	for _, entry := range merged {
+		result = append(result, entry.statistics())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Fingerprint < result[j].Fingerprint
+	})
+	return result, nil
+}
+
+func (ctx *statisticsContext) ResetLocalStatementStatistics(fingerprint string) uint64 {
+	if ctx.statistics == nil {
+		return 0
+	}
+
+	ctx.statistics.Lock()
+	defer ctx.statistics.Unlock()
+	if fingerprint != "" {
+		entry, ok := ctx.statistics.entries[fingerprint]
+		if !ok {
+			return 0
+		}
+		heap.Remove(&ctx.statistics.order, entry.index)
+		delete(ctx.statistics.entries, fingerprint)
+		return 1
+	}
+
+	removed := uint64(len(ctx.statistics.entries))
+	ctx.statistics.entries = map[string]*statementStatisticsEntry{}
+	ctx.statistics.order = statementStatisticsHeap{}
+	return removed
+}
+
+func (ctx *statisticsContext) ResetStatementStatistics(fingerprint string) (uint64, error) {
+	removed := ctx.ResetLocalStatementStatistics(fingerprint)
+	err := ctx.forEachNeighbor(func(driver *rpcer.RpcDriver) error {
+		count, err := driver.ResetStatementStatistics(fingerprint)
+		removed += count
+		return err
+	})
+	return removed, err
+}
+
+// forEachNeighbor connects to each of the other coordinators in the cluster. A coordinator that
+// cannot be reached is skipped, but an error returned by the callback is returned.
+func (ctx *statisticsContext) forEachNeighbor(callback func(driver *rpcer.RpcDriver) error) error {
+	neighbors, err := ctx.Neighbors()
+	if err != nil {
+		return err
+	}
+
+	for _, neighbor := range neighbors {
+		if neighbor.ID == ctx.db.ID() {
+			continue
+		}
+
+		addr, err := util.ResolveAddress(neighbor.Addr)
+		if err != nil {
+			return err
+		}
+
+		driver, err := rpcer.NewRPCDriver(ctx.db.ID(), ctx.Addr(), addr)
+		if err != nil {
+			timber.Warningf("could not connect to coordinator [%s] at address %s: %v", neighbor.ID, neighbor.Addr, err)
+			continue
+		}
+
+		err = func() error {
+			defer driver.Close()
+			return callback(driver)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
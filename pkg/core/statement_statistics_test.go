@@ -0,0 +1,88 @@
+package core
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStatementStatistics(t *testing.T) {
+	newContext := func() StatisticsContext {
+		return &statisticsContext{
+			&base{
+				statistics: newStatementStatistics(),
+			},
+		}
+	}
+
+	t.Run("executions are combined", func(t *testing.T) {
+		ctx := newContext()
+		normalized := 0
+		query := func() string {
+			normalized++
+			return "SELECT * FROM accounts WHERE id = $1"
+		}
+
+		ctx.RecordStatement(StatementExecution{
+			Fingerprint: "accounts",
+			ShardIDs:    []uint64{3, 1},
+			Rows:        1,
+			Duration:    2 * time.Millisecond,
+		}, query)
+		ctx.RecordStatement(StatementExecution{
+			Fingerprint: "accounts",
+			ShardIDs:    []uint64{1},
+			Duration:    4 * time.Millisecond,
+			Error:       fmt.Errorf("relation does not exist"),
+		}, query)
+
+		statistics := ctx.GetLocalStatementStatistics()
+		assert.Len(t, statistics, 1)
+		assert.Equal(t, 1, normalized)
+		assert.Equal(t, StatementStatistics{
+			Fingerprint: "accounts",
+			Query:       "SELECT * FROM accounts WHERE id = $1",
+			Calls:       2,
+			Errors:      1,
+			Rows:        1,
+			TotalTime:   6 * time.Millisecond,
+			MaxTime:     4 * time.Millisecond,
+			ShardIDs:    []uint64{1, 3},
+		}, statistics[0])
+		assert.Equal(t, 3*time.Millisecond, statistics[0].MeanTime())
+	})
+
+	t.Run("least called statement is evicted", func(t *testing.T) {
+		ctx := newContext()
+		for i := 0; i < maxStatementStatistics; i++ {
+			fingerprint := fmt.Sprintf("statement-%d", i)
+			ctx.RecordStatement(StatementExecution{Fingerprint: fingerprint}, func() string { return fingerprint })
+			if i != 0 {
+				ctx.RecordStatement(StatementExecution{Fingerprint: fingerprint}, func() string { return fingerprint })
+			}
+		}
+
+		ctx.RecordStatement(StatementExecution{Fingerprint: "new"}, func() string { return "new" })
+
+		statistics := ctx.GetLocalStatementStatistics()
+		assert.Len(t, statistics, maxStatementStatistics)
+		for _, statement := range statistics {
+			assert.NotEqual(t, "statement-0", statement.Fingerprint)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		ctx := newContext()
+		for _, fingerprint := range []string{"a", "b", "c"} {
+			ctx.RecordStatement(StatementExecution{Fingerprint: fingerprint}, func() string { return "" })
+		}
+
+		assert.Equal(t, uint64(1), ctx.ResetLocalStatementStatistics("b"))
+		assert.Equal(t, uint64(0), ctx.ResetLocalStatementStatistics("b"))
+		assert.Len(t, ctx.GetLocalStatementStatistics(), 2)
+
+		assert.Equal(t, uint64(2), ctx.ResetLocalStatementStatistics(""))
+		assert.Empty(t, ctx.GetLocalStatementStatistics())
+	})
+}
@@ -28,12 +28,15 @@ CREATE TABLE settings (
 );
 
 CREATE TABLE data_nodes (
-    data_node_id BIGINT PRIMARY KEY,
-    address      TEXT    NOT NULL,
-    port         INT     NOT NULL,
-    user         TEXT    NOT NULL,
-    password     TEXT    NOT NULL,
-    healthy      BOOLEAN NOT NULL,
+    data_node_id  BIGINT PRIMARY KEY,
+    address       TEXT    NOT NULL,
+    port          INT     NOT NULL,
+    user          TEXT    NOT NULL,
+    password      TEXT    NOT NULL,
+    healthy       BOOLEAN NOT NULL,
+    draining      BOOLEAN NOT NULL,
+    ssl_mode      TEXT    NOT NULL DEFAULT 'disable',
+    ssl_root_cert TEXT    NOT NULL DEFAULT '',
     UNIQUE (address, port)
 );
 
@@ -48,6 +51,23 @@ CREATE TABLE tenants (
     FOREIGN KEY (shard_id) REFERENCES shards (shard_id)
 );
 
+CREATE TABLE tenant_moves (
+    tenant_id       BIGINT PRIMARY KEY,
+    source_shard_id BIGINT NOT NULL,
+    target_shard_id BIGINT NOT NULL,
+    state           INT    NOT NULL,
+    FOREIGN KEY (tenant_id) REFERENCES tenants (tenant_id) ON DELETE CASCADE,
+    FOREIGN KEY (source_shard_id) REFERENCES shards (shard_id),
+    FOREIGN KEY (target_shard_id) REFERENCES shards (shard_id)
+);
+
+CREATE TABLE shard_splits (
+    source_shard_id BIGINT PRIMARY KEY,
+    target_shard_id BIGINT NOT NULL UNIQUE,
+    FOREIGN KEY (source_shard_id) REFERENCES shards (shard_id),
+    FOREIGN KEY (target_shard_id) REFERENCES shards (shard_id)
+);
+
 CREATE TABLE data_node_shards (
     data_node_shard_id BIGINT PRIMARY KEY,
     data_node_id       BIGINT  NOT NULL,
@@ -58,6 +78,79 @@ CREATE TABLE data_node_shards (
     FOREIGN KEY (shard_id) REFERENCES shards (shard_id)
 );
 
+CREATE TABLE data_node_shard_provisions (
+    data_node_shard_id BIGINT PRIMARY KEY,
+    state              INT     NOT NULL,
+    force              BOOLEAN NOT NULL,
+    FOREIGN KEY (data_node_shard_id) REFERENCES data_node_shards (data_node_shard_id) ON DELETE CASCADE
+);
+
+CREATE TABLE data_node_shard_moves (
+    source_data_node_shard_id BIGINT  PRIMARY KEY,
+    target_data_node_shard_id BIGINT  NOT NULL UNIQUE,
+    state                     INT     NOT NULL,
+    keep_source               BOOLEAN NOT NULL,
+    FOREIGN KEY (source_data_node_shard_id) REFERENCES data_node_shards (data_node_shard_id),
+    FOREIGN KEY (target_data_node_shard_id) REFERENCES data_node_shards (data_node_shard_id)
+);
+
+-- write_fences block writes to a tenant while it is cut over to another shard, or to a whole shard
+-- while one of its data node shards is cut over to another data node. A fence with a data node
+-- shard and no shard blocks the writes sent to every shard while that data node shard finishes
+-- being provisioned. Each coordinator acknowledges a fence once the writes it was already running
+-- have finished.
+CREATE TABLE write_fences (
+    fence_id           BIGINT PRIMARY KEY,
+    tenant_id          BIGINT NOT NULL,
+    shard_id           BIGINT NOT NULL,
+    data_node_shard_id BIGINT NOT NULL
+);
+
+CREATE TABLE write_fence_acks (
+    fence_id       BIGINT NOT NULL,
+    coordinator_id TEXT   NOT NULL,
+    PRIMARY KEY (fence_id, coordinator_id),
+    FOREIGN KEY (fence_id) REFERENCES write_fences (fence_id) ON DELETE CASCADE
+);
+
+-- data_node_shard_releases are data node shards that were removed from the cluster. Each
+-- coordinator closes its pool for the data node shard once its sessions have released their
+-- connections to it and then acknowledges the release. A data node is only removed once every
+-- coordinator has acknowledged the releases of its data node shards.
+CREATE TABLE data_node_shard_releases (
+    data_node_shard_id BIGINT PRIMARY KEY,
+    data_node_id       BIGINT NOT NULL
+);
+
+CREATE TABLE data_node_shard_release_acks (
+    data_node_shard_id BIGINT NOT NULL,
+    coordinator_id     TEXT   NOT NULL,
+    PRIMARY KEY (data_node_shard_id, coordinator_id),
+    FOREIGN KEY (data_node_shard_id) REFERENCES data_node_shard_releases (data_node_shard_id) ON DELETE CASCADE
+);
+
+-- rebalance_claims record which coordinator is performing a piece of rebalancing work, like moving
+-- a tenant. A claim that has not been renewed before it expires can be taken by another
+-- coordinator.
+CREATE TABLE rebalance_claims (
+    claim          TEXT PRIMARY KEY,
+    coordinator_id TEXT   NOT NULL,
+    expires_at     BIGINT NOT NULL
+);
+
+CREATE TABLE diverged_data_node_shards (
+    data_node_shard_id BIGINT PRIMARY KEY,
+    state              INT NOT NULL,
+    FOREIGN KEY (data_node_shard_id) REFERENCES data_node_shards (data_node_shard_id) ON DELETE CASCADE
+);
+
+-- caught_up_replicas are the read only replicas that were close enough to their primary the last
+-- time the leader measured the replication lag. Only these read only replicas are read from.
+CREATE TABLE caught_up_replicas (
+    data_node_shard_id BIGINT PRIMARY KEY,
+    FOREIGN KEY (data_node_shard_id) REFERENCES data_node_shards (data_node_shard_id) ON DELETE CASCADE
+);
+
 CREATE TABLE schemas (
     schema_id   INT PRIMARY KEY,
     schema_name TEXT NOT NULL UNIQUE
@@ -86,6 +179,13 @@ CREATE TABLE columns (
     UNIQUE (table_id, column_name)
 );
 
+-- schema_definitions stores every DDL statement that has been executed on the data nodes, in the
+-- order it was executed. This is used to create the schema on new shards.
+CREATE TABLE schema_definitions (
+    definition_id BIGINT PRIMARY KEY,
+    query         TEXT NOT NULL
+);
+
 INSERT INTO schemas (schema_id, schema_name)
 VALUES (0, 'public');
 
@@ -280,4 +380,8 @@ VALUES (1, 'replication_mode', 20, 0, null, null),
        (3, 'max_pool_size', 20, 5, null, null),
        (4, 'min_pool_size', 20, 0, null, null),
        (5, 'pool_refresh_interval', 1186, null, null, '30 seconds'),
-       (6, 'number_of_shards', 20, 3, null, null);
\ No newline at end of file
+       (6, 'number_of_shards', 20, 3, null, null),
+       (7, 'max_replication_lag', 20, 16777216, null, null),
+       (8, 'pool_mode', 20, 0, null, null),
+       (9, 'slow_query_threshold', 20, 1000, null, null),
+       (10, 'slow_query_log_parameters', 16, null, 0, null);
\ No newline at end of file
@@ -6,6 +6,8 @@ import (
 	"github.com/elliotcourant/noahdb/pkg/frunk"
 	"github.com/elliotcourant/timber"
 	"github.com/readystock/goqu"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,6 +28,9 @@ type tableContext struct {
 
 type TableContext interface {
 	NewTable(table Table, columns []Column) (Table, []Column, error)
+	DropTable(tableId uint64) error
+	AddColumns(table Table, columns []Column) ([]Column, error)
+	DropColumns(columnIds ...uint64) error
 	NextSequenceID(table Table, column Column) (uint64, error)
 	GetTable(name string) (Table, bool, error)
 	GetTables(...string) ([]Table, error)
@@ -34,6 +39,7 @@ type TableContext interface {
 	GetSequenceColumnForTable(tableId uint64) (Column, bool, error)
 	GetShardKeyColumnForTable(uint64) (Column, error)
 	GetTablesInSchema(schema string, names ...string) ([]Table, error)
+	GetTablesByType(tableType TableType) ([]Table, error)
 	GetTenantTable() (Table, bool, error)
 	GetColumnFromTables(column string, tables []string) (Column, bool, error)
 }
@@ -98,6 +104,92 @@ func (ctx *tableContext) NewTable(table Table, columns []Column) (Table, []Colum
 	return table, columns, err
 }
 
+// DropTable removes the table and its columns from the metadata store.
+func (ctx *tableContext) DropTable(tableId uint64) error {
+	deleteColumnsSql := goqu.
+		From("columns").
+		Where(goqu.Ex{
+			"table_id": tableId,
+		}).
+		Delete().Sql
+	deleteTableSql := goqu.
+		From("tables").
+		Where(goqu.Ex{
+			"table_id": tableId,
+		}).
+		Delete().Sql
+	_, err := ctx.db.Exec(strings.Join([]string{deleteColumnsSql, deleteTableSql}, ";\n"))
+	return err
+}
+
+// AddColumns stores columns that were added to an existing table. The columns are sorted after
+// the table's existing columns.
+func (ctx *tableContext) AddColumns(table Table, columns []Column) ([]Column, error) {
+	existing, err := ctx.GetColumns(table.TableID)
+	if err != nil {
+		return nil, err
+	}
+
+	sort := int32(0)
+	for _, column := range existing {
+		if column.Sort >= sort {
+			sort = column.Sort + 1
+		}
+	}
+
+	columnSql := make([]string, len(columns))
+	for i := range columns {
+		colId, err := ctx.db.NextSequenceValueById(columnIdSequencePath)
+		if err != nil {
+			return nil, err
+		}
+		columns[i].TableID, columns[i].ColumnID, columns[i].Sort = table.TableID, colId, sort+int32(i)
+
+		col := columns[i]
+		fcid := &col.ForeignColumnID
+		if *fcid == 0 {
+			fcid = nil
+		}
+		columnSql[i] = goqu.
+			From("columns").
+			Insert(goqu.Record{
+				"column_id":         col.ColumnID,
+				"table_id":          col.TableID,
+				"type_id":           col.Type,
+				"sort":              col.Sort,
+				"column_name":       col.ColumnName,
+				"primary_key":       col.PrimaryKey,
+				"nullable":          col.Nullable,
+				"shard_key":         col.ShardKey,
+				"serial":            col.Serial,
+				"foreign_column_id": fcid,
+			}).Sql
+	}
+
+	if len(columnSql) == 0 {
+		return columns, nil
+	}
+
+	_, err = ctx.db.Exec(strings.Join(columnSql, ";\n"))
+	return columns, err
+}
+
+// DropColumns removes columns that were dropped from a table from the metadata store.
+func (ctx *tableContext) DropColumns(columnIds ...uint64) error {
+	if len(columnIds) == 0 {
+		return nil
+	}
+
+	compiledSql := goqu.
+		From("columns").
+		Where(goqu.Ex{
+			"column_id": columnIds,
+		}).
+		Delete().Sql
+	_, err := ctx.db.Exec(compiledSql)
+	return err
+}
+
 func (ctx *tableContext) NextSequenceID(table Table, column Column) (uint64, error) {
 	startTimestamp := time.Now()
 	defer func() {
@@ -159,6 +251,23 @@ func (ctx *tableContext) GetTable(name string) (Table, bool, error) {
 }
 
 func (ctx *tableContext) GetTables(names ...string) ([]Table, error) {
+	sortedNames := append([]string{}, names...)
+	sort.Strings(sortedNames)
+	key := strings.Join(sortedNames, ",")
+	cached, version, ok := ctx.cache.tables.get(key)
+	if ok {
+		return append([]Table{}, cached.([]Table)...), nil
+	}
+
+	tables, err := ctx.getTables(names...)
+	if err != nil {
+		return nil, err
+	}
+	ctx.cache.tables.put(version, key, append([]Table{}, tables...))
+	return tables, nil
+}
+
+func (ctx *tableContext) getTables(names ...string) ([]Table, error) {
 	query := getTablesQuery
 	if len(names) > 0 {
 		query = query.Where(goqu.Ex{
@@ -192,7 +301,36 @@ func (ctx *tableContext) GetTablesInSchema(schema string, names ...string) ([]Ta
 	return ctx.tablesFromRows(rows)
 }
 
+// GetTablesByType returns all of the tables of the provided type.
+func (ctx *tableContext) GetTablesByType(tableType TableType) ([]Table, error) {
+	compiledSql, _, _ := getTablesQuery.
+		Where(goqu.Ex{
+			"table_type": tableType,
+		}).
+		ToSql()
+	rows, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.tablesFromRows(rows)
+}
+
 func (ctx *tableContext) GetColumns(tableId uint64) ([]Column, error) {
+	key := strconv.FormatUint(tableId, 10)
+	cached, version, ok := ctx.cache.columns.get(key)
+	if ok {
+		return append([]Column{}, cached.([]Column)...), nil
+	}
+
+	columns, err := ctx.getColumns(tableId)
+	if err != nil {
+		return nil, err
+	}
+	ctx.cache.columns.put(version, key, append([]Column{}, columns...))
+	return columns, nil
+}
+
+func (ctx *tableContext) getColumns(tableId uint64) ([]Column, error) {
 	compileSql, _, _ := getColumnsQuery.
 		Where(goqu.Ex{
 			"table_id": tableId,
@@ -231,6 +369,21 @@ func (ctx *tableContext) GetPrimaryKeyColumnByName(tableName string) (Column, bo
 }
 
 func (ctx *tableContext) GetShardKeyColumnForTable(tableId uint64) (Column, error) {
+	key := "shard_key:" + strconv.FormatUint(tableId, 10)
+	cached, version, ok := ctx.cache.columns.get(key)
+	if ok {
+		return cached.(Column), nil
+	}
+
+	column, err := ctx.getShardKeyColumnForTable(tableId)
+	if err != nil {
+		return Column{}, err
+	}
+	ctx.cache.columns.put(version, key, column)
+	return column, nil
+}
+
+func (ctx *tableContext) getShardKeyColumnForTable(tableId uint64) (Column, error) {
 	compiledSql, _, _ := getColumnsQuery.
 		Where(goqu.Ex{
 			"table_id":  tableId,
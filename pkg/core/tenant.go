@@ -6,6 +6,7 @@ import (
 	"github.com/elliotcourant/noahdb/pkg/frunk"
 	"github.com/elliotcourant/timber"
 	"github.com/readystock/goqu"
+	"strconv"
 )
 
 var (
@@ -22,6 +23,9 @@ type TenantContext interface {
 	GetTenants() ([]Tenant, error)
 	GetTenant(uint64) (Tenant, error)
 	NewTenants(tenantIds ...uint64) ([]Tenant, error)
+	MoveTenant(tenantId, targetShardId uint64) error
+	GetTenantMoves() ([]TenantMove, error)
+	ResumeTenantMoves() error
 }
 
 func (ctx *base) Tenants() TenantContext {
@@ -76,6 +80,21 @@ func (ctx *tenantContext) GetTenants() ([]Tenant, error) {
 }
 
 func (ctx *tenantContext) GetTenant(id uint64) (Tenant, error) {
+	key := strconv.FormatUint(id, 10)
+	cached, version, ok := ctx.cache.tenants.get(key)
+	if ok {
+		return cached.(Tenant), nil
+	}
+
+	tenant, err := ctx.getTenant(id)
+	if err != nil {
+		return Tenant{}, err
+	}
+	ctx.cache.tenants.put(version, key, tenant)
+	return tenant, nil
+}
+
+func (ctx *tenantContext) getTenant(id uint64) (Tenant, error) {
 	compiledSql, _, _ := getTenantsQuery.
 		Where(goqu.Ex{
 			"tenant_id": id,
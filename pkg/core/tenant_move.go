@@ -0,0 +1,524 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/timber"
+	"github.com/lib/pq"
+	"github.com/readystock/goqu"
+	"strings"
+)
+
+var (
+	getTenantMovesQuery = goqu.
+		From("tenant_moves").
+		Select(
+			"tenant_id",
+			"source_shard_id",
+			"target_shard_id",
+			"state")
+)
+
+// tenantMoveTable is a sharded table that needs to be copied when moving a tenant.
+type tenantMoveTable struct {
+	name        string
+	shardKey    string
+	primaryKeys []string
+}
+
+// MoveTenant will move all of the data for the provided tenant from the shard it currently lives on
+// to the target shard. The tenant's rows are copied while writes are still allowed, then writes for
+// the tenant are blocked on every coordinator while the remaining changes are copied and the tenant
+// is pointed at the new shard. Once the tenant has been moved the rows are removed from the old
+// shard.
+func (ctx *tenantContext) MoveTenant(tenantId, targetShardId uint64) error {
+	return ctx.moveTenantToShard(tenantId, targetShardId, ShardState_Stable)
+}
+
+// moveTenantToShard will start or resume moving the tenant to the target shard. The target shard
+// must be in one of the provided states, this allows a shard that is being split to receive
+// tenants before it is available for new tenants.
+func (ctx *tenantContext) moveTenantToShard(tenantId, targetShardId uint64, targetStates ...ShardState) error {
+	// The move is claimed before anything else so that the leader resuming moves and another
+	// coordinator running noah.move_tenant can't move the same tenant at the same time.
+	claim, ok, err := ctx.claimRebalance(tenantMoveClaim(tenantId))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("tenant [%d] is already being moved by another coordinator", tenantId)
+	}
+	defer claim.release()
+
+	tenant, err := ctx.GetTenant(tenantId)
+	if err != nil {
+		return err
+	}
+
+	moves, err := ctx.getTenantMoves(tenantId)
+	if err != nil {
+		return err
+	}
+
+	// If this tenant is already being moved then we want to resume that move, but only if it is
+	// being moved to the same shard.
+	if len(moves) > 0 {
+		if moves[0].TargetShardID != targetShardId {
+			return fmt.Errorf(
+				"tenant [%d] is already being moved to shard [%d]", tenantId, moves[0].TargetShardID)
+		}
+		return ctx.moveTenant(claim, moves[0])
+	}
+
+	if tenant.ShardID == targetShardId {
+		return fmt.Errorf("tenant [%d] is already on shard [%d]", tenantId, targetShardId)
+	}
+
+	shards, err := ctx.Shards().GetShards()
+	if err != nil {
+		return err
+	}
+
+	targetIsAvailable := false
+	for _, shard := range shards {
+		if shard.ShardID != targetShardId {
+			continue
+		}
+		for _, state := range targetStates {
+			if shard.State == state {
+				targetIsAvailable = true
+				break
+			}
+		}
+		break
+	}
+	if !targetIsAvailable {
+		return fmt.Errorf("shard [%d] does not exist or is not stable", targetShardId)
+	}
+
+	move := TenantMove{
+		TenantID:      tenantId,
+		SourceShardID: tenant.ShardID,
+		TargetShardID: targetShardId,
+		State:         TenantMoveState_Copying,
+	}
+
+	compiledSql := goqu.
+		From("tenant_moves").
+		Insert(goqu.Record{
+			"tenant_id":       move.TenantID,
+			"source_shard_id": move.SourceShardID,
+			"target_shard_id": move.TargetShardID,
+			"state":           move.State,
+		}).Sql
+	if _, err := ctx.db.Exec(compiledSql); err != nil {
+		return err
+	}
+
+	return ctx.moveTenant(claim, move)
+}
+
+// GetTenantMoves returns all of the tenant moves that have not finished yet.
+func (ctx *tenantContext) GetTenantMoves() ([]TenantMove, error) {
+	return ctx.getTenantMoves()
+}
+
+// ResumeTenantMoves will continue any tenant moves that were interrupted, like when the leader of
+// the cluster changes in the middle of a move.
+func (ctx *tenantContext) ResumeTenantMoves() error {
+	moves, err := ctx.getTenantMoves()
+	if err != nil {
+		return err
+	}
+
+	for _, move := range moves {
+		claim, ok, err := ctx.claimRebalance(tenantMoveClaim(move.TenantID))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			timber.Debugf("tenant [%d] is being moved by another coordinator", move.TenantID)
+			continue
+		}
+
+		timber.Infof("resuming move of tenant [%d] to shard [%d]", move.TenantID, move.TargetShardID)
+		err = ctx.moveTenant(claim, move)
+		claim.release()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tenantMoveClaim is the key of the claim that is held while a tenant is being moved.
+func tenantMoveClaim(tenantId uint64) string {
+	return fmt.Sprintf("tenant_move:%d", tenantId)
+}
+
+func (ctx *tenantContext) moveTenant(claim *rebalanceClaim, move TenantMove) error {
+	tables, err := ctx.getTenantMoveTables()
+	if err != nil {
+		return err
+	}
+
+	sources, err := ctx.Shards().GetWriteDataNodeShards(move.SourceShardID)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no writable data node shards for shard [%d]", move.SourceShardID)
+	}
+
+	targets, err := ctx.Shards().GetWriteDataNodeShards(move.TargetShardID)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no writable data node shards for shard [%d]", move.TargetShardID)
+	}
+
+	// We only need to read the tenant's rows from one of the source data node shards.
+	source, err := ctx.openDataNodeShard(sources[0])
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	targetDbs := make([]*sql.DB, 0, len(targets))
+	defer func() {
+		for _, db := range targetDbs {
+			db.Close()
+		}
+	}()
+	for _, target := range targets {
+		db, err := ctx.openDataNodeShard(target)
+		if err != nil {
+			return err
+		}
+		targetDbs = append(targetDbs, db)
+	}
+
+	syncTenant := func() error {
+		for _, table := range tables {
+			for _, target := range targetDbs {
+				if err := syncTenantTable(source, target, table, move.TenantID); err != nil {
+					return fmt.Errorf("could not copy table [%s] for tenant [%d]: %v", table.name, move.TenantID, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	if move.State == TenantMoveState_Copying {
+		// Copy the bulk of the tenant's data while writes are still allowed.
+		timber.Debugf("copying tenant [%d] from shard [%d] to shard [%d]", move.TenantID, move.SourceShardID, move.TargetShardID)
+		if err := syncTenant(); err != nil {
+			return err
+		}
+	}
+
+	// Block writes to the tenant on every coordinator. If the move was interrupted while it was
+	// cutting over then the fence left behind by the last attempt is replaced.
+	cuttingOverSql := goqu.
+		From("tenant_moves").
+		Where(goqu.Ex{
+			"tenant_id": move.TenantID,
+		}).
+		Update(goqu.Record{
+			"state": TenantMoveState_CuttingOver,
+		}).Sql
+	fence, err := ctx.raiseWriteFence(writeFence{
+		TenantID: move.TenantID,
+		ShardID:  move.SourceShardID,
+	}, cuttingOverSql)
+	if err != nil {
+		return err
+	}
+	move.State = TenantMoveState_CuttingOver
+
+	// Once every coordinator has acknowledged the fence none of them are writing to the tenant, so
+	// nothing can change while the last of the tenant's changes are copied.
+	if err := ctx.awaitWriteFence(fence); err != nil {
+		ctx.abortTenantCutover(move, fence)
+		return err
+	}
+
+	timber.Debugf("cutting over tenant [%d] to shard [%d]", move.TenantID, move.TargetShardID)
+	if err := syncTenant(); err != nil {
+		ctx.abortTenantCutover(move, fence)
+		return err
+	}
+
+	// The tenant is pointed at the target shard and the fence is lowered together, so writes that
+	// were blocked are routed to the target shard. This is only applied if we still hold the claim
+	// on the move.
+	updateTenantSql := fmt.Sprintf("%s AND %s", goqu.
+		From("tenants").
+		Where(goqu.Ex{
+			"tenant_id": move.TenantID,
+		}).
+		Update(goqu.Record{
+			"shard_id": move.TargetShardID,
+		}).Sql, claim.guard())
+	deleteMoveSql := goqu.
+		From("tenant_moves").
+		Where(goqu.Ex{
+			"tenant_id": move.TenantID,
+		}).
+		Delete().Sql
+	response, err := ctx.db.ExecuteEx(&frunk.ExecuteRequest{
+		Queries: []string{
+			updateTenantSql,
+			fmt.Sprintf("%s AND %s", deleteMoveSql, claim.guard()),
+			fmt.Sprintf("%s AND %s", lowerWriteFenceSql(fence), claim.guard()),
+		},
+		Atomic: true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := executeResponseError(response); err != nil {
+		return err
+	}
+	if len(response.Results) == 0 || response.Results[0].RowsAffected == 0 {
+		return fmt.Errorf("tenant [%d] could not be cut over, the move was claimed by another coordinator", move.TenantID)
+	}
+
+	// Now that the tenant lives on the target shard we can remove the tenant's rows from each of
+	// the source data node shards.
+	for _, dataNodeShard := range sources {
+		db, err := ctx.openDataNodeShard(dataNodeShard)
+		if err != nil {
+			timber.Errorf("could not cleanup tenant [%d] on data node shard [%d]: %v", move.TenantID, dataNodeShard.DataNodeShardID, err)
+			continue
+		}
+		for _, table := range tables {
+			if _, err := db.Exec(fmt.Sprintf(
+				"DELETE FROM %s WHERE %s = $1",
+				pq.QuoteIdentifier(table.name),
+				pq.QuoteIdentifier(table.shardKey)), move.TenantID); err != nil {
+				timber.Errorf("could not cleanup table [%s] for tenant [%d] on data node shard [%d]: %v",
+					table.name, move.TenantID, dataNodeShard.DataNodeShardID, err)
+			}
+		}
+		db.Close()
+	}
+
+	timber.Infof("moved tenant [%d] from shard [%d] to shard [%d]", move.TenantID, move.SourceShardID, move.TargetShardID)
+	return nil
+}
+
+// abortTenantCutover lowers the fence so that writes to the tenant are allowed again on the source
+// shard. The move is left in the copying state so that it can be tried again.
+func (ctx *tenantContext) abortTenantCutover(move TenantMove, fence writeFence) {
+	copyingSql := goqu.
+		From("tenant_moves").
+		Where(goqu.Ex{
+			"tenant_id": move.TenantID,
+		}).
+		Update(goqu.Record{
+			"state": TenantMoveState_Copying,
+		}).Sql
+	if _, err := ctx.db.Exec(strings.Join([]string{lowerWriteFenceSql(fence), copyingSql}, ";")); err != nil {
+		timber.Errorf("could not unblock writes to tenant [%d]: %v", move.TenantID, err)
+	}
+}
+
+// getTenantMoveTables returns all of the sharded tables along with the columns needed to copy
+// a tenant's rows.
+func (ctx *tenantContext) getTenantMoveTables() ([]tenantMoveTable, error) {
+	tables, err := ctx.Tables().GetTablesByType(TableType_Sharded)
+	if err != nil {
+		return nil, err
+	}
+
+	moveTables, err := ctx.getSyncTables(tables)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, moveTable := range moveTables {
+		if moveTable.shardKey == "" {
+			return nil, fmt.Errorf("sharded table [%s] does not have a shard key", moveTable.name)
+		}
+	}
+
+	return moveTables, nil
+}
+
+// getSyncTables returns the columns needed to copy rows for each of the provided tables.
+func (ctx *base) getSyncTables(tables []Table) ([]tenantMoveTable, error) {
+	syncTables := make([]tenantMoveTable, len(tables))
+	for i, table := range tables {
+		columns, err := ctx.Tables().GetColumns(table.TableID)
+		if err != nil {
+			return nil, err
+		}
+
+		syncTable := tenantMoveTable{
+			name:        table.TableName,
+			primaryKeys: make([]string, 0),
+		}
+		for _, column := range columns {
+			if column.ShardKey {
+				syncTable.shardKey = column.ColumnName
+			}
+			if column.PrimaryKey {
+				syncTable.primaryKeys = append(syncTable.primaryKeys, column.ColumnName)
+			}
+		}
+
+		syncTables[i] = syncTable
+	}
+
+	return syncTables, nil
+}
+
+// syncTenantTable will make the tenant's rows in the target table match the rows in the source
+// table.
+func syncTenantTable(source, target *sql.DB, table tenantMoveTable, tenantId uint64) error {
+	_, err := syncTableRows(source, target, table, fmt.Sprintf("t.%s = $1", pq.QuoteIdentifier(table.shardKey)), tenantId)
+	return err
+}
+
+// syncTableRows will make the rows in the target table that match the filter the same as the rows
+// in the source table. Rows are compared using a hash of the entire row so only the rows that are
+// different are copied, this way the same function can be used for the initial copy and to catch
+// up. The filter can reference the provided arguments starting at $1. If any rows were changed in
+// the target table then true is returned.
+func syncTableRows(source, target *sql.DB, table tenantMoveTable, filter string, args ...interface{}) (bool, error) {
+	tableName := pq.QuoteIdentifier(table.name)
+
+	// If the table does not have a primary key then the entire row is used to identify it.
+	key := "t::text"
+	if len(table.primaryKeys) > 0 {
+		quoted := make([]string, len(table.primaryKeys))
+		for i, primaryKey := range table.primaryKeys {
+			quoted[i] = "t." + pq.QuoteIdentifier(primaryKey)
+		}
+		key = fmt.Sprintf("ROW(%s)::text", strings.Join(quoted, ", "))
+	}
+
+	hashQuery := fmt.Sprintf(
+		"SELECT %s, md5(t::text) FROM %s t WHERE %s", key, tableName, filter)
+
+	sourceHashes, err := getRowHashes(source, hashQuery, args...)
+	if err != nil {
+		return false, err
+	}
+
+	targetHashes, err := getRowHashes(target, hashQuery, args...)
+	if err != nil {
+		return false, err
+	}
+
+	stale, changed := make([]string, 0), make([]string, 0)
+	for key, hash := range sourceHashes {
+		if targetHash, ok := targetHashes[key]; !ok || targetHash != hash {
+			changed = append(changed, key)
+		}
+	}
+	for key, hash := range targetHashes {
+		if sourceHash, ok := sourceHashes[key]; !ok || sourceHash != hash {
+			stale = append(stale, key)
+		}
+	}
+
+	if len(stale) == 0 && len(changed) == 0 {
+		return false, nil
+	}
+
+	// The keys are passed after the filter's arguments.
+	keysParam := fmt.Sprintf("$%d", len(args)+1)
+
+	var rows sql.NullString
+	if len(changed) > 0 {
+		if err := source.QueryRow(fmt.Sprintf(
+			"SELECT json_agg(t) FROM %s t WHERE %s AND %s = ANY(%s)",
+			tableName, filter, key, keysParam), append(args, pq.Array(changed))...).Scan(&rows); err != nil {
+			return false, err
+		}
+	}
+
+	tx, err := target.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	if len(stale) > 0 {
+		if _, err := tx.Exec(fmt.Sprintf(
+			"DELETE FROM %s t WHERE %s AND %s = ANY(%s)",
+			tableName, filter, key, keysParam), append(args, pq.Array(stale))...); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	if rows.Valid {
+		if _, err := tx.Exec(fmt.Sprintf(
+			"INSERT INTO %s SELECT * FROM json_populate_recordset(NULL::%s, $1)",
+			tableName, tableName), rows.String); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func getRowHashes(db *sql.DB, query string, args ...interface{}) (map[string]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := map[string]string{}
+	for rows.Next() {
+		key, hash := "", ""
+		if err := rows.Scan(&key, &hash); err != nil {
+			return nil, err
+		}
+		hashes[key] = hash
+	}
+	return hashes, rows.Err()
+}
+
+func (ctx *tenantContext) getTenantMoves(tenantIds ...uint64) ([]TenantMove, error) {
+	query := getTenantMovesQuery
+	if len(tenantIds) > 0 {
+		query = query.Where(goqu.Ex{
+			"tenant_id": tenantIds,
+		})
+	}
+	compiledSql, _, _ := query.ToSql()
+	response, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.tenantMovesFromRows(response)
+}
+
+func (ctx *tenantContext) tenantMovesFromRows(response *frunk.QueryResponse) ([]TenantMove, error) {
+	rows := rqliter.NewRqlRows(response)
+	moves := make([]TenantMove, 0)
+	for rows.Next() {
+		move := TenantMove{}
+		if err := rows.Scan(
+			&move.TenantID,
+			&move.SourceShardID,
+			&move.TargetShardID,
+			&move.State); err != nil {
+			return nil, err
+		}
+		moves = append(moves, move)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
@@ -0,0 +1,43 @@
+package core
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/logger"
+	"github.com/elliotcourant/noahdb/pkg/tracing"
+)
+
+const (
+	traceFileMaxSize    = 64 * 1024 * 1024
+	traceFileMaxBackups = 5
+)
+
+// newTracer creates the tracer for this coordinator from the trace settings in the config. If
+// traces are not being exported then nil is returned, a nil tracer does not record any spans.
+func newTracer(config ColonyConfig, id string) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+	switch {
+	case config.TraceFile != "" && config.TraceCollector != "":
+		return nil, fmt.Errorf("traces can be written to a file or sent to a collector, but not both")
+	case config.TraceFile != "":
+		exporter = tracing.NewFileExporter(
+			logger.NewRotatingFile(config.TraceFile, traceFileMaxSize, traceFileMaxBackups))
+	case config.TraceCollector != "":
+		collector, err := tracing.NewCollectorExporter(config.TraceCollector)
+		if err != nil {
+			return nil, err
+		}
+		exporter = collector
+	default:
+		return nil, nil
+	}
+
+	return tracing.NewTracer(exporter,
+		tracing.String("service.name", "noahdb"),
+		tracing.String("service.instance.id", id)), nil
+}
+
+// Tracer returns the tracer that statements record their spans with, this will be nil if traces
+// are not being exported.
+func (ctx *base) Tracer() *tracing.Tracer {
+	return ctx.tracer
+}
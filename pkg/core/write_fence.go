@@ -0,0 +1,492 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
+	"github.com/elliotcourant/timber"
+	"github.com/readystock/goqu"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// writeFenceTimeout is how long a write will wait for a fence to be lowered, and how long the
+	// coordinator that raised a fence will wait for every coordinator to acknowledge it.
+	writeFenceTimeout = 30 * time.Second
+
+	writeFenceInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrWriteFenceChanged is returned when a write fence was raised or lowered after a write was
+	// planned. The metadata the write was routed with may have changed, so it needs to be planned
+	// again.
+	ErrWriteFenceChanged = errors.New("write fences changed while the statement was being planned")
+)
+
+var (
+	getWriteFencesQuery = goqu.
+		From("write_fences").
+		Select(
+			"fence_id",
+			"tenant_id",
+			"shard_id",
+			"data_node_shard_id")
+)
+
+type WriteFenceContext interface {
+	// Epoch changes each time a write fence is raised or lowered on this coordinator. It should be
+	// read before a statement is planned and passed to AcquireWrite.
+	Epoch() uint64
+
+	// AcquireWrite records the writes that a statement is about to send to the data nodes. If a
+	// fence is blocking any of the writes then this waits for the fence to be lowered. If the
+	// fences changed since the epoch was read then ErrWriteFenceChanged is returned and the
+	// statement needs to be planned again. Writes that are added to the same lease are held
+	// until the lease is released, which should happen once the transaction has ended.
+	AcquireWrite(lease *WriteLease, epoch uint64, writes ...Write) (*WriteLease, error)
+}
+
+type writeFenceContext struct {
+	*base
+}
+
+func (ctx *base) WriteFences() WriteFenceContext {
+	return &writeFenceContext{
+		ctx,
+	}
+}
+
+// Write is a single write that a statement sends to a data node shard.
+type Write struct {
+	// TenantIDs are the tenants that the write was routed by, this is empty if the write was not
+	// routed by a tenant.
+	TenantIDs []uint64
+
+	// ShardID is 0 for writes that are sent to every shard, like writes to global and tenant
+	// tables and changes to the schema.
+	ShardID         uint64
+	DataNodeShardID uint64
+}
+
+// WriteLease is the set of writes that a session has sent to the data nodes in its current
+// transaction. Fences are not acknowledged until the leases that were held when they were raised
+// have been released.
+type WriteLease struct {
+	fences *writeFences
+	writes []Write
+}
+
+// Release is called once the transaction that the writes belong to has ended.
+func (lease *WriteLease) Release() {
+	if lease == nil {
+		return
+	}
+	lease.fences.release(lease)
+}
+
+// writeFence blocks writes to a tenant while it is cut over to another shard, or blocks all of
+// the writes to a shard while one of its data node shards is cut over to another data node. A
+// fence for a data node shard does not have a tenant. While a data node shard is being
+// provisioned it does not receive the writes that are sent to every shard, so it is fenced
+// without a shard to block those writes while it catches up.
+type writeFence struct {
+	FenceID         uint64
+	TenantID        uint64
+	ShardID         uint64
+	DataNodeShardID uint64
+}
+
+// matches returns true if the write could change the rows that the fence is protecting.
+func (fence writeFence) matches(write Write) bool {
+	// Every write to a shard is sent to each of its data node shards. A fence for a data node
+	// shard that is being provisioned matches the writes that are sent to every shard.
+	if fence.DataNodeShardID != 0 {
+		return write.ShardID == fence.ShardID
+	}
+
+	if len(write.TenantIDs) == 0 {
+		return write.ShardID != 0 && write.ShardID == fence.ShardID
+	}
+
+	for _, tenantId := range write.TenantIDs {
+		if tenantId == fence.TenantID {
+			return true
+		}
+	}
+	return false
+}
+
+func (fence writeFence) blockedError() error {
+	if fence.DataNodeShardID != 0 && fence.ShardID == 0 {
+		return fmt.Errorf("writes to every shard are blocked while data node shard [%d] is being provisioned, try again later",
+			fence.DataNodeShardID)
+	}
+	if fence.DataNodeShardID != 0 {
+		return fmt.Errorf("writes to shard [%d] are blocked while data node shard [%d] is being moved, try again later",
+			fence.ShardID, fence.DataNodeShardID)
+	}
+	return fmt.Errorf("writes to tenant [%d] are blocked while it is being moved, try again later", fence.TenantID)
+}
+
+// activeWriteFence is a fence that this coordinator is enforcing.
+type activeWriteFence struct {
+	writeFence
+
+	// pending are the leases that could have been writing to the tenant when the fence was
+	// raised. The fence is acknowledged once all of them have been released.
+	pending map[*WriteLease]bool
+}
+
+// writeFences are the fences that this coordinator is enforcing and the writes that are running.
+type writeFences struct {
+	sync.Mutex
+	changed *sync.Cond
+
+	epoch  uint64
+	active map[uint64]*activeWriteFence
+	leases map[*WriteLease]bool
+
+	// refresh is signaled when the write_fences table is changed.
+	refresh chan struct{}
+}
+
+func newWriteFences() *writeFences {
+	fences := &writeFences{
+		active:  map[uint64]*activeWriteFence{},
+		leases:  map[*WriteLease]bool{},
+		refresh: make(chan struct{}, 1),
+	}
+	fences.changed = sync.NewCond(fences)
+	return fences
+}
+
+// observe is called as changes are applied to the internal store, the fences are read again if
+// they might have changed.
+func (fences *writeFences) observe(queries []string) {
+	changed := queries == nil
+	for _, query := range queries {
+		if strings.Contains(query, "write_fences") {
+			changed = true
+			break
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	select {
+	case fences.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// update replaces the fences being enforced with the fences that are raised. The fences that were
+// not being enforced yet are returned so they can be acknowledged.
+func (fences *writeFences) update(raised []writeFence) []*activeWriteFence {
+	fences.Lock()
+	defer fences.Unlock()
+
+	ids := map[uint64]bool{}
+	added := make([]*activeWriteFence, 0)
+	for _, fence := range raised {
+		ids[fence.FenceID] = true
+		if _, ok := fences.active[fence.FenceID]; ok {
+			continue
+		}
+
+		active := &activeWriteFence{
+			writeFence: fence,
+			pending:    map[*WriteLease]bool{},
+		}
+		for lease := range fences.leases {
+			for _, write := range lease.writes {
+				if fence.matches(write) {
+					active.pending[lease] = true
+					break
+				}
+			}
+		}
+		fences.active[fence.FenceID] = active
+		added = append(added, active)
+	}
+
+	lowered := false
+	for id := range fences.active {
+		if !ids[id] {
+			delete(fences.active, id)
+			lowered = true
+		}
+	}
+
+	if len(added) > 0 || lowered {
+		fences.epoch++
+		fences.changed.Broadcast()
+	}
+
+	return added
+}
+
+// drained waits until the writes that were running when the fence was raised have finished. If
+// the fence is lowered first then false is returned.
+func (fences *writeFences) drained(fence *activeWriteFence) bool {
+	fences.Lock()
+	defer fences.Unlock()
+	for len(fence.pending) > 0 && fences.active[fence.FenceID] == fence {
+		fences.changed.Wait()
+	}
+	return fences.active[fence.FenceID] == fence
+}
+
+// blocking returns the fence that is blocking any of the writes. Fences that were raised while
+// the lease was already held are waiting for the lease to be released, so they cannot block it.
+func (fences *writeFences) blocking(lease *WriteLease, writes []Write) (writeFence, bool) {
+	for _, fence := range fences.active {
+		if lease != nil && fence.pending[lease] {
+			continue
+		}
+		for _, write := range writes {
+			if fence.matches(write) {
+				return fence.writeFence, true
+			}
+		}
+	}
+	return writeFence{}, false
+}
+
+func (fences *writeFences) acquire(lease *WriteLease, epoch uint64, writes []Write) (*WriteLease, error) {
+	fences.Lock()
+	defer fences.Unlock()
+
+	deadline := time.Now().Add(writeFenceTimeout)
+	waited := false
+	for {
+		fence, blocked := fences.blocking(lease, writes)
+		if !blocked {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return lease, fence.blockedError()
+		}
+
+		// sync.Cond can't wait with a timeout, so the waiters are woken up at the deadline.
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			fences.Lock()
+			defer fences.Unlock()
+			fences.changed.Broadcast()
+		})
+		fences.changed.Wait()
+		timer.Stop()
+		waited = true
+	}
+
+	// If we had to wait for a fence, or a fence was raised or lowered since the statement was
+	// planned, then the writes might be going to the wrong shard.
+	if waited || epoch != fences.epoch {
+		return lease, ErrWriteFenceChanged
+	}
+
+	if lease == nil {
+		lease = &WriteLease{
+			fences: fences,
+		}
+	}
+	lease.writes = append(lease.writes, writes...)
+	fences.leases[lease] = true
+	return lease, nil
+}
+
+func (fences *writeFences) release(lease *WriteLease) {
+	fences.Lock()
+	defer fences.Unlock()
+	delete(fences.leases, lease)
+	for _, fence := range fences.active {
+		delete(fence.pending, lease)
+	}
+	lease.writes = nil
+	fences.changed.Broadcast()
+}
+
+func (ctx *writeFenceContext) Epoch() uint64 {
+	ctx.fences.Lock()
+	defer ctx.fences.Unlock()
+	return ctx.fences.epoch
+}
+
+func (ctx *writeFenceContext) AcquireWrite(lease *WriteLease, epoch uint64, writes ...Write) (*WriteLease, error) {
+	return ctx.fences.acquire(lease, epoch, writes)
+}
+
+// watchWriteFences enforces the fences that are raised in the internal store. Once the writes
+// that were running when a fence was raised have finished the fence is acknowledged, that way
+// the coordinator that raised it knows that no coordinator is still writing to the fenced rows.
+func (ctx *base) watchWriteFences() {
+	for {
+		raised, err := ctx.getWriteFences()
+		if err != nil {
+			timber.Warningf("could not retrieve write fences: %v", err)
+		} else {
+			for _, fence := range ctx.fences.update(raised) {
+				go ctx.acknowledgeWriteFence(fence)
+			}
+		}
+
+		<-ctx.fences.refresh
+	}
+}
+
+func (ctx *base) acknowledgeWriteFence(fence *activeWriteFence) {
+	if !ctx.fences.drained(fence) {
+		return
+	}
+
+	// The fence might be lowered before the acknowledgement is applied, so it is only recorded
+	// if the fence still exists.
+	compiledSql := fmt.Sprintf(
+		"INSERT INTO write_fence_acks (fence_id, coordinator_id) SELECT %d, %s "+
+			"WHERE EXISTS (SELECT 1 FROM write_fences WHERE fence_id = %d) "+
+			"AND NOT EXISTS (SELECT 1 FROM write_fence_acks WHERE fence_id = %d AND coordinator_id = %s)",
+		fence.FenceID, quoteText(ctx.db.ID()), fence.FenceID, fence.FenceID, quoteText(ctx.db.ID()))
+	if _, err := ctx.db.Exec(compiledSql); err != nil {
+		timber.Errorf("could not acknowledge write fence [%d]: %v", fence.FenceID, err)
+	}
+}
+
+// raiseWriteFence blocks writes to the fence's tenant or data node shard on every coordinator.
+// Any fence for the same tenant or data node shard that was left behind by a move that was
+// interrupted is replaced. The provided statements are applied together with the fence.
+func (ctx *base) raiseWriteFence(fence writeFence, statements ...string) (writeFence, error) {
+	id, err := ctx.db.NextSequenceValueById(writeFenceIdSequencePath)
+	if err != nil {
+		return fence, err
+	}
+	fence.FenceID = id
+
+	replaced := goqu.Ex{
+		"tenant_id": fence.TenantID,
+	}
+	if fence.DataNodeShardID != 0 {
+		replaced = goqu.Ex{
+			"data_node_shard_id": fence.DataNodeShardID,
+		}
+	}
+	deleteSql := goqu.
+		From("write_fences").
+		Where(replaced).
+		Delete().Sql
+	insertSql := goqu.
+		From("write_fences").
+		Insert(goqu.Record{
+			"fence_id":           fence.FenceID,
+			"tenant_id":          fence.TenantID,
+			"shard_id":           fence.ShardID,
+			"data_node_shard_id": fence.DataNodeShardID,
+		}).Sql
+	statements = append([]string{deleteSql, insertSql}, statements...)
+	if _, err := ctx.db.Exec(strings.Join(statements, ";")); err != nil {
+		return fence, err
+	}
+	return fence, nil
+}
+
+// lowerWriteFenceSql returns the statement that lowers the fence, it should be applied together
+// with the changes that the fence was protecting.
+func lowerWriteFenceSql(fence writeFence) string {
+	return goqu.
+		From("write_fences").
+		Where(goqu.Ex{
+			"fence_id": fence.FenceID,
+		}).
+		Delete().Sql
+}
+
+// awaitWriteFence waits for every coordinator in the cluster to acknowledge the fence. Once they
+// have, none of them are writing to the fenced rows and none of them will until the fence is
+// lowered.
+func (ctx *base) awaitWriteFence(fence writeFence) error {
+	deadline := time.Now().Add(writeFenceTimeout)
+	for {
+		servers, err := ctx.db.Nodes()
+		if err != nil {
+			return err
+		}
+
+		compiledSql, _, _ := goqu.
+			From("write_fence_acks").
+			Select("coordinator_id").
+			Where(goqu.Ex{
+				"fence_id": fence.FenceID,
+			}).
+			ToSql()
+		response, err := ctx.db.Query(compiledSql)
+		if err != nil {
+			return err
+		}
+
+		acknowledged := map[string]bool{}
+		rows := rqliter.NewRqlRows(response)
+		for rows.Next() {
+			coordinatorId := ""
+			if err := rows.Scan(&coordinatorId); err != nil {
+				return err
+			}
+			acknowledged[coordinatorId] = true
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		missing := make([]string, 0)
+		for _, server := range servers {
+			if !acknowledged[server.ID] {
+				missing = append(missing, server.ID)
+			}
+		}
+
+		if len(missing) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if fence.DataNodeShardID != 0 && fence.ShardID == 0 {
+				return fmt.Errorf("timed out waiting for coordinators %v to finish writing to every shard",
+					missing)
+			}
+			if fence.DataNodeShardID != 0 {
+				return fmt.Errorf("timed out waiting for coordinators %v to finish writing to shard [%d]",
+					missing, fence.ShardID)
+			}
+			return fmt.Errorf("timed out waiting for coordinators %v to finish writing to tenant [%d]",
+				missing, fence.TenantID)
+		}
+
+		time.Sleep(writeFenceInterval)
+	}
+}
+
+func (ctx *base) getWriteFences() ([]writeFence, error) {
+	compiledSql, _, _ := getWriteFencesQuery.ToSql()
+	response, err := ctx.db.Query(compiledSql)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := rqliter.NewRqlRows(response)
+	fences := make([]writeFence, 0)
+	for rows.Next() {
+		fence := writeFence{}
+		if err := rows.Scan(
+			&fence.FenceID,
+			&fence.TenantID,
+			&fence.ShardID,
+			&fence.DataNodeShardID); err != nil {
+			return nil, err
+		}
+		fences = append(fences, fence)
+	}
+	return fences, rows.Err()
+}
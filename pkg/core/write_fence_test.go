@@ -0,0 +1,149 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestWriteFences_Acquire(t *testing.T) {
+	fence := writeFence{
+		FenceID:  1,
+		TenantID: 5,
+		ShardID:  2,
+	}
+	write := Write{
+		TenantIDs: []uint64{5},
+		ShardID:   2,
+	}
+
+	t.Run("writes to other tenants are not blocked", func(t *testing.T) {
+		fences := newWriteFences()
+		fences.update([]writeFence{fence})
+
+		lease, err := fences.acquire(nil, fences.epoch, []Write{{TenantIDs: []uint64{6}, ShardID: 2}})
+		assert.NoError(t, err)
+		assert.NotNil(t, lease)
+		lease.Release()
+	})
+
+	t.Run("changes since planning are reported", func(t *testing.T) {
+		fences := newWriteFences()
+		epoch := fences.epoch
+
+		// A fence is raised and lowered again while the write is being planned.
+		fences.update([]writeFence{fence})
+		fences.update(nil)
+
+		_, err := fences.acquire(nil, epoch, []Write{write})
+		assert.Equal(t, ErrWriteFenceChanged, err)
+
+		lease, err := fences.acquire(nil, fences.epoch, []Write{write})
+		assert.NoError(t, err)
+		lease.Release()
+	})
+
+	t.Run("blocked writes wait for the fence to be lowered", func(t *testing.T) {
+		fences := newWriteFences()
+		fences.update([]writeFence{fence})
+		epoch := fences.epoch
+
+		acquired := make(chan error, 1)
+		go func() {
+			_, err := fences.acquire(nil, epoch, []Write{write})
+			acquired <- err
+		}()
+
+		select {
+		case <-acquired:
+			t.Fatal("write was not blocked by the fence")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		fences.update(nil)
+		assert.Equal(t, ErrWriteFenceChanged, <-acquired)
+	})
+
+	t.Run("fence waits for leases held when it was raised", func(t *testing.T) {
+		fences := newWriteFences()
+		lease, err := fences.acquire(nil, fences.epoch, []Write{write})
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		added := fences.update([]writeFence{fence})
+		if !assert.Len(t, added, 1) {
+			panic("fence was not added")
+		}
+
+		// The transaction that was already writing to the tenant can keep writing to it.
+		lease, err = fences.acquire(lease, fences.epoch, []Write{write})
+		assert.NoError(t, err)
+
+		drained := make(chan bool, 1)
+		go func() {
+			drained <- fences.drained(added[0])
+		}()
+
+		select {
+		case <-drained:
+			t.Fatal("fence was drained while a lease was still held")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		lease.Release()
+		assert.True(t, <-drained)
+	})
+
+	t.Run("lowered fences are not drained", func(t *testing.T) {
+		fences := newWriteFences()
+		lease, err := fences.acquire(nil, fences.epoch, []Write{write})
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		added := fences.update([]writeFence{fence})
+		fences.update(nil)
+		assert.False(t, fences.drained(added[0]))
+		lease.Release()
+	})
+}
+
+func TestWriteFence_Matches(t *testing.T) {
+	t.Run("tenant fence", func(t *testing.T) {
+		fence := writeFence{
+			FenceID:  1,
+			TenantID: 5,
+			ShardID:  2,
+		}
+		assert.True(t, fence.matches(Write{TenantIDs: []uint64{5}, ShardID: 2}))
+		assert.False(t, fence.matches(Write{TenantIDs: []uint64{6}, ShardID: 2}))
+		assert.True(t, fence.matches(Write{ShardID: 2}))
+		assert.False(t, fence.matches(Write{ShardID: 3}))
+	})
+
+	t.Run("data node shard fence", func(t *testing.T) {
+		fence := writeFence{
+			FenceID:         1,
+			ShardID:         2,
+			DataNodeShardID: 7,
+		}
+		// Every write to the shard is blocked, no matter which tenant it belongs to.
+		assert.True(t, fence.matches(Write{TenantIDs: []uint64{5}, ShardID: 2}))
+		assert.True(t, fence.matches(Write{TenantIDs: []uint64{6}, ShardID: 2, DataNodeShardID: 8}))
+		assert.True(t, fence.matches(Write{ShardID: 2}))
+		assert.False(t, fence.matches(Write{TenantIDs: []uint64{5}, ShardID: 3}))
+		assert.False(t, fence.matches(Write{DataNodeShardID: 8}))
+	})
+
+	t.Run("provisioning fence", func(t *testing.T) {
+		fence := writeFence{
+			FenceID:         1,
+			DataNodeShardID: 7,
+		}
+		// Writes that are sent to every shard are blocked, writes to a single shard are not.
+		assert.True(t, fence.matches(Write{DataNodeShardID: 8}))
+		assert.True(t, fence.matches(Write{}))
+		assert.False(t, fence.matches(Write{TenantIDs: []uint64{5}, ShardID: 2, DataNodeShardID: 8}))
+	})
+}
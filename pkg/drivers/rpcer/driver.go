@@ -120,3 +120,77 @@ func (rpc *RpcDriver) GetSequenceChunk(name string) (*pgproto.SequenceChunkRespo
 		return nil, fmt.Errorf("could not handle response message when discovering: %v", msg)
 	}
 }
+
+// Execute sends queries to the leader of the cluster to be applied to the internal store.
+func (rpc *RpcDriver) Execute(queries []string, atomic bool) (*pgproto.CommandResponse, error) {
+	if err := rpc.front.Send(&pgproto.CommandRequest{
+		CommandType: pgproto.RpcCommandType_Execute,
+		Queries:     queries,
+		Atomic:      atomic,
+	}); err != nil {
+		return nil, err
+	}
+
+	response, err := rpc.front.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg := response.(type) {
+	case *pgproto.CommandResponse:
+		return msg, nil
+	case *pgproto.ErrorResponse:
+		return nil, fmt.Errorf("could not execute on leader: %s", msg.Message)
+	default:
+		return nil, fmt.Errorf("could not handle response message when executing: %v", msg)
+	}
+}
+
+// GetStatementStatistics retrieves the statistics of the statements that have been run on the
+// remote coordinator.
+func (rpc *RpcDriver) GetStatementStatistics() ([]pgproto.StatementStatistic, error) {
+	response, err := rpc.statementStatistics(&pgproto.StatementStatisticsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return response.Statements, nil
+}
+
+// ResetStatementStatistics clears the statistics of the statements that have been run on the
+// remote coordinator, if a fingerprint is provided then only that statement is cleared. The
+// number of statements that were cleared is returned.
+func (rpc *RpcDriver) ResetStatementStatistics(fingerprint string) (uint64, error) {
+	response, err := rpc.statementStatistics(&pgproto.StatementStatisticsRequest{
+		Reset:       true,
+		Fingerprint: fingerprint,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return response.Removed, nil
+}
+
+func (rpc *RpcDriver) statementStatistics(request *pgproto.StatementStatisticsRequest) (*pgproto.StatementStatisticsResponse, error) {
+	if err := rpc.front.Send(request); err != nil {
+		return nil, err
+	}
+
+	response, err := rpc.front.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg := response.(type) {
+	case *pgproto.StatementStatisticsResponse:
+		return msg, nil
+	case *pgproto.ErrorResponse:
+		return nil, fmt.Errorf("could not retrieve statement statistics: %s", msg.Message)
+	default:
+		return nil, fmt.Errorf("could not handle response message when retrieving statement statistics: %v", msg)
+	}
+}
+
+// Close closes the connection to the remote coordinator.
+func (rpc *RpcDriver) Close() error {
+	return rpc.conn.Close()
+}
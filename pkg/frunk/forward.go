@@ -0,0 +1,96 @@
+package frunk
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/drivers/rpcer"
+	"github.com/elliotcourant/noahdb/pkg/pgproto"
+	"github.com/elliotcourant/noahdb/pkg/util"
+	"github.com/elliotcourant/timber"
+	sdb "github.com/rqlite/rqlite/db"
+	"time"
+)
+
+// forwardExecute sends an execute request to the leader of the cluster, only the leader can apply
+// changes. Once the leader has applied the change this store waits until the same raft index has
+// been applied locally, that way the caller will be able to read its own write.
+func (s *Store) forwardExecute(ex *ExecuteRequest) (*ExecuteResponse, error) {
+	start := time.Now()
+
+	response, err := func() (*pgproto.CommandResponse, error) {
+		s.leaderClientSync.Lock()
+		defer s.leaderClientSync.Unlock()
+
+		driver, err := s.getLeaderClient()
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := driver.Execute(ex.Queries, ex.Atomic)
+		if err != nil {
+			// The connection might be broken, the next change will connect to the leader again.
+			s.closeLeaderClient()
+			return nil, err
+		}
+		return response, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.WaitForAppliedIndex(response.Index, s.ApplyTimeout); err != nil {
+		return nil, fmt.Errorf("change was applied by the leader but not by this node: %v", err)
+	}
+
+	results := make([]*sdb.Result, len(response.Results))
+	for i, result := range response.Results {
+		results[i] = &sdb.Result{
+			LastInsertID: result.LastInsertID,
+			RowsAffected: result.RowsAffected,
+			Error:        result.Error,
+		}
+	}
+
+	return &ExecuteResponse{
+		Results: results,
+		Time:    time.Since(start).Seconds(),
+		Raft:    RaftResponse{response.Index, s.raftID},
+	}, nil
+}
+
+// getLeaderClient returns the driver for the current leader. A new driver is connected if there
+// is not one yet, or if the leader has changed since it was connected. The caller must hold
+// leaderClientSync.
+func (s *Store) getLeaderClient() (*rpcer.RpcDriver, error) {
+	leaderAddr, err := util.ResolveAddress(s.LeaderAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	if s.leaderClient != nil && s.leaderClientAddr == leaderAddr {
+		return s.leaderClient, nil
+	}
+
+	s.closeLeaderClient()
+
+	timber.Verbosef("connecting to leader [%s] to forward changes", leaderAddr)
+	driver, err := rpcer.NewRPCDriver(s.ID(), nil, leaderAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.leaderClient, s.leaderClientAddr = driver, leaderAddr
+	return driver, nil
+}
+
+// closeLeaderClient closes the driver for the leader if there is one. The caller must hold
+// leaderClientSync.
+func (s *Store) closeLeaderClient() {
+	if s.leaderClient == nil {
+		return
+	}
+
+	if err := s.leaderClient.Close(); err != nil {
+		timber.Debugf("could not close connection to leader [%s]: %v", s.leaderClientAddr, err)
+	}
+	s.leaderClient, s.leaderClientAddr = nil, ""
+}
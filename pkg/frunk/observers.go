@@ -0,0 +1,22 @@
+package frunk
+
+// ExecuteObserver is called each time queries that change the database have been applied by
+// the state machine. This happens on every node in the cluster. When the entire database has
+// been replaced, like when a snapshot is restored, the observer is called with nil queries.
+type ExecuteObserver func(queries []string)
+
+// RegisterExecuteObserver adds an observer that will be called each time the database is
+// changed. Observers are called while the change is being applied, so they should not block.
+func (s *Store) RegisterExecuteObserver(observer ExecuteObserver) {
+	s.executeObserversSync.Lock()
+	defer s.executeObserversSync.Unlock()
+	s.executeObservers = append(s.executeObservers, observer)
+}
+
+func (s *Store) notifyExecuteObservers(queries []string) {
+	s.executeObserversSync.RLock()
+	defer s.executeObserversSync.RUnlock()
+	for _, observer := range s.executeObservers {
+		observer(queries)
+	}
+}
@@ -221,7 +221,14 @@ type Store struct {
 	sequenceChunks    map[string]*SequenceChunk
 	sequenceCache     map[string]*pgproto.Sequence
 
-	leaderClient *rpcer.RpcDriver
+	// leaderClient is used to forward changes to the leader, it is replaced when the leader
+	// changes. Only one request can use it at a time.
+	leaderClientSync sync.Mutex
+	leaderClient     *rpcer.RpcDriver
+	leaderClientAddr string
+
+	executeObserversSync sync.RWMutex
+	executeObservers     []ExecuteObserver
 }
 
 // StoreConfig represents the configuration of the underlying Store.
@@ -444,6 +451,10 @@ func (s *Store) Close(wait bool) error {
 	close(s.done)
 	s.wg.Wait()
 
+	s.leaderClientSync.Lock()
+	s.closeLeaderClient()
+	s.leaderClientSync.Unlock()
+
 	// XXX CLOSE OTHER CONNECTIONS
 	if err := s.dbConn.Close(); err != nil {
 		return err
@@ -620,6 +631,11 @@ func (s *Store) WaitForAppliedIndex(idx uint64, timeout time.Duration) error {
 	}
 }
 
+// RaftStats returns the stats reported by raft, such as the current term and commit index.
+func (s *Store) RaftStats() map[string]string {
+	return s.raft.Stats()
+}
+
 // Stats returns stats for the store.
 func (s *Store) Stats() (map[string]interface{}, error) {
 	fkEnabled, err := s.dbConn.FKConstraints()
@@ -890,11 +906,15 @@ func (s *Store) execute(c *Connection, ex *ExecuteRequest) (*ExecuteResponse, er
 	start := time.Now()
 
 	if !s.IsLeader() {
-		leaderAddr, err := s.WaitForLeader(time.Second * 5)
-		if err != nil {
+		if _, err := s.WaitForLeader(time.Second * 5); err != nil {
 			return nil, err
 		}
-		timber.Infof("leader address [%s]", leaderAddr)
+
+		// Only the leader can apply changes, so if we are still not the leader once there is one
+		// then the change needs to be sent to the leader.
+		if !s.IsLeader() {
+			return s.forwardExecute(ex)
+		}
 	}
 
 	d := &databaseSub{
@@ -1193,6 +1213,7 @@ func (s *Store) Apply(l *raft.Log) interface{} {
 			txChange := NewTxStateChange(conn)
 			r, err := conn.db.Execute(d.Queries, d.Atomic, d.Timings)
 			txChange.CheckAndSet()
+			s.notifyExecuteObservers(d.Queries)
 			return &fsmExecuteResponse{results: r, error: err}
 		}
 		r, err := conn.db.Query(d.Queries, d.Atomic, d.Timings)
@@ -1420,6 +1441,7 @@ func (s *Store) Restore(rc io.ReadCloser) error {
 	if err := s.dbConn.Load(conn); err != nil {
 		return err
 	}
+	s.notifyExecuteObservers(nil)
 
 	// Get size of meta, read those bytes, and set to meta.
 	if err := binary.Read(rc, binary.LittleEndian, &sz); err != nil {
@@ -0,0 +1,65 @@
+package logger
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile_Write(t *testing.T) {
+	directory, err := ioutil.TempDir("", "noahdb-rotate")
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "logs", "test.log")
+	file := NewRotatingFile(path, 10, 2)
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		n, err := file.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+
+	read := func(path string) string {
+		contents, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		return string(contents)
+	}
+
+	// Each line puts the file over its maximum size, so every line ends up in its own file and
+	// the first line is removed once there are more than two backups.
+	assert.Equal(t, "fourth\n", read(path))
+	assert.Equal(t, "third\n", read(path+".1"))
+	assert.Equal(t, "second\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRotatingFile_Reopen(t *testing.T) {
+	directory, err := ioutil.TempDir("", "noahdb-rotate")
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "test.log")
+	file := NewRotatingFile(path, 10, 1)
+	_, err = file.Write([]byte("first\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	// The size of the existing file is used when it is opened again.
+	file = NewRotatingFile(path, 10, 1)
+	defer file.Close()
+	_, err = file.Write([]byte("second\n"))
+	assert.NoError(t, err)
+
+	contents, err := ioutil.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, "first\n", string(contents))
+}
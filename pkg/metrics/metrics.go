@@ -0,0 +1,393 @@
+// Package metrics exposes coordinator metrics in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	contentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// DefaultBuckets are the upper bounds in seconds of the buckets used for latency histograms.
+	DefaultBuckets = []float64{
+		0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+	}
+)
+
+type family interface {
+	name() string
+	write(buf *bytes.Buffer)
+}
+
+// Registry holds all of the metrics for a single coordinator.
+type Registry struct {
+	sync.RWMutex
+	families map[string]family
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		families: map[string]family{},
+	}
+}
+
+func (r *Registry) register(f family) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.families[f.name()]; ok {
+		panic(fmt.Sprintf("metric [%s] is already registered", f.name()))
+	}
+	r.families[f.name()] = f
+}
+
+// WriteTo writes every metric in the registry to the writer, metrics are sorted by name so the
+// output is stable between scrapes.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.RLock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make([]family, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		families[i] = r.families[name]
+	}
+	r.RUnlock()
+
+	buf := &bytes.Buffer{}
+	for _, f := range families {
+		f.write(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP lets the registry be used as the handler for a scrape endpoint.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	_, _ = r.WriteTo(w)
+}
+
+// Serve listens on the address and serves the registry at /metrics until the listener fails.
+func Serve(addr string, registry *Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	return http.ListenAndServe(addr, mux)
+}
+
+type desc struct {
+	metricName string
+	help       string
+	labelNames []string
+}
+
+func (d desc) name() string {
+	return d.metricName
+}
+
+func (d desc) writeHeader(buf *bytes.Buffer, metricType string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", d.metricName, escapeHelp(d.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", d.metricName, metricType)
+}
+
+func (d desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf(
+			"metric [%s] expects %d label value(s), got %d",
+			d.metricName, len(d.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// writeSample writes a single line of the exposition, extra is an additional label like the le
+// label of a histogram bucket.
+func writeSample(buf *bytes.Buffer, name string, labelNames, labelValues []string, extra string, value float64) {
+	buf.WriteString(name)
+	if len(labelNames) > 0 || extra != "" {
+		pairs := make([]string, 0, len(labelNames)+1)
+		for i, labelName := range labelNames {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labelName, escapeLabel(labelValues[i])))
+		}
+		if extra != "" {
+			pairs = append(pairs, extra)
+		}
+		buf.WriteString("{")
+		buf.WriteString(strings.Join(pairs, ","))
+		buf.WriteString("}")
+	}
+	buf.WriteString(" ")
+	buf.WriteString(formatFloat(value))
+	buf.WriteString("\n")
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+// sortedSeries returns the series in a stable order.
+func sortedSeries(values map[string]*series) []*series {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*series, len(keys))
+	for i, key := range keys {
+		result[i] = values[key]
+	}
+	return result
+}
+
+// CounterVec is a counter that only ever increases, partitioned by its labels.
+type CounterVec struct {
+	desc
+	sync.Mutex
+	values map[string]*series
+}
+
+// NewCounterVec creates a counter and adds it to the registry.
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	counter := &CounterVec{
+		desc:   desc{metricName: name, help: help, labelNames: labelNames},
+		values: map[string]*series{},
+	}
+	r.register(counter)
+	return counter
+}
+
+// Inc increments the counter for the label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the label values, the delta cannot be negative.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter [%s] cannot decrease", c.metricName))
+	}
+	key := c.key(labelValues)
+	c.Lock()
+	defer c.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		c.values[key] = s
+	}
+	s.value += delta
+}
+
+func (c *CounterVec) write(buf *bytes.Buffer) {
+	c.Lock()
+	defer c.Unlock()
+	c.writeHeader(buf, "counter")
+	for _, s := range sortedSeries(c.values) {
+		writeSample(buf, c.metricName, c.labelNames, s.labelValues, "", s.value)
+	}
+}
+
+// GaugeVec is a value that can go up and down, partitioned by its labels.
+type GaugeVec struct {
+	desc
+	sync.Mutex
+	values map[string]*series
+}
+
+// NewGaugeVec creates a gauge and adds it to the registry.
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	gauge := &GaugeVec{
+		desc:   desc{metricName: name, help: help, labelNames: labelNames},
+		values: map[string]*series{},
+	}
+	r.register(gauge)
+	return gauge
+}
+
+// Set replaces the value of the gauge for the label values.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.Lock()
+	defer g.Unlock()
+	g.values[key] = &series{labelValues: labelValues, value: value}
+}
+
+// Add changes the value of the gauge for the label values by delta.
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.Lock()
+	defer g.Unlock()
+	s, ok := g.values[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		g.values[key] = s
+	}
+	s.value += delta
+}
+
+// Inc increases the gauge for the label values by one.
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec decreases the gauge for the label values by one.
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *GaugeVec) write(buf *bytes.Buffer) {
+	g.Lock()
+	defer g.Unlock()
+	g.writeHeader(buf, "gauge")
+	for _, s := range sortedSeries(g.values) {
+		writeSample(buf, g.metricName, g.labelNames, s.labelValues, "", s.value)
+	}
+}
+
+// GaugeCollector is called each time the registry is scraped, it should call emit once for
+// every series of the gauge with the current value.
+type GaugeCollector func(emit func(value float64, labelValues ...string))
+
+type gaugeFunc struct {
+	desc
+	collect GaugeCollector
+}
+
+// NewGaugeFunc adds a gauge whose values are read at scrape time. This is used for values that
+// are already tracked somewhere else, like raft's commit index or the size of a pool.
+func (r *Registry) NewGaugeFunc(name, help string, collect GaugeCollector, labelNames ...string) {
+	r.register(&gaugeFunc{
+		desc:    desc{metricName: name, help: help, labelNames: labelNames},
+		collect: collect,
+	})
+}
+
+func (g *gaugeFunc) write(buf *bytes.Buffer) {
+	values := map[string]*series{}
+	g.collect(func(value float64, labelValues ...string) {
+		values[g.key(labelValues)] = &series{labelValues: labelValues, value: value}
+	})
+	g.writeHeader(buf, "gauge")
+	for _, s := range sortedSeries(values) {
+		writeSample(buf, g.metricName, g.labelNames, s.labelValues, "", s.value)
+	}
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// HistogramVec counts observations into buckets, partitioned by its labels.
+type HistogramVec struct {
+	desc
+	sync.Mutex
+	buckets []float64
+	values  map[string]*histogramSeries
+}
+
+// NewHistogramVec creates a histogram and adds it to the registry. If no buckets are provided
+// then the DefaultBuckets are used.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	histogram := &HistogramVec{
+		desc:    desc{metricName: name, help: help, labelNames: labelNames},
+		buckets: sorted,
+		values:  map[string]*histogramSeries{},
+	}
+	r.register(histogram)
+	return histogram
+}
+
+// Observe adds the value to the histogram for the label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// ObserveDuration adds the duration in seconds to the histogram for the label values.
+func (h *HistogramVec) ObserveDuration(duration time.Duration, labelValues ...string) {
+	h.Observe(duration.Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(buf *bytes.Buffer) {
+	h.Lock()
+	defer h.Unlock()
+	h.writeHeader(buf, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.values[key]
+		for i, bound := range h.buckets {
+			writeSample(buf, h.metricName+"_bucket", h.labelNames, s.labelValues,
+				fmt.Sprintf(`le="%s"`, formatFloat(bound)), float64(s.counts[i]))
+		}
+		writeSample(buf, h.metricName+"_bucket", h.labelNames, s.labelValues,
+			`le="+Inf"`, float64(s.count))
+		writeSample(buf, h.metricName+"_sum", h.labelNames, s.labelValues, "", s.sum)
+		writeSample(buf, h.metricName+"_count", h.labelNames, s.labelValues, "", float64(s.count))
+	}
+}
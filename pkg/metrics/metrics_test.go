@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	t.Run("counter", func(t *testing.T) {
+		registry := NewRegistry()
+		counter := registry.NewCounterVec("test_total", "A test counter.", "type")
+		counter.Inc("select")
+		counter.Add(2, "insert")
+
+		buf := &bytes.Buffer{}
+		_, err := registry.WriteTo(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "# HELP test_total A test counter.\n"+
+			"# TYPE test_total counter\n"+
+			`test_total{type="insert"} 2`+"\n"+
+			`test_total{type="select"} 1`+"\n", buf.String())
+	})
+
+	t.Run("gauge", func(t *testing.T) {
+		registry := NewRegistry()
+		gauge := registry.NewGaugeVec("test_gauge", "A test gauge.")
+		gauge.Inc()
+		gauge.Inc()
+		gauge.Dec()
+
+		buf := &bytes.Buffer{}
+		_, err := registry.WriteTo(buf)
+		assert.NoError(t, err)
+		assert.Contains(t, buf.String(), "test_gauge 1\n")
+	})
+
+	t.Run("gauge func", func(t *testing.T) {
+		registry := NewRegistry()
+		registry.NewGaugeFunc("test_size", "A test gauge func.", func(emit func(float64, ...string)) {
+			emit(3, "2")
+			emit(5, "1")
+		}, "id")
+
+		buf := &bytes.Buffer{}
+		_, err := registry.WriteTo(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "# HELP test_size A test gauge func.\n"+
+			"# TYPE test_size gauge\n"+
+			`test_size{id="1"} 5`+"\n"+
+			`test_size{id="2"} 3`+"\n", buf.String())
+	})
+
+	t.Run("histogram", func(t *testing.T) {
+		registry := NewRegistry()
+		histogram := registry.NewHistogramVec("test_seconds", "A test histogram.", []float64{1, 0.1})
+		histogram.Observe(0.05)
+		histogram.Observe(0.5)
+		histogram.Observe(2)
+
+		buf := &bytes.Buffer{}
+		_, err := registry.WriteTo(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "# HELP test_seconds A test histogram.\n"+
+			"# TYPE test_seconds histogram\n"+
+			`test_seconds_bucket{le="0.1"} 1`+"\n"+
+			`test_seconds_bucket{le="1"} 2`+"\n"+
+			`test_seconds_bucket{le="+Inf"} 3`+"\n"+
+			"test_seconds_sum 2.55\n"+
+			"test_seconds_count 3\n", buf.String())
+	})
+
+	t.Run("escaped label", func(t *testing.T) {
+		registry := NewRegistry()
+		registry.NewCounterVec("test_total", "A test counter.", "error").Inc(`bad "value"`)
+
+		buf := &bytes.Buffer{}
+		_, err := registry.WriteTo(buf)
+		assert.NoError(t, err)
+		assert.Contains(t, buf.String(), `test_total{error="bad \"value\""} 1`)
+	})
+
+	t.Run("duplicate metric", func(t *testing.T) {
+		registry := NewRegistry()
+		registry.NewCounterVec("test_total", "A test counter.")
+		assert.Panics(t, func() {
+			registry.NewGaugeVec("test_total", "A test gauge.")
+		})
+	})
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("test_total", "A test counter.").Inc()
+
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	response, err := server.Client().Get(server.URL)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, contentType, response.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "test_total 1\n")
+}
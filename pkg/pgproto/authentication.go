@@ -1,6 +1,7 @@
 package pgproto
 
 import (
+	"bytes"
 	"encoding/binary"
 
 	"github.com/pkg/errors"
@@ -11,6 +12,9 @@ const (
 	AuthTypeOk                = 0
 	AuthTypeCleartextPassword = 3
 	AuthTypeMD5Password       = 5
+	AuthTypeSASL              = 10
+	AuthTypeSASLContinue      = 11
+	AuthTypeSASLFinal         = 12
 )
 
 type Authentication struct {
@@ -18,6 +22,12 @@ type Authentication struct {
 
 	// MD5Password fields
 	Salt [4]byte
+
+	// SASL fields
+	SASLAuthMechanisms []string
+
+	// SASLContinue and SASLFinal fields
+	SASLData []byte
 }
 
 func (*Authentication) Backend() {}
@@ -30,6 +40,19 @@ func (dst *Authentication) Decode(src []byte) error {
 	case AuthTypeCleartextPassword:
 	case AuthTypeMD5Password:
 		copy(dst.Salt[:], src[4:8])
+	case AuthTypeSASL:
+		authMechanisms := src[4:]
+		for len(authMechanisms) > 1 {
+			idx := bytes.IndexByte(authMechanisms, 0)
+			if idx < 0 {
+				return errors.Errorf("invalid SASL authentication mechanisms")
+			}
+			dst.SASLAuthMechanisms = append(dst.SASLAuthMechanisms, string(authMechanisms[:idx]))
+			authMechanisms = authMechanisms[idx+1:]
+		}
+	case AuthTypeSASLContinue, AuthTypeSASLFinal:
+		// The source buffer is reused for the next message so the data needs to be copied.
+		dst.SASLData = append([]byte{}, src[4:]...)
 	default:
 		return errors.Errorf("unknown authentication type: %d", dst.Type)
 	}
@@ -46,6 +69,14 @@ func (src *Authentication) Encode(dst []byte) []byte {
 	switch src.Type {
 	case AuthTypeMD5Password:
 		dst = append(dst, src.Salt[:]...)
+	case AuthTypeSASL:
+		for _, authMechanism := range src.SASLAuthMechanisms {
+			dst = append(dst, authMechanism...)
+			dst = append(dst, 0)
+		}
+		dst = append(dst, 0)
+	case AuthTypeSASLContinue, AuthTypeSASLFinal:
+		dst = append(dst, src.SASLData...)
 	}
 
 	pgio.SetInt32(dst[sp:], int32(len(dst[sp:])))
@@ -0,0 +1,49 @@
+package pgproto
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAuthentication(t *testing.T) {
+	t.Run("encode and decode sasl", func(t *testing.T) {
+		item := Authentication{
+			Type: AuthTypeSASL,
+			SASLAuthMechanisms: []string{
+				"SCRAM-SHA-256-PLUS",
+				"SCRAM-SHA-256",
+			},
+		}
+		encoded := item.Encode(nil)
+		decodeEntry := Authentication{}
+		err := decodeEntry.Decode(encoded[5:])
+		assert.NoError(t, err)
+		assert.Equal(t, item, decodeEntry)
+	})
+
+	t.Run("encode and decode sasl continue", func(t *testing.T) {
+		item := Authentication{
+			Type:     AuthTypeSASLContinue,
+			SASLData: []byte("r=nonce,s=salt,i=4096"),
+		}
+		encoded := item.Encode(nil)
+		decodeEntry := Authentication{}
+		err := decodeEntry.Decode(encoded[5:])
+		assert.NoError(t, err)
+		assert.Equal(t, item, decodeEntry)
+	})
+}
+
+func TestSASLInitialResponse(t *testing.T) {
+	t.Run("encode and decode", func(t *testing.T) {
+		item := SASLInitialResponse{
+			AuthMechanism: "SCRAM-SHA-256",
+			Data:          []byte("n,,n=,r=nonce"),
+		}
+		encoded := item.Encode(nil)
+		decodeEntry := SASLInitialResponse{}
+		err := decodeEntry.Decode(encoded[5:])
+		assert.NoError(t, err)
+		assert.Equal(t, item, decodeEntry)
+	})
+}
@@ -29,6 +29,10 @@ type CommandRequest struct {
 	Queries         []string
 	KeyValueSets    []KeyValue
 	KeyValueDeletes [][]byte
+
+	// Atomic is used with RpcCommandType_Execute, when it is true all of the queries will be
+	// applied in a single transaction.
+	Atomic bool
 }
 
 func (CommandRequest) Frontend() {}
@@ -78,6 +82,10 @@ func (item *CommandRequest) Decode(src []byte) error {
 
 		item.KeyValueDeletes[i] = buf.Next(size)
 	}
+
+	if atomic := buf.Next(1); len(atomic) == 1 {
+		item.Atomic = atomic[0] == 1
+	}
 	return nil
 }
 
@@ -125,6 +133,8 @@ func (item *CommandRequest) Encode(dst []byte) []byte {
 		dst = append(dst, deleteBytes...)
 	}
 
+	dst = pgio.AppendBool(dst, item.Atomic)
+
 	pgio.SetInt32(dst[sp:], int32(len(dst[sp:])))
 	return dst
 }
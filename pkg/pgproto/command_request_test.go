@@ -29,6 +29,7 @@ func TestCommandRequest(t *testing.T) {
 				[]byte("test"),
 				[]byte("asnjkldgjkas"),
 			},
+			Atomic: true,
 		}
 		encoded := item.Encode(nil)
 		fmt.Println(hex.Dump(encoded))
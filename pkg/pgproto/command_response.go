@@ -0,0 +1,67 @@
+package pgproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/elliotcourant/noahdb/pkg/pgio"
+)
+
+// CommandResult is the result of a single query in a CommandRequest.
+type CommandResult struct {
+	LastInsertID int64
+	RowsAffected int64
+	Error        string
+}
+
+// CommandResponse is sent by the leader once the queries in a CommandRequest have been applied.
+// Index is the raft index of the change so that the coordinator that sent the request can wait
+// for the change to be applied locally.
+type CommandResponse struct {
+	Index   uint64
+	Results []CommandResult
+}
+
+func (CommandResponse) Backend() {}
+
+func (CommandResponse) RpcBackend() {}
+
+func (item *CommandResponse) Decode(src []byte) error {
+	*item = CommandResponse{}
+	buf := bytes.NewBuffer(src)
+
+	item.Index = binary.BigEndian.Uint64(buf.Next(8))
+
+	numberOfResults := int(binary.BigEndian.Uint16(buf.Next(2)))
+	item.Results = make([]CommandResult, numberOfResults)
+	for i := 0; i < numberOfResults; i++ {
+		result := CommandResult{}
+		result.LastInsertID = int64(binary.BigEndian.Uint64(buf.Next(8)))
+		result.RowsAffected = int64(binary.BigEndian.Uint64(buf.Next(8)))
+
+		errorLength := int(int32(binary.BigEndian.Uint32(buf.Next(4))))
+		result.Error = string(buf.Next(errorLength))
+
+		item.Results[i] = result
+	}
+
+	return nil
+}
+
+func (item *CommandResponse) Encode(dst []byte) []byte {
+	dst = append(dst, RpcCommandResponse)
+	sp := len(dst)
+	dst = pgio.AppendInt32(dst, -1)
+
+	dst = pgio.AppendUint64(dst, item.Index)
+
+	dst = pgio.AppendUint16(dst, uint16(len(item.Results)))
+	for _, result := range item.Results {
+		dst = pgio.AppendInt64(dst, result.LastInsertID)
+		dst = pgio.AppendInt64(dst, result.RowsAffected)
+		dst = pgio.AppendInt32(dst, int32(len(result.Error)))
+		dst = append(dst, result.Error...)
+	}
+
+	pgio.SetInt32(dst[sp:], int32(len(dst[sp:])))
+	return dst
+}
@@ -0,0 +1,28 @@
+package pgproto
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCommandResponse(t *testing.T) {
+	t.Run("encode and decode", func(t *testing.T) {
+		item := CommandResponse{
+			Index: 42,
+			Results: []CommandResult{
+				{
+					LastInsertID: 7,
+					RowsAffected: 1,
+				},
+				{
+					Error: "UNIQUE constraint failed: data_nodes.address, data_nodes.port",
+				},
+			},
+		}
+		encoded := item.Encode(nil)
+		decodeEntry := CommandResponse{}
+		err := decodeEntry.Decode(encoded[5:])
+		assert.NoError(t, err)
+		assert.Equal(t, item, decodeEntry)
+	})
+}
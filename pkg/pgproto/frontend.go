@@ -110,6 +110,10 @@ func (b *Frontend) Receive() (BackendMessage, error) {
 		msg = &DiscoveryResponse{}
 	case RpcSequenceResponse:
 		msg = &SequenceChunkResponse{}
+	case RpcCommandResponse:
+		msg = &CommandResponse{}
+	case RpcStatementStatisticsResponse:
+		msg = &StatementStatisticsResponse{}
 	default:
 		return nil, errors.Errorf("unknown message type: %c", b.msgType)
 	}
@@ -97,6 +97,11 @@ const (
 	RpcCommandRequest   = '$'
 	RpcCommandResponse  = '~'
 
+	// RpcStatementStatisticsRequest asks a coordinator for the statistics of the statements it
+	// has run, it can also be used to reset them.
+	RpcStatementStatisticsRequest  = '%'
+	RpcStatementStatisticsResponse = '^'
+
 	// Both
 	PgCopyData = 'd'
 	PgCopyDone = 'c'
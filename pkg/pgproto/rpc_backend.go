@@ -55,6 +55,10 @@ func (b *RpcBackend) Receive() (RpcFrontendMessage, error) {
 		msg = &b.join
 	case RpcSequenceRequest:
 		msg = &SequenceRequest{}
+	case RpcCommandRequest:
+		msg = &CommandRequest{}
+	case RpcStatementStatisticsRequest:
+		msg = &StatementStatisticsRequest{}
 	default:
 		return nil, fmt.Errorf("unknown message type: %c", b.msgType)
 	}
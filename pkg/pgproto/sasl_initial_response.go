@@ -0,0 +1,71 @@
+package pgproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/readystock/pgx/pgio"
+)
+
+type SASLInitialResponse struct {
+	AuthMechanism string
+	Data          []byte
+}
+
+func (*SASLInitialResponse) Frontend() {}
+
+func (dst *SASLInitialResponse) Decode(src []byte) error {
+	*dst = SASLInitialResponse{}
+
+	idx := bytes.IndexByte(src, 0)
+	if idx < 0 {
+		return errors.Errorf("invalid SASL initial response")
+	}
+	dst.AuthMechanism = string(src[:idx])
+	src = src[idx+1:]
+
+	if len(src) < 4 {
+		return errors.Errorf("invalid SASL initial response")
+	}
+	dataLength := int32(binary.BigEndian.Uint32(src))
+	src = src[4:]
+	// A length of -1 means there is no initial response data.
+	if dataLength >= 0 {
+		if int(dataLength) > len(src) {
+			return errors.Errorf("invalid SASL initial response")
+		}
+		dst.Data = append([]byte{}, src[:dataLength]...)
+	}
+
+	return nil
+}
+
+func (src *SASLInitialResponse) Encode(dst []byte) []byte {
+	dst = append(dst, 'p')
+	sp := len(dst)
+	dst = pgio.AppendInt32(dst, -1)
+
+	dst = append(dst, src.AuthMechanism...)
+	dst = append(dst, 0)
+
+	dst = pgio.AppendInt32(dst, int32(len(src.Data)))
+	dst = append(dst, src.Data...)
+
+	pgio.SetInt32(dst[sp:], int32(len(dst[sp:])))
+
+	return dst
+}
+
+func (src *SASLInitialResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type          string
+		AuthMechanism string
+		Data          string
+	}{
+		Type:          "SASLInitialResponse",
+		AuthMechanism: src.AuthMechanism,
+		Data:          string(src.Data),
+	})
+}
@@ -0,0 +1,36 @@
+package pgproto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/readystock/pgx/pgio"
+)
+
+// SSLRequest is sent instead of a startup message to ask the server to upgrade the connection to
+// TLS. The server responds with a single byte, 'S' if it is willing to use TLS or 'N' if not.
+type SSLRequest struct{}
+
+func (*SSLRequest) Frontend() {}
+
+func (dst *SSLRequest) Decode(src []byte) error {
+	if len(src) != 4 || binary.BigEndian.Uint32(src) != sslRequestNumber {
+		return errors.Errorf("invalid ssl request")
+	}
+	return nil
+}
+
+func (src *SSLRequest) Encode(dst []byte) []byte {
+	dst = pgio.AppendInt32(dst, 8)
+	dst = pgio.AppendInt32(dst, sslRequestNumber)
+	return dst
+}
+
+func (src *SSLRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type string
+	}{
+		Type: "SSLRequest",
+	})
+}
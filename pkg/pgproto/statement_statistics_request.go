@@ -0,0 +1,44 @@
+package pgproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/elliotcourant/noahdb/pkg/pgio"
+)
+
+// StatementStatisticsRequest asks a coordinator for the statistics of the statements that it has
+// run. If Reset is true then the statistics are cleared instead, if a Fingerprint is provided then
+// only that statement is cleared.
+type StatementStatisticsRequest struct {
+	Reset       bool
+	Fingerprint string
+}
+
+func (StatementStatisticsRequest) Frontend() {}
+
+func (StatementStatisticsRequest) RpcFrontend() {}
+
+func (item *StatementStatisticsRequest) Decode(src []byte) error {
+	*item = StatementStatisticsRequest{}
+	buf := bytes.NewBuffer(src)
+
+	item.Reset = buf.Next(1)[0] == 1
+
+	fingerprintLength := int(int32(binary.BigEndian.Uint32(buf.Next(4))))
+	item.Fingerprint = string(buf.Next(fingerprintLength))
+
+	return nil
+}
+
+func (item *StatementStatisticsRequest) Encode(dst []byte) []byte {
+	dst = append(dst, RpcStatementStatisticsRequest)
+	sp := len(dst)
+	dst = pgio.AppendInt32(dst, -1)
+
+	dst = pgio.AppendBool(dst, item.Reset)
+	dst = pgio.AppendInt32(dst, int32(len(item.Fingerprint)))
+	dst = append(dst, item.Fingerprint...)
+
+	pgio.SetInt32(dst[sp:], int32(len(dst[sp:])))
+	return dst
+}
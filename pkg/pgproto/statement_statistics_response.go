@@ -0,0 +1,97 @@
+package pgproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/elliotcourant/noahdb/pkg/pgio"
+)
+
+// StatementStatistic is the statistics for a single normalized statement on a coordinator. The
+// times are in nanoseconds.
+type StatementStatistic struct {
+	Fingerprint string
+	Query       string
+	Calls       uint64
+	Errors      uint64
+	Rows        uint64
+	TotalTime   int64
+	MaxTime     int64
+	ShardIDs    []uint64
+}
+
+// StatementStatisticsResponse is sent in response to a StatementStatisticsRequest. When the
+// statistics were reset Removed is the number of statements that were cleared.
+type StatementStatisticsResponse struct {
+	Statements []StatementStatistic
+	Removed    uint64
+}
+
+func (StatementStatisticsResponse) Backend() {}
+
+func (StatementStatisticsResponse) RpcBackend() {}
+
+func (item *StatementStatisticsResponse) Decode(src []byte) error {
+	*item = StatementStatisticsResponse{}
+	buf := bytes.NewBuffer(src)
+
+	numberOfStatements := int(binary.BigEndian.Uint32(buf.Next(4)))
+	item.Statements = make([]StatementStatistic, numberOfStatements)
+	for i := 0; i < numberOfStatements; i++ {
+		statement := StatementStatistic{}
+
+		fingerprintLength := int(int32(binary.BigEndian.Uint32(buf.Next(4))))
+		statement.Fingerprint = string(buf.Next(fingerprintLength))
+
+		queryLength := int(int32(binary.BigEndian.Uint32(buf.Next(4))))
+		statement.Query = string(buf.Next(queryLength))
+
+		statement.Calls = binary.BigEndian.Uint64(buf.Next(8))
+		statement.Errors = binary.BigEndian.Uint64(buf.Next(8))
+		statement.Rows = binary.BigEndian.Uint64(buf.Next(8))
+		statement.TotalTime = int64(binary.BigEndian.Uint64(buf.Next(8)))
+		statement.MaxTime = int64(binary.BigEndian.Uint64(buf.Next(8)))
+
+		numberOfShards := int(binary.BigEndian.Uint16(buf.Next(2)))
+		statement.ShardIDs = make([]uint64, numberOfShards)
+		for x := 0; x < numberOfShards; x++ {
+			statement.ShardIDs[x] = binary.BigEndian.Uint64(buf.Next(8))
+		}
+
+		item.Statements[i] = statement
+	}
+
+	item.Removed = binary.BigEndian.Uint64(buf.Next(8))
+
+	return nil
+}
+
+func (item *StatementStatisticsResponse) Encode(dst []byte) []byte {
+	dst = append(dst, RpcStatementStatisticsResponse)
+	sp := len(dst)
+	dst = pgio.AppendInt32(dst, -1)
+
+	dst = pgio.AppendUint32(dst, uint32(len(item.Statements)))
+	for _, statement := range item.Statements {
+		dst = pgio.AppendInt32(dst, int32(len(statement.Fingerprint)))
+		dst = append(dst, statement.Fingerprint...)
+
+		dst = pgio.AppendInt32(dst, int32(len(statement.Query)))
+		dst = append(dst, statement.Query...)
+
+		dst = pgio.AppendUint64(dst, statement.Calls)
+		dst = pgio.AppendUint64(dst, statement.Errors)
+		dst = pgio.AppendUint64(dst, statement.Rows)
+		dst = pgio.AppendInt64(dst, statement.TotalTime)
+		dst = pgio.AppendInt64(dst, statement.MaxTime)
+
+		dst = pgio.AppendUint16(dst, uint16(len(statement.ShardIDs)))
+		for _, shardId := range statement.ShardIDs {
+			dst = pgio.AppendUint64(dst, shardId)
+		}
+	}
+
+	dst = pgio.AppendUint64(dst, item.Removed)
+
+	pgio.SetInt32(dst[sp:], int32(len(dst[sp:])))
+	return dst
+}
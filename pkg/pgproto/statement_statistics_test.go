@@ -0,0 +1,51 @@
+package pgproto
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStatementStatisticsRequest(t *testing.T) {
+	t.Run("encode and decode", func(t *testing.T) {
+		item := StatementStatisticsRequest{
+			Reset:       true,
+			Fingerprint: "02a281c251c3a43d2fe7457dff01f76c5cc523f8c8",
+		}
+		encoded := item.Encode(nil)
+		decodeEntry := StatementStatisticsRequest{}
+		err := decodeEntry.Decode(encoded[5:])
+		assert.NoError(t, err)
+		assert.Equal(t, item, decodeEntry)
+	})
+}
+
+func TestStatementStatisticsResponse(t *testing.T) {
+	t.Run("encode and decode", func(t *testing.T) {
+		item := StatementStatisticsResponse{
+			Statements: []StatementStatistic{
+				{
+					Fingerprint: "02a281c251c3a43d2fe7457dff01f76c5cc523f8c8",
+					Query:       "SELECT * FROM accounts WHERE account_id = $1",
+					Calls:       12,
+					Errors:      1,
+					Rows:        11,
+					TotalTime:   4500000,
+					MaxTime:     1200000,
+					ShardIDs:    []uint64{1, 3},
+				},
+				{
+					Fingerprint: "0231b4f4b9b39b0e6a4e3bd8e5bcbd2a4bb2ed8e59",
+					Query:       "BEGIN",
+					Calls:       3,
+					ShardIDs:    []uint64{},
+				},
+			},
+			Removed: 2,
+		}
+		encoded := item.Encode(nil)
+		decodeEntry := StatementStatisticsResponse{}
+		err := decodeEntry.Decode(encoded[5:])
+		assert.NoError(t, err)
+		assert.Equal(t, item, decodeEntry)
+	})
+}
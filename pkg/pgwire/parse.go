@@ -9,10 +9,13 @@ import (
 	"github.com/elliotcourant/noahdb/pkg/types"
 	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
 	"github.com/readystock/golog"
+	"time"
 )
 
 func (wire *wireServer) handleParse(parseMessage *pgproto.Parse) error {
+	parseStart := time.Now()
 	parseTree, err := ast.Parse(parseMessage.Query)
+	parseDuration := time.Since(parseStart)
 	if err != nil {
 		return err
 	}
@@ -62,9 +65,12 @@ func (wire *wireServer) handleParse(parseMessage *pgproto.Parse) error {
 	}
 
 	return wire.StatementBuffer().Push(commands.PrepareStatement{
-		Name:         parseMessage.Name,
-		Statement:    stmt,
-		TypeHints:    sqlTypeHints,
-		RawTypeHints: rawTypeHints,
+		Name:          parseMessage.Name,
+		Statement:     stmt,
+		TypeHints:     sqlTypeHints,
+		RawTypeHints:  rawTypeHints,
+		Query:         parseMessage.Query,
+		ParseStart:    parseStart,
+		ParseDuration: parseDuration,
 	})
 }
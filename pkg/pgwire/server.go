@@ -73,7 +73,9 @@ func NewServer(colony core.Colony, transport TransportWrapper) error {
 					return
 				}
 			} else {
+				colony.Metrics().ConnectionOpened()
 				defer func() {
+					colony.Metrics().ConnectionClosed()
 					if err := conn.Close(); err != nil {
 						log.Warningf("error returned when closing connection: %v", err)
 					}
@@ -91,6 +93,9 @@ type wireServer struct {
 	backend *pgproto.Backend
 	stmtBuf stmtbuf.StatementBuffer
 	log     timber.Logger
+
+	// user is the name of the user that the client connected as.
+	user string
 }
 
 func newWire(colony core.Colony, reader io.Reader, writer io.Writer, logger timber.Logger) (*wireServer, error) {
@@ -111,6 +116,8 @@ func (wire *wireServer) Serve(startupMsg pgproto.StartupMessage) error {
 		return wire.Errorf("user authentication required")
 	} else if username := strings.ToLower(strings.TrimSpace(user)); username != "noah" {
 		return wire.Errorf("user [%s] does not exist", username)
+	} else {
+		wire.user = username
 	}
 
 	switch startupMsg.ProtocolVersion {
@@ -222,6 +229,10 @@ func (wire *wireServer) StatementBuffer() stmtbuf.StatementBuffer {
 	return wire.stmtBuf
 }
 
+func (wire *wireServer) User() string {
+	return wire.user
+}
+
 func (wire *wireServer) Colony() core.Colony {
 	return wire.colony
 }
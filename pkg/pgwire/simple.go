@@ -5,10 +5,13 @@ import (
 	"github.com/elliotcourant/noahdb/pkg/ast"
 	"github.com/elliotcourant/noahdb/pkg/commands"
 	"github.com/elliotcourant/noahdb/pkg/pgproto"
+	"time"
 )
 
 func (wire *wireServer) handleSimpleQuery(parseMessage *pgproto.Query) error {
+	parseStart := time.Now()
 	parseTree, err := ast.Parse(parseMessage.String)
+	parseDuration := time.Since(parseStart)
 	if err != nil {
 		return err
 	}
@@ -26,6 +29,9 @@ func (wire *wireServer) handleSimpleQuery(parseMessage *pgproto.Query) error {
 	}
 
 	return wire.StatementBuffer().Push(commands.ExecuteStatement{
-		Statement: stmt,
+		Statement:     stmt,
+		Query:         parseMessage.String,
+		ParseStart:    parseStart,
+		ParseDuration: parseDuration,
 	})
 }
@@ -0,0 +1,37 @@
+package rpcwire
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/frunk"
+	"github.com/elliotcourant/noahdb/pkg/pgproto"
+)
+
+// handleCommand applies changes that were forwarded by a coordinator that is not the leader.
+func (wire *rpcWire) handleCommand(command *pgproto.CommandRequest) error {
+	switch command.CommandType {
+	case pgproto.RpcCommandType_Execute:
+		response, err := wire.colony.Execute(&frunk.ExecuteRequest{
+			Queries: command.Queries,
+			Atomic:  command.Atomic,
+		})
+		if err != nil {
+			return err
+		}
+
+		results := make([]pgproto.CommandResult, len(response.Results))
+		for i, result := range response.Results {
+			results[i] = pgproto.CommandResult{
+				LastInsertID: result.LastInsertID,
+				RowsAffected: result.RowsAffected,
+				Error:        result.Error,
+			}
+		}
+
+		return wire.backend.Send(&pgproto.CommandResponse{
+			Index:   response.Raft.Index,
+			Results: results,
+		})
+	default:
+		return fmt.Errorf("cannot handle command type [%d]", command.CommandType)
+	}
+}
@@ -87,6 +87,14 @@ func serveRpcConnection(colony core.Colony, conn net.Conn) error {
 				Offset: chunk.Offset,
 				Count:  chunk.Offset,
 			})
+		case *pgproto.CommandRequest:
+			if err := wire.handleCommand(message); err != nil {
+				backend.Send(&pgproto.ErrorResponse{Message: err.Error()})
+			}
+		case *pgproto.StatementStatisticsRequest:
+			if err := wire.handleStatementStatistics(message); err != nil {
+				backend.Send(&pgproto.ErrorResponse{Message: err.Error()})
+			}
 		case *pgproto.Terminate:
 			return nil
 		default:
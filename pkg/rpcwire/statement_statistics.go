@@ -0,0 +1,34 @@
+package rpcwire
+
+import (
+	"github.com/elliotcourant/noahdb/pkg/pgproto"
+)
+
+// handleStatementStatistics returns or resets the statistics of the statements that have been
+// run on this coordinator, this is used to build the view of the statistics for the cluster.
+func (wire *rpcWire) handleStatementStatistics(request *pgproto.StatementStatisticsRequest) error {
+	if request.Reset {
+		return wire.backend.Send(&pgproto.StatementStatisticsResponse{
+			Removed: wire.colony.Statistics().ResetLocalStatementStatistics(request.Fingerprint),
+		})
+	}
+
+	statistics := wire.colony.Statistics().GetLocalStatementStatistics()
+	statements := make([]pgproto.StatementStatistic, len(statistics))
+	for i, statistic := range statistics {
+		statements[i] = pgproto.StatementStatistic{
+			Fingerprint: statistic.Fingerprint,
+			Query:       statistic.Query,
+			Calls:       statistic.Calls,
+			Errors:      statistic.Errors,
+			Rows:        statistic.Rows,
+			TotalTime:   int64(statistic.TotalTime),
+			MaxTime:     int64(statistic.MaxTime),
+			ShardIDs:    statistic.ShardIDs,
+		}
+	}
+
+	return wire.backend.Send(&pgproto.StatementStatisticsResponse{
+		Statements: statements,
+	})
+}
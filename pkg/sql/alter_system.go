@@ -0,0 +1,67 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
+)
+
+type alterSystemStmtPlanner struct {
+	tree ast.AlterSystemStmt
+}
+
+func newAlterSystemStatementPlan(tree ast.AlterSystemStmt) *alterSystemStmtPlanner {
+	return &alterSystemStmtPlanner{
+		tree: tree,
+	}
+}
+
+// getNoahQueryPlan changes a cluster setting with ALTER SYSTEM SET. Settings are stored by the
+// coordinators, so the statement is never sent to the data nodes.
+func (stmt *alterSystemStmtPlanner) getNoahQueryPlan(s *session) (InitialPlan, bool, error) {
+	if s.GetTransactionState() != TransactionState_None {
+		return InitialPlan{}, false, fmt.Errorf("ALTER SYSTEM cannot run inside a transaction block")
+	}
+
+	setStmt := stmt.tree.Setstmt
+	if setStmt == nil || setStmt.Name == nil {
+		return InitialPlan{}, false, fmt.Errorf("ALTER SYSTEM requires a setting")
+	}
+
+	if setStmt.Kind != ast.VAR_SET_VALUE {
+		return InitialPlan{}, false, fmt.Errorf("only ALTER SYSTEM SET is supported")
+	}
+
+	if len(setStmt.Args.Items) != 1 {
+		return InitialPlan{}, false, fmt.Errorf("SET %s takes only one argument", *setStmt.Name)
+	}
+
+	if err := setNoahSetting(s, *setStmt.Name, setStmt.Args.Items[0]); err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	return InitialPlan{
+		Target:     PlanTarget_COORDINATOR,
+		CommandTag: stmt.tree.StatementTag(),
+	}, true, nil
+}
+
+// setNoahSetting changes the value of the setting with the provided name for the entire cluster.
+// The value is validated against the type of the setting by the colony.
+func setNoahSetting(s *session, name string, value ast.Node) error {
+	setting, ok, err := s.Colony().Setting().GetSettingByName(name)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("unrecognized configuration parameter \"%s\"", name)
+	}
+
+	text, err := queryutil.GetStringValue(value, s.arguments.values())
+	if err != nil {
+		return err
+	}
+
+	return s.Colony().Setting().SetSetting(setting.SettingID, text)
+}
@@ -14,15 +14,19 @@ func (s *session) addPortal(
 	preparedStatementName string,
 	stmt *PreparedStatement,
 	args []types.Value,
+	rawArgs [][]byte,
+	argFormatCodes []pgwirebase.FormatCode,
 	columnFormatCodes []pgwirebase.FormatCode) error {
 	if _, ok := s.portals[portalName]; ok {
 		panic(fmt.Sprintf("portal already exists: %s", portalName))
 	}
 
 	portal := &PreparedPortal{
-		Stmt:       stmt,
-		Qargs:      args,
-		OutFormats: columnFormatCodes,
+		Stmt:           stmt,
+		Qargs:          args,
+		Args:           rawArgs,
+		ArgFormatCodes: argFormatCodes,
+		OutFormats:     columnFormatCodes,
 	}
 	s.portals[portalName] = portalEntry{
 		PreparedPortal: portal,
@@ -102,6 +106,8 @@ func (s *session) executeBind(bind commands.BindStatement, result *commands.Comm
 		bind.PreparedStatementName,
 		ps.PreparedStatement,
 		args,
+		bind.Args,
+		argFormatCodes,
 		bind.OutFormats); err != nil {
 		return err
 	}
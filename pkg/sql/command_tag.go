@@ -0,0 +1,96 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// commandTag is a parsed representation of the tag sent in a CommandComplete message by a data
+// node shard, such as "UPDATE 37" or "INSERT 0 5".
+type commandTag struct {
+	Command string
+	OID     uint64
+	Rows    uint64
+	HasRows bool
+}
+
+// shardCommandTag is the command tag received from a single data node shard while executing an
+// expanded plan.
+type shardCommandTag struct {
+	ShardID uint64
+	Tag     commandTag
+}
+
+// parseCommandTag will take the raw tag from a CommandComplete message and parse the command
+// and the row count if one is present. Tags without a row count like "CREATE TABLE" are returned
+// with HasRows set to false.
+func parseCommandTag(tag string) commandTag {
+	fields := strings.Fields(tag)
+	if len(fields) == 0 {
+		return commandTag{}
+	}
+
+	rows, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return commandTag{
+			Command: tag,
+		}
+	}
+
+	result := commandTag{
+		Command: fields[0],
+		Rows:    rows,
+		HasRows: true,
+	}
+
+	// INSERT tags include the OID of the inserted row before the row count.
+	if fields[0] == "INSERT" && len(fields) == 3 {
+		result.OID, _ = strconv.ParseUint(fields[1], 10, 64)
+	}
+
+	return result
+}
+
+// String will return the tag in the format that is expected in a CommandComplete message.
+func (tag commandTag) String() string {
+	if !tag.HasRows {
+		return tag.Command
+	}
+	if tag.Command == "INSERT" {
+		return tag.Command + " " + strconv.FormatUint(tag.OID, 10) + " " + strconv.FormatUint(tag.Rows, 10)
+	}
+	return tag.Command + " " + strconv.FormatUint(tag.Rows, 10)
+}
+
+// combineCommandTags takes the command tags received from each data node shard and returns the
+// single tag that should be sent to the client. If no tags were received then false is returned.
+func combineCommandTags(strategy CommandTagStrategy, tags []shardCommandTag) (commandTag, bool) {
+	if len(tags) == 0 {
+		return commandTag{}, false
+	}
+
+	switch strategy {
+	case CommandTagStrategy_SPLIT:
+		// Each shard received a different part of the statement, but a shard may be stored on
+		// more than one data node. So we only want to count one replica of each shard.
+		combined := commandTag{
+			Command: tags[0].Tag.Command,
+			HasRows: tags[0].Tag.HasRows,
+		}
+		counted := map[uint64]struct{}{}
+		for _, tag := range tags {
+			if _, ok := counted[tag.ShardID]; ok {
+				continue
+			}
+			counted[tag.ShardID] = struct{}{}
+			combined.Rows += tag.Tag.Rows
+		}
+		return combined, true
+	default:
+		// Every data node shard holds a copy of the same rows, so any one of the tags
+		// represents the whole statement. The OID is not meaningful across data nodes.
+		combined := tags[0].Tag
+		combined.OID = 0
+		return combined, true
+	}
+}
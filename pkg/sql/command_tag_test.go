@@ -0,0 +1,62 @@
+package sql
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseCommandTag(t *testing.T) {
+	t.Run("update", func(t *testing.T) {
+		tag := parseCommandTag("UPDATE 37")
+		assert.Equal(t, commandTag{Command: "UPDATE", Rows: 37, HasRows: true}, tag)
+		assert.Equal(t, "UPDATE 37", tag.String())
+	})
+
+	t.Run("insert", func(t *testing.T) {
+		tag := parseCommandTag("INSERT 0 5")
+		assert.Equal(t, commandTag{Command: "INSERT", Rows: 5, HasRows: true}, tag)
+		assert.Equal(t, "INSERT 0 5", tag.String())
+	})
+
+	t.Run("without rows", func(t *testing.T) {
+		tag := parseCommandTag("CREATE TABLE")
+		assert.Equal(t, commandTag{Command: "CREATE TABLE"}, tag)
+		assert.Equal(t, "CREATE TABLE", tag.String())
+	})
+}
+
+func TestCombineCommandTags(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		_, ok := combineCommandTags(CommandTagStrategy_SPLIT, nil)
+		assert.False(t, ok)
+	})
+
+	t.Run("replicated", func(t *testing.T) {
+		tag, ok := combineCommandTags(CommandTagStrategy_REPLICATED, []shardCommandTag{
+			{ShardID: 1, Tag: parseCommandTag("INSERT 0 3")},
+			{ShardID: 2, Tag: parseCommandTag("INSERT 0 3")},
+			{ShardID: 3, Tag: parseCommandTag("INSERT 0 3")},
+		})
+		assert.True(t, ok)
+		assert.Equal(t, "INSERT 0 3", tag.String())
+	})
+
+	t.Run("split", func(t *testing.T) {
+		tag, ok := combineCommandTags(CommandTagStrategy_SPLIT, []shardCommandTag{
+			{ShardID: 1, Tag: parseCommandTag("UPDATE 12")},
+			{ShardID: 2, Tag: parseCommandTag("UPDATE 25")},
+		})
+		assert.True(t, ok)
+		assert.Equal(t, "UPDATE 37", tag.String())
+	})
+
+	t.Run("split with replicas", func(t *testing.T) {
+		tag, ok := combineCommandTags(CommandTagStrategy_SPLIT, []shardCommandTag{
+			{ShardID: 1, Tag: parseCommandTag("INSERT 0 2")},
+			{ShardID: 1, Tag: parseCommandTag("INSERT 0 2")},
+			{ShardID: 2, Tag: parseCommandTag("INSERT 0 4")},
+		})
+		assert.True(t, ok)
+		assert.Equal(t, "INSERT 0 6", tag.String())
+	})
+}
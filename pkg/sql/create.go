@@ -28,7 +28,9 @@ func newCreateStatementPlan(tree ast.CreateStmt) *createStmtPlanner {
 func (stmt *createStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, error) {
 	// schemaName := *stmt.tree.Relation.Schemaname
 	tableName := *stmt.tree.Relation.Relname
+	metadataSpan := s.startMetadataSpan("GetTables")
 	tables, err := s.Colony().Tables().GetTables(tableName)
+	endSpan(metadataSpan, err)
 	if err != nil {
 		return InitialPlan{}, false, fmt.Errorf("could not verify table doesn't exit: %v", err)
 	}
@@ -46,7 +48,9 @@ func (stmt *createStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 
 	// We want to verify that if they are creating a tenant table that it is the only one.
 	if stmt.table.TableType == core.TableType_Tenant {
+		metadataSpan := s.startMetadataSpan("GetTenantTable")
 		tenantTable, ok, err := s.Colony().Tables().GetTenantTable()
+		endSpan(metadataSpan, err)
 		if err != nil {
 			return InitialPlan{}, false, fmt.Errorf("could not verify tenant table: %v", err)
 		}
@@ -59,16 +63,20 @@ func (stmt *createStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 		return InitialPlan{}, false, err
 	}
 
-	stmt.table, stmt.columns, err = s.Colony().Tables().NewTable(stmt.table, stmt.columns)
+	compiledQuery, err := stmt.tree.Deparse(ast.Context_None)
 	if err != nil {
-		return InitialPlan{}, false, fmt.Errorf("could not create table internally: %v", err)
+		return InitialPlan{}, false, fmt.Errorf("could not recompile query: %v", err)
 	}
 
-	compiledQuery, err := stmt.tree.Deparse(ast.Context_None)
+	stmt.table, stmt.columns, err = s.Colony().Tables().NewTable(stmt.table, stmt.columns)
 	if err != nil {
-		return InitialPlan{}, false, fmt.Errorf("could not recompile query: %v", err)
+		return InitialPlan{}, false, fmt.Errorf("could not create table internally: %v", err)
 	}
 
+	// The table is created in the metadata now so that the statements that follow it in the same
+	// transaction can use it. If the table could not be created on the data nodes then it is
+	// removed again.
+	tableId := stmt.table.TableID
 	return InitialPlan{
 		Target:  PlanTarget_STANDARD,
 		ShardID: 0,
@@ -78,6 +86,12 @@ func (stmt *createStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 				Type:  stmt.tree.StatementType(),
 			},
 		},
+		SchemaChange: &schemaChange{
+			query: compiledQuery,
+			rollback: func() error {
+				return s.Colony().Tables().DropTable(tableId)
+			},
+		},
 	}, true, nil
 }
 
@@ -137,7 +151,9 @@ func (stmt *createStmtPlanner) handleColumns(s *session) error {
 		referenceTableName := strings.ToLower(*constraint.Pktable.Relname)
 		key := strings.ToLower(constraint.PkAttrs.Items[0].(ast.String).Str)
 
+		metadataSpan := s.startMetadataSpan("GetTable")
 		referenceTable, ok, err := s.Colony().Tables().GetTable(referenceTableName)
+		endSpan(metadataSpan, err)
 		if err != nil {
 			return fmt.Errorf("could not create constraint referencing table [%s]: %v", referenceTableName, err)
 		}
@@ -145,7 +161,9 @@ func (stmt *createStmtPlanner) handleColumns(s *session) error {
 			return fmt.Errorf("could not create constraint referencing table [%s], it does not exist", referenceTableName)
 		}
 
+		metadataSpan = s.startMetadataSpan("GetPrimaryKeyColumnByName")
 		referencePrimaryKey, ok, err := s.Colony().Tables().GetPrimaryKeyColumnByName(referenceTableName)
+		endSpan(metadataSpan, err)
 		if err != nil {
 			return fmt.Errorf("could not verify primary key on reference table [%s]: %v", referenceTableName, err)
 		}
@@ -210,7 +228,9 @@ func (stmt *createStmtPlanner) handleColumns(s *session) error {
 
 					col.TypeName.Names.Items = []ast.Node{ast.String{Str: typeName}}
 
+					metadataSpan := s.startMetadataSpan("GetTypeByName")
 					pgType, ok, err := s.Colony().Types().GetTypeByName(typeName)
+					endSpan(metadataSpan, err)
 					if err != nil {
 						return err
 					} else if !ok {
@@ -2,6 +2,7 @@ package sql_test
 
 import (
 	"database/sql"
+	"fmt"
 	"github.com/elliotcourant/noahdb/testutils"
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
@@ -32,3 +33,174 @@ func TestNewCreateStatementPlan(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestCreateTableOnNewShard(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE accounts (id BIGSERIAL PRIMARY KEY, name TEXT) TABLESPACE "noah.tenants"`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE colors (id BIGSERIAL PRIMARY KEY, name TEXT)`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO accounts (name) VALUES('new shard');`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO colors (name) VALUES('red'), ('blue');`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE products (id BIGSERIAL PRIMARY KEY, account_id BIGINT NOT NULL REFERENCES accounts (id), color_id BIGINT NOT NULL REFERENCES colors (id)) TABLESPACE "noah.sharded"`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	shard, err := colony.Shards().NewShard()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	err = colony.Shards().BalanceOrphanShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	tenants, err := colony.Tenants().GetTenants()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Len(t, tenants, 1)
+
+	err = colony.Tenants().MoveTenant(tenants[0].TenantID, shard.ShardID)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	// The tenant now lives on the new shard, so the tables and the global rows need to be there.
+	colorIds := make([]uint64, 0)
+	rows, err := db.Query(`SELECT id FROM colors`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	for rows.Next() {
+		id := uint64(0)
+		assert.NoError(t, rows.Scan(&id))
+		colorIds = append(colorIds, id)
+	}
+	rows.Close()
+
+	for _, colorId := range colorIds {
+		_, err = db.Exec(fmt.Sprintf(`INSERT INTO products (account_id, color_id) VALUES(%d, %d);`, tenants[0].TenantID, colorId))
+		assert.NoError(t, err)
+	}
+
+	products := 0
+	err = db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM products INNER JOIN colors ON colors.id = products.color_id WHERE products.account_id = %d`, tenants[0].TenantID)).Scan(&products)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, products)
+}
+
+func TestSchemaDefinitions(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	// getDefinitions returns the definitions that were stored after the ones that already exist.
+	existing, err := colony.Schema().GetDefinitions()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	getDefinitions := func() []string {
+		definitions, err := colony.Schema().GetDefinitions()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		return definitions[len(existing):]
+	}
+
+	t.Run("failed statements are not stored", func(t *testing.T) {
+		_, err := db.Exec(`CREATE TABLE broken (id BIGSERIAL PRIMARY KEY, name TEXT CHECK (not_a_function(name)))`)
+		assert.Error(t, err)
+
+		_, ok, err := colony.Tables().GetTable("broken")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		assert.Empty(t, getDefinitions())
+	})
+
+	t.Run("schema changes are stored in order", func(t *testing.T) {
+		statements := []string{
+			`CREATE TABLE colors (id BIGSERIAL PRIMARY KEY, name TEXT)`,
+			`CREATE INDEX ix_colors_name ON colors (name)`,
+			`CREATE TYPE shade AS ENUM ('light', 'dark')`,
+			`ALTER TABLE colors ADD COLUMN hex TEXT`,
+			`DROP INDEX ix_colors_name`,
+		}
+		for _, statement := range statements {
+			_, err := db.Exec(statement)
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+		}
+
+		definitions := getDefinitions()
+		if !assert.Len(t, definitions, len(statements)) {
+			return
+		}
+		for i, statement := range statements[1:] {
+			assert.Equal(t, statement, definitions[i+1])
+		}
+
+		table, _, err := colony.Tables().GetTable("colors")
+		assert.NoError(t, err)
+		columns, err := colony.Tables().GetColumns(table.TableID)
+		assert.NoError(t, err)
+		assert.Len(t, columns, 3)
+	})
+
+	t.Run("rolled back statements are not stored", func(t *testing.T) {
+		before := len(getDefinitions())
+
+		tx, err := db.Begin()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		_, err = tx.Exec(`CREATE INDEX ix_colors_hex ON colors (hex)`)
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Rollback())
+
+		assert.Len(t, getDefinitions(), before)
+	})
+
+	t.Run("dropped tables are removed", func(t *testing.T) {
+		_, err := db.Exec(`DROP TABLE colors`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		_, ok, err := colony.Tables().GetTable("colors")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		definitions := getDefinitions()
+		assert.Equal(t, `DROP TABLE colors`, definitions[len(definitions)-1])
+	})
+}
@@ -1,12 +1,8 @@
 package sql
 
 import (
-	"fmt"
-	"github.com/ahmetb/go-linq/v3"
 	"github.com/elliotcourant/noahdb/pkg/ast"
 	"github.com/elliotcourant/noahdb/pkg/core"
-	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
-	"strings"
 )
 
 type deleteStmtPlanner struct {
@@ -21,33 +17,26 @@ func newDeleteStatementPlan(tree ast.DeleteStmt) *deleteStmtPlanner {
 }
 
 func (stmt *deleteStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, error) {
-	tableNames := queryutil.GetTables(stmt.tree)
-	if len(tableNames) == 0 {
-		return InitialPlan{}, false, nil
+	tables, err := s.getWriteTables(stmt.tree)
+	if err != nil {
+		return InitialPlan{}, false, err
 	}
 
-	linq.From(tableNames).Distinct().ToSlice(&tableNames)
+	stmt.tables = tables
 
-	tables, err := s.Colony().Tables().GetTables(tableNames...)
+	query, err := stmt.tree.Deparse(ast.Context_None)
 	if err != nil {
 		return InitialPlan{}, false, err
 	}
 
-	if len(tables) != len(tableNames) {
-		// This means that there is a table missing.
-		missingTables := make([]string, 0)
-		linq.From(tableNames).
-			ExceptBy(linq.From(tables), func(i interface{}) interface{} {
-				if table, ok := i.(core.Table); ok {
-					return table.TableName
-				}
-				return nil
-			}).ToSlice(&missingTables)
-		s.log.Debugf("could not resolve tables: %s", strings.Join(missingTables, ", "))
-		return InitialPlan{}, false, fmt.Errorf("could not resolve tables with names: %s", strings.Join(missingTables, ", "))
+	writeQuery := ""
+	if len(stmt.tree.ReturningList.Items) > 0 {
+		tree := stmt.tree
+		tree.ReturningList.Items = []ast.Node{}
+		if writeQuery, err = tree.Deparse(ast.Context_None); err != nil {
+			return InitialPlan{}, false, err
+		}
 	}
 
-	stmt.tables = tables
-
-	return InitialPlan{}, false, nil
+	return s.getTableWritePlan(stmt.tree, tables, query, writeQuery)
 }
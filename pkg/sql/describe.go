@@ -9,9 +9,9 @@ import (
 )
 
 func (s *session) executeDescribe(describe commands.DescribeStatement, result *commands.CommandResult) error {
-	ps, ok := s.preparedStatements[describe.Name]
 	switch describe.Type {
 	case pgwirebase.PrepareStatement:
+		ps, ok := s.preparedStatements[describe.Name]
 		if !ok {
 			return fmt.Errorf("unknown prepared statement %q", describe.Name)
 		}
@@ -35,12 +35,124 @@ func (s *session) executeDescribe(describe commands.DescribeStatement, result *c
 			})
 		}
 	case pgwirebase.PreparePortal:
+		portal, ok := s.portals[describe.Name]
 		if !ok {
 			return fmt.Errorf("unknown portal %q", describe.Name)
 		}
 
+		if portal.Stmt == nil ||
+			portal.Stmt.Statement == nil ||
+			portal.Stmt.Statement.StatementType() != ast.Rows {
+			// The portal has no data to be returned.
+			result.SetNoDataMessage(true)
+			return nil
+		}
+
+		// Unlike a statement, a portal knows what format each column will be returned in.
+		fields := make([]pgproto.FieldDescription, len(portal.Stmt.Columns))
+		for i, field := range portal.Stmt.Columns {
+			switch len(portal.OutFormats) {
+			case 0:
+				field.Format = int16(pgwirebase.FormatText)
+			case 1:
+				field.Format = int16(portal.OutFormats[0])
+			default:
+				if i < len(portal.OutFormats) {
+					field.Format = int16(portal.OutFormats[i])
+				}
+			}
+			fields[i] = field
+		}
+
+		return s.sessionContext.Backend().Send(&pgproto.RowDescription{
+			Fields: fields,
+		})
 	default:
 		return fmt.Errorf("unknown describe type: %s", describe.Type)
 	}
 	return nil
 }
+
+// describeOnDataNode will parse and describe the prepared statement on a single data node shard,
+// the parameter types and the columns that the data node returns are then used for the prepared
+// statement.
+func (s *session) describeOnDataNode(prepared *PreparedStatement) ([]uint32, []pgproto.FieldDescription, error) {
+	query, err := prepared.Statement.Deparse(ast.Context_None)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, err := s.Colony().DataNodes().GetRandomDataNodeShardID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The connection is taken straight from the colony's pool rather than from the session, that
+	// way describing a statement in a transaction does not make the data node shard join it.
+	frontend, err := s.Colony().Pool().GetConnectionForDataNodeShard(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	// If the connection failed part way through then it is reset, or closed if it can't be,
+	// before it is given back to the pool.
+	synced := false
+	defer func() {
+		if !synced {
+			frontend.MarkDirty()
+		}
+		frontend.Release()
+	}()
+
+	s.log.Verbosef("{%d} describing: %s", id, query)
+
+	parameterTypes := make([]uint32, len(prepared.RawTypeHints))
+	for i, oid := range prepared.RawTypeHints {
+		parameterTypes[i] = uint32(oid)
+	}
+
+	if err := frontend.Send(&pgproto.Parse{
+		Name:          "",
+		Query:         query,
+		ParameterOIDs: parameterTypes,
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	if err := frontend.Send(&pgproto.Describe{
+		ObjectType: 'S',
+		Name:       "",
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	if err := frontend.Send(&pgproto.Sync{}); err != nil {
+		return nil, nil, err
+	}
+
+	var parameters []uint32
+	var fields []pgproto.FieldDescription
+	var describeErr error
+	for {
+		message, err := frontend.Receive()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch msg := message.(type) {
+		case *pgproto.ParameterDescription:
+			parameters = msg.ParameterOIDs
+		case *pgproto.RowDescription:
+			fields = make([]pgproto.FieldDescription, len(msg.Fields))
+			copy(fields, msg.Fields)
+		case *pgproto.NoData:
+			fields = nil
+		case *pgproto.ErrorResponse:
+			describeErr = newDataNodeError(msg)
+		case *pgproto.ReadyForQuery:
+			synced = true
+			return parameters, fields, describeErr
+		default:
+			s.log.Tracef("received default message [%T]", message)
+		}
+	}
+}
@@ -4,23 +4,38 @@ import (
 	"github.com/elliotcourant/noahdb/pkg/ast"
 	"github.com/elliotcourant/noahdb/pkg/core"
 	"github.com/elliotcourant/noahdb/pkg/drivers/rqliter"
+	"github.com/elliotcourant/noahdb/pkg/pgerror"
 	"github.com/elliotcourant/noahdb/pkg/pgproto"
 	"github.com/elliotcourant/noahdb/pkg/pgwirebase"
+	"github.com/elliotcourant/noahdb/pkg/tracing"
 	"github.com/elliotcourant/noahdb/pkg/types"
 	"time"
 )
 
 type responsePipe struct {
-	conn core.PoolConnection
-	err  error
+	index int
+	task  ExpandedPlanTask
+	conn  core.PoolConnection
+	err   error
+
+	// statement is the name of the named statement used on the connection, if any.
+	statement string
+
+	// span covers the round trip to the data node shard, from acquiring a connection until the
+	// data node shard is ready for another query.
+	span *tracing.Span
 }
 
-func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
+func (s *session) executeExpandedPlan(plan ExpandedPlan, span *tracing.Span, result execResult) error {
 	if len(plan.OutFormats) == 0 {
 		plan.OutFormats = []pgwirebase.FormatCode{
 			pgwirebase.FormatText,
 		}
 	}
+	if plan.Explain != nil {
+		return s.executeExplainPlan(plan, span, result)
+	}
+
 	startTimestamp := time.Now()
 	defer func() {
 		s.log.Verbosef("[%s] execution of statement", time.Since(startTimestamp))
@@ -32,13 +47,23 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 
 		for i, task := range plan.Tasks {
 			go func(index int, task ExpandedPlanTask) {
-				var response = &responsePipe{}
+				var response = &responsePipe{
+					index: index,
+					task:  task,
+					span:  span.StartChild("data node shard", tracing.SpanKindClient),
+				}
+				response.span.SetAttributes(
+					tracing.Int("noahdb.data_node_shard_id", int64(task.DataNodeShardID)),
+					tracing.Int("noahdb.shard_id", int64(task.ShardID)),
+					tracing.Bool("noahdb.read_only", task.ReadOnly))
 				defer func() {
 					s.log.Verbosef("[%s] dispatch of query to data node shard [%d]", time.Since(startTimestamp), task.DataNodeShardID)
 					responses <- response
 				}()
 
+				acquireSpan := response.span.StartChild("acquire connection", tracing.SpanKindInternal)
 				frontend, err := s.GetConnectionForDataNodeShard(task.DataNodeShardID)
+				endSpan(acquireSpan, err)
 				if err != nil {
 					s.log.Errorf(
 						"could not retrieve connection from pool for data node shard [%d]: %s",
@@ -47,9 +72,25 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 					return
 				}
 				s.log.Verbosef("{%d} executing: %s", task.DataNodeShardID, task.Query)
+				dispatchTimestamp := time.Now()
+				dispatchSpan := response.span.StartChild("dispatch", tracing.SpanKindInternal)
+				defer func() {
+					endSpan(dispatchSpan, response.err)
+				}()
+
+				// Anything other than reading or writing rows, like SET or creating a temp table,
+				// might leave state behind on the connection. So it needs to be reset before it is
+				// used by another session.
+				if plan.DistPlanType == DistributedPlanType_NONE &&
+					task.Type != ast.Rows && task.Type != ast.RowsAffected {
+					frontend.MarkDirty()
+				}
 
 				queryMode := s.GetQueryMode()
-				if task.Type != ast.Rows {
+				if plan.Arguments != nil {
+					// Placeholders can only be sent to the data node with the extended protocol.
+					queryMode = QueryModeExtended
+				} else if task.Type != ast.Rows {
 					queryMode = QueryModeStandard
 				}
 
@@ -69,32 +110,60 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 				case QueryModeExtended:
 					// When we are in extended query mode we want to send the query in the same
 					// extended query mode.
-					if err := frontend.Send(&pgproto.Parse{
-						Name:  "",
-						Query: task.Query,
-					}); err != nil {
-						s.log.Errorf(
-							"could not send query to data node shard [%d]: %s",
-							task.DataNodeShardID, err.Error())
-						response.err = err
-						return
+					parameterTypes, parameterFormats, parameters := plan.Arguments.forTask(task)
+
+					// Statements that read or write rows are prepared as named statements on the
+					// data node connection so that executing them again only requires a Bind.
+					statementName, prepared := "", false
+					if plan.Fingerprint != "" && (task.Type == ast.Rows || task.Type == ast.RowsAffected) {
+						var stale []string
+						statementName, prepared, stale = frontend.PrepareStatement(plan.Fingerprint, task.Query, parameterTypes)
+						response.statement = statementName
+						for _, name := range stale {
+							if err := frontend.Send(&pgproto.Close{
+								ObjectType: 'S',
+								Name:       name,
+							}); err != nil {
+								s.log.Errorf(
+									"could not close statement on data node shard [%d]: %s",
+									task.DataNodeShardID, err.Error())
+								response.err = err
+								return
+							}
+						}
 					}
 
-					if err := frontend.Send(&pgproto.Describe{
-						ObjectType: 'S',
-						Name:       "",
-					}); err != nil {
-						s.log.Errorf(
-							"could not describe query on data node shard [%d]: %s",
-							task.DataNodeShardID, err.Error())
-						response.err = err
-						return
+					if !prepared {
+						if err := frontend.Send(&pgproto.Parse{
+							Name:          statementName,
+							Query:         task.Query,
+							ParameterOIDs: parameterTypes,
+						}); err != nil {
+							s.log.Errorf(
+								"could not send query to data node shard [%d]: %s",
+								task.DataNodeShardID, err.Error())
+							response.err = err
+							return
+						}
+
+						if err := frontend.Send(&pgproto.Describe{
+							ObjectType: 'S',
+							Name:       statementName,
+						}); err != nil {
+							s.log.Errorf(
+								"could not describe query on data node shard [%d]: %s",
+								task.DataNodeShardID, err.Error())
+							response.err = err
+							return
+						}
 					}
 
 					if err := frontend.Send(&pgproto.Bind{
-						DestinationPortal: "",
-						PreparedStatement: "",
-						ResultFormatCodes: plan.OutFormats,
+						DestinationPortal:    "",
+						PreparedStatement:    statementName,
+						ParameterFormatCodes: parameterFormats,
+						Parameters:           parameters,
+						ResultFormatCodes:    plan.OutFormats,
 					}); err != nil {
 						s.log.Errorf(
 							"could not bind on data node shard [%d]: %s",
@@ -123,27 +192,45 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 					}
 				}
 
+				s.timings.observeDispatch(time.Since(dispatchTimestamp))
 				response.conn = frontend
 			}(i, task)
 		}
 
+		// A write that is committed on some replicas but not others leaves the replicas with
+		// different data. This can only happen when the statement is committed as it is executed
+		// or when the transaction is being committed.
+		checkReplicas := s.GetTransactionState() == TransactionState_None ||
+			plan.DistPlanType == DistributedPlanType_COMMIT
+
 		// If we are committing or rolling back a transaction then clear the transaction state.
-		if plan.DistPlanType != DistributedPlanType_NONE {
+		if plan.DistPlanType == DistributedPlanType_COMMIT ||
+			plan.DistPlanType == DistributedPlanType_ROLLBACK {
 			s.SetTransactionState(TransactionState_None)
 		}
 
+		// Keep track of the command tag from each data node shard, in the order of the tasks so
+		// that replicated statements always report the same data node shard's count.
+		tags := make([]*shardCommandTag, len(plan.Tasks))
+		sentRowDescription := s.GetQueryMode() == QueryModeExtended
+
+		// If any of the data node shards return an error then we want to keep reading the
+		// responses from the others so their connections are left in a usable state, but the
+		// first error will be returned to the client.
+		var executeErr error
+		succeeded, failed := make([]uint64, 0), make([]uint64, 0)
 		for i := 0; i < len(plan.Tasks); i++ {
-			sentRowDescription := s.GetQueryMode() == QueryModeExtended
+			response := <-responses
 			err := func(response *responsePipe) error {
 				if response.err != nil {
 					return response.err
 				}
 				frontend := response.conn
-				// If we are not in a transaction then we can throw this connection away.
-				if s.GetTransactionState() == TransactionState_None {
+				// Give the connection back to the pool if the pool mode allows it.
+				if s.shouldReleaseConnections() {
 					defer s.ReleaseConnectionForDataNodeShard(frontend)
 				}
-				canExit := false
+				var responseErr error
 				for {
 					message, err := frontend.Receive()
 					if err != nil {
@@ -151,55 +238,97 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 						return err
 					}
 
-					switch message.(type) {
+					switch msg := message.(type) {
 					case *pgproto.RowDescription:
-						if sentRowDescription {
+						if sentRowDescription || executeErr != nil {
 							continue
 						}
 						if err := s.Backend().Send(message); err != nil {
 							return err
 						}
-						canExit = true
 						sentRowDescription = true
 					case *pgproto.DataRow:
+						if executeErr != nil || responseErr != nil {
+							continue
+						}
 						if err := s.Backend().Send(message); err != nil {
 							return err
 						}
-						canExit = true
 					case *pgproto.ErrorResponse:
-						if err := s.Backend().Send(message); err != nil {
-							return err
+						// If the statement failed then we can't be sure that it was prepared on
+						// the data node, so it will be parsed again the next time it is used.
+						if response.statement != "" {
+							frontend.ForgetStatement(response.statement)
 						}
-						canExit = true
-						return nil
+						responseErr = newDataNodeError(msg)
 					case *pgproto.CommandComplete:
-						canExit = true
-						return nil
-					case *pgproto.ReadyForQuery:
-						if canExit {
-							return nil
+						tags[response.index] = &shardCommandTag{
+							ShardID: response.task.ShardID,
+							Tag:     parseCommandTag(msg.CommandTag),
 						}
+					case *pgproto.ReadyForQuery:
+						// The data node shard is done with the task once it is ready for the
+						// next query.
+						return responseErr
 					default:
 						s.log.Tracef("received default message [%T]", message)
 						// Do nothing
 					}
 				}
-			}(<-responses)
-			if err != nil {
-				return err
+			}(response)
+			endSpan(response.span, err)
+			if err != nil && executeErr == nil {
+				executeErr = err
+			}
+			if !response.task.ReadOnly {
+				if err != nil {
+					failed = append(failed, response.task.DataNodeShardID)
+				} else {
+					succeeded = append(succeeded, response.task.DataNodeShardID)
+				}
+			}
+		}
+
+		if checkReplicas && len(succeeded) > 0 && len(failed) > 0 {
+			go s.verifyReplicas(succeeded[0], failed)
+		}
+
+		if executeErr != nil {
+			return executeErr
+		}
+
+		received := make([]shardCommandTag, 0, len(tags))
+		for _, tag := range tags {
+			if tag != nil {
+				received = append(received, *tag)
+			}
+		}
+
+		if tag, ok := combineCommandTags(plan.TagStrategy, received); ok {
+			result.SetCommandTag(tag.String())
+		}
+
+		// Changing the schema can change the result of a statement that has already been
+		// prepared on a data node, so those statements need to be prepared again.
+		for _, task := range plan.Tasks {
+			if task.Type == ast.DDL {
+				s.Colony().Pool().InvalidatePreparedStatements()
+				break
 			}
 		}
 	case PlanTarget_INTERNAL:
 		for i, task := range plan.Tasks {
 			return func() error {
 				s.log.Verbosef("executing task %d on internal data store", i)
+				querySpan := span.StartChild("internal query", tracing.SpanKindInternal)
 				response, err := s.Colony().Query(task.Query)
+				endSpan(querySpan, err)
 				rows := rqliter.NewRqlRows(response)
 				if err != nil {
 					s.log.Errorf("could not execute internal query: %s", err.Error())
 					return err
 				}
-				result := make([][]interface{}, 0)
+				values := make([][]interface{}, 0)
 				columns := rows.Columns()
 				for rows.Next() {
 					row := make([]interface{}, len(columns))
@@ -210,7 +339,7 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 						s.log.Errorf("could not scan row: %s", err.Error())
 						return err
 					}
-					result = append(result, row)
+					values = append(values, row)
 				}
 				if err := rows.Err(); err != nil {
 					s.log.Errorf("could not query internal store: %s", err.Error())
@@ -232,19 +361,21 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 						defer func() {
 							rowDescription.Fields[i] = field
 						}()
-						if len(result) > 0 {
-							if len(result[0])-1 >= i {
+						if len(values) > 0 {
+							if len(values[0])-1 >= i {
 								// This is some weird pointer magic to determine the type of the cell
 								// basically without the *interface{} cast T would be 3 types at once?
 								// which shouldn't be possible to my knowledge but it would show
 								// as interface{} | *interface{} | int64 with a select 1 query.
 								// So none of the types in the switch case would evaluate properly.
 								// This weird magic fixes that.
-								t := result[0][i].(*interface{})
+								t := values[0][i].(*interface{})
 								typs[i] = *t
 								switch (*t).(type) {
 								case int64:
 									field.DataTypeOID = uint32(types.Type_int8)
+								case string:
+									field.DataTypeOID = uint32(types.Type_text)
 								}
 							}
 						}
@@ -255,7 +386,7 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 					return err
 				}
 
-				for _, row := range result {
+				for _, row := range values {
 					dataRow := pgproto.DataRow{
 						Values: make([][]byte, len(columns)),
 					}
@@ -270,12 +401,27 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 							if err != nil {
 								return err
 							}
+						case string:
+							val := types.Text{}
+							if err := val.Set(*col.(*interface{})); err != nil {
+								return err
+							}
+							dataRow.Values[x], err = val.EncodeText(nil, nil)
+							if err != nil {
+								return err
+							}
 						}
 					}
 					if err := s.Backend().Send(&dataRow); err != nil {
 						return err
 					}
 				}
+
+				result.SetCommandTag(commandTag{
+					Command: "SELECT",
+					Rows:    uint64(len(values)),
+					HasRows: true,
+				}.String())
 				return nil
 			}()
 		}
@@ -283,3 +429,27 @@ func (s *session) executeExpandedPlan(plan ExpandedPlan) error {
 
 	return nil
 }
+
+// verifyReplicas checks the data node shards that failed to execute a write against one that
+// succeeded. Any of them that no longer match will stop receiving reads until they are repaired.
+func (s *session) verifyReplicas(healthyDataNodeShardId uint64, failedDataNodeShardIds []uint64) {
+	diverged, err := s.Colony().Shards().VerifyReplicas(healthyDataNodeShardId, failedDataNodeShardIds...)
+	if err != nil {
+		s.log.Errorf("could not verify data node shards %v: %s", failedDataNodeShardIds, err.Error())
+		return
+	}
+	if len(diverged) > 0 {
+		s.log.Warningf("data node shards %v have diverged from data node shard [%d]", diverged, healthyDataNodeShardId)
+	}
+}
+
+// newDataNodeError converts an error received from a data node into an error that can be returned
+// to the client.
+func newDataNodeError(msg *pgproto.ErrorResponse) error {
+	return &pgerror.Error{
+		Code:    msg.Code,
+		Message: msg.Message,
+		Detail:  msg.Detail,
+		Hint:    msg.Hint,
+	}
+}
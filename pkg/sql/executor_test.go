@@ -0,0 +1,87 @@
+package sql_test
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/testutils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExecutor_CommandTags(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE accounts (id BIGSERIAL PRIMARY KEY, name TEXT) TABLESPACE "noah.tenants"`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE colors (id BIGSERIAL PRIMARY KEY, name TEXT)`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE products (id BIGSERIAL PRIMARY KEY, account_id BIGINT NOT NULL REFERENCES accounts (id), sku TEXT) TABLESPACE "noah.sharded"`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	t.Run("replicated", func(t *testing.T) {
+		dataNodeShards, err := colony.DataNodes().GetDataNodeShardIDs()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		// The rows are written to every data node shard, but should only be counted once.
+		assert.True(t, len(dataNodeShards) > 1)
+
+		result, err := db.Exec(`INSERT INTO colors (name) VALUES ('red'), ('blue'), ('green')`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		affected, err := result.RowsAffected()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), affected)
+
+		result, err = db.Exec(`UPDATE colors SET name = 'updated' WHERE name IN ('red', 'blue')`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		affected, err = result.RowsAffected()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), affected)
+	})
+
+	t.Run("split", func(t *testing.T) {
+		_, err := db.Exec(`INSERT INTO accounts (name) VALUES ('account one'), ('account two')`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		tenants, err := colony.Tenants().GetTenants()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		if !assert.Len(t, tenants, 2) {
+			return
+		}
+		// The rows for each tenant are sent to a different shard and the counts are added up.
+		assert.NotEqual(t, tenants[0].ShardID, tenants[1].ShardID)
+
+		result, err := db.Exec(fmt.Sprintf(
+			`INSERT INTO products (account_id, sku) VALUES (%d, 'one'), (%d, 'two'), (%d, 'three')`,
+			tenants[0].TenantID, tenants[0].TenantID, tenants[1].TenantID))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		affected, err := result.RowsAffected()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), affected)
+	})
+}
@@ -0,0 +1,409 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/ahmetb/go-linq/v3"
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/core"
+	"github.com/elliotcourant/noahdb/pkg/pgproto"
+	"github.com/elliotcourant/noahdb/pkg/pgwirebase"
+	"github.com/elliotcourant/noahdb/pkg/tracing"
+	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// explainActualRows matches the actual number of rows returned by the top node of a plan
+	// from EXPLAIN ANALYZE, it only matches plans in the text format.
+	explainActualRows = regexp.MustCompile(`\(actual (?:time=[0-9.]+\.\.[0-9.]+ )?rows=([0-9]+) loops=[0-9]+\)`)
+)
+
+type explainStmtPlanner struct {
+	tree ast.ExplainStmt
+}
+
+func newExplainStatementPlan(tree ast.ExplainStmt) *explainStmtPlanner {
+	return &explainStmtPlanner{
+		tree: tree,
+	}
+}
+
+// explainPlan is attached to the plan of a statement that is being explained. Instead of the
+// statement each task is explained on its data node shard, the plans from the data nodes are shown
+// after the plan from noahdb.
+type explainPlan struct {
+	// lines describe how noahdb planned the statement, the expanded plan and the plans from the
+	// data nodes are added once the plan has been expanded.
+	lines   []string
+	options string
+	analyze bool
+}
+
+// getNoahQueryPlan plans the explained statement the same way it would be planned if it was run.
+// The plan is expanded and routed like the statement would be, but each of the data node shards
+// is asked for its own plan when it is executed. The plan from noahdb is shown first followed by
+// the plans from the data nodes. With ANALYZE the statement is actually executed on the data node
+// shards.
+func (stmt *explainStmtPlanner) getNoahQueryPlan(s *session) (InitialPlan, bool, error) {
+	statement, ok := stmt.tree.Query.(ast.Stmt)
+	if !ok {
+		return InitialPlan{}, false, fmt.Errorf("cannot explain %T", stmt.tree.Query)
+	}
+
+	switch statement.(type) {
+	case ast.SelectStmt, ast.InsertStmt, ast.UpdateStmt, ast.DeleteStmt:
+	default:
+		return InitialPlan{}, false, fmt.Errorf("EXPLAIN is not supported for %s", statement.StatementTag())
+	}
+
+	analyze := stmt.isAnalyze()
+	if err := stmt.checkStatement(s, statement, analyze); err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	options, err := stmt.tree.DeparseOptions()
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	// The tables are resolved before the statement is planned since planning can change the tree.
+	tables, err := getExplainTables(s, statement)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	// Without ANALYZE the statement is never executed, so planning it must not change anything.
+	if !analyze {
+		s.explaining = true
+		defer func() {
+			s.explaining = false
+		}()
+	}
+
+	plan, ok, err := s.getInitialPlan(statement)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	if !ok || plan.Target != PlanTarget_STANDARD {
+		return InitialPlan{}, false, fmt.Errorf("could not generate plan for statement")
+	}
+
+	lines := []string{"Noah Plan"}
+	if len(tables) > 0 {
+		names := make([]string, len(tables))
+		for i, table := range tables {
+			names[i] = fmt.Sprintf("%s (%s)", table.TableName, table.TableType.String())
+		}
+		lines = append(lines, fmt.Sprintf("  Tables: %s", strings.Join(names, ", ")))
+	}
+	lines = append(lines, explainInitialPlan(plan, "  ")...)
+
+	plan.Explain = &explainPlan{
+		lines:   lines,
+		options: options,
+		analyze: analyze,
+	}
+	return plan, true, nil
+}
+
+// executeExplainPlan explains each of the plan's tasks on their data node shards and sends the
+// plan to the client as rows from the internal store.
+func (s *session) executeExplainPlan(plan ExpandedPlan, span *tracing.Span, result execResult) error {
+	lines := append(make([]string, 0, len(plan.Explain.lines)), plan.Explain.lines...)
+	lines = append(lines, explainExpandedPlan(plan, "  ")...)
+
+	for _, task := range plan.Tasks {
+		taskLines, err := s.explainOnDataNode(task, plan.Explain.options, plan.Explain.analyze)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, taskLines...)
+	}
+
+	query, err := getExplainQuery(lines)
+	if err != nil {
+		return err
+	}
+
+	return s.executeExpandedPlan(ExpandedPlan{
+		Target: PlanTarget_INTERNAL,
+		Tasks: []ExpandedPlanTask{
+			{
+				Query:    query,
+				ReadOnly: true,
+				Type:     ast.Rows,
+			},
+		},
+		OutFormats: plan.OutFormats,
+	}, span, result)
+}
+
+// isAnalyze returns true if the ANALYZE option was provided and was not disabled.
+func (stmt *explainStmtPlanner) isAnalyze() bool {
+	analyze := false
+	for _, item := range stmt.tree.Options.Items {
+		defElem, ok := item.(ast.DefElem)
+		if !ok || defElem.Defname == nil || strings.ToLower(*defElem.Defname) != "analyze" {
+			continue
+		}
+
+		switch arg := defElem.Arg.(type) {
+		case nil:
+			analyze = true
+		case ast.String:
+			switch strings.ToLower(arg.Str) {
+			case "false", "off", "no", "0":
+				analyze = false
+			default:
+				analyze = true
+			}
+		case ast.Integer:
+			analyze = arg.Ival != 0
+		default:
+			analyze = true
+		}
+	}
+	return analyze
+}
+
+// checkStatement makes sure that the statement can be explained. Statements that use the noah
+// schema are performed by the coordinator while they are being planned. Inserts into tenant tables
+// can only be explained without ANALYZE, executing them would require the tenants to be created.
+func (stmt *explainStmtPlanner) checkStatement(s *session, statement ast.Stmt, analyze bool) error {
+	rangeVars := queryutil.GetRangeVars(statement)
+	for i := range rangeVars {
+		if _, ok := getNoahRelation(&rangeVars[i]); ok {
+			return fmt.Errorf("cannot EXPLAIN statements that use the %s schema", noahSchemaName)
+		}
+	}
+
+	switch tree := statement.(type) {
+	case ast.SelectStmt:
+		for _, functionCall := range newSelectStatementPlan(tree).getFunctionCalls() {
+			if schema, _ := getFunctionName(functionCall); schema == noahSchemaName {
+				return fmt.Errorf("cannot EXPLAIN statements that use the %s schema", noahSchemaName)
+			}
+		}
+	case ast.InsertStmt:
+		if !analyze || tree.Relation == nil || tree.Relation.Relname == nil {
+			return nil
+		}
+
+		tables, err := s.Colony().Tables().GetTables(*tree.Relation.Relname)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range tables {
+			if table.TableType == core.TableType_Tenant {
+				return fmt.Errorf("cannot EXPLAIN ANALYZE an insert into tenant table [%s]", table.TableName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getExplainTables returns the tables that are referenced by the statement sorted by their name.
+func getExplainTables(s *session, statement ast.Stmt) ([]core.Table, error) {
+	tableNames := queryutil.GetTables(statement)
+	if len(tableNames) == 0 {
+		return nil, nil
+	}
+
+	linq.From(tableNames).Distinct().ToSlice(&tableNames)
+
+	tables, err := s.Colony().Tables().GetTables(tableNames...)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].TableName < tables[j].TableName
+	})
+	return tables, nil
+}
+
+// explainInitialPlan describes the initial plan, each split of the plan is described beneath it.
+func explainInitialPlan(plan InitialPlan, indent string) []string {
+	lines := make([]string, 0)
+	if len(plan.Splits) > 0 {
+		lines = append(lines, fmt.Sprintf("%sInitial Plan: %s split across %d shards", indent, plan.Target, len(plan.Splits)))
+	} else if plan.ShardID != 0 {
+		lines = append(lines, fmt.Sprintf("%sInitial Plan: %s on shard %d", indent, plan.Target, plan.ShardID))
+	} else {
+		lines = append(lines, fmt.Sprintf("%sInitial Plan: %s on any shard", indent, plan.Target))
+	}
+
+	if len(plan.TenantIDs) > 0 {
+		tenantIds := make([]string, len(plan.TenantIDs))
+		for i, tenantId := range plan.TenantIDs {
+			tenantIds[i] = strconv.FormatUint(tenantId, 10)
+		}
+		lines = append(lines, fmt.Sprintf("%s  Tenant IDs: %s", indent, strings.Join(tenantIds, ", ")))
+	}
+
+	// Plan types are shown in a stable order.
+	planTypes := make([]string, 0, len(plan.Types))
+	for planType := range plan.Types {
+		planTypes = append(planTypes, string(planType))
+	}
+	sort.Strings(planTypes)
+	for _, planType := range planTypes {
+		lines = append(lines, fmt.Sprintf("%s  %s: %s", indent, planType, plan.Types[PlanType(planType)].Query))
+	}
+
+	for _, split := range plan.Splits {
+		lines = append(lines, explainInitialPlan(split, indent+"  ")...)
+	}
+
+	return lines
+}
+
+// explainExpandedPlan describes each of the tasks that would be sent to the data node shards.
+func explainExpandedPlan(plan ExpandedPlan, indent string) []string {
+	lines := []string{
+		fmt.Sprintf("%sExpanded Plan: %d task(s)", indent, len(plan.Tasks)),
+	}
+	for _, task := range plan.Tasks {
+		access := "read write"
+		if task.ReadOnly {
+			access = "read only"
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s  Data Node Shard %d (shard %d, %s): %s",
+				indent, task.DataNodeShardID, task.ShardID, access, task.Query))
+	}
+	return lines
+}
+
+// explainOnDataNode runs EXPLAIN for the task's query on its data node shard and returns the plan
+// from the data node. If analyze is true then the time it took the data node to run the query and
+// the number of rows it returned are added.
+func (s *session) explainOnDataNode(task ExpandedPlanTask, options string, analyze bool) ([]string, error) {
+	synced := false
+	var frontend core.PoolConnection
+	if analyze {
+		// EXPLAIN ANALYZE executes the statement, so the data node shard joins the session's
+		// transaction the same way it would if the statement was run.
+		conn, err := s.GetConnectionForDataNodeShard(task.DataNodeShardID)
+		if err != nil {
+			return nil, err
+		}
+		frontend = conn
+
+		if s.shouldReleaseConnections() {
+			defer s.ReleaseConnectionForDataNodeShard(frontend)
+		}
+	} else {
+		// Otherwise the connection is taken straight from the colony's pool, that way explaining
+		// a statement in a transaction does not make the data node shard join it.
+		conn, err := s.Colony().Pool().GetConnectionForDataNodeShard(task.DataNodeShardID)
+		if err != nil {
+			return nil, err
+		}
+		frontend = conn
+
+		// If the connection failed part way through then it is reset, or closed if it can't be,
+		// before it is given back to the pool.
+		defer func() {
+			if !synced {
+				frontend.MarkDirty()
+			}
+			frontend.Release()
+		}()
+	}
+
+	query := "EXPLAIN " + task.Query
+	if options != "" {
+		query = fmt.Sprintf("EXPLAIN %s %s", options, task.Query)
+	}
+	s.log.Verbosef("{%d} explaining: %s", task.DataNodeShardID, query)
+
+	// The extended protocol is always used so that any arguments bound to the statement can be
+	// forwarded to the data node.
+	parameterTypes, parameterFormats, parameters := s.arguments.forTask(task)
+	startTimestamp := time.Now()
+	for _, message := range []pgproto.FrontendMessage{
+		&pgproto.Parse{
+			Query:         query,
+			ParameterOIDs: parameterTypes,
+		},
+		&pgproto.Bind{
+			ParameterFormatCodes: parameterFormats,
+			Parameters:           parameters,
+			ResultFormatCodes: []pgwirebase.FormatCode{
+				pgwirebase.FormatText,
+			},
+		},
+		&pgproto.Execute{},
+		&pgproto.Sync{},
+	} {
+		if err := frontend.Send(message); err != nil {
+			return nil, err
+		}
+	}
+
+	lines := []string{
+		fmt.Sprintf("Data Node Shard %d", task.DataNodeShardID),
+	}
+	var responseErr error
+	for ready := false; !ready; {
+		message, err := frontend.Receive()
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := message.(type) {
+		case *pgproto.DataRow:
+			if len(msg.Values) > 0 {
+				for _, line := range strings.Split(string(msg.Values[0]), "\n") {
+					lines = append(lines, "  "+line)
+				}
+			}
+		case *pgproto.ErrorResponse:
+			responseErr = newDataNodeError(msg)
+		case *pgproto.ReadyForQuery:
+			ready = true
+			synced = true
+		}
+	}
+
+	if responseErr != nil {
+		return nil, responseErr
+	}
+
+	if analyze {
+		lines = append(lines, fmt.Sprintf("  Shard Execution Time: %.3f ms",
+			float64(time.Since(startTimestamp))/float64(time.Millisecond)))
+		if len(lines) > 1 {
+			if match := explainActualRows.FindStringSubmatch(lines[1]); match != nil {
+				lines = append(lines, fmt.Sprintf("  Shard Rows: %s", match[1]))
+			}
+		}
+	}
+
+	return lines, nil
+}
+
+// getExplainQuery returns a query for the internal store that will return each line of the plan
+// as a row in the order they were provided.
+func getExplainQuery(lines []string) (string, error) {
+	values := make([]string, len(lines))
+	for i, line := range lines {
+		literal, err := getInternalLiteral(line)
+		if err != nil {
+			return "", err
+		}
+		values[i] = fmt.Sprintf("(%d, %s)", i, literal)
+	}
+
+	return fmt.Sprintf(
+		`WITH query_plan(n, line) AS (VALUES %s) SELECT line AS "QUERY PLAN" FROM query_plan ORDER BY n`,
+		strings.Join(values, ", ")), nil
+}
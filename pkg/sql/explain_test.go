@@ -0,0 +1,141 @@
+package sql_test
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/testutils"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+	func() {
+		db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		_, err = db.Exec(`CREATE TABLE accounts (id BIGSERIAL PRIMARY KEY, name TEXT) TABLESPACE "noah.tenants"`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		_, err = db.Exec(`CREATE TABLE products (id BIGSERIAL PRIMARY KEY, account_id BIGINT NOT NULL REFERENCES accounts (id), sku TEXT) TABLESPACE "noah.sharded"`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		var accountId uint64
+		if err := db.QueryRow(`INSERT INTO accounts (name) VALUES ('account one') RETURNING id;`).Scan(&accountId); !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		_, err = db.Exec(fmt.Sprintf(`INSERT INTO products (account_id, sku) VALUES (%d, 'SKU001'), (%d, 'SKU002');`, accountId, accountId))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		explain := func(t *testing.T, query string) string {
+			rows, err := db.Query(query)
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+			defer rows.Close()
+
+			lines := make([]string, 0)
+			for rows.Next() {
+				var line string
+				if err := rows.Scan(&line); !assert.NoError(t, err) {
+					panic(err)
+				}
+				lines = append(lines, line)
+			}
+			assert.NoError(t, rows.Err())
+			return strings.Join(lines, "\n")
+		}
+
+		t.Run("explain", func(t *testing.T) {
+			plan := explain(t, fmt.Sprintf(`EXPLAIN SELECT id, sku FROM products WHERE account_id = %d`, accountId))
+			assert.True(t, strings.HasPrefix(plan, "Noah Plan\n"), plan)
+			assert.Contains(t, plan, "Tables: products (Sharded)")
+			assert.Contains(t, plan, fmt.Sprintf("Tenant IDs: %d", accountId))
+			assert.Contains(t, plan, "Initial Plan: STANDARD on shard")
+			assert.Contains(t, plan, "read only")
+			assert.Contains(t, plan, "Data Node Shard")
+			assert.Contains(t, plan, "Scan on products")
+			assert.NotContains(t, plan, "Shard Execution Time")
+		})
+
+		t.Run("explain analyze", func(t *testing.T) {
+			plan := explain(t, fmt.Sprintf(`EXPLAIN (ANALYZE) SELECT id, sku FROM products WHERE account_id = %d`, accountId))
+			assert.Contains(t, plan, "actual time=")
+			assert.Contains(t, plan, "Shard Execution Time: ")
+			assert.Contains(t, plan, "Shard Rows: 2")
+		})
+
+		t.Run("explain insert into tenant table", func(t *testing.T) {
+			plan := explain(t, `EXPLAIN INSERT INTO accounts (name) VALUES ('account two')`)
+			assert.Contains(t, plan, "Tables: accounts (Tenant)")
+			assert.Contains(t, plan, "Initial Plan: STANDARD on any shard")
+
+			// The tenant would only be created if the insert was executed.
+			tenants, err := colony.Tenants().GetTenants()
+			assert.NoError(t, err)
+			assert.Len(t, tenants, 1)
+
+			_, err = db.Query(`EXPLAIN ANALYZE INSERT INTO accounts (name) VALUES ('account two')`)
+			assert.Error(t, err)
+		})
+
+		t.Run("explain does not use the sequence", func(t *testing.T) {
+			var before, after uint64
+			insert := fmt.Sprintf(`INSERT INTO products (account_id, sku) VALUES (%d, 'SKU003') RETURNING id`, accountId)
+			if err := db.QueryRow(insert).Scan(&before); !assert.NoError(t, err) {
+				panic(err)
+			}
+
+			explain(t, fmt.Sprintf(`EXPLAIN INSERT INTO products (account_id, sku) VALUES (%d, 'SKU004'), (%d, 'SKU005')`, accountId, accountId))
+
+			if err := db.QueryRow(insert).Scan(&after); !assert.NoError(t, err) {
+				panic(err)
+			}
+			assert.Equal(t, before+1, after)
+		})
+
+		t.Run("explain in transaction", func(t *testing.T) {
+			// Explaining a statement without ANALYZE does not execute it, so none of the data
+			// node shards should join the transaction.
+			tx, err := db.Begin()
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+			defer tx.Rollback()
+
+			rows, err := tx.Query(fmt.Sprintf(`EXPLAIN SELECT id, sku FROM products WHERE account_id = %d`, accountId))
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+			for rows.Next() {
+			}
+			assert.NoError(t, rows.Err())
+			rows.Close()
+
+			ids, err := colony.DataNodes().GetDataNodeShardIDs()
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+			for _, id := range ids {
+				assert.Equal(t, int64(0), colony.Pool().ActiveConnections(id), "data node shard [%d]", id)
+			}
+		})
+
+		t.Run("explain noah table", func(t *testing.T) {
+			_, err := db.Query(`EXPLAIN SELECT * FROM noah.data_nodes`)
+			assert.Error(t, err)
+		})
+	}()
+}
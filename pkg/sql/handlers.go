@@ -12,7 +12,8 @@ func getStatementHandler(tree ast.Stmt) (interface{}, error) {
 	// case ast.AlterDatabaseStmt:
 	// case ast.AlterDefaultPrivilegesStmt:
 	// case ast.AlterDomainStmt:
-	// case ast.AlterEnumStmt:
+	case ast.AlterEnumStmt:
+		return newSchemaStatementPlan(stmt), nil
 	// case ast.AlterEventTrigStmt:
 	// case ast.AlterExtensionContentsStmt:
 	// case ast.AlterExtensionStmt:
@@ -30,10 +31,12 @@ func getStatementHandler(tree ast.Stmt) (interface{}, error) {
 	// case ast.AlterRoleStmt:
 	// case ast.AlterSeqStmt:
 	// case ast.AlterSubscriptionStmt:
-	// case ast.AlterSystemStmt:
+	case ast.AlterSystemStmt:
+		return newAlterSystemStatementPlan(stmt), nil
 	// case ast.AlterTableMoveAllStmt:
 	// case ast.AlterTableSpaceOptionsStmt:
-	// case ast.AlterTableStmt:
+	case ast.AlterTableStmt:
+		return newSchemaStatementPlan(stmt), nil
 	// case ast.AlterTSConfigurationStmt:
 	// case ast.AlterTSDictionaryStmt:
 	// case ast.AlterUserMappingStmt:
@@ -42,14 +45,17 @@ func getStatementHandler(tree ast.Stmt) (interface{}, error) {
 	// case ast.ClusterStmt:
 	// case ast.CommentStmt:
 	//     // return nil, _comment.CreateCommentStatment(stmt, tree).HandleComment(ctx)
-	// case ast.CompositeTypeStmt:
+	case ast.CompositeTypeStmt:
+		return newSchemaStatementPlan(stmt), nil
 	// case ast.ConstraintsSetStmt:
 	// case ast.CopyStmt:
 	// case ast.CreateAmStmt:
 	// case ast.CreateCastStmt:
 	// case ast.CreateConversionStmt:
-	// case ast.CreateDomainStmt:
-	// case ast.CreateEnumStmt:
+	case ast.CreateDomainStmt:
+		return newSchemaStatementPlan(stmt), nil
+	case ast.CreateEnumStmt:
+		return newSchemaStatementPlan(stmt), nil
 	// case ast.CreateEventTrigStmt:
 	// case ast.CreateExtensionStmt:
 	// case ast.CreateFdwStmt:
@@ -83,18 +89,20 @@ func getStatementHandler(tree ast.Stmt) (interface{}, error) {
 	// case nodes.DoStmt:
 	// case nodes.DropOwnedStmt:
 	// case nodes.DropRoleStmt:
-	// case ast.DropStmt:
-	// 	return CreateDropStatement(stmt), nil
+	case ast.DropStmt:
+		return newSchemaStatementPlan(stmt), nil
 	// case nodes.DropSubscriptionStmt:
 	// case nodes.DropTableSpaceStmt:
 	// case nodes.DropUserMappingStmt:
 	// case nodes.DropdbStmt:
 	// case nodes.ExecuteStmt:
-	// case nodes.ExplainStmt:
+	case ast.ExplainStmt:
+		return newExplainStatementPlan(stmt), nil
 	// case nodes.FetchStmt:
 	// case nodes.GrantRoleStmt:
 	// case nodes.ImportForeignSchemaStmt:
-	// case nodes.IndexStmt:
+	case ast.IndexStmt:
+		return newSchemaStatementPlan(stmt), nil
 	case ast.InsertStmt:
 		return newInsertStatementPlan(stmt), nil
 	// case nodes.ListenStmt:
@@ -117,11 +125,11 @@ func getStatementHandler(tree ast.Stmt) (interface{}, error) {
 	// 	return CreateTransactionStatement(stmt), nil
 	// case nodes.TruncateStmt:
 	// case nodes.UnlistenStmt:
-	// case nodes.UpdateStmt:
-	//     // return nil, _update.HandleUpdate(ctx, stmt)
+	case ast.UpdateStmt:
+		return newUpdateStatementPlan(stmt), nil
 	// case nodes.VacuumStmt:
-	// case ast.VariableSetStmt:
-	// 	return CreateVariableSetStatement(stmt), nil
+	case ast.VariableSetStmt:
+		return newVariableSetStatementPlan(stmt), nil
 	// case ast.VariableShowStmt:
 	// 	return CreateVariableShowStatement(stmt), nil
 	// case nodes.ViewStmt:
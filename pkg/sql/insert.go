@@ -5,6 +5,7 @@ import (
 	"github.com/ahmetb/go-linq/v3"
 	"github.com/elliotcourant/noahdb/pkg/ast"
 	"github.com/elliotcourant/noahdb/pkg/core"
+	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
 )
 
 type insertStmtPlanner struct {
@@ -19,7 +20,9 @@ func newInsertStatementPlan(tree ast.InsertStmt) *insertStmtPlanner {
 
 func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, error) {
 	tableName := *stmt.tree.Relation.Relname
+	metadataSpan := s.startMetadataSpan("GetTables")
 	tables, err := s.Colony().Tables().GetTables(tableName)
+	endSpan(metadataSpan, err)
 	if err != nil {
 		return InitialPlan{}, false, err
 	}
@@ -40,11 +43,26 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 
 	table := tables[0] // We only want to work with one table.
 
+	// Sequence values are added to the columns and rows below. The statement is planned again if
+	// the write fences change while it is being planned, so the columns and rows are copied to
+	// keep the original statement as the client sent it.
+	stmt.tree.Cols.Items = append(make([]ast.Node, 0, len(stmt.tree.Cols.Items)+1), stmt.tree.Cols.Items...)
+	if selectStmt, ok := stmt.tree.SelectStmt.(ast.SelectStmt); ok {
+		valuesLists := make([][]ast.Node, len(selectStmt.ValuesLists))
+		for i, row := range selectStmt.ValuesLists {
+			valuesLists[i] = append(make([]ast.Node, 0, len(row)+1), row...)
+		}
+		selectStmt.ValuesLists = valuesLists
+		stmt.tree.SelectStmt = selectStmt
+	}
+
 	var sequenceColumn core.Column
 	if table.HasSequence {
 		// If the table has a sequence then we want to get the column that has the sequence and
 		// handle it in the query.
+		metadataSpan := s.startMetadataSpan("GetSequenceColumnForTable")
 		sc, ok, err := s.Colony().Tables().GetSequenceColumnForTable(table.TableID)
+		endSpan(metadataSpan, err)
 		if err != nil {
 			return InitialPlan{}, false, err
 		}
@@ -66,7 +84,16 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 			})
 
 			for i, row := range stmt.tree.SelectStmt.(ast.SelectStmt).ValuesLists {
+				// Values are not taken from the sequence for a statement that is only being
+				// explained, the column is left to its default instead.
+				if s.explaining {
+					stmt.tree.SelectStmt.(ast.SelectStmt).ValuesLists[i] = append(row, ast.SetToDefault{})
+					continue
+				}
+
+				metadataSpan := s.startMetadataSpan("NextSequenceID")
 				newId, err := s.Colony().Tables().NextSequenceID(table, sequenceColumn)
+				endSpan(metadataSpan, err)
 				if err != nil {
 					return InitialPlan{}, false, err
 				}
@@ -83,8 +110,14 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 					return InitialPlan{}, false, fmt.Errorf("cannot manually set value of serialized column [%s]", sequenceColumn.ColumnName)
 				}
 
+				if s.explaining {
+					continue
+				}
+
 				// Generate a new ID.
+				metadataSpan := s.startMetadataSpan("NextSequenceID")
 				newId, err := s.Colony().Tables().NextSequenceID(table, sequenceColumn)
+				endSpan(metadataSpan, err)
 				if err != nil {
 					return InitialPlan{}, false, err
 				}
@@ -98,9 +131,12 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 		}
 	}
 
+	// Inserts into tenant tables create the tenants before the rows are written.
+	var newTenantIds []uint64
+
 	switch table.TableType {
 	case core.TableType_Noah:
-		panic("not handling this yet")
+		return InitialPlan{}, false, fmt.Errorf("table [%s] can only be changed through the %s schema", tableName, noahSchemaName)
 	case core.TableType_Tenant:
 		// Get the values of the primary key we are inserting.
 		var primaryKey core.Column
@@ -115,18 +151,28 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 			return ok && *resTarget.Name == primaryKey.ColumnName
 		})
 
-		switch primaryKeyInsertIndex {
-		case -1:
+		switch {
+		case primaryKeyInsertIndex == -1:
 			return InitialPlan{}, false, fmt.Errorf("no primary key value specified")
+		case s.explaining:
+			// The insert is sent to every shard regardless of which tenants it creates, so they
+			// are not created for a statement that is only being explained.
 		default:
 			ids := make([]uint64, len(stmt.tree.SelectStmt.(ast.SelectStmt).ValuesLists))
 			for i, item := range stmt.tree.SelectStmt.(ast.SelectStmt).ValuesLists {
-				ids[i] = uint64(item[primaryKeyInsertIndex].(ast.A_Const).Val.(ast.Integer).Ival)
+				id, err := queryutil.GetNumericValue(item[primaryKeyInsertIndex], s.arguments.values())
+				if err != nil {
+					return InitialPlan{}, false, err
+				}
+				ids[i] = id
 			}
+			metadataSpan := s.startMetadataSpan("NewTenants")
 			_, err := s.Colony().Tenants().NewTenants(ids...)
+			endSpan(metadataSpan, err)
 			if err != nil {
 				return InitialPlan{}, false, err
 			}
+			newTenantIds = ids
 		}
 		fallthrough
 	case core.TableType_Global:
@@ -136,8 +182,9 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 		}
 
 		plan := InitialPlan{
-			Target:  PlanTarget_STANDARD,
-			ShardID: 0,
+			Target:    PlanTarget_STANDARD,
+			ShardID:   0,
+			TenantIDs: newTenantIds,
 			Types: map[PlanType]InitialPlanTask{
 				planType: {
 					Query: recompiled,
@@ -160,7 +207,9 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 
 		return plan, true, nil
 	case core.TableType_Sharded:
+		metadataSpan := s.startMetadataSpan("GetShardKeyColumnForTable")
 		shardKeyColumn, err := s.Colony().Tables().GetShardKeyColumnForTable(table.TableID)
+		endSpan(metadataSpan, err)
 		if err != nil {
 			return InitialPlan{}, false, err
 		}
@@ -176,11 +225,19 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 
 		// Discover the unique tenant IDs in the single insert
 
+		// The shard key might be a placeholder, so we want to resolve the value of each row's
+		// shard key before we try to figure out where the rows belong.
+		rowTenantIds := make([]uint64, len(stmt.tree.SelectStmt.(ast.SelectStmt).ValuesLists))
+		for i, item := range stmt.tree.SelectStmt.(ast.SelectStmt).ValuesLists {
+			tenantId, err := queryutil.GetNumericValue(item[shardKeyInsertIndex], s.arguments.values())
+			if err != nil {
+				return InitialPlan{}, false, err
+			}
+			rowTenantIds[i] = tenantId
+		}
+
 		tenantIds := make([]uint64, 0)
-		linq.From(stmt.tree.SelectStmt.(ast.SelectStmt).ValuesLists).
-			Select(func(i interface{}) interface{} {
-				return uint64(i.([]ast.Node)[shardKeyInsertIndex].(ast.A_Const).Val.(ast.Integer).Ival)
-			}).
+		linq.From(rowTenantIds).
 			Distinct().
 			ToSlice(&tenantIds)
 
@@ -194,14 +251,17 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 				return InitialPlan{}, false, err
 			}
 
+			metadataSpan := s.startMetadataSpan("GetTenant")
 			tenant, err := s.Colony().Tenants().GetTenant(tenantIds[0])
+			endSpan(metadataSpan, err)
 			if err != nil {
 				return InitialPlan{}, false, err
 			}
 
 			plan := InitialPlan{
-				Target:  PlanTarget_STANDARD,
-				ShardID: tenant.ShardID,
+				Target:    PlanTarget_STANDARD,
+				ShardID:   tenant.ShardID,
+				TenantIDs: tenantIds,
 				Types: map[PlanType]InitialPlanTask{
 					planType: {
 						Query: recompiled,
@@ -224,12 +284,79 @@ func (stmt *insertStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 
 			return plan, true, nil
 		default:
+			// The rows being inserted belong to several tenants, these tenants might live on
+			// different shards. So we want to split the rows up by the shard they belong to and
+			// generate a plan for each shard.
 			datums := map[uint64][][]ast.Node{}
-			for _, item := range stmt.tree.SelectStmt.(ast.SelectStmt).ValuesLists {
-				tenantId := uint64(item[shardKeyInsertIndex].(ast.A_Const).Val.(ast.Integer).Ival)
-				datums[tenantId] = append(datums[tenantId], item)
+			shardTenantIds := map[uint64][]uint64{}
+			shardIds := make([]uint64, 0)
+			for i, item := range stmt.tree.SelectStmt.(ast.SelectStmt).ValuesLists {
+				metadataSpan := s.startMetadataSpan("GetTenant")
+				tenant, err := s.Colony().Tenants().GetTenant(rowTenantIds[i])
+				endSpan(metadataSpan, err)
+				if err != nil {
+					return InitialPlan{}, false, err
+				}
+				if _, ok := datums[tenant.ShardID]; !ok {
+					shardIds = append(shardIds, tenant.ShardID)
+				}
+				if !linq.From(shardTenantIds[tenant.ShardID]).Contains(rowTenantIds[i]) {
+					shardTenantIds[tenant.ShardID] = append(shardTenantIds[tenant.ShardID], rowTenantIds[i])
+				}
+				datums[tenant.ShardID] = append(datums[tenant.ShardID], item)
+			}
+
+			plan := InitialPlan{
+				Target:    PlanTarget_STANDARD,
+				TenantIDs: tenantIds,
+				Splits:    make([]InitialPlan, len(shardIds)),
 			}
 
+			for i, shardId := range shardIds {
+				selectStmt := stmt.tree.SelectStmt.(ast.SelectStmt)
+				selectStmt.ValuesLists = datums[shardId]
+				tree := stmt.tree
+				tree.SelectStmt = selectStmt
+
+				recompiled, err := tree.Deparse(ast.Context_None)
+				if err != nil {
+					return InitialPlan{}, false, err
+				}
+
+				// Each split only includes some of the rows, so it might not reference all of
+				// the placeholders that were bound to the original statement.
+				parameters := queryutil.GetArguments(tree)
+
+				split := InitialPlan{
+					Target:    PlanTarget_STANDARD,
+					ShardID:   shardId,
+					TenantIDs: shardTenantIds[shardId],
+					Types: map[PlanType]InitialPlanTask{
+						planType: {
+							Query:      recompiled,
+							Type:       tree.StatementType(),
+							Parameters: parameters,
+						},
+					},
+				}
+
+				if planType == PlanType_READWRITE {
+					tree.ReturningList.Items = []ast.Node{}
+					recompiled, err = tree.Deparse(ast.Context_None)
+					if err != nil {
+						return InitialPlan{}, false, err
+					}
+					split.Types[PlanType_WRITE] = InitialPlanTask{
+						Query:      recompiled,
+						Type:       tree.StatementType(),
+						Parameters: queryutil.GetArguments(tree),
+					}
+				}
+
+				plan.Splits[i] = split
+			}
+
+			return plan, true, nil
 		}
 	}
 	return InitialPlan{}, false, nil
@@ -0,0 +1,61 @@
+package sql_test
+
+import (
+	"database/sql"
+	"github.com/elliotcourant/noahdb/testutils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE metrics_test (id BIGSERIAL PRIMARY KEY, name TEXT);`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`SELECT * FROM metrics_test;`)
+	assert.NoError(t, err)
+
+	_, err = db.Exec(`SELECT * FROM not_a_table;`)
+	assert.Error(t, err)
+
+	server := httptest.NewServer(colony.Metrics().Registry())
+	defer server.Close()
+
+	response, err := server.Client().Get(server.URL + "/metrics")
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	output := string(body)
+
+	assert.Contains(t, output, "noahdb_connections_total ")
+	assert.Contains(t, output, `noahdb_statements_total{type="CREATE TABLE",outcome="success"} 1`)
+	assert.Contains(t, output, `noahdb_statements_total{type="SELECT",outcome="success"}`)
+	assert.Contains(t, output, `noahdb_statements_total{type="SELECT",outcome="error"}`)
+	assert.Contains(t, output, `noahdb_statement_planning_seconds_count{type="SELECT"}`)
+	assert.Contains(t, output, `noahdb_statement_execution_seconds_count{type="SELECT"}`)
+	assert.Contains(t, output, `noahdb_pool_wait_seconds_count{data_node_shard_id=`)
+	assert.Contains(t, output, `noahdb_pool_idle_connections{data_node_shard_id=`)
+	assert.Contains(t, output, `noahdb_raft_state{state="leader"} 1`)
+	assert.Contains(t, output, "noahdb_raft_term ")
+	assert.Contains(t, output, "noahdb_raft_commit_index ")
+	assert.Contains(t, output, "noahdb_shards ")
+	assert.Contains(t, output, "noahdb_tenants ")
+}
@@ -0,0 +1,261 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	noahSchemaName = "noah"
+)
+
+// noahFunction is an administrative function that can be called with a select statement, like
+// SELECT noah.move_tenant(42, 7). The value returned by the function is returned to the client as
+// a single column.
+type noahFunction func(s *session, args []ast.Node) (interface{}, error)
+
+var (
+	noahFunctions = map[string]noahFunction{
+		"balance_replicas":      balanceReplicasFunction,
+		"drain_data_node":       drainDataNodeFunction,
+		"move_tenant":           moveTenantFunction,
+		"reset_stat_statements": resetStatStatementsFunction,
+		"set_setting":           setSettingFunction,
+		"split_shard":           splitShardFunction,
+	}
+)
+
+// moveTenantFunction moves a tenant to another shard, it returns the ID of the shard that the
+// tenant now lives on.
+func moveTenantFunction(s *session, args []ast.Node) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("move_tenant requires a tenant ID and a shard ID")
+	}
+
+	tenantId, err := queryutil.GetNumericValue(args[0], s.arguments.values())
+	if err != nil {
+		return nil, err
+	}
+
+	shardId, err := queryutil.GetNumericValue(args[1], s.arguments.values())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Colony().Tenants().MoveTenant(tenantId, shardId); err != nil {
+		return nil, err
+	}
+
+	return int64(shardId), nil
+}
+
+// splitShardFunction moves about half of the data on a shard to a new shard, it returns the ID of
+// the new shard.
+func splitShardFunction(s *session, args []ast.Node) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("split_shard requires a shard ID")
+	}
+
+	shardId, err := queryutil.GetNumericValue(args[0], s.arguments.values())
+	if err != nil {
+		return nil, err
+	}
+
+	split, err := s.Colony().Shards().SplitShard(shardId)
+	if err != nil {
+		return nil, err
+	}
+
+	return int64(split.TargetShardID), nil
+}
+
+// drainDataNodeFunction moves all of the shards off of a data node and then removes the data node
+// from the cluster, it returns the ID of the data node that was removed.
+func drainDataNodeFunction(s *session, args []ast.Node) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("drain_data_node requires a data node ID")
+	}
+
+	dataNodeId, err := queryutil.GetNumericValue(args[0], s.arguments.values())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Colony().DataNodes().DrainDataNode(dataNodeId); err != nil {
+		return nil, err
+	}
+
+	return int64(dataNodeId), nil
+}
+
+// balanceReplicasFunction adds replicas to any shards that have fewer than the replication factor
+// and repairs any replicas that have diverged, it returns true once the replicas are balanced.
+func balanceReplicasFunction(s *session, args []ast.Node) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("balance_replicas does not take any arguments")
+	}
+
+	if err := s.Colony().Shards().BalanceReplicas(); err != nil {
+		return nil, err
+	}
+
+	if err := s.Colony().Shards().RepairDivergedDataNodeShards(); err != nil {
+		return nil, err
+	}
+
+	return true, nil
+}
+
+// resetStatStatementsFunction clears the statistics of the statements run on every coordinator,
+// if a fingerprint is provided then only that statement is cleared. It returns the number of
+// statements that were cleared.
+func resetStatStatementsFunction(s *session, args []ast.Node) (interface{}, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("reset_stat_statements takes an optional fingerprint")
+	}
+
+	fingerprint := ""
+	if len(args) == 1 {
+		value, err := queryutil.GetStringValue(args[0], s.arguments.values())
+		if err != nil {
+			return nil, err
+		}
+		fingerprint = value
+	}
+
+	removed, err := s.Colony().Statistics().ResetStatementStatistics(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	return int64(removed), nil
+}
+
+// setSettingFunction changes the value of a cluster setting, it returns the name of the setting
+// that was changed.
+func setSettingFunction(s *session, args []ast.Node) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("set_setting requires a setting name and a value")
+	}
+
+	name, err := queryutil.GetStringValue(args[0], s.arguments.values())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setNoahSetting(s, name, args[1]); err != nil {
+		return nil, err
+	}
+
+	return name, nil
+}
+
+// getNoahFunctionPlan will execute any noah functions that are called in the select statement. If
+// the statement does not call any noah functions then false is returned.
+func (stmt *selectStmtPlanner) getNoahFunctionPlan(s *session) (InitialPlan, bool, error) {
+	functionCalls := stmt.getFunctionCalls()
+	noahCalls := 0
+	for _, functionCall := range functionCalls {
+		if schema, _ := getFunctionName(functionCall); schema == noahSchemaName {
+			noahCalls++
+		}
+	}
+
+	if noahCalls == 0 {
+		return InitialPlan{}, false, nil
+	}
+
+	if noahCalls != len(stmt.tree.TargetList.Items) || len(queryutil.GetTables(stmt.tree)) > 0 {
+		return InitialPlan{}, false, fmt.Errorf("noah functions cannot be combined with other targets or tables")
+	}
+
+	// These functions make changes to the cluster that cannot be rolled back.
+	if s.GetTransactionState() != TransactionState_None {
+		return InitialPlan{}, false, fmt.Errorf("noah functions cannot be called inside a transaction block")
+	}
+
+	columns := make([]string, len(stmt.tree.TargetList.Items))
+	for i, item := range stmt.tree.TargetList.Items {
+		resTarget := item.(ast.ResTarget)
+		functionCall := resTarget.Val.(ast.FuncCall)
+		_, name := getFunctionName(functionCall)
+		function, ok := noahFunctions[name]
+		if !ok {
+			return InitialPlan{}, false, fmt.Errorf("function %s.%s does not exist", noahSchemaName, name)
+		}
+
+		value, err := function(s, functionCall.Args.Items)
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+
+		columnName := name
+		if resTarget.Name != nil {
+			columnName = *resTarget.Name
+		}
+
+		literal, err := getInternalLiteral(value)
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+
+		columns[i] = fmt.Sprintf(`%s AS "%s"`, literal, strings.Replace(columnName, `"`, `""`, -1))
+	}
+
+	// The results of the functions are returned through the internal store so that they are
+	// sent to the client the same way as any other internal query.
+	return InitialPlan{
+		Target: PlanTarget_INTERNAL,
+		Types: map[PlanType]InitialPlanTask{
+			PlanType_READ: {
+				Query: fmt.Sprintf("SELECT %s", strings.Join(columns, ", ")),
+				Type:  ast.Rows,
+			},
+		},
+	}, true, nil
+}
+
+// getFunctionName returns the schema and the name of the function being called. If the function
+// is not qualified then the schema will be blank.
+func getFunctionName(functionCall ast.FuncCall) (string, string) {
+	names := make([]string, 0, len(functionCall.Funcname.Items))
+	for _, item := range functionCall.Funcname.Items {
+		if name, ok := item.(ast.String); ok {
+			names = append(names, strings.ToLower(name.Str))
+		}
+	}
+
+	switch len(names) {
+	case 0:
+		return "", ""
+	case 1:
+		return "", names[0]
+	default:
+		return names[len(names)-2], names[len(names)-1]
+	}
+}
+
+// getInternalLiteral returns the provided value as a literal that can be used in a query for the
+// internal store.
+func getInternalLiteral(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case string:
+		return fmt.Sprintf("'%s'", strings.Replace(v, "'", "''", -1)), nil
+	default:
+		return "", fmt.Errorf("cannot return value of type %T", value)
+	}
+}
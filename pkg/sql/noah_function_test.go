@@ -0,0 +1,131 @@
+package sql_test
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/testutils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMoveTenantFunction(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE accounts (id BIGSERIAL PRIMARY KEY, name TEXT) TABLESPACE "noah.tenants"`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO accounts (name) VALUES('moving');`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE products (id BIGSERIAL PRIMARY KEY, account_id BIGINT NOT NULL REFERENCES accounts (id), sku TEXT) TABLESPACE "noah.sharded"`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	tenants, err := colony.Tenants().GetTenants()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Len(t, tenants, 1)
+	tenant := tenants[0]
+
+	numberOfProducts := 10
+	for i := 0; i < numberOfProducts; i++ {
+		_, err = db.Exec(fmt.Sprintf(`INSERT INTO products (account_id, sku) VALUES(%d, 'sku %d');`, tenant.TenantID, i))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+	}
+
+	shards, err := colony.Shards().GetShards()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	targetShardId := uint64(0)
+	for _, shard := range shards {
+		if shard.ShardID != tenant.ShardID {
+			targetShardId = shard.ShardID
+			break
+		}
+	}
+	assert.NotZero(t, targetShardId)
+
+	t.Run("move tenant", func(t *testing.T) {
+		movedTo := uint64(0)
+		err := db.QueryRow(fmt.Sprintf(`SELECT noah.move_tenant(%d, %d)`, tenant.TenantID, targetShardId)).Scan(&movedTo)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		assert.Equal(t, targetShardId, movedTo)
+
+		moved, err := colony.Tenants().GetTenant(tenant.TenantID)
+		assert.NoError(t, err)
+		assert.Equal(t, targetShardId, moved.ShardID)
+
+		products := 0
+		err = db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM products WHERE account_id = %d`, tenant.TenantID)).Scan(&products)
+		assert.NoError(t, err)
+		assert.Equal(t, numberOfProducts, products)
+	})
+
+	t.Run("writes during move", func(t *testing.T) {
+		// Writes keep happening while the tenant is moved back, none of them should be lost on
+		// the shard that the tenant is leaving.
+		stop, written := make(chan struct{}), make(chan int)
+		go func() {
+			count := 0
+			defer func() {
+				written <- count
+			}()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				if _, err := db.Exec(fmt.Sprintf(`INSERT INTO products (account_id, sku) VALUES(%d, 'during %d');`, tenant.TenantID, count)); err != nil {
+					t.Errorf("could not insert product during move: %v", err)
+					return
+				}
+				if _, err := db.Exec(`UPDATE products SET sku = 'updated' WHERE account_id = $1 AND sku = $2`, tenant.TenantID, fmt.Sprintf("during %d", count)); err != nil {
+					t.Errorf("could not update product during move: %v", err)
+					return
+				}
+				count++
+			}
+		}()
+
+		_, err := db.Exec(fmt.Sprintf(`SELECT noah.move_tenant(%d, %d)`, tenant.TenantID, tenant.ShardID))
+		close(stop)
+		count := <-written
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		products, updated := 0, 0
+		err = db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM products WHERE account_id = %d`, tenant.TenantID)).Scan(&products)
+		assert.NoError(t, err)
+		assert.Equal(t, numberOfProducts+count, products)
+		err = db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM products WHERE account_id = %d AND sku = 'updated'`, tenant.TenantID)).Scan(&updated)
+		assert.NoError(t, err)
+		assert.Equal(t, count, updated)
+	})
+
+	t.Run("move to the same shard", func(t *testing.T) {
+		_, err := db.Exec(fmt.Sprintf(`SELECT noah.move_tenant(%d, %d)`, tenant.TenantID, tenant.ShardID))
+		assert.Error(t, err)
+	})
+}
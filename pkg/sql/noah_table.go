@@ -0,0 +1,802 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/core"
+	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// noahRow is a set of column values from an INSERT, the SET clause of an UPDATE or the filter of
+// an UPDATE or DELETE against a noah table.
+type noahRow map[string]ast.Node
+
+// noahTable is a system table in the noah schema, like noah.data_nodes. Reads are served from the
+// internal store, writes are performed with the same operations that the coordinator uses to
+// manage the cluster. A table that does not support a type of write will leave it nil.
+type noahTable struct {
+	// query returns a query for the internal store that produces the rows of the table.
+	query func(s *session) (string, error)
+
+	// columns are the names of the columns that the table has.
+	columns []string
+
+	insert func(s *session, row noahRow) error
+	update func(s *session, set noahRow, filter noahRow) (uint64, error)
+	delete func(s *session, filter noahRow) (uint64, error)
+}
+
+var (
+	noahTables = map[string]noahTable{
+		"coordinators": {
+			query:   coordinatorsQuery,
+			columns: []string{"coordinator_id", "address", "leader"},
+			insert:  insertCoordinator,
+		},
+		"data_node_shards": {
+			query: staticQuery(`SELECT data_node_shards.data_node_shard_id, data_node_shards.data_node_id, data_node_shards.shard_id, data_node_shards.read_only, data_node_shard_provisions.data_node_shard_id IS NOT NULL AS provisioning, diverged_data_node_shards.data_node_shard_id IS NOT NULL AS diverged FROM data_node_shards LEFT JOIN data_node_shard_provisions ON data_node_shard_provisions.data_node_shard_id = data_node_shards.data_node_shard_id LEFT JOIN diverged_data_node_shards ON diverged_data_node_shards.data_node_shard_id = data_node_shards.data_node_shard_id`),
+			columns: []string{
+				"data_node_shard_id", "data_node_id", "shard_id", "read_only", "provisioning", "diverged",
+			},
+		},
+		"data_nodes": {
+			// The password of the data node is never returned.
+			query: staticQuery(`SELECT data_node_id, address, port, user AS "user", healthy, draining, ssl_mode, ssl_root_cert FROM data_nodes`),
+			columns: []string{
+				"data_node_id", "address", "port", "user", "password", "healthy", "draining", "ssl_mode", "ssl_root_cert",
+			},
+			insert: insertDataNode,
+			update: updateDataNode,
+			delete: deleteDataNode,
+		},
+		"settings": {
+			query:   staticQuery(`SELECT setting_id, setting_key, type_id, COALESCE(CAST(int_value AS TEXT), CASE boolean_value WHEN 1 THEN 'true' WHEN 0 THEN 'false' END, text_value) AS value FROM settings`),
+			columns: []string{"setting_id", "setting_key", "type_id", "value"},
+			update:  updateSetting,
+		},
+		"shards": {
+			query:   staticQuery(`SELECT shard_id, state, (SELECT COUNT(*) FROM tenants WHERE tenants.shard_id = shards.shard_id) AS tenants FROM shards`),
+			columns: []string{"shard_id", "state", "tenants"},
+			insert:  insertShard,
+		},
+		"stat_statements": {
+			query: statStatementsQuery,
+			columns: []string{
+				"fingerprint", "query", "calls", "errors", "rows", "total_time", "mean_time", "max_time", "shards",
+			},
+			delete: deleteStatStatements,
+		},
+		"tenants": {
+			query:   staticQuery(`SELECT tenant_id, shard_id, EXISTS (SELECT 1 FROM tenant_moves WHERE tenant_moves.tenant_id = tenants.tenant_id) AS moving FROM tenants`),
+			columns: []string{"tenant_id", "shard_id", "moving"},
+			insert:  insertTenant,
+			update:  updateTenant,
+		},
+	}
+)
+
+func staticQuery(query string) func(s *session) (string, error) {
+	return func(s *session) (string, error) {
+		return query, nil
+	}
+}
+
+// coordinatorsQuery returns the coordinators that are part of the raft cluster. These are not
+// stored in a table so the rows are built from the current configuration.
+func coordinatorsQuery(s *session) (string, error) {
+	servers, err := s.Colony().Neighbors()
+	if err != nil {
+		return "", err
+	}
+
+	_, leaderId, err := s.Colony().LeaderID()
+	if err != nil {
+		return "", err
+	}
+
+	if len(servers) == 0 {
+		return `SELECT NULL AS coordinator_id, NULL AS address, NULL AS leader WHERE 0`, nil
+	}
+
+	rows := make([]string, len(servers))
+	for i, server := range servers {
+		id, _ := getInternalLiteral(server.ID)
+		address, _ := getInternalLiteral(server.Addr)
+		leader, _ := getInternalLiteral(server.ID == leaderId)
+		rows[i] = fmt.Sprintf(`SELECT %s AS coordinator_id, %s AS address, %s AS leader`, id, address, leader)
+	}
+
+	return strings.Join(rows, " UNION ALL "), nil
+}
+
+// statStatementsQuery returns the statistics of the statements that have been run on every
+// coordinator in the cluster. Times are in milliseconds and the shards that the statement was
+// sent to are returned as a comma separated list. The rows are built as a single VALUES list,
+// sqlite limits how many selects can be combined with UNION ALL and there can be thousands of
+// statements.
+func statStatementsQuery(s *session) (string, error) {
+	statistics, err := s.Colony().Statistics().GetStatementStatistics()
+	if err != nil {
+		return "", err
+	}
+
+	if len(statistics) == 0 {
+		return `SELECT NULL AS fingerprint, NULL AS query, NULL AS calls, NULL AS errors, NULL AS "rows", NULL AS total_time, NULL AS mean_time, NULL AS max_time, NULL AS shards WHERE 0`, nil
+	}
+
+	milliseconds := func(duration time.Duration) float64 {
+		return float64(duration) / float64(time.Millisecond)
+	}
+
+	rows := make([]string, len(statistics))
+	for i, statement := range statistics {
+		shardIds := make([]string, len(statement.ShardIDs))
+		for x, shardId := range statement.ShardIDs {
+			shardIds[x] = strconv.FormatUint(shardId, 10)
+		}
+
+		values := []interface{}{
+			statement.Fingerprint,
+			statement.Query,
+			int64(statement.Calls),
+			int64(statement.Errors),
+			int64(statement.Rows),
+			milliseconds(statement.TotalTime),
+			milliseconds(statement.MeanTime()),
+			milliseconds(statement.MaxTime),
+			strings.Join(shardIds, ","),
+		}
+		literals := make([]string, len(values))
+		for x, value := range values {
+			literals[x], _ = getInternalLiteral(value)
+		}
+
+		rows[i] = fmt.Sprintf("(%s)", strings.Join(literals, ", "))
+	}
+
+	return fmt.Sprintf(
+		`SELECT column1 AS fingerprint, column2 AS query, column3 AS calls, column4 AS errors, column5 AS "rows", column6 AS total_time, column7 AS mean_time, column8 AS max_time, column9 AS shards FROM (VALUES %s)`,
+		strings.Join(rows, ", ")), nil
+}
+
+// deleteStatStatements resets the statistics of the statements on every coordinator, if the
+// fingerprint is provided then only that statement is reset.
+func deleteStatStatements(s *session, filter noahRow) (uint64, error) {
+	if err := filter.only("fingerprint"); err != nil {
+		return 0, err
+	}
+
+	fingerprint := ""
+	if _, ok := filter["fingerprint"]; ok {
+		value, err := filter.text("fingerprint", s)
+		if err != nil {
+			return 0, err
+		}
+		fingerprint = value
+	}
+
+	return s.Colony().Statistics().ResetStatementStatistics(fingerprint)
+}
+
+// insertCoordinator adds a new coordinator to the raft cluster.
+func insertCoordinator(s *session, row noahRow) error {
+	if err := row.require("coordinator_id", "address"); err != nil {
+		return err
+	}
+
+	id, err := row.text("coordinator_id", s)
+	if err != nil {
+		return err
+	}
+
+	address, err := row.text("address", s)
+	if err != nil {
+		return err
+	}
+
+	return s.Colony().Join(id, address)
+}
+
+// insertDataNode adds a new data node to the cluster, any shards that do not have a data node yet
+// will be placed on it.
+func insertDataNode(s *session, row noahRow) error {
+	if err := row.only("address", "port", "user", "password", "ssl_mode", "ssl_root_cert"); err != nil {
+		return err
+	}
+
+	if err := row.require("address", "port", "user"); err != nil {
+		return err
+	}
+
+	address, err := row.text("address", s)
+	if err != nil {
+		return err
+	}
+
+	port, err := row.number("port", s)
+	if err != nil {
+		return err
+	}
+
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port [%d] for data node", port)
+	}
+
+	user, err := row.text("user", s)
+	if err != nil {
+		return err
+	}
+
+	password, sslMode, sslRootCert := "", core.SSLModeDisable, ""
+	if _, ok := row["password"]; ok {
+		if password, err = row.text("password", s); err != nil {
+			return err
+		}
+	}
+
+	_, hasSSLMode := row["ssl_mode"]
+	_, hasSSLRootCert := row["ssl_root_cert"]
+	if hasSSLMode {
+		if sslMode, err = row.text("ssl_mode", s); err != nil {
+			return err
+		}
+	}
+
+	if hasSSLRootCert {
+		if sslRootCert, err = row.text("ssl_root_cert", s); err != nil {
+			return err
+		}
+	}
+
+	// Make sure the SSL settings are valid before the data node is created.
+	if err := core.ValidateSSLMode(sslMode); err != nil {
+		return err
+	}
+
+	dataNode, err := s.Colony().DataNodes().NewDataNode(address, int32(port), user, password)
+	if err != nil {
+		return err
+	}
+
+	if hasSSLMode || hasSSLRootCert {
+		if err := s.Colony().DataNodes().SetDataNodeSSL(dataNode.DataNodeID, sslMode, sslRootCert); err != nil {
+			return err
+		}
+	}
+
+	return s.Colony().Shards().BalanceOrphanShards()
+}
+
+// updateDataNode changes how the coordinators connect to a data node.
+func updateDataNode(s *session, set noahRow, filter noahRow) (uint64, error) {
+	if err := set.only("ssl_mode", "ssl_root_cert"); err != nil {
+		return 0, err
+	}
+
+	id, err := filter.id("data_node_id", s)
+	if err != nil {
+		return 0, err
+	}
+
+	dataNode, err := s.Colony().DataNodes().GetDataNode(id)
+	if err != nil {
+		return 0, err
+	}
+
+	sslMode, sslRootCert := dataNode.SSLMode, dataNode.SSLRootCert
+	if _, ok := set["ssl_mode"]; ok {
+		if sslMode, err = set.text("ssl_mode", s); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, ok := set["ssl_root_cert"]; ok {
+		if sslRootCert, err = set.text("ssl_root_cert", s); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := s.Colony().DataNodes().SetDataNodeSSL(id, sslMode, sslRootCert); err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// deleteDataNode moves all of the shards off of a data node and then removes it from the cluster.
+func deleteDataNode(s *session, filter noahRow) (uint64, error) {
+	id, err := filter.id("data_node_id", s)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.Colony().DataNodes().DrainDataNode(id); err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// updateSetting changes the value of a cluster setting.
+func updateSetting(s *session, set noahRow, filter noahRow) (uint64, error) {
+	if err := set.only("value"); err != nil {
+		return 0, err
+	}
+
+	if err := set.require("value"); err != nil {
+		return 0, err
+	}
+
+	var name string
+	if _, ok := filter["setting_key"]; ok && len(filter) == 1 {
+		key, err := filter.text("setting_key", s)
+		if err != nil {
+			return 0, err
+		}
+
+		setting, ok, err := s.Colony().Setting().GetSettingByName(key)
+		if err != nil {
+			return 0, err
+		} else if !ok {
+			return 0, nil
+		}
+		name = setting.SettingKey
+	} else {
+		id, err := filter.id("setting_id", s)
+		if err != nil {
+			return 0, fmt.Errorf("rows can only be filtered by setting_key or setting_id")
+		}
+
+		setting, ok, err := s.Colony().Setting().GetSetting(core.SettingKeyOptions(id))
+		if err != nil {
+			return 0, err
+		} else if !ok {
+			return 0, nil
+		}
+		name = setting.SettingKey
+	}
+
+	if err := setNoahSetting(s, name, set["value"]); err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// insertShard creates a new shard and places it on a data node.
+func insertShard(s *session, row noahRow) error {
+	if err := row.only(); err != nil {
+		return err
+	}
+
+	if _, err := s.Colony().Shards().NewShard(); err != nil {
+		return err
+	}
+
+	return s.Colony().Shards().BalanceOrphanShards()
+}
+
+// insertTenant creates a new tenant, the tenant will be placed on the shard with the least
+// pressure.
+func insertTenant(s *session, row noahRow) error {
+	if err := row.only("tenant_id"); err != nil {
+		return err
+	}
+
+	// Tenant IDs are chosen by the application, they are not generated.
+	if err := row.require("tenant_id"); err != nil {
+		return err
+	}
+
+	id, err := row.number("tenant_id", s)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Colony().Tenants().NewTenants(id)
+	return err
+}
+
+// updateTenant moves a tenant to the shard that is being set.
+func updateTenant(s *session, set noahRow, filter noahRow) (uint64, error) {
+	if err := set.only("shard_id"); err != nil {
+		return 0, err
+	}
+
+	tenantId, err := filter.id("tenant_id", s)
+	if err != nil {
+		return 0, err
+	}
+
+	shardId, err := set.id("shard_id", s)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.Colony().Tenants().MoveTenant(tenantId, shardId); err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// require returns an error if any of the provided columns are missing from the row.
+func (row noahRow) require(columns ...string) error {
+	for _, column := range columns {
+		if _, ok := row[column]; !ok {
+			return fmt.Errorf("a value must be provided for column %s", column)
+		}
+	}
+	return nil
+}
+
+// only returns an error if the row has a value for a column that cannot be written.
+func (row noahRow) only(columns ...string) error {
+	for name := range row {
+		allowed := false
+		for _, column := range columns {
+			if name == column {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("column %s cannot be written", name)
+		}
+	}
+	return nil
+}
+
+// id returns the value of a column that must identify a single object.
+func (row noahRow) id(column string, s *session) (uint64, error) {
+	value, ok := row[column]
+	if !ok || len(row) != 1 {
+		return 0, fmt.Errorf("rows can only be filtered by %s", column)
+	}
+
+	return queryutil.GetNumericValue(value, s.arguments.values())
+}
+
+func (row noahRow) number(column string, s *session) (uint64, error) {
+	return queryutil.GetNumericValue(row[column], s.arguments.values())
+}
+
+func (row noahRow) text(column string, s *session) (string, error) {
+	return queryutil.GetStringValue(row[column], s.arguments.values())
+}
+
+// getNoahTable returns the noah table with the provided name.
+func getNoahTable(name string) (noahTable, error) {
+	table, ok := noahTables[name]
+	if !ok {
+		return noahTable{}, fmt.Errorf("relation %s.%s does not exist", noahSchemaName, name)
+	}
+	return table, nil
+}
+
+// getNoahRelation returns the name of the noah table that the range var references, if the range
+// var does not reference the noah schema then false is returned.
+func getNoahRelation(rangeVar *ast.RangeVar) (string, bool) {
+	if rangeVar == nil || rangeVar.Schemaname == nil || strings.ToLower(*rangeVar.Schemaname) != noahSchemaName {
+		return "", false
+	}
+	return strings.ToLower(*rangeVar.Relname), true
+}
+
+// getNoahTablePlan builds a plan to read noah tables from the internal store. Each noah table
+// that is referenced is replaced with a common table expression. If the statement does not
+// reference any noah tables then false is returned.
+func (stmt *selectStmtPlanner) getNoahTablePlan(s *session) (InitialPlan, bool, error) {
+	tree := stmt.tree
+	if args := s.arguments.values(); len(args) > 0 {
+		tree = queryutil.ReplaceArguments(tree, args).(ast.SelectStmt)
+	}
+
+	rangeVars := queryutil.GetRangeVars(tree)
+	names := make([]string, 0, len(rangeVars))
+	for i := range rangeVars {
+		if name, ok := getNoahRelation(&rangeVars[i]); ok {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return InitialPlan{}, false, nil
+	}
+
+	if len(names) != len(rangeVars) {
+		return InitialPlan{}, false, fmt.Errorf("noah tables cannot be combined with other tables")
+	}
+
+	if tree.WithClause != nil {
+		return InitialPlan{}, false, fmt.Errorf("WITH is not supported when querying noah tables")
+	}
+
+	expressions := make([]string, 0, len(names))
+	added := map[string]struct{}{}
+	for _, name := range names {
+		if _, ok := added[name]; ok {
+			continue
+		}
+		added[name] = struct{}{}
+
+		table, err := getNoahTable(name)
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+
+		query, err := table.query(s)
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+
+		expressions = append(expressions, fmt.Sprintf(`"noah_%s" AS (%s)`, name, query))
+	}
+
+	// The statement that was parsed might be cached as a prepared statement, so the noah tables
+	// are renamed in a copy of it.
+	renamed := queryutil.ReplaceRangeVars(tree, func(rangeVar ast.RangeVar) ast.RangeVar {
+		relation := "noah_" + strings.ToLower(*rangeVar.Relname)
+		rangeVar.Schemaname, rangeVar.Relname = nil, &relation
+		return rangeVar
+	}).(ast.SelectStmt)
+
+	query, err := renamed.Deparse(ast.Context_None)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	return InitialPlan{
+		Target: PlanTarget_INTERNAL,
+		Types: map[PlanType]InitialPlanTask{
+			PlanType_READ: {
+				Query: fmt.Sprintf("WITH %s %s", strings.Join(expressions, ", "), query),
+				Type:  ast.Rows,
+			},
+		},
+	}, true, nil
+}
+
+// getNoahWritePlan returns a plan that reports the result of a write to a noah table. The write
+// has already been performed by the time the plan is returned.
+func getNoahWritePlan(command string, rows uint64) InitialPlan {
+	return InitialPlan{
+		Target: PlanTarget_COORDINATOR,
+		CommandTag: commandTag{
+			Command: command,
+			Rows:    rows,
+			HasRows: true,
+		}.String(),
+	}
+}
+
+// checkNoahWrite returns an error if the write cannot be performed against a noah table.
+func checkNoahWrite(s *session, returningList ast.List, withClause *ast.WithClause) error {
+	// These writes make changes to the cluster that cannot be rolled back.
+	if s.GetTransactionState() != TransactionState_None {
+		return fmt.Errorf("noah tables cannot be changed inside a transaction block")
+	}
+
+	if len(returningList.Items) > 0 {
+		return fmt.Errorf("RETURNING is not supported for noah tables")
+	}
+
+	if withClause != nil {
+		return fmt.Errorf("WITH is not supported for noah tables")
+	}
+
+	return nil
+}
+
+// getNoahFilter reads the WHERE clause of a write to a noah table. Only filters that compare
+// columns to values and are combined with AND are supported.
+func getNoahFilter(table noahTable, node ast.Node) (noahRow, error) {
+	filter := noahRow{}
+	if node == nil {
+		return filter, nil
+	}
+
+	switch expr := node.(type) {
+	case ast.BoolExpr:
+		if expr.Boolop != ast.AND_EXPR {
+			return nil, fmt.Errorf("only filters combined with AND are supported for noah tables")
+		}
+
+		for _, arg := range expr.Args.Items {
+			items, err := getNoahFilter(table, arg)
+			if err != nil {
+				return nil, err
+			}
+
+			for column, value := range items {
+				if _, ok := filter[column]; ok {
+					return nil, fmt.Errorf("column %s cannot be filtered more than once", column)
+				}
+				filter[column] = value
+			}
+		}
+	case ast.A_Expr:
+		if expr.Kind != ast.AEXPR_OP || len(expr.Name.Items) != 1 {
+			return nil, fmt.Errorf("only equality filters are supported for noah tables")
+		}
+
+		if operator, ok := expr.Name.Items[0].(ast.String); !ok || operator.Str != "=" {
+			return nil, fmt.Errorf("only equality filters are supported for noah tables")
+		}
+
+		columnRef, ok := expr.Lexpr.(ast.ColumnRef)
+		if !ok || len(columnRef.Fields.Items) == 0 {
+			return nil, fmt.Errorf("noah table filters must compare a column to a value")
+		}
+
+		name, ok := columnRef.Fields.Items[len(columnRef.Fields.Items)-1].(ast.String)
+		if !ok {
+			return nil, fmt.Errorf("noah table filters must compare a column to a value")
+		}
+
+		column := strings.ToLower(name.Str)
+		if err := table.checkColumn(column); err != nil {
+			return nil, err
+		}
+
+		filter[column] = expr.Rexpr
+	default:
+		return nil, fmt.Errorf("only equality filters are supported for noah tables")
+	}
+
+	return filter, nil
+}
+
+// checkColumn returns an error if the column does not exist on the table.
+func (table noahTable) checkColumn(column string) error {
+	for _, name := range table.columns {
+		if name == column {
+			return nil
+		}
+	}
+	return fmt.Errorf("column %s does not exist", column)
+}
+
+// getNoahQueryPlan performs inserts into noah tables.
+func (stmt *insertStmtPlanner) getNoahQueryPlan(s *session) (InitialPlan, bool, error) {
+	name, ok := getNoahRelation(stmt.tree.Relation)
+	if !ok {
+		return InitialPlan{}, false, nil
+	}
+
+	table, err := getNoahTable(name)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	if err := checkNoahWrite(s, stmt.tree.ReturningList, stmt.tree.WithClause); err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	if table.insert == nil || stmt.tree.OnConflictClause != nil {
+		return InitialPlan{}, false, fmt.Errorf("cannot insert into %s.%s", noahSchemaName, name)
+	}
+
+	if len(stmt.tree.Cols.Items) == 0 && stmt.tree.SelectStmt != nil {
+		return InitialPlan{}, false, fmt.Errorf("column names must be provided when inserting into noah tables")
+	}
+
+	columns := make([]string, len(stmt.tree.Cols.Items))
+	for i, item := range stmt.tree.Cols.Items {
+		column := strings.ToLower(*item.(ast.ResTarget).Name)
+		if err := table.checkColumn(column); err != nil {
+			return InitialPlan{}, false, err
+		}
+		columns[i] = column
+	}
+
+	// INSERT ... DEFAULT VALUES does not have a select statement.
+	valuesLists := [][]ast.Node{{}}
+	if stmt.tree.SelectStmt != nil {
+		selectStmt, ok := stmt.tree.SelectStmt.(ast.SelectStmt)
+		if !ok || len(selectStmt.ValuesLists) == 0 {
+			return InitialPlan{}, false, fmt.Errorf("only VALUES can be inserted into noah tables")
+		}
+		valuesLists = selectStmt.ValuesLists
+	}
+
+	for _, values := range valuesLists {
+		if len(values) != len(columns) {
+			return InitialPlan{}, false, fmt.Errorf("INSERT has a different number of expressions than target columns")
+		}
+
+		row := noahRow{}
+		for i, value := range values {
+			// Columns that are set to DEFAULT are treated as if they were not provided.
+			if _, ok := value.(ast.SetToDefault); ok {
+				continue
+			}
+			row[columns[i]] = value
+		}
+
+		if err := table.insert(s, row); err != nil {
+			return InitialPlan{}, false, err
+		}
+	}
+
+	return getNoahWritePlan("INSERT", uint64(len(valuesLists))), true, nil
+}
+
+// getNoahQueryPlan performs updates to noah tables.
+func (stmt *updateStmtPlanner) getNoahQueryPlan(s *session) (InitialPlan, bool, error) {
+	name, ok := getNoahRelation(stmt.tree.Relation)
+	if !ok {
+		return InitialPlan{}, false, nil
+	}
+
+	table, err := getNoahTable(name)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	if err := checkNoahWrite(s, stmt.tree.ReturningList, stmt.tree.WithClause); err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	if table.update == nil || len(stmt.tree.FromClause.Items) > 0 {
+		return InitialPlan{}, false, fmt.Errorf("cannot update %s.%s", noahSchemaName, name)
+	}
+
+	set := noahRow{}
+	for _, item := range stmt.tree.TargetList.Items {
+		target := item.(ast.ResTarget)
+		column := strings.ToLower(*target.Name)
+		if err := table.checkColumn(column); err != nil {
+			return InitialPlan{}, false, err
+		}
+		set[column] = target.Val
+	}
+
+	filter, err := getNoahFilter(table, stmt.tree.WhereClause)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	rows, err := table.update(s, set, filter)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	return getNoahWritePlan("UPDATE", rows), true, nil
+}
+
+// getNoahQueryPlan performs deletes from noah tables.
+func (stmt *deleteStmtPlanner) getNoahQueryPlan(s *session) (InitialPlan, bool, error) {
+	name, ok := getNoahRelation(stmt.tree.Relation)
+	if !ok {
+		return InitialPlan{}, false, nil
+	}
+
+	table, err := getNoahTable(name)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	if err := checkNoahWrite(s, stmt.tree.ReturningList, stmt.tree.WithClause); err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	if table.delete == nil || len(stmt.tree.UsingClause.Items) > 0 {
+		return InitialPlan{}, false, fmt.Errorf("cannot delete from %s.%s", noahSchemaName, name)
+	}
+
+	filter, err := getNoahFilter(table, stmt.tree.WhereClause)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	rows, err := table.delete(s, filter)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	return getNoahWritePlan("DELETE", rows), true, nil
+}
@@ -0,0 +1,272 @@
+package sql_test
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/core"
+	"github.com/elliotcourant/noahdb/testutils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNoahTables(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	t.Run("select data nodes", func(t *testing.T) {
+		dataNodes, err := colony.DataNodes().GetDataNodes()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		count := 0
+		err = db.QueryRow(`SELECT count(*) FROM noah.data_nodes WHERE healthy = 1`).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, len(dataNodes), count)
+	})
+
+	t.Run("password is not returned", func(t *testing.T) {
+		_, err := db.Exec(`SELECT password FROM noah.data_nodes`)
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown table", func(t *testing.T) {
+		_, err := db.Exec(`SELECT * FROM noah.not_a_table`)
+		assert.Error(t, err)
+	})
+
+	t.Run("insert shard", func(t *testing.T) {
+		before, err := colony.Shards().GetShards()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		result, err := db.Exec(`INSERT INTO noah.shards DEFAULT VALUES`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		rows, err := result.RowsAffected()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), rows)
+
+		count := 0
+		err = db.QueryRow(`SELECT count(*) FROM noah.shards`).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, len(before)+1, count)
+	})
+
+	t.Run("insert and move tenant", func(t *testing.T) {
+		_, err := db.Exec(`INSERT INTO noah.tenants (tenant_id) VALUES (9001)`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		tenant, err := colony.Tenants().GetTenant(9001)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		shards, err := colony.Shards().GetShards()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		targetShardId := uint64(0)
+		for _, shard := range shards {
+			if shard.ShardID != tenant.ShardID {
+				targetShardId = shard.ShardID
+				break
+			}
+		}
+		assert.NotZero(t, targetShardId)
+
+		_, err = db.Exec(fmt.Sprintf(`UPDATE noah.tenants SET shard_id = %d WHERE tenant_id = 9001`, targetShardId))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		shardId := uint64(0)
+		err = db.QueryRow(`SELECT shard_id FROM noah.tenants WHERE tenant_id = 9001`).Scan(&shardId)
+		assert.NoError(t, err)
+		assert.Equal(t, targetShardId, shardId)
+	})
+
+	t.Run("insert tenant without id", func(t *testing.T) {
+		_, err := db.Exec(`INSERT INTO noah.tenants DEFAULT VALUES`)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "a value must be provided for column tenant_id")
+		}
+	})
+
+	t.Run("update without filter", func(t *testing.T) {
+		_, err := db.Exec(`UPDATE noah.tenants SET shard_id = 1`)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid data node port", func(t *testing.T) {
+		_, err := db.Exec(`INSERT INTO noah.data_nodes (address, port, "user") VALUES ('127.0.0.1', 70000, 'postgres')`)
+		assert.Error(t, err)
+	})
+
+	t.Run("write in transaction", func(t *testing.T) {
+		tx, err := db.Begin()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`INSERT INTO noah.shards DEFAULT VALUES`)
+		assert.Error(t, err)
+	})
+}
+
+func TestAlterSystem(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	t.Run("alter system", func(t *testing.T) {
+		_, err := db.Exec(`ALTER SYSTEM SET max_pool_size = 12`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		value := ""
+		err = db.QueryRow(`SELECT value FROM noah.settings WHERE setting_key = 'max_pool_size'`).Scan(&value)
+		assert.NoError(t, err)
+		assert.Equal(t, "12", value)
+	})
+
+	t.Run("set setting function", func(t *testing.T) {
+		_, err := db.Exec(`SELECT noah.set_setting('max_pool_size', 8)`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		value, _, err := colony.Setting().GetSettingValue(core.SettingKeyOptions_MaxPoolSize)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(8), value)
+	})
+
+	t.Run("update settings table", func(t *testing.T) {
+		_, err := db.Exec(`UPDATE noah.settings SET value = '45 seconds' WHERE setting_key = 'pool_refresh_interval'`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		value, _, err := colony.Setting().GetSettingValue(core.SettingKeyOptions_PoolRefreshInterval)
+		assert.NoError(t, err)
+		assert.Equal(t, "45 seconds", value)
+	})
+
+	t.Run("unknown setting", func(t *testing.T) {
+		_, err := db.Exec(`ALTER SYSTEM SET not_a_setting = 1`)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		_, err := db.Exec(`ALTER SYSTEM SET replication_factor = 0`)
+		assert.Error(t, err)
+	})
+}
+
+func TestStatStatements(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE colors (id BIGSERIAL PRIMARY KEY, name TEXT)`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO colors (name) VALUES('red'), ('blue');`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	t.Run("statements with different constants are combined", func(t *testing.T) {
+		for _, name := range []string{"red", "blue", "green"} {
+			_, err := db.Exec(fmt.Sprintf(`SELECT id FROM colors WHERE name = '%s'`, name))
+			assert.NoError(t, err)
+		}
+
+		statistics := colony.Statistics().GetLocalStatementStatistics()
+		found := false
+		for _, statement := range statistics {
+			if statement.Query != `SELECT id FROM colors WHERE name = $1` {
+				continue
+			}
+			found = true
+			assert.Equal(t, uint64(3), statement.Calls)
+			assert.Equal(t, uint64(2), statement.Rows)
+			assert.Equal(t, uint64(0), statement.Errors)
+		}
+		assert.True(t, found)
+	})
+
+	t.Run("select stat statements", func(t *testing.T) {
+		calls := 0
+		err := db.QueryRow(`SELECT calls FROM noah.stat_statements WHERE query LIKE '%FROM colors WHERE%'`).Scan(&calls)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("errors are counted", func(t *testing.T) {
+		_, err := db.Exec(`SELECT not_a_column FROM colors`)
+		assert.Error(t, err)
+
+		errors := 0
+		err = db.QueryRow(`SELECT errors FROM noah.stat_statements WHERE query LIKE '%not_a_column%'`).Scan(&errors)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, errors)
+	})
+
+	t.Run("select many stat statements", func(t *testing.T) {
+		// sqlite can only combine 500 selects with UNION ALL, there should be no limit on the
+		// number of statements that can be returned.
+		for i := 0; i < 600; i++ {
+			fingerprint := fmt.Sprintf("many_%d", i)
+			colony.Statistics().RecordStatement(core.StatementExecution{
+				Fingerprint: fingerprint,
+				Rows:        1,
+			}, func() string {
+				return fmt.Sprintf("SELECT %s", fingerprint)
+			})
+		}
+
+		count := 0
+		err := db.QueryRow(`SELECT count(*) FROM noah.stat_statements WHERE fingerprint LIKE 'many_%'`).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 600, count)
+	})
+
+	t.Run("reset stat statements", func(t *testing.T) {
+		_, err := db.Exec(`DELETE FROM noah.stat_statements`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		count := 0
+		err = db.QueryRow(`SELECT count(*) FROM noah.stat_statements WHERE query LIKE '%FROM colors WHERE%'`).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+}
@@ -2,8 +2,13 @@ package sql
 
 import (
 	"fmt"
+	"github.com/ahmetb/go-linq/v3"
 	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/core"
 	"github.com/elliotcourant/noahdb/pkg/pgwirebase"
+	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
+	"math/rand"
+	"strings"
 	"time"
 )
 
@@ -20,6 +25,10 @@ type PlanTarget string
 const (
 	PlanTarget_STANDARD PlanTarget = "STANDARD"
 	PlanTarget_INTERNAL PlanTarget = "INTERNAL"
+
+	// PlanTarget_COORDINATOR is used for statements that have already been performed by the
+	// coordinator while they were being planned, like writes to noah tables.
+	PlanTarget_COORDINATOR PlanTarget = "COORDINATOR"
 )
 
 type DistributedPlanType int
@@ -28,11 +37,32 @@ const (
 	DistributedPlanType_NONE     DistributedPlanType = 0
 	DistributedPlanType_COMMIT   DistributedPlanType = 1
 	DistributedPlanType_ROLLBACK DistributedPlanType = 2
+
+	// DistributedPlanType_SAVEPOINT is used for SAVEPOINT, RELEASE and ROLLBACK TO. The query of
+	// the plan is sent to every data node shard that has joined the transaction.
+	DistributedPlanType_SAVEPOINT DistributedPlanType = 3
+)
+
+// CommandTagStrategy determines how the command tags returned by each data node shard are
+// combined into the single tag that is sent to the client.
+type CommandTagStrategy int
+
+const (
+	// CommandTagStrategy_REPLICATED is used when every data node shard that is targeted holds a
+	// copy of the same rows, like writes to global tables. Only one replica's count is reported.
+	CommandTagStrategy_REPLICATED CommandTagStrategy = 0
+	// CommandTagStrategy_SPLIT is used when a statement has been divided between several shards.
+	// The count from each shard is added together.
+	CommandTagStrategy_SPLIT CommandTagStrategy = 1
 )
 
 type InitialPlanTask struct {
 	Query string
 	Type  ast.StmtType
+
+	// Parameters are the placeholders that are referenced in the query, if this is nil then the
+	// query references all of the arguments that were bound to the statement.
+	Parameters []int
 }
 
 type InitialPlan struct {
@@ -40,6 +70,26 @@ type InitialPlan struct {
 	ShardID      uint64
 	Target       PlanTarget
 	DistPlanType DistributedPlanType
+
+	// TenantIDs are the tenants that were found in the statement when it was routed. This is
+	// only used to show how the statement was planned.
+	TenantIDs []uint64
+
+	// Splits is used when a single statement needs to be divided into several statements that
+	// each target a different shard. When splits are present the types and shard ID of the parent
+	// plan are ignored.
+	Splits []InitialPlan
+
+	// CommandTag is sent to the client for plans that target the coordinator.
+	CommandTag string
+
+	// SchemaChange is set when the statement changes the schema of the data nodes. It is finished
+	// once the statement has been executed.
+	SchemaChange *schemaChange
+
+	// Explain is set when the statement is being explained rather than executed. The plan is
+	// routed like the explained statement, each task asks its data node shard for its own plan.
+	Explain *explainPlan
 }
 
 type ExpandedPlan struct {
@@ -47,13 +97,27 @@ type ExpandedPlan struct {
 	Target       PlanTarget
 	OutFormats   []pgwirebase.FormatCode
 	DistPlanType DistributedPlanType
+	TagStrategy  CommandTagStrategy
+
+	// Arguments are the parameters bound by the client, if there are any then the tasks will be
+	// sent to the data nodes using the extended query protocol.
+	Arguments *boundArguments
+
+	// Fingerprint is the fingerprint of the original statement, it is used to reuse statements
+	// that have already been prepared on the data node connections.
+	Fingerprint string
+
+	// Explain is carried over from the initial plan.
+	Explain *explainPlan
 }
 
 type ExpandedPlanTask struct {
 	Query           string
 	ReadOnly        bool
+	ShardID         uint64
 	DataNodeShardID uint64
 	Type            ast.StmtType
+	Parameters      []int
 }
 
 type NoahQueryPlanner interface {
@@ -95,6 +159,14 @@ func (s *session) expandQueryPlan(plan InitialPlan) (ExpandedPlan, error) {
 					DataNodeShardID: id,
 					Type:            ast.Ack,
 				}
+			case DistributedPlanType_SAVEPOINT:
+				writePlan, _ := plan.Types[PlanType_WRITE]
+				tasks[i] = ExpandedPlanTask{
+					Query:           writePlan.Query,
+					ReadOnly:        false,
+					DataNodeShardID: id,
+					Type:            ast.Ack,
+				}
 			}
 		}
 
@@ -102,6 +174,26 @@ func (s *session) expandQueryPlan(plan InitialPlan) (ExpandedPlan, error) {
 			Target:       PlanTarget_STANDARD,
 			Tasks:        tasks,
 			DistPlanType: plan.DistPlanType,
+			TagStrategy:  CommandTagStrategy_REPLICATED,
+		}, nil
+	}
+
+	if len(plan.Splits) > 0 {
+		// Each split targets its own shard, so we want to expand each one and then execute all
+		// of the resulting tasks together. The rows affected on each shard will be added up.
+		tasks := make([]ExpandedPlanTask, 0, len(plan.Splits))
+		for _, split := range plan.Splits {
+			expanded, err := s.expandQueryPlan(split)
+			if err != nil {
+				return ExpandedPlan{}, err
+			}
+			tasks = append(tasks, expanded.Tasks...)
+		}
+
+		return ExpandedPlan{
+			Target:      plan.Target,
+			Tasks:       tasks,
+			TagStrategy: CommandTagStrategy_SPLIT,
 		}, nil
 	}
 
@@ -131,7 +223,9 @@ func (s *session) expandQueryPlan(plan InitialPlan) (ExpandedPlan, error) {
 		// any random node.
 		if _, ok := plan.Types[PlanType_READ]; ok {
 			// Get a single node to execute the read query.
+			metadataSpan := s.startMetadataSpan("GetRandomDataNodeShardID")
 			id, err := s.Colony().DataNodes().GetRandomDataNodeShardID()
+			endSpan(metadataSpan, err)
 			if err != nil {
 				return ExpandedPlan{}, err
 			}
@@ -148,7 +242,16 @@ func (s *session) expandQueryPlan(plan InitialPlan) (ExpandedPlan, error) {
 		}
 
 		if !readOnly {
-			ids, err := s.Colony().DataNodes().GetDataNodeShardIDs()
+			getIds, operation := s.Colony().DataNodes().GetDataNodeShardIDs, "GetDataNodeShardIDs"
+			if writePlan, ok := plan.Types[PlanType_WRITE]; ok && writePlan.Type == ast.DDL {
+				// Changes to the schema are not copied to read only replicas by logical
+				// replication, so they need to be sent to every data node shard.
+				getIds, operation = s.Colony().DataNodes().GetSchemaDataNodeShardIDs, "GetSchemaDataNodeShardIDs"
+			}
+
+			metadataSpan := s.startMetadataSpan(operation)
+			ids, err := getIds()
+			endSpan(metadataSpan, err)
 			if err != nil {
 				return ExpandedPlan{}, err
 			}
@@ -156,7 +259,9 @@ func (s *session) expandQueryPlan(plan InitialPlan) (ExpandedPlan, error) {
 			break
 		}
 	default:
+		metadataSpan := s.startMetadataSpan("GetDataNodeShardIDsForShard")
 		tempDataNodeShardIds, err := s.Colony().DataNodes().GetDataNodeShardIDsForShard(plan.ShardID)
+		endSpan(metadataSpan, err)
 		if err != nil {
 			return ExpandedPlan{}, fmt.Errorf("could not retrieve data nodes for shard ID [%d]: %s", plan.ShardID, err.Error())
 		}
@@ -166,8 +271,19 @@ func (s *session) expandQueryPlan(plan InitialPlan) (ExpandedPlan, error) {
 		}
 
 		if _, ok := plan.Types[PlanType_READ]; ok {
-			// Get any readable node for the given shard ID
-			dataNodeShards = append(dataNodeShards, tempDataNodeShardIds[0])
+			// Reads are spread across all of the replicas of the shard that are in sync.
+			metadataSpan := s.startMetadataSpan("GetReadDataNodeShardIDsForShard")
+			readDataNodeShardIds, err := s.Colony().DataNodes().GetReadDataNodeShardIDsForShard(plan.ShardID)
+			endSpan(metadataSpan, err)
+			if err != nil {
+				return ExpandedPlan{}, fmt.Errorf("could not retrieve data nodes for shard ID [%d]: %s", plan.ShardID, err.Error())
+			}
+
+			if len(readDataNodeShardIds) < 1 {
+				return ExpandedPlan{}, fmt.Errorf("could not retrieve data nodes for shard ID [%d]: no readable nodes were returned", plan.ShardID)
+			}
+
+			dataNodeShards = append(dataNodeShards, readDataNodeShardIds[rand.Intn(len(readDataNodeShardIds))])
 			break
 		}
 
@@ -189,15 +305,16 @@ func (s *session) expandQueryPlan(plan InitialPlan) (ExpandedPlan, error) {
 	for i, id := range dataNodeShards {
 		task := ExpandedPlanTask{
 			ReadOnly:        readOnly,
+			ShardID:         plan.ShardID,
 			DataNodeShardID: id,
 		}
 
 		if readPlan, ok := plan.Types[PlanType_READ]; ok {
-			task.Query, task.Type = readPlan.Query, readPlan.Type
+			task.Query, task.Type, task.Parameters = readPlan.Query, readPlan.Type, readPlan.Parameters
 		} else if writePlan, ok := plan.Types[PlanType_WRITE]; ok {
-			task.Query, task.Type = writePlan.Query, writePlan.Type
+			task.Query, task.Type, task.Parameters = writePlan.Query, writePlan.Type, writePlan.Parameters
 		} else if writePlan, ok := plan.Types[PlanType_READWRITE]; ok {
-			task.Query, task.Type = writePlan.Query, writePlan.Type
+			task.Query, task.Type, task.Parameters = writePlan.Query, writePlan.Type, writePlan.Parameters
 		}
 
 		tasks[i] = task
@@ -211,11 +328,138 @@ func (s *session) expandQueryPlan(plan InitialPlan) (ExpandedPlan, error) {
 	// then we want to make sure that just one of the executions
 	// has a returning clause.
 	if readWritePlan, ok := plan.Types[PlanType_READWRITE]; ok {
-		tasks[0].Query, tasks[0].Type = readWritePlan.Query, readWritePlan.Type
+		tasks[0].Query, tasks[0].Type, tasks[0].Parameters = readWritePlan.Query, readWritePlan.Type, readWritePlan.Parameters
 	}
 
+	// Whether this plan was broadcast to every shard (global tables) or sent to each replica of a
+	// single shard, every data node shard targeted holds the same rows.
 	return ExpandedPlan{
-		Target: plan.Target,
-		Tasks:  tasks,
+		Target:      plan.Target,
+		Tasks:       tasks,
+		TagStrategy: CommandTagStrategy_REPLICATED,
 	}, nil
 }
+
+// getTableWritePlan builds the plan for an UPDATE or DELETE statement that changes the provided
+// tables. Writes to sharded tables are routed to the shard of the single tenant in the statement,
+// any other write is sent to every shard. If the statement has a returning clause then
+// writeQuery is the statement without it, otherwise writeQuery is empty.
+func (s *session) getTableWritePlan(
+	tree ast.Stmt, tables []core.Table, query, writeQuery string) (InitialPlan, bool, error) {
+	types := map[PlanType]InitialPlanTask{
+		PlanType_WRITE: {
+			Query: query,
+			Type:  tree.StatementType(),
+		},
+	}
+	if writeQuery != "" {
+		types = map[PlanType]InitialPlanTask{
+			PlanType_READWRITE: {
+				Query: query,
+				Type:  tree.StatementType(),
+			},
+			PlanType_WRITE: {
+				Query: writeQuery,
+				Type:  tree.StatementType(),
+			},
+		}
+	}
+
+	sharded := false
+	for _, table := range tables {
+		switch table.TableType {
+		case core.TableType_Noah:
+			return InitialPlan{}, false, fmt.Errorf("table [%s] can only be changed through the %s schema", table.TableName, noahSchemaName)
+		case core.TableType_Sharded:
+			sharded = true
+		}
+	}
+
+	if !sharded {
+		return InitialPlan{
+			Target:  PlanTarget_STANDARD,
+			ShardID: 0,
+			Types:   types,
+		}, true, nil
+	}
+
+	shardColumnNames := map[string]string{}
+	columnsAndTables := map[string][]string{}
+	for _, table := range tables {
+		metadataSpan := s.startMetadataSpan("GetColumns")
+		columns, err := s.Colony().Tables().GetColumns(table.TableID)
+		endSpan(metadataSpan, err)
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+		for _, column := range columns {
+			if column.ShardKey {
+				shardColumnNames[table.TableName] = column.ColumnName
+			}
+			columnsAndTables[column.ColumnName] = append(columnsAndTables[column.ColumnName], table.TableName)
+		}
+	}
+
+	tenantIds, err := queryutil.FindAccountIdsWithArguments(
+		tree,
+		shardColumnNames,
+		columnsAndTables,
+		s.arguments.values())
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+	linq.From(tenantIds).Distinct().ToSlice(&tenantIds)
+
+	switch len(tenantIds) {
+	case 0:
+		return InitialPlan{}, false,
+			fmt.Errorf("cannot change sharded tables without specifying a tenant ID")
+	case 1:
+	default:
+		return InitialPlan{}, false,
+			fmt.Errorf("cannot change sharded tables for multiple tenants")
+	}
+
+	metadataSpan := s.startMetadataSpan("GetTenant")
+	tenant, err := s.Colony().Tenants().GetTenant(tenantIds[0])
+	endSpan(metadataSpan, err)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	return InitialPlan{
+		Target:    PlanTarget_STANDARD,
+		ShardID:   tenant.ShardID,
+		TenantIDs: tenantIds,
+		Types:     types,
+	}, true, nil
+}
+
+// getWriteTables resolves every table that is referenced in an UPDATE or DELETE statement.
+func (s *session) getWriteTables(tree ast.Stmt) ([]core.Table, error) {
+	tableNames := queryutil.GetTables(tree)
+	linq.From(tableNames).Distinct().ToSlice(&tableNames)
+
+	metadataSpan := s.startMetadataSpan("GetTables")
+	tables, err := s.Colony().Tables().GetTables(tableNames...)
+	endSpan(metadataSpan, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tables) != len(tableNames) {
+		// This means that there is a table missing.
+		missingTables := make([]string, 0)
+		linq.From(tableNames).
+			ExceptBy(linq.From(tables), func(i interface{}) interface{} {
+				if table, ok := i.(core.Table); ok {
+					return table.TableName
+				}
+				return nil
+			}).ToSlice(&missingTables)
+		s.log.Debugf("could not resolve tables: %s", strings.Join(missingTables, ", "))
+		return nil, fmt.Errorf("could not resolve tables with names: %s", strings.Join(missingTables, ", "))
+	}
+
+	return tables, nil
+}
@@ -1,7 +1,6 @@
 package sql
 
 import (
-	"fmt"
 	"github.com/ahmetb/go-linq/v3"
 	"github.com/elliotcourant/noahdb/pkg/ast"
 	"github.com/elliotcourant/noahdb/pkg/commands"
@@ -15,8 +14,12 @@ const (
 	defaultColumnName = "?column?"
 )
 
-func (s *session) addPreparedStatement(name string, stmt ast.Stmt, parseTypeHints queryutil.PlaceholderTypes) (*PreparedStatement, error) {
-	prepared, err := s.prepare(stmt, parseTypeHints)
+func (s *session) addPreparedStatement(
+	name string,
+	stmt ast.Stmt,
+	parseTypeHints queryutil.PlaceholderTypes,
+	rawTypeHints []types.OID) (*PreparedStatement, error) {
+	prepared, err := s.prepare(stmt, parseTypeHints, rawTypeHints)
 	if err != nil {
 		return nil, err
 	}
@@ -50,20 +53,31 @@ func (s *session) executePrepare(prepare commands.PrepareStatement, result *comm
 		s.deletePreparedStatement("")
 	}
 
-	_, err := s.addPreparedStatement(prepare.Name, prepare.Statement, prepare.TypeHints)
-	return err
+	prepared, err := s.addPreparedStatement(prepare.Name, prepare.Statement, prepare.TypeHints, prepare.RawTypeHints)
+	if err != nil {
+		return err
+	}
+
+	prepared.Str = prepare.Query
+	prepared.source = statementSource{
+		query:         prepare.Query,
+		parseStart:    prepare.ParseStart,
+		parseDuration: prepare.ParseDuration,
+	}
+	return nil
 }
 
 func (s *session) prepare(
-	stmt ast.Stmt, placeholderHints queryutil.PlaceholderTypes,
+	stmt ast.Stmt, placeholderHints queryutil.PlaceholderTypes, rawTypeHints []types.OID,
 ) (*PreparedStatement, error) {
 	if placeholderHints == nil {
 		placeholderHints = make(map[int]types.Type)
 	}
 
 	prepared := &PreparedStatement{
-		TypeHints: placeholderHints,
-		Statement: stmt,
+		TypeHints:    placeholderHints,
+		Statement:    stmt,
+		RawTypeHints: rawTypeHints,
 	}
 
 	if stmt == nil {
@@ -82,7 +96,7 @@ func (s *session) prepare(
 	}).Distinct().ToSlice(&tableNames)
 
 	// Infer the type info for each of the columns that will be returned.
-	columns, err := s.getPreparedStatementColumns(
+	columns, resolved, err := s.getPreparedStatementColumns(
 		referenceColumns,
 		tableNames,
 		tableAliasMap,
@@ -101,6 +115,21 @@ func (s *session) prepare(
 	}
 	prepared.InferredTypes = inferredTypes
 
+	// If we could not figure out the type of every column on our own then we want to let a data
+	// node describe the statement for us. Every shard has the same schema so any of them will do.
+	if !resolved && stmt.StatementType() == ast.Rows {
+		parameters, fields, err := s.describeOnDataNode(prepared)
+		if err != nil {
+			return nil, err
+		}
+		prepared.Columns = fields
+		for i, oid := range parameters {
+			if i < len(prepared.InferredTypes) {
+				prepared.InferredTypes[i] = types.Type(oid)
+			}
+		}
+	}
+
 	return prepared, nil
 }
 
@@ -108,8 +137,9 @@ func (s *session) getPreparedStatementColumns(
 	resTargets []ast.ResTarget,
 	tableNames []string,
 	tableAliases map[string]string,
-	placeholderHints queryutil.PlaceholderTypes) ([]pgproto.FieldDescription, error) {
+	placeholderHints queryutil.PlaceholderTypes) ([]pgproto.FieldDescription, bool, error) {
 	columns := make([]pgproto.FieldDescription, len(resTargets))
+	resolved := true
 
 	for i, col := range resTargets {
 		column := pgproto.FieldDescription{
@@ -121,7 +151,7 @@ func (s *session) getPreparedStatementColumns(
 			typeName, _ := colt.TypeName.Deparse(ast.Context_None)
 			typ, ok, err := s.Colony().Types().GetTypeByName(typeName)
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
 
 			// If we do not recognize the type we want to be optimistic, and return text for now
@@ -145,9 +175,18 @@ func (s *session) getPreparedStatementColumns(
 				column.DataTypeOID = types.Type_text.Uint32()
 			}
 		case ast.ColumnRef:
+			// A star will expand to any number of columns, only the data node knows what those
+			// columns will be.
+			if len(colt.Fields.Items) > 0 {
+				if _, ok := colt.Fields.Items[len(colt.Fields.Items)-1].(ast.A_Star); ok {
+					resolved = false
+					break
+				}
+			}
+
 			colNames, err := colt.Fields.DeparseList(ast.Context_Operator)
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
 
 			column.Name = colNames[len(colNames)-1]
@@ -163,21 +202,29 @@ func (s *session) getPreparedStatementColumns(
 				c, t = colNames[0], tableNames
 			} else if tbl, ok := tableAliases[colNames[0]]; ok {
 				c, t = column.Name, []string{tbl}
-			} else {
-				return nil, fmt.Errorf("could not resolve table [%s]", colNames[0])
+			}
+
+			// The column belongs to something that is not a table, like a CTE or a subquery,
+			// so only the data node will know its type.
+			if len(t) == 0 {
+				resolved = false
+				break
 			}
 
 			cl, ok, err := s.Colony().Tables().GetColumnFromTables(c, t)
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			} else if !ok {
-				return nil, fmt.Errorf("could not resolve column [%s]", colNames[0])
+				resolved = false
+				break
 			}
 
 			column.DataTypeOID = cl.Type.Uint32()
 			column.TableOID = uint32(cl.TableID)
 		default:
-			s.log.Debugf("test %+v", colt)
+			// Expressions, aggregates and function calls can't be resolved from the metadata
+			// alone, so the type will need to be retrieved from a data node.
+			resolved = false
 		}
 
 		if col.Name != nil {
@@ -187,7 +234,7 @@ func (s *session) getPreparedStatementColumns(
 		columns[i] = column
 	}
 
-	return columns, nil
+	return columns, resolved, nil
 }
 
 func (s *session) getInferredPreparedStatementParamTypes(
@@ -33,3 +33,81 @@ func Test_ExecPrepare(t *testing.T) {
 		fmt.Println(arg1, arg2)
 	}()
 }
+
+func Test_ExecPrepareExpression(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+	func() {
+		db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		// The type of an expression can't be inferred from the metadata, so this will be
+		// described by one of the data nodes.
+		prepared, err := db.Prepare("SELECT $1::int + 1, upper($2::text)")
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		sum, upper := 0, ""
+		if err := prepared.QueryRow(1, "noah").Scan(&sum, &upper); err != nil {
+			panic(err)
+		}
+		assert.Equal(t, 2, sum)
+		assert.Equal(t, "NOAH", upper)
+	}()
+}
+
+func Test_ExecPrepareDerivedTables(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+	func() {
+		db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		// Columns from CTEs and subqueries are not in the metadata, so these statements will be
+		// described by one of the data nodes.
+		for _, query := range []string{
+			"WITH numbers AS (SELECT $1::int AS n) SELECT numbers.n FROM numbers",
+			"SELECT sub.n FROM (SELECT $1::int AS n) sub",
+			"WITH numbers AS (SELECT $1::int AS n) SELECT n FROM numbers",
+		} {
+			prepared, err := db.Prepare(query)
+			if !assert.NoError(t, err, query) {
+				continue
+			}
+
+			n := 0
+			assert.NoError(t, prepared.QueryRow(5).Scan(&n), query)
+			assert.Equal(t, 5, n, query)
+			prepared.Close()
+		}
+
+		// Describing a statement inside of a transaction should not make any of the data node
+		// shards join that transaction.
+		tx, err := db.Begin()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		defer tx.Rollback()
+
+		prepared, err := tx.Prepare("WITH numbers AS (SELECT $1::int AS n) SELECT n FROM numbers")
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		defer prepared.Close()
+
+		ids, err := colony.DataNodes().GetDataNodeShardIDs()
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		for _, id := range ids {
+			assert.Equal(t, int64(0), colony.Pool().ActiveConnections(id), "data node shard [%d]", id)
+		}
+	}()
+}
@@ -10,6 +10,7 @@ import (
 
 func Run(stx sessionContext, log timber.Logger, terminateChannel chan bool) error {
 	s := newSession(stx, log)
+	defer s.close()
 	for {
 		select {
 		case <-terminateChannel:
@@ -36,6 +37,11 @@ func Run(stx sessionContext, log timber.Logger, terminateChannel chan bool) erro
 				result = commands.CreateExecuteCommandResult(s.Backend(), cmd.Statement)
 				err = s.executeStatement(
 					cmd.Statement,
+					statementSource{
+						query:         cmd.Query,
+						parseStart:    cmd.ParseStart,
+						parseDuration: cmd.ParseDuration,
+					},
 					result,
 					nil,
 					nil)
@@ -57,8 +63,9 @@ func Run(stx sessionContext, log timber.Logger, terminateChannel chan bool) erro
 				result = commands.CreateExecutePortalResult(s.Backend(), portal.Stmt.Statement)
 				err = s.executeStatement(
 					portal.Stmt.Statement,
+					portal.Stmt.sourceForExecution(),
 					result,
-					portal.Qargs,
+					portal.PreparedPortal,
 					portal.OutFormats)
 			case commands.PrepareStatement:
 				result = commands.CreatePreparedStatementResult(s.Backend(), cmd.Statement)
@@ -75,6 +82,7 @@ func Run(stx sessionContext, log timber.Logger, terminateChannel chan bool) erro
 				result = commands.CreateErrorResult(s.Backend(), cmd.Err)
 			case commands.Sync:
 				result = commands.CreateSyncCommandResult(s.Backend())
+				result.SetTransactionStatus(s.GetTransactionState().Status())
 			case commands.Flush:
 			case commands.CopyIn:
 			default:
@@ -82,6 +90,16 @@ func Run(stx sessionContext, log timber.Logger, terminateChannel chan bool) erro
 				panic(fmt.Sprintf("unsupported command type [%T]", cmd))
 			}
 
+			if err == nil {
+				err = result.Err()
+			}
+
+			// Any error inside of a transaction block will cause the transaction to fail, the
+			// client will then need to roll back the transaction.
+			if err != nil && s.GetTransactionState() == TransactionState_Active {
+				s.SetTransactionState(TransactionState_Failed)
+			}
+
 			if err != nil {
 				if err = result.CloseWithErr(err); err != nil {
 					return err
@@ -90,14 +108,8 @@ func Run(stx sessionContext, log timber.Logger, terminateChannel chan bool) erro
 					return err
 				}
 			} else {
-				if resultError := result.Err(); resultError != nil {
-					if err := result.CloseWithErr(resultError); err != nil {
-						return err
-					}
-				} else {
-					if err := result.Close(); err != nil {
-						return err
-					}
+				if err := result.Close(); err != nil {
+					return err
 				}
 				s.StatementBuffer().AdvanceOne()
 			}
@@ -0,0 +1,302 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/core"
+	"strings"
+)
+
+// schemaChange is a change to the schema of every data node shard. The statement is only stored as
+// a schema definition once it has been committed on the data nodes, that way shards that are added
+// later replay exactly the changes that were made to the existing shards, in the same order.
+type schemaChange struct {
+	// query is the statement that is stored as a schema definition.
+	query string
+
+	// commit updates noah's metadata once the change has been committed, this may be nil.
+	commit func() error
+
+	// rollback undoes any changes to noah's metadata that were made while the statement was
+	// being planned, this may be nil.
+	rollback func() error
+}
+
+// finishSchemaChanges is called once a statement has been executed. Schema changes made in a
+// transaction are held until the transaction ends, they are stored if it was committed and
+// discarded if it was rolled back.
+func (s *session) finishSchemaChanges(plan InitialPlan, err error) error {
+	if plan.SchemaChange != nil {
+		if err != nil {
+			s.rollbackSchemaChanges(plan.SchemaChange)
+		} else {
+			s.schemaChanges = append(s.schemaChanges, plan.SchemaChange)
+		}
+	}
+
+	if s.GetTransactionState() != TransactionState_None || len(s.schemaChanges) == 0 {
+		return nil
+	}
+
+	changes := s.schemaChanges
+	s.schemaChanges = nil
+	if err != nil || plan.DistPlanType == DistributedPlanType_ROLLBACK {
+		s.rollbackSchemaChanges(changes...)
+		return nil
+	}
+
+	for _, change := range changes {
+		if change.commit != nil {
+			if err := change.commit(); err != nil {
+				return fmt.Errorf("could not update metadata for schema change: %v", err)
+			}
+		}
+
+		if err := s.Colony().Schema().NewDefinition(change.query); err != nil {
+			return fmt.Errorf("could not store schema definition: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *session) rollbackSchemaChanges(changes ...*schemaChange) {
+	// Changes are undone in the opposite order that they were made.
+	for i := len(changes) - 1; i >= 0; i-- {
+		if changes[i].rollback == nil {
+			continue
+		}
+		if err := changes[i].rollback(); err != nil {
+			s.log.Errorf("could not undo metadata for schema change [%s]: %v", changes[i].query, err)
+		}
+	}
+}
+
+// schemaStmtPlanner plans statements that change the schema of the data nodes other than
+// CREATE TABLE, like CREATE INDEX, CREATE TYPE, ALTER TABLE and DROP.
+type schemaStmtPlanner struct {
+	tree ast.Stmt
+}
+
+func newSchemaStatementPlan(tree ast.Stmt) *schemaStmtPlanner {
+	return &schemaStmtPlanner{
+		tree: tree,
+	}
+}
+
+func (stmt *schemaStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, error) {
+	// Most of these statements can't be deparsed, so the statement is sent to the data nodes as
+	// the client wrote it.
+	query, err := s.getSchemaChangeQuery()
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	change := &schemaChange{
+		query: query,
+	}
+
+	switch tree := stmt.tree.(type) {
+	case ast.DropStmt:
+		if err := stmt.planDropTables(s, tree, change); err != nil {
+			return InitialPlan{}, false, err
+		}
+	case ast.AlterTableStmt:
+		if err := stmt.planAlterTable(s, tree, change); err != nil {
+			return InitialPlan{}, false, err
+		}
+	}
+
+	return InitialPlan{
+		Target:  PlanTarget_STANDARD,
+		ShardID: 0,
+		Types: map[PlanType]InitialPlanTask{
+			PlanType_WRITE: {
+				Query: query,
+				Type:  stmt.tree.StatementType(),
+			},
+		},
+		SchemaChange: change,
+	}, true, nil
+}
+
+// getSchemaChangeQuery returns the text of the statement that is being planned.
+func (s *session) getSchemaChangeQuery() (string, error) {
+	tree, err := ast.Parse(s.statementText)
+	if err != nil {
+		return "", err
+	}
+
+	if len(tree.Statements) != 1 {
+		return "", fmt.Errorf("schema changes must be sent as a single statement")
+	}
+
+	return strings.TrimSpace(s.statementText), nil
+}
+
+// planDropTables removes the metadata for any of the dropped tables once the tables have been
+// dropped from the data nodes.
+func (stmt *schemaStmtPlanner) planDropTables(s *session, tree ast.DropStmt, change *schemaChange) error {
+	if tree.RemoveType != ast.OBJECT_TABLE {
+		return nil
+	}
+
+	tables := make([]core.Table, 0, len(tree.Objects.Items))
+	for _, object := range tree.Objects.Items {
+		names, ok := object.(ast.List)
+		if !ok || len(names.Items) == 0 {
+			continue
+		}
+
+		name, ok := names.Items[len(names.Items)-1].(ast.String)
+		if !ok {
+			continue
+		}
+
+		table, ok, err := s.Colony().Tables().GetTable(name.Str)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if table.TableType == core.TableType_Noah {
+			return fmt.Errorf("table [%s] cannot be dropped", table.TableName)
+		}
+
+		tables = append(tables, table)
+	}
+
+	change.commit = func() error {
+		for _, table := range tables {
+			if err := s.Colony().Tables().DropTable(table.TableID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// planAlterTable records the columns that are added to or dropped from a table once the table has
+// been changed on the data nodes. The columns that noah uses to route statements can't be changed.
+func (stmt *schemaStmtPlanner) planAlterTable(s *session, tree ast.AlterTableStmt, change *schemaChange) error {
+	if tree.Relation == nil || tree.Relation.Relname == nil {
+		return nil
+	}
+
+	table, ok, err := s.Colony().Tables().GetTable(*tree.Relation.Relname)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	if table.TableType == core.TableType_Noah {
+		return fmt.Errorf("table [%s] cannot be altered", table.TableName)
+	}
+
+	existing, err := s.Colony().Tables().GetColumns(table.TableID)
+	if err != nil {
+		return err
+	}
+
+	columnsByName := map[string]core.Column{}
+	for _, column := range existing {
+		columnsByName[column.ColumnName] = column
+	}
+
+	added, dropped := make([]core.Column, 0), make([]uint64, 0)
+	for _, item := range tree.Cmds.Items {
+		cmd, ok := item.(ast.AlterTableCmd)
+		if !ok {
+			continue
+		}
+
+		switch cmd.Subtype {
+		case ast.AT_AddColumn:
+			def, ok := cmd.Def.(ast.ColumnDef)
+			if !ok {
+				continue
+			}
+
+			column, err := stmt.getAddedColumn(s, def)
+			if err != nil {
+				return err
+			}
+			added = append(added, column)
+		case ast.AT_DropColumn, ast.AT_AlterColumnType:
+			if cmd.Name == nil {
+				continue
+			}
+
+			column, ok := columnsByName[*cmd.Name]
+			if !ok {
+				continue
+			}
+
+			if column.PrimaryKey || column.ShardKey || column.Serial {
+				return fmt.Errorf("column [%s] of table [%s] is used by noah and cannot be changed", column.ColumnName, table.TableName)
+			}
+
+			if cmd.Subtype == ast.AT_DropColumn {
+				dropped = append(dropped, column.ColumnID)
+			}
+		}
+	}
+
+	change.commit = func() error {
+		if _, err := s.Colony().Tables().AddColumns(table, added); err != nil {
+			return err
+		}
+		return s.Colony().Tables().DropColumns(dropped...)
+	}
+
+	return nil
+}
+
+// getAddedColumn returns the metadata for a column that is being added to an existing table.
+// Columns that noah would route statements by can only be defined when the table is created.
+func (stmt *schemaStmtPlanner) getAddedColumn(s *session, def ast.ColumnDef) (core.Column, error) {
+	column := core.Column{
+		ColumnName: *def.Colname,
+		Nullable:   !def.IsNotNull,
+	}
+
+	for _, item := range def.Constraints.Items {
+		if constraint, ok := item.(ast.Constraint); ok &&
+			(constraint.Contype == ast.CONSTR_PRIMARY || constraint.Contype == ast.CONSTR_FOREIGN) {
+			return column, fmt.Errorf("column [%s] cannot be a primary or foreign key, it can only be added when the table is created", column.ColumnName)
+		}
+	}
+
+	if def.TypeName == nil {
+		return column, fmt.Errorf("column [%s] does not have a type", column.ColumnName)
+	}
+
+	names := make([]string, 0)
+	for _, item := range def.TypeName.Names.Items {
+		if typeName, ok := item.(ast.String); ok && typeName.Str != "" {
+			names = append(names, typeName.Str)
+		}
+	}
+	typeName := strings.Join(names, ".")
+
+	switch typeName {
+	case "bigserial", "serial":
+		return column, fmt.Errorf("column [%s] cannot be a serial column, it can only be added when the table is created", column.ColumnName)
+	}
+
+	pgType, ok, err := s.Colony().Types().GetTypeByName(typeName)
+	if err != nil {
+		return column, err
+	} else if !ok {
+		return column, fmt.Errorf("could not resolve type [%s]", typeName)
+	}
+	column.Type = pgType
+
+	return column, nil
+}
@@ -22,6 +22,16 @@ func newSelectStatementPlan(tree ast.SelectStmt) *selectStmtPlanner {
 }
 
 func (stmt *selectStmtPlanner) getNoahQueryPlan(s *session) (InitialPlan, bool, error) {
+	// Administrative functions like noah.move_tenant are executed by the coordinator.
+	if plan, ok, err := stmt.getNoahFunctionPlan(s); err != nil || ok {
+		return plan, ok, err
+	}
+
+	// System tables like noah.data_nodes are read from the internal store.
+	if plan, ok, err := stmt.getNoahTablePlan(s); err != nil || ok {
+		return plan, ok, err
+	}
+
 	tableNames := queryutil.GetTables(stmt.tree)
 	if len(tableNames) == 0 {
 		return InitialPlan{}, false, nil
@@ -29,7 +39,9 @@ func (stmt *selectStmtPlanner) getNoahQueryPlan(s *session) (InitialPlan, bool,
 
 	linq.From(tableNames).Distinct().ToSlice(&tableNames)
 
+	metadataSpan := s.startMetadataSpan("GetTables")
 	tables, err := s.Colony().Tables().GetTables(tableNames...)
+	endSpan(metadataSpan, err)
 	if err != nil {
 		return InitialPlan{}, false, err
 	}
@@ -119,7 +131,9 @@ func (stmt *selectStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 		columnsAndTables := map[string][]string{}
 
 		for _, table := range stmt.tables {
+			metadataSpan := s.startMetadataSpan("GetColumns")
 			columns, err := s.Colony().Tables().GetColumns(table.TableID)
+			endSpan(metadataSpan, err)
 			if err != nil {
 				return InitialPlan{}, false, err
 			}
@@ -134,7 +148,11 @@ func (stmt *selectStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 			}
 		}
 
-		tenantIds, err := queryutil.FindAccountIdsEx(stmt.tree, shardColumnNames, columnsAndTables)
+		tenantIds, err := queryutil.FindAccountIdsWithArguments(
+			stmt.tree,
+			shardColumnNames,
+			columnsAndTables,
+			s.arguments.values())
 		if err != nil {
 			return InitialPlan{}, false, err
 		}
@@ -153,14 +171,17 @@ func (stmt *selectStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, erro
 				fmt.Errorf("cannot query sharded tables for multiple tenants")
 		}
 
+		metadataSpan := s.startMetadataSpan("GetTenant")
 		tenant, err := s.Colony().Tenants().GetTenant(tenantId)
+		endSpan(metadataSpan, err)
 		if err != nil {
 			return InitialPlan{}, false, fmt.Errorf("could not generate query plan: %s", err.Error())
 		}
 
 		return InitialPlan{
-			Target:  PlanTarget_STANDARD,
-			ShardID: tenant.ShardID,
+			Target:    PlanTarget_STANDARD,
+			ShardID:   tenant.ShardID,
+			TenantIDs: tenantIds,
 			Types: map[PlanType]InitialPlanTask{
 				PlanType_READ: {
 					Type:  stmt.tree.StatementType(),
@@ -7,10 +7,12 @@ import (
 	"github.com/elliotcourant/noahdb/pkg/executor"
 	"github.com/elliotcourant/noahdb/pkg/pgproto"
 	"github.com/elliotcourant/noahdb/pkg/pgwirebase"
+	"github.com/elliotcourant/noahdb/pkg/tracing"
 	"github.com/elliotcourant/noahdb/pkg/types"
 	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
 	"github.com/elliotcourant/noahdb/pkg/util/stmtbuf"
 	"github.com/elliotcourant/timber"
+	"strings"
 	"sync"
 	"time"
 )
@@ -22,17 +24,40 @@ const (
 	QueryModeExtended           = 1
 )
 
+const (
+	// maxWriteFenceAttempts is how many times a statement will be planned or expanded again
+	// because the write fences changed while it was being planned.
+	maxWriteFenceAttempts = 5
+)
+
 type TransactionState int
 
 const (
 	TransactionState_None   TransactionState = 0
 	TransactionState_Active                  = 1
+	TransactionState_Failed                  = 2
 )
 
+// Status returns the transaction status indicator that is sent to the client in a ReadyForQuery
+// message.
+func (state TransactionState) Status() byte {
+	switch state {
+	case TransactionState_Active:
+		return 'T'
+	case TransactionState_Failed:
+		return 'E'
+	default:
+		return 'I'
+	}
+}
+
 type sessionContext interface {
 	Backend() *pgproto.Backend
 	Colony() core.Colony
 	StatementBuffer() stmtbuf.StatementBuffer
+
+	// User is the name of the user that the client connected as.
+	User() string
 }
 
 type Session interface {
@@ -51,9 +76,57 @@ type session struct {
 	transactionState     TransactionState
 	transactionStateSync sync.RWMutex
 
+	// savepoints are the names of the savepoints in the current transaction, in the order that
+	// they were created. These are created on any data node shard that joins the transaction.
+	savepoints []string
+
+	// beginQuery is the BEGIN statement that started the current transaction including any of its
+	// options, it is sent to each data node shard that joins the transaction.
+	beginQuery string
+
 	pool     map[uint64]core.PoolConnection
 	poolSync sync.Mutex
 
+	// poolMode determines when the connections in pool are given back to the colony's pool.
+	poolMode core.PoolModeOptions
+
+	// joined are the data node shards that have started the current transaction. A connection
+	// can be held across transactions when session pooling is used, so holding a connection does
+	// not mean that its data node shard has begun the current transaction.
+	joined map[uint64]bool
+
+	// arguments are the parameters bound to the statement that is currently being planned, this
+	// will be nil if the current statement was not executed from a portal.
+	arguments *boundArguments
+
+	// timings are how long each stage of the statement that is currently being run took, this
+	// will be nil when a statement is not being run.
+	timings *statementTimings
+
+	// traceParent is set with SET traceparent, statements that don't have a traceparent in a
+	// comment are added to this trace.
+	traceParent tracing.SpanContext
+
+	// stageSpan is the span of the plan or expand stage that is currently running, reads of the
+	// colony's metadata are recorded as its children. This is nil outside of those stages.
+	stageSpan *tracing.Span
+
+	// writeLease holds the writes to sharded tables in the current transaction, writes to a tenant
+	// that is being moved are not cut over until the lease has been released.
+	writeLease *core.WriteLease
+
+	// schemaChanges are the changes to the schema that have been made in the current transaction,
+	// they are stored once the transaction has been committed.
+	schemaChanges []*schemaChange
+
+	// statementText is the text of the statement that is currently being planned as it was sent
+	// by the client.
+	statementText string
+
+	// explaining is true while a statement is being planned for EXPLAIN without ANALYZE, the
+	// planner must not change anything while it is set since the statement is never executed.
+	explaining bool
+
 	executor executor.Executor
 }
 
@@ -71,9 +144,84 @@ func (s *session) GetQueryMode() QueryMode {
 
 func (s *session) SetTransactionState(state TransactionState) {
 	s.transactionStateSync.Lock()
-	defer s.transactionStateSync.Unlock()
 	s.log.Debugf("transitioning transaction state to [%d]", state)
 	s.transactionState = state
+	if state == TransactionState_None {
+		s.savepoints = nil
+		s.beginQuery = ""
+	}
+	s.transactionStateSync.Unlock()
+
+	if state == TransactionState_None {
+		s.poolSync.Lock()
+		s.joined = map[uint64]bool{}
+		s.poolSync.Unlock()
+	}
+}
+
+// BeginTransaction will start a new transaction, the provided query will be used to begin the
+// transaction on each data node shard that joins it.
+func (s *session) BeginTransaction(beginQuery string) {
+	s.SetTransactionState(TransactionState_Active)
+	s.transactionStateSync.Lock()
+	defer s.transactionStateSync.Unlock()
+	s.beginQuery = beginQuery
+}
+
+// GetBeginQuery returns the query that should be used to begin the current transaction on a data
+// node shard.
+func (s *session) GetBeginQuery() string {
+	s.transactionStateSync.RLock()
+	defer s.transactionStateSync.RUnlock()
+	if s.beginQuery == "" {
+		return "BEGIN"
+	}
+	return s.beginQuery
+}
+
+// AddSavepoint records a new savepoint in the current transaction.
+func (s *session) AddSavepoint(name string) {
+	s.transactionStateSync.Lock()
+	defer s.transactionStateSync.Unlock()
+	s.savepoints = append(s.savepoints, name)
+}
+
+// ReleaseSavepoint removes the most recent savepoint with the provided name as well as any
+// savepoints that were created after it. If the savepoint does not exist then false is returned.
+func (s *session) ReleaseSavepoint(name string) bool {
+	s.transactionStateSync.Lock()
+	defer s.transactionStateSync.Unlock()
+	for i := len(s.savepoints) - 1; i >= 0; i-- {
+		if s.savepoints[i] == name {
+			s.savepoints = s.savepoints[:i]
+			return true
+		}
+	}
+	return false
+}
+
+// RollbackToSavepoint removes any savepoints that were created after the most recent savepoint
+// with the provided name, the savepoint itself is kept. If the savepoint does not exist then false
+// is returned.
+func (s *session) RollbackToSavepoint(name string) bool {
+	s.transactionStateSync.Lock()
+	defer s.transactionStateSync.Unlock()
+	for i := len(s.savepoints) - 1; i >= 0; i-- {
+		if s.savepoints[i] == name {
+			s.savepoints = s.savepoints[:i+1]
+			return true
+		}
+	}
+	return false
+}
+
+// GetSavepoints returns the names of the savepoints in the current transaction.
+func (s *session) GetSavepoints() []string {
+	s.transactionStateSync.RLock()
+	defer s.transactionStateSync.RUnlock()
+	savepoints := make([]string, len(s.savepoints))
+	copy(savepoints, s.savepoints)
+	return savepoints
 }
 
 func (s *session) GetTransactionState() TransactionState {
@@ -85,26 +233,39 @@ func (s *session) GetTransactionState() TransactionState {
 func (s *session) GetConnectionForDataNodeShard(id uint64) (core.PoolConnection, error) {
 	startTimestamp := time.Now()
 	defer func() {
+		s.timings.observeConnectionAcquisition(time.Since(startTimestamp))
 		s.log.Verbosef("[%s] acquisition of connection to data node shard [%d]", time.Since(startTimestamp), id)
 	}()
 	s.poolSync.Lock()
 	defer s.poolSync.Unlock()
-	if pool, ok := s.pool[id]; ok {
-		return pool, nil
-	}
-	pc, err := s.Colony().Pool().GetConnectionForDataNodeShard(id)
-	if err != nil {
-		return nil, err
+	pc, ok := s.pool[id]
+	if !ok {
+		conn, err := s.Colony().Pool().GetConnectionForDataNodeShard(id)
+		if err != nil {
+			return nil, err
+		}
+		pc = conn
+		s.pool[id] = pc
 	}
-	s.pool[id] = pc
 
-	if s.GetTransactionState() == TransactionState_Active {
+	if s.GetTransactionState() == TransactionState_Active && !s.joined[id] {
+		s.joined[id] = true
+
+		// If savepoints were created before this data node shard joined the transaction then
+		// they need to be created here too. Nothing has happened on this shard yet so creating
+		// them all now puts it in the same state as the shards that were already in the
+		// transaction.
+		queries := []string{s.GetBeginQuery()}
+		for _, savepoint := range s.GetSavepoints() {
+			queries = append(queries, fmt.Sprintf("SAVEPOINT %s", savepoint))
+		}
 		err := pc.Send(&pgproto.Query{
-			String: "BEGIN",
+			String: strings.Join(queries, "; "),
 		})
 		if err != nil {
 			return pc, err
 		}
+		var beginErr error
 		for {
 			msg, err := pc.Receive()
 			if err != nil {
@@ -112,9 +273,9 @@ func (s *session) GetConnectionForDataNodeShard(id uint64) (core.PoolConnection,
 			}
 			switch m := msg.(type) {
 			case *pgproto.ErrorResponse:
-				return pc, fmt.Errorf("received error from pool conn with begin: %v", m.Message)
+				beginErr = fmt.Errorf("received error from pool conn with begin: %v", m.Message)
 			case *pgproto.ReadyForQuery:
-				return pc, nil
+				return pc, beginErr
 			}
 		}
 	}
@@ -125,29 +286,78 @@ func (s *session) GetConnectionForDataNodeShard(id uint64) (core.PoolConnection,
 func (s *session) GetPendingDataNodeShards() []uint64 {
 	s.poolSync.Lock()
 	defer s.poolSync.Unlock()
-	ids := make([]uint64, len(s.pool))
-	for id := range s.pool {
+	ids := make([]uint64, 0, len(s.joined))
+	for id := range s.joined {
 		ids = append(ids, id)
 	}
 	return ids
 }
 
+// shouldReleaseConnections returns true if the session's connections should be given back to the
+// pool once the current statement has finished.
+func (s *session) shouldReleaseConnections() bool {
+	switch s.poolMode {
+	case core.PoolModeOptions_SessionPooling:
+		return false
+	case core.PoolModeOptions_StatementPooling:
+		return true
+	default:
+		return s.GetTransactionState() == TransactionState_None
+	}
+}
+
 func (s *session) ReleaseConnectionForDataNodeShard(conn core.PoolConnection) {
 	s.poolSync.Lock()
 	defer s.poolSync.Unlock()
 	if _, ok := s.pool[conn.ID()]; ok {
 		delete(s.pool, conn.ID())
 	}
+	delete(s.joined, conn.ID())
 	conn.Release()
 }
 
+// close gives all of the connections that the session is still holding back to the pool, this is
+// called once the client has disconnected.
+func (s *session) close() {
+	inTransaction := s.GetTransactionState() != TransactionState_None
+	s.poolSync.Lock()
+	defer s.poolSync.Unlock()
+	for id, conn := range s.pool {
+		if inTransaction && s.joined[id] {
+			// The client went away in the middle of a transaction, nothing it did should be
+			// kept.
+			if err := conn.Exec("ROLLBACK"); err != nil {
+				s.log.Warningf("could not rollback transaction on data node shard [%d]: %v", id, err)
+				conn.Close()
+				continue
+			}
+		}
+		conn.Release()
+	}
+	s.pool = map[uint64]core.PoolConnection{}
+	s.joined = map[uint64]bool{}
+	s.releaseWrites()
+
+	// The transaction was rolled back, so none of the schema changes made in it should be kept.
+	s.rollbackSchemaChanges(s.schemaChanges...)
+	s.schemaChanges = nil
+}
+
 func newSession(s sessionContext, log timber.Logger) *session {
+	poolMode, err := s.Colony().Pool().GetPoolMode()
+	if err != nil {
+		log.Warningf("could not retrieve pool mode, using transaction pooling: %v", err)
+		poolMode = core.PoolModeOptions_TransactionPooling
+	}
+
 	return &session{
 		sessionContext:     s,
 		preparedStatements: map[string]preparedStatementEntry{},
 		portals:            map[string]portalEntry{},
 		log:                log,
 		pool:               map[uint64]core.PoolConnection{},
+		poolMode:           poolMode,
+		joined:             map[uint64]bool{},
 		executor: executor.NewExecutor(
 			s.Colony(),
 			log,
@@ -165,10 +375,129 @@ type PreparedPortal struct {
 	Stmt  *PreparedStatement
 	Qargs queryutil.QueryArguments
 
+	// Args are the parameters exactly as they were provided by the client in the Bind message.
+	Args [][]byte
+
+	// ArgFormatCodes contains the formats of each of the parameters in Args.
+	ArgFormatCodes []pgwirebase.FormatCode
+
 	// OutFormats contains the requested formats for the output columns.
 	OutFormats []pgwirebase.FormatCode
 }
 
+// boundArguments are the parameters of a portal, they are forwarded to the data nodes natively
+// instead of being written into the query text.
+type boundArguments struct {
+	// Values are the decoded parameters, the planner only reads these when it needs a value to
+	// route the statement. Like a shard key or a tenant ID.
+	Values queryutil.QueryArguments
+
+	// Raw are the parameters exactly as they were sent by the client.
+	Raw [][]byte
+
+	// Formats contains a format code for each of the raw parameters.
+	Formats []pgwirebase.FormatCode
+
+	// Types contains the type OID of each parameter as it was specified by the client, an OID of
+	// 0 will let the data node infer the type of the parameter.
+	Types []types.OID
+}
+
+// newBoundArguments creates the arguments to forward to the data nodes for the provided portal.
+// If the portal does not have any parameters then nil is returned.
+func newBoundArguments(portal *PreparedPortal) *boundArguments {
+	if portal == nil || len(portal.Args) == 0 {
+		return nil
+	}
+
+	args := &boundArguments{
+		Values:  portal.Qargs,
+		Raw:     portal.Args,
+		Formats: make([]pgwirebase.FormatCode, len(portal.Args)),
+		Types:   make([]types.OID, len(portal.Args)),
+	}
+
+	for i := range portal.Args {
+		// A single format code applies to all parameters.
+		switch len(portal.ArgFormatCodes) {
+		case 0:
+			args.Formats[i] = pgwirebase.FormatText
+		case 1:
+			args.Formats[i] = portal.ArgFormatCodes[0]
+		default:
+			args.Formats[i] = portal.ArgFormatCodes[i]
+		}
+
+		if portal.Stmt != nil && i < len(portal.Stmt.RawTypeHints) {
+			args.Types[i] = portal.Stmt.RawTypeHints[i]
+		}
+	}
+
+	return args
+}
+
+// forTask returns the parameter types, formats and values that should be sent to the data node
+// for the provided task. Parameters that are not referenced by the task's query are sent as NULL
+// text values, this way the number of parameters always matches the original statement.
+func (args *boundArguments) forTask(task ExpandedPlanTask) ([]uint32, []int16, [][]byte) {
+	if args == nil {
+		return nil, nil, nil
+	}
+
+	parameterTypes := make([]uint32, len(args.Raw))
+	parameterFormats := make([]int16, len(args.Raw))
+	parameters := make([][]byte, len(args.Raw))
+
+	referenced := map[int]struct{}{}
+	for _, number := range task.Parameters {
+		referenced[number] = struct{}{}
+	}
+
+	for i := range args.Raw {
+		if _, ok := referenced[i+1]; task.Parameters != nil && !ok {
+			parameterTypes[i] = types.Type_text.Uint32()
+			parameterFormats[i] = int16(pgwirebase.FormatText)
+			parameters[i] = nil
+			continue
+		}
+
+		parameterTypes[i] = uint32(args.Types[i])
+		parameterFormats[i] = int16(args.Formats[i])
+		parameters[i] = args.Raw[i]
+	}
+
+	return parameterTypes, parameterFormats, parameters
+}
+
+// text returns each of the parameters as text so they can be logged, parameters that were sent
+// in the binary format are shown as hex.
+func (args *boundArguments) text() []string {
+	if args == nil {
+		return nil
+	}
+
+	values := make([]string, len(args.Raw))
+	for i, raw := range args.Raw {
+		switch {
+		case raw == nil:
+			values[i] = "NULL"
+		case args.Formats[i] == pgwirebase.FormatBinary:
+			values[i] = fmt.Sprintf(`\x%x`, raw)
+		default:
+			values[i] = string(raw)
+		}
+	}
+	return values
+}
+
+// values returns the decoded parameters, or nil if there are none.
+func (args *boundArguments) values() queryutil.QueryArguments {
+	if args == nil {
+		return nil
+	}
+	return args.Values
+}
+
 // PreparedPortal is a PreparedStatement that has been bound with query arguments.
 type portalEntry struct {
 	*PreparedPortal
@@ -195,7 +524,21 @@ type PreparedStatement struct {
 
 	Types queryutil.PlaceholderTypes
 
+	// RawTypeHints are the parameter type OIDs exactly as they were specified by the client.
+	RawTypeHints []types.OID
+
 	Columns []pgproto.FieldDescription
 
 	InferredTypes []types.Type
+
+	// source is the text the statement was parsed from and when it was parsed.
+	source statementSource
+}
+
+// sourceForExecution returns the source of the prepared statement. The statement is only parsed
+// once, so the time it took to parse it is only included the first time it is executed.
+func (p *PreparedStatement) sourceForExecution() statementSource {
+	source := p.source
+	p.source.parseStart, p.source.parseDuration = time.Time{}, 0
+	return source
 }
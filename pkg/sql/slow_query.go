@@ -0,0 +1,64 @@
+package sql
+
+import (
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/core"
+	"sync"
+	"time"
+)
+
+// statementTimings are how long each stage of the statement that is currently being run took,
+// they are written to the slow query log if the statement is slow.
+type statementTimings struct {
+	sync.Mutex
+	stages core.SlowQueryStages
+}
+
+// observeConnectionAcquisition records the time it took to get a connection to a data node
+// shard. Connections are acquired for each data node shard at the same time, so only the longest
+// is kept.
+func (timings *statementTimings) observeConnectionAcquisition(duration time.Duration) {
+	if timings == nil {
+		return
+	}
+	timings.Lock()
+	defer timings.Unlock()
+	if duration > timings.stages.ConnectionAcquisition {
+		timings.stages.ConnectionAcquisition = duration
+	}
+}
+
+// observeDispatch records the time it took to send a task to its data node shard, only the
+// longest is kept.
+func (timings *statementTimings) observeDispatch(duration time.Duration) {
+	if timings == nil {
+		return
+	}
+	timings.Lock()
+	defer timings.Unlock()
+	if duration > timings.stages.Dispatch {
+		timings.stages.Dispatch = duration
+	}
+}
+
+func (timings *statementTimings) getStages() core.SlowQueryStages {
+	timings.Lock()
+	defer timings.Unlock()
+	return timings.stages
+}
+
+// logSlowQuery writes the statement to the slow query log. Unless parameters are being logged
+// the normalized query is written without any of the values bound to the statement.
+func (s *session) logSlowQuery(statement ast.Stmt, arguments *boundArguments, query core.SlowQuery) {
+	query.User = s.User()
+	if s.Colony().SlowQueries().LogParameters() {
+		query.Query = deparseStatement(statement)
+		query.Parameters = arguments.text()
+	} else {
+		query.Query = getNormalizedQuery(statement)
+	}
+
+	if err := s.Colony().SlowQueries().Log(query); err != nil {
+		s.log.Warningf("could not write to slow query log: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package sql_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/core"
+	"github.com/elliotcourant/noahdb/testutils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+type slowQueryLine struct {
+	Duration   float64            `json:"duration_ms"`
+	User       string             `json:"user"`
+	Query      string             `json:"query"`
+	Parameters []string           `json:"parameters"`
+	TenantIDs  []uint64           `json:"tenant_ids"`
+	ShardIDs   []uint64           `json:"shard_ids"`
+	Stages     map[string]float64 `json:"stages"`
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+	func() {
+		db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		_, err = db.Exec(`CREATE TABLE accounts (id BIGSERIAL PRIMARY KEY, name TEXT) TABLESPACE "noah.tenants"`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		_, err = db.Exec(`CREATE TABLE products (id BIGSERIAL PRIMARY KEY, account_id BIGINT NOT NULL REFERENCES accounts (id), sku TEXT) TABLESPACE "noah.sharded"`)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		var accountId uint64
+		if err := db.QueryRow(`INSERT INTO accounts (name) VALUES ('account one') RETURNING id;`).Scan(&accountId); !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		// Every statement is slower than a threshold of zero.
+		if err := colony.Setting().SetSetting(core.SettingKeyOptions_SlowQueryThreshold, int64(0)); !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		readLog := func(t *testing.T, contains string) []slowQueryLine {
+			contents, err := ioutil.ReadFile(colony.SlowQueries().Path())
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+
+			lines := make([]slowQueryLine, 0)
+			for _, text := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+				var line slowQueryLine
+				if err := json.Unmarshal([]byte(text), &line); !assert.NoError(t, err) {
+					panic(err)
+				}
+				if strings.Contains(line.Query, contains) {
+					lines = append(lines, line)
+				}
+			}
+			return lines
+		}
+
+		t.Run("parameters are masked", func(t *testing.T) {
+			rows, err := db.Query(fmt.Sprintf(`SELECT id, sku FROM products WHERE account_id = %d AND sku = 'masked'`, accountId))
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+			rows.Close()
+
+			lines := readLog(t, "FROM products")
+			if !assert.Len(t, lines, 1) {
+				return
+			}
+			line := lines[0]
+			assert.Equal(t, "noah", line.User)
+			assert.NotContains(t, line.Query, "masked")
+			assert.Contains(t, line.Query, "$1")
+			assert.Empty(t, line.Parameters)
+			assert.Equal(t, []uint64{accountId}, line.TenantIDs)
+			assert.NotEmpty(t, line.ShardIDs)
+			for _, stage := range []string{
+				"planning_ms",
+				"expansion_ms",
+				"connection_acquisition_ms",
+				"dispatch_ms",
+				"execution_ms",
+			} {
+				assert.Contains(t, line.Stages, stage)
+			}
+		})
+
+		t.Run("parameters are logged", func(t *testing.T) {
+			if err := colony.Setting().SetSetting(core.SettingKeyOptions_SlowQueryLogParameters, true); !assert.NoError(t, err) {
+				panic(err)
+			}
+			defer colony.Setting().SetSetting(core.SettingKeyOptions_SlowQueryLogParameters, false)
+
+			rows, err := db.Query(`SELECT sku FROM products WHERE account_id = $1 AND sku = $2`, accountId, "visible")
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+			rows.Close()
+
+			lines := readLog(t, "SELECT sku FROM products")
+			if !assert.Len(t, lines, 1) {
+				return
+			}
+			assert.Equal(t, []string{fmt.Sprint(accountId), "visible"}, lines[0].Parameters)
+		})
+
+		t.Run("disabled", func(t *testing.T) {
+			if err := colony.Setting().SetSetting(core.SettingKeyOptions_SlowQueryThreshold, int64(-1)); !assert.NoError(t, err) {
+				panic(err)
+			}
+
+			_, err := db.Exec(`SELECT 'not logged'`)
+			assert.NoError(t, err)
+			assert.Empty(t, readLog(t, "not logged"))
+		})
+	}()
+}
@@ -3,84 +3,314 @@ package sql
 import (
 	"fmt"
 	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/core"
 	"github.com/elliotcourant/noahdb/pkg/pgwirebase"
-	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
+	"github.com/elliotcourant/noahdb/pkg/tracing"
 	"time"
 )
 
 func (s *session) stageQueryToResult(
 	statement ast.Stmt,
-	placeholders queryutil.QueryArguments,
-	outFormats []pgwirebase.FormatCode) error {
-	// If there are placeholders present then we need to walk the syntax tree and add the
-	// placeholders into the query manually, this is a bit weird and kind of expensive. But it's
-	// the best solution I have at the moment for the query planner.
-	if placeholders != nil {
-		statement = queryutil.ReplaceArguments(statement, placeholders).(ast.Stmt)
-	}
+	source statementSource,
+	arguments *boundArguments,
+	outFormats []pgwirebase.FormatCode,
+	result execResult) (err error) {
+	// If there are placeholders present then they are left in the syntax tree, the planner will
+	// only read their values when it needs them to route the statement. The arguments are then
+	// forwarded to the data nodes as they were provided by the client.
+	s.arguments = arguments
+	s.statementText = source.query
+	timings := &statementTimings{}
+	s.timings = timings
+	defer func() {
+		s.arguments = nil
+		s.statementText = ""
+		s.timings = nil
+		s.stageSpan = nil
+	}()
+
+	// The statement is fingerprinted before it is planned since planning can change the tree.
+	fingerprint := ast.Fingerprint(statement)
+	recorded := &statementResult{execResult: result}
+	result = recorded
+	shardIds, tenantIds := make([]uint64, 0), make([]uint64, 0)
+	span := s.startStatementSpan(statement, source)
 
 	planAndExpandTimestamp := time.Now()
+	planning, execution := time.Duration(0), time.Duration(0)
 	defer func() {
+		// If the statement did not make it to be executed then all of the time was spent
+		// planning it.
+		if planning == 0 {
+			planning = time.Since(planAndExpandTimestamp)
+		}
+		s.Colony().Metrics().ObserveStatement(statement.StatementTag(), err, planning, execution)
+		duration := time.Since(planAndExpandTimestamp)
+		s.Colony().Statistics().RecordStatement(core.StatementExecution{
+			Fingerprint: fingerprint,
+			ShardIDs:    shardIds,
+			Rows:        parseCommandTag(recorded.tag).Rows,
+			Duration:    duration,
+			Error:       err,
+		}, func() string {
+			return getNormalizedQuery(statement)
+		})
+		if threshold, ok := s.Colony().SlowQueries().Threshold(); ok && duration >= threshold {
+			stages := timings.getStages()
+			stages.Execution = execution
+			s.logSlowQuery(statement, arguments, core.SlowQuery{
+				Timestamp: planAndExpandTimestamp,
+				Duration:  duration,
+				TenantIDs: tenantIds,
+				ShardIDs:  shardIds,
+				Error:     err,
+				Stages:    stages,
+			})
+		}
+		span.SetAttributes(
+			tracing.String("noahdb.tenant_ids", idList(tenantIds)),
+			tracing.String("noahdb.shard_ids", idList(shardIds)),
+			tracing.Int("db.rows", int64(parseCommandTag(recorded.tag).Rows)))
+		endSpan(span, err)
 		s.log.Verbosef("[%s] planning and execution of statement", time.Since(planAndExpandTimestamp))
+
+		// The writes of the statement are held until the transaction that they belong to ends.
+		if s.GetTransactionState() == TransactionState_None {
+			s.releaseWrites()
+		}
 	}()
 
-	plan, sendToNodes, err := func() (InitialPlan, bool, error) {
-		startTimestamp := time.Now()
-		defer func() {
-			s.log.Verbosef("[%s] initial planning of statement", time.Since(startTimestamp))
-		}()
-		planner, err := getStatementHandler(statement)
-		if err != nil {
-			return InitialPlan{}, false, err
+	// Changes to the schema are only stored once they have been committed on the data nodes.
+	var plan InitialPlan
+	defer func() {
+		if schemaErr := s.finishSchemaChanges(plan, err); schemaErr != nil && err == nil {
+			err = schemaErr
 		}
+	}()
+
+	// Writes are routed using the metadata that was read while they were planned. If a write
+	// fence was raised or lowered before the writes were acquired then that metadata might have
+	// changed, so the statement is planned again. Statements that are not routed to a single shard
+	// are sent to every data node shard that exists when the plan is expanded, so only the
+	// expansion is repeated for them. Planning them again would repeat side effects like creating
+	// tenants or the metadata for a new table.
+	var expandedPlan ExpandedPlan
+	planned := false
+	for attempt := 1; ; attempt++ {
+		epoch := s.Colony().WriteFences().Epoch()
 
-		plan := InitialPlan{}
+		if !planned || plan.ShardID != 0 || len(plan.Splits) > 0 {
+			planSpan := span.StartChild("plan", tracing.SpanKindInternal)
+			s.stageSpan = planSpan
+			var sendToNodes bool
+			plan, sendToNodes, err = s.getInitialPlan(statement)
+			timings.stages.Planning = time.Since(planAndExpandTimestamp)
+			tenantIds = append(tenantIds[:0], plan.TenantIDs...)
+			s.stageSpan = nil
+			endSpan(planSpan, err)
+			planned = true
 
-		if transactionPlanner, ok := planner.(TransactionQueryPlanner); ok {
-			transactionPlan, sendToNodes, err := transactionPlanner.getTransactionQueryPlan(s)
 			if err != nil {
-				return transactionPlan, false, err
+				return err
+			}
+
+			if !sendToNodes {
+				return nil
 			}
-			return transactionPlan, sendToNodes, nil
-		}
 
-		// Check to see if the provided statement can target noah's internal query interface.
-		if noahPlanner, ok := planner.(NoahQueryPlanner); ok {
-			// Try to build a noah query plan, if the query that was provided does actually use noah
-			// tables then this will skip the standard planner and jump to expand the initial query plan
-			if plan, ok, err = noahPlanner.getNoahQueryPlan(s); err != nil {
-				return InitialPlan{}, false, err
-			} else if ok {
-				return plan, ok, nil
+			// The statement has already been performed, we only need to tell the client what was
+			// done.
+			if plan.Target == PlanTarget_COORDINATOR {
+				result.SetCommandTag(plan.CommandTag)
+				return nil
 			}
 		}
 
-		if normalQueryPlanner, ok := planner.(QueryPlanner); ok {
-			if plan, ok, err = normalQueryPlanner.GetQueryPlan(s); err != nil {
-				return InitialPlan{}, false, err
-			} else if ok {
-				return plan, ok, nil
+		expansionTimestamp := time.Now()
+		expandSpan := span.StartChild("expand", tracing.SpanKindInternal)
+		s.stageSpan = expandSpan
+		expandedPlan, err = s.expandQueryPlan(plan)
+		timings.stages.Expansion = time.Since(expansionTimestamp)
+		s.stageSpan = nil
+		expandSpan.SetAttributes(tracing.Int("noahdb.tasks", int64(len(expandedPlan.Tasks))))
+		endSpan(expandSpan, err)
+		planning = time.Since(planAndExpandTimestamp)
+		s.log.Verbosef("[%s] planning and expanding of statement", planning)
+		if err != nil {
+			return err
+		}
+
+		err = s.acquireWrites(epoch, plan, expandedPlan)
+		if err != core.ErrWriteFenceChanged || attempt >= maxWriteFenceAttempts {
+			if err != nil {
+				return err
 			}
+			break
 		}
+		s.log.Debugf("write fences changed while planning statement, planning again")
+	}
 
-		return InitialPlan{}, false, fmt.Errorf("could not generate plan for statement")
-	}()
+	expandedPlan.OutFormats = outFormats
+	expandedPlan.Arguments = arguments
+	expandedPlan.Fingerprint = fingerprint
+	expandedPlan.Explain = plan.Explain
 
-	if err != nil {
-		return err
+	for _, task := range expandedPlan.Tasks {
+		if task.ShardID != 0 {
+			shardIds = append(shardIds, task.ShardID)
+		}
+	}
+
+	executionTimestamp := time.Now()
+	executeSpan := span.StartChild("execute", tracing.SpanKindInternal)
+	err = s.executeExpandedPlan(expandedPlan, executeSpan, result)
+	execution = time.Since(executionTimestamp)
+	endSpan(executeSpan, err)
+	return err
+}
+
+// acquireWrites records the writes that the plan is about to perform with the colony's write
+// fences. This will wait if any of the tenants the plan writes to are being cut over to another
+// shard, or if the plan writes to every shard while a data node shard is being provisioned.
+func (s *session) acquireWrites(epoch uint64, plan InitialPlan, expandedPlan ExpandedPlan) error {
+	if expandedPlan.DistPlanType != DistributedPlanType_NONE {
+		return nil
+	}
+
+	// The statement is not executed by EXPLAIN unless ANALYZE is used.
+	if plan.Explain != nil && !plan.Explain.analyze {
+		return nil
+	}
+
+	writes := make([]core.Write, 0)
+	for _, task := range expandedPlan.Tasks {
+		if task.ReadOnly {
+			continue
+		}
+
+		// Only the rows of sharded tables are moved with a tenant. Writes to global and tenant
+		// tables and changes to the schema are sent to every shard, they don't have a shard ID.
+		write := core.Write{
+			ShardID:         task.ShardID,
+			DataNodeShardID: task.DataNodeShardID,
+		}
+		if task.ShardID != 0 {
+			write.TenantIDs = plan.TenantIDs
+		}
+		writes = append(writes, write)
 	}
 
-	if !sendToNodes {
+	if len(writes) == 0 {
 		return nil
 	}
 
-	expandedPlan, err := s.expandQueryPlan(plan)
-	s.log.Verbosef("[%s] planning and expanding of statement", time.Since(planAndExpandTimestamp))
+	lease, err := s.Colony().WriteFences().AcquireWrite(s.writeLease, epoch, writes...)
+	s.writeLease = lease
+	return err
+}
+
+// releaseWrites lets any write fences that are waiting for this session's writes be acknowledged.
+func (s *session) releaseWrites() {
+	s.writeLease.Release()
+	s.writeLease = nil
+}
+
+// getInitialPlan builds the initial plan for the statement. If the statement was performed
+// entirely while it was being planned then false may be returned.
+func (s *session) getInitialPlan(statement ast.Stmt) (InitialPlan, bool, error) {
+	startTimestamp := time.Now()
+	defer func() {
+		s.log.Verbosef("[%s] initial planning of statement", time.Since(startTimestamp))
+	}()
+	planner, err := getStatementHandler(statement)
 	if err != nil {
-		return err
+		return InitialPlan{}, false, err
 	}
 
-	expandedPlan.OutFormats = outFormats
+	// Once a transaction has failed only statements that end the transaction or roll back to
+	// a savepoint can be executed.
+	if s.GetTransactionState() == TransactionState_Failed {
+		if transactionPlanner, ok := planner.(*transactionStmtPlanner); !ok ||
+			!transactionPlanner.isAllowedInFailedTransaction() {
+			return InitialPlan{}, false, newInFailedTransactionError()
+		}
+	}
+
+	plan := InitialPlan{}
+
+	if transactionPlanner, ok := planner.(TransactionQueryPlanner); ok {
+		transactionPlan, sendToNodes, err := transactionPlanner.getTransactionQueryPlan(s)
+		if err != nil {
+			return transactionPlan, false, err
+		}
+		return transactionPlan, sendToNodes, nil
+	}
+
+	// Check to see if the provided statement can target noah's internal query interface.
+	if noahPlanner, ok := planner.(NoahQueryPlanner); ok {
+		// Try to build a noah query plan, if the query that was provided does actually use noah
+		// tables then this will skip the standard planner and jump to expand the initial query plan
+		if plan, ok, err = noahPlanner.getNoahQueryPlan(s); err != nil {
+			return InitialPlan{}, false, err
+		} else if ok {
+			return plan, ok, nil
+		}
+	}
+
+	if normalQueryPlanner, ok := planner.(QueryPlanner); ok {
+		if plan, ok, err = normalQueryPlanner.GetQueryPlan(s); err != nil {
+			return InitialPlan{}, false, err
+		} else if ok {
+			return plan, ok, nil
+		}
+	}
+
+	return InitialPlan{}, false, fmt.Errorf("could not generate plan for statement")
+}
+
+// statementResult keeps the command tag that was sent to the client so that the number of rows
+// can be added to the statistics of the statement.
+type statementResult struct {
+	execResult
+	tag string
+}
+
+func (result *statementResult) SetCommandTag(tag string) {
+	result.tag = tag
+	result.execResult.SetCommandTag(tag)
+}
+
+// getNormalizedQuery returns the text of the statement with its constants replaced by
+// placeholders, this is what is shown for the statement in noah.stat_statements.
+func getNormalizedQuery(statement ast.Stmt) string {
+	query := deparseStatement(statement)
+	normalized, err := ast.Normalize(query)
+	if err != nil {
+		return query
+	}
+
+	return normalized
+}
+
+// deparseStatement returns the text of the statement. Not every statement can be deparsed yet,
+// those statements are shown by their tag instead.
+func deparseStatement(statement ast.Stmt) string {
+	switch statement.(type) {
+	case ast.AlterEnumStmt,
+		ast.AlterSystemStmt,
+		ast.AlterTableStmt,
+		ast.CompositeTypeStmt,
+		ast.CreateDomainStmt,
+		ast.CreateEnumStmt,
+		ast.CreateSchemaStmt,
+		ast.IndexStmt:
+		return statement.StatementTag()
+	}
+
+	query, err := statement.Deparse(ast.Context_None)
+	if err != nil {
+		return statement.StatementTag()
+	}
 
-	return s.executeExpandedPlan(expandedPlan)
+	return query
 }
@@ -0,0 +1,31 @@
+package sql
+
+import (
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDeparseStatement(t *testing.T) {
+	parse := func(t *testing.T, query string) ast.Stmt {
+		tree, err := ast.Parse(query)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		return tree.Statements[0].(ast.RawStmt).Stmt.(ast.Stmt)
+	}
+
+	t.Run("deparsed", func(t *testing.T) {
+		assert.Contains(t, deparseStatement(parse(t, "SELECT id FROM accounts")), "accounts")
+	})
+
+	t.Run("statements without a deparser", func(t *testing.T) {
+		assert.Equal(t, "CREATE INDEX", deparseStatement(parse(t, "CREATE INDEX idx_name ON accounts (name)")))
+		assert.Equal(t, "ALTER TABLE", deparseStatement(parse(t, "ALTER TABLE accounts ADD COLUMN email TEXT")))
+		assert.Equal(t, "CREATE TYPE", deparseStatement(parse(t, "CREATE TYPE mood AS ENUM ('sad', 'happy')")))
+	})
+
+	t.Run("unsupported drop", func(t *testing.T) {
+		assert.Equal(t, "DROP TYPE", deparseStatement(parse(t, "DROP TYPE mood")))
+	})
+}
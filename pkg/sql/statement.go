@@ -3,19 +3,20 @@ package sql
 import (
 	"github.com/elliotcourant/noahdb/pkg/ast"
 	"github.com/elliotcourant/noahdb/pkg/pgwirebase"
-	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
 )
 
 type execResult interface {
 	SetError(error)
+	SetCommandTag(string)
 	Err() error
 }
 
 func (s *session) executeStatement(
 	stmt ast.Stmt,
+	source statementSource,
 	result execResult,
-	placeholders queryutil.QueryArguments,
+	portal *PreparedPortal,
 	outFormats []pgwirebase.FormatCode) error {
-	result.SetError(s.stageQueryToResult(stmt, placeholders, outFormats))
+	result.SetError(s.stageQueryToResult(stmt, source, newBoundArguments(portal), outFormats, result))
 	return nil
 }
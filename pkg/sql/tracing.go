@@ -0,0 +1,81 @@
+package sql
+
+import (
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/tracing"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// traceParentVariable is the session variable that a W3C traceparent can be set with, the
+	// statements run afterwards are added to that trace.
+	traceParentVariable = "traceparent"
+)
+
+// statementSource is the text that a statement was parsed from, as well as when it was parsed.
+type statementSource struct {
+	query         string
+	parseStart    time.Time
+	parseDuration time.Duration
+}
+
+// startStatementSpan starts the root span for a statement. If the query has a traceparent in a
+// comment then the span is added to that trace, otherwise the traceparent set on the session is
+// used. This returns nil if traces are not being recorded.
+func (s *session) startStatementSpan(statement ast.Stmt, source statementSource) *tracing.Span {
+	tracer := s.Colony().Tracer()
+	if tracer == nil {
+		return nil
+	}
+
+	parent := s.traceParent
+	if commentParent, ok := tracing.TraceParentFromComment(source.query); ok {
+		parent = commentParent
+	}
+
+	start := time.Now()
+	if !source.parseStart.IsZero() {
+		start = source.parseStart
+	}
+
+	span := tracer.StartSpanAt(statement.StatementTag(), parent, tracing.SpanKindServer, start)
+	span.SetAttributes(
+		tracing.String("db.system", "postgresql"),
+		tracing.String("db.user", s.User()),
+		tracing.String("db.operation", statement.StatementTag()),
+		tracing.String("db.statement", getNormalizedQuery(statement)))
+
+	if !source.parseStart.IsZero() {
+		span.RecordChild("parse", tracing.SpanKindInternal,
+			source.parseStart, source.parseStart.Add(source.parseDuration))
+	}
+
+	return span
+}
+
+// startMetadataSpan starts a span for a read of the colony's metadata as a child of the stage
+// that is currently running. The span is nil if the statement is not being traced.
+func (s *session) startMetadataSpan(operation string) *tracing.Span {
+	span := s.stageSpan.StartChild("metadata "+operation, tracing.SpanKindInternal)
+	span.SetAttributes(
+		tracing.String("db.system", "sqlite"),
+		tracing.String("db.operation", operation))
+	return span
+}
+
+// endSpan records the error on the span, if there is one, and then ends it.
+func endSpan(span *tracing.Span, err error) {
+	span.SetError(err)
+	span.End()
+}
+
+// idList formats the IDs as a comma separated list so they can be recorded on a span.
+func idList(ids []uint64) string {
+	items := make([]string, len(ids))
+	for i, id := range ids {
+		items[i] = strconv.FormatUint(id, 10)
+	}
+	return strings.Join(items, ",")
+}
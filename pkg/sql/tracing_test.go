@@ -0,0 +1,162 @@
+package sql_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/elliotcourant/noahdb/testutils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type exportedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+func TestTracing(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	// Test colonies write their traces to a file next to the slow query log.
+	traceFile := filepath.Join(filepath.Dir(colony.SlowQueries().Path()), "traces.json")
+
+	// Traces are exported in the background, so this waits for a trace to show up in the file.
+	getTrace := func(t *testing.T, traceId string) []exportedSpan {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			contents, _ := ioutil.ReadFile(traceFile)
+			spans := make([]exportedSpan, 0)
+			for _, line := range bytes.Split(bytes.TrimSpace(contents), []byte("\n")) {
+				if len(line) == 0 {
+					continue
+				}
+				request := struct {
+					ResourceSpans []struct {
+						ScopeSpans []struct {
+							Spans []exportedSpan `json:"spans"`
+						} `json:"scopeSpans"`
+					} `json:"resourceSpans"`
+				}{}
+				if err := json.Unmarshal(line, &request); !assert.NoError(t, err) {
+					panic(err)
+				}
+				for _, resource := range request.ResourceSpans {
+					for _, scope := range resource.ScopeSpans {
+						for _, span := range scope.Spans {
+							if span.TraceID == traceId {
+								spans = append(spans, span)
+							}
+						}
+					}
+				}
+			}
+			if len(spans) > 0 {
+				return spans
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}
+
+	spanNames := func(spans []exportedSpan) []string {
+		names := make([]string, len(spans))
+		for i, span := range spans {
+			names[i] = span.Name
+		}
+		return names
+	}
+
+	func() {
+		db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+
+		t.Run("traceparent comment", func(t *testing.T) {
+			_, err := db.Exec(`SELECT 1 /*traceparent='00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01'*/`)
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+
+			spans := getTrace(t, "4bf92f3577b34da6a3ce929d0e0e4736")
+			names := spanNames(spans)
+			for _, name := range []string{
+				"SELECT",
+				"parse",
+				"plan",
+				"expand",
+				"execute",
+				"data node shard",
+				"acquire connection",
+				"dispatch",
+			} {
+				assert.Contains(t, names, name)
+			}
+
+			for _, span := range spans {
+				if span.Name == "SELECT" {
+					assert.Equal(t, "00f067aa0ba902b7", span.ParentSpanID)
+				}
+			}
+		})
+
+		t.Run("metadata reads", func(t *testing.T) {
+			_, err := db.Exec(`CREATE TABLE trace_colors (id BIGSERIAL PRIMARY KEY, name TEXT)`)
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+
+			_, err = db.Exec(`SELECT * FROM trace_colors /*traceparent='00-5c0b6f6c2a1e4d8f9b3a7e2d1c4f8a6b-1a2b3c4d5e6f7a8b-01'*/`)
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+
+			spans := getTrace(t, "5c0b6f6c2a1e4d8f9b3a7e2d1c4f8a6b")
+			ids := map[string]string{}
+			for _, span := range spans {
+				ids[span.Name] = span.SpanID
+			}
+			assert.Contains(t, spanNames(spans), "metadata GetTables")
+			for _, span := range spans {
+				if span.Name == "metadata GetTables" {
+					assert.Equal(t, ids["plan"], span.ParentSpanID)
+				}
+			}
+		})
+
+		t.Run("traceparent variable", func(t *testing.T) {
+			ctx := context.Background()
+			conn, err := db.Conn(ctx)
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+			defer conn.Close()
+
+			_, err = conn.ExecContext(ctx, `SET traceparent = '00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01'`)
+			if !assert.NoError(t, err) {
+				panic(err)
+			}
+
+			_, err = conn.ExecContext(ctx, `SELECT 2`)
+			assert.NoError(t, err)
+			assert.Contains(t, spanNames(getTrace(t, "0af7651916cd43dd8448eb211c80319c")), "SELECT")
+
+			_, err = conn.ExecContext(ctx, `SET traceparent = 'not a traceparent'`)
+			assert.Error(t, err)
+
+			_, err = conn.ExecContext(ctx, `SET search_path = public`)
+			assert.Error(t, err)
+
+			_, err = conn.ExecContext(ctx, `RESET traceparent`)
+			assert.NoError(t, err)
+		})
+	}()
+}
@@ -3,6 +3,8 @@ package sql
 import (
 	"fmt"
 	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/core"
+	"github.com/elliotcourant/noahdb/pkg/pgerror"
 )
 
 type transactionStmtPlanner struct {
@@ -22,9 +24,23 @@ func newTransactionStatementPlan(tree ast.TransactionStmt) *transactionStmtPlann
 func (stmt *transactionStmtPlanner) getTransactionQueryPlan(s *session) (InitialPlan, bool, error) {
 	switch stmt.tree.Kind {
 	case ast.TRANS_STMT_BEGIN, ast.TRANS_STMT_START:
+		// With statement pooling the connections are given back after every statement, so a
+		// transaction cannot span more than one statement.
+		if s.poolMode == core.PoolModeOptions_StatementPooling {
+			return InitialPlan{}, false, pgerror.NewErrorf(
+				pgerror.CodeFeatureNotSupportedError,
+				"transaction blocks are not allowed when statement pooling is used")
+		}
+
 		switch s.GetTransactionState() {
 		case TransactionState_None:
-			s.SetTransactionState(TransactionState_Active)
+			// The options like the isolation level need to be applied to every data node shard
+			// that joins this transaction, so we keep the entire BEGIN statement.
+			beginQuery, err := stmt.tree.Deparse(ast.Context_None)
+			if err != nil {
+				return InitialPlan{}, false, err
+			}
+			s.BeginTransaction(beginQuery)
 		default:
 			// Already in a transaction
 			return InitialPlan{}, false, fmt.Errorf("transaction already active")
@@ -32,6 +48,18 @@ func (stmt *transactionStmtPlanner) getTransactionQueryPlan(s *session) (Initial
 		return InitialPlan{}, false, nil
 	case ast.TRANS_STMT_COMMIT:
 		switch s.GetTransactionState() {
+		case TransactionState_Failed:
+			// A failed transaction cannot be committed, so it is rolled back instead.
+			return InitialPlan{
+				Types: map[PlanType]InitialPlanTask{
+					PlanType_WRITE: {
+						Query: "ROLLBACK",
+						Type:  stmt.tree.StatementType(),
+					},
+				},
+				ShardID:      0,
+				DistPlanType: DistributedPlanType_ROLLBACK,
+			}, true, nil
 		case TransactionState_Active:
 			return InitialPlan{
 				Types: map[PlanType]InitialPlanTask{
@@ -49,7 +77,7 @@ func (stmt *transactionStmtPlanner) getTransactionQueryPlan(s *session) (Initial
 		}
 	case ast.TRANS_STMT_ROLLBACK:
 		switch s.GetTransactionState() {
-		case TransactionState_Active:
+		case TransactionState_Active, TransactionState_Failed:
 			return InitialPlan{
 				Types: map[PlanType]InitialPlanTask{
 					PlanType_WRITE: {
@@ -64,7 +92,93 @@ func (stmt *transactionStmtPlanner) getTransactionQueryPlan(s *session) (Initial
 			// No transaction
 			return InitialPlan{}, false, fmt.Errorf("no active transaction")
 		}
+	case ast.TRANS_STMT_SAVEPOINT, ast.TRANS_STMT_RELEASE, ast.TRANS_STMT_ROLLBACK_TO:
+		switch s.GetTransactionState() {
+		case TransactionState_None:
+			return InitialPlan{}, false, pgerror.NewErrorf(
+				pgerror.CodeNoActiveSQLTransactionError,
+				"%s can only be used in transaction blocks", stmt.tree.StatementTag())
+		case TransactionState_Failed:
+			// Only rolling back to a savepoint can recover a failed transaction.
+			if stmt.tree.Kind != ast.TRANS_STMT_ROLLBACK_TO {
+				return InitialPlan{}, false, newInFailedTransactionError()
+			}
+		}
+
+		name, err := stmt.getSavepointName()
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+
+		switch stmt.tree.Kind {
+		case ast.TRANS_STMT_SAVEPOINT:
+			s.AddSavepoint(name)
+		case ast.TRANS_STMT_RELEASE:
+			if !s.ReleaseSavepoint(name) {
+				return InitialPlan{}, false, pgerror.NewErrorf(
+					pgerror.CodeInvalidSavepointSpecificationError,
+					"savepoint %s does not exist", name)
+			}
+		case ast.TRANS_STMT_ROLLBACK_TO:
+			if !s.RollbackToSavepoint(name) {
+				return InitialPlan{}, false, pgerror.NewErrorf(
+					pgerror.CodeInvalidSavepointSpecificationError,
+					"savepoint %s does not exist", name)
+			}
+			// Rolling back to the savepoint will recover the transaction if it had failed. If the
+			// rollback fails on any of the data node shards then the session will fail again.
+			s.SetTransactionState(TransactionState_Active)
+		}
+
+		// If no data node shards have joined the transaction yet then there is nothing to send,
+		// the savepoint will be created on each data node shard as it joins.
+		if len(s.GetPendingDataNodeShards()) == 0 {
+			return InitialPlan{}, false, nil
+		}
+
+		query, err := stmt.tree.Deparse(ast.Context_None)
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+
+		return InitialPlan{
+			Types: map[PlanType]InitialPlanTask{
+				PlanType_WRITE: {
+					Query: query,
+					Type:  stmt.tree.StatementType(),
+				},
+			},
+			ShardID:      0,
+			DistPlanType: DistributedPlanType_SAVEPOINT,
+		}, true, nil
 	default:
 		return InitialPlan{}, false, fmt.Errorf("could not handle transaction type [%s]", stmt.tree.Kind)
 	}
 }
+
+// isAllowedInFailedTransaction returns true if the statement can be executed while the current
+// transaction has failed.
+func (stmt *transactionStmtPlanner) isAllowedInFailedTransaction() bool {
+	switch stmt.tree.Kind {
+	case ast.TRANS_STMT_COMMIT, ast.TRANS_STMT_ROLLBACK, ast.TRANS_STMT_ROLLBACK_TO:
+		return true
+	default:
+		return false
+	}
+}
+
+func newInFailedTransactionError() error {
+	return pgerror.NewError(
+		pgerror.CodeInFailedSQLTransactionError,
+		"current transaction is aborted, commands ignored until end of transaction block")
+}
+
+// getSavepointName returns the quoted name of the savepoint that the statement references.
+func (stmt *transactionStmtPlanner) getSavepointName() (string, error) {
+	for _, item := range stmt.tree.Options.Items {
+		if defElem, ok := item.(ast.DefElem); ok && defElem.Defname != nil && *defElem.Defname == "savepoint_name" {
+			return defElem.Arg.Deparse(ast.Context_None)
+		}
+	}
+	return "", fmt.Errorf("could not find savepoint name")
+}
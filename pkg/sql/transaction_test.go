@@ -1,6 +1,7 @@
 package sql_test
 
 import (
+	"context"
 	"database/sql"
 	"github.com/elliotcourant/noahdb/testutils"
 	"github.com/stretchr/testify/assert"
@@ -31,3 +32,89 @@ func Test_Transaction(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func Test_TransactionSavepoint(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	t.Run("savepoint before any shard joins", func(t *testing.T) {
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+
+		_, err = tx.Exec(`SAVEPOINT before_select`)
+		assert.NoError(t, err)
+
+		// The data node shard that joins here needs to have the savepoint created so that we
+		// can roll back to it.
+		_, err = tx.Exec(`SELECT 1`)
+		assert.NoError(t, err)
+
+		_, err = tx.Exec(`ROLLBACK TO SAVEPOINT before_select`)
+		assert.NoError(t, err)
+
+		_, err = tx.Exec(`RELEASE SAVEPOINT before_select`)
+		assert.NoError(t, err)
+
+		err = tx.Commit()
+		assert.NoError(t, err)
+	})
+
+	t.Run("release unknown savepoint", func(t *testing.T) {
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+
+		_, err = tx.Exec(`RELEASE SAVEPOINT does_not_exist`)
+		assert.Error(t, err)
+
+		err = tx.Rollback()
+		assert.NoError(t, err)
+	})
+}
+
+func Test_TransactionFailed(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	t.Run("statements rejected until rollback", func(t *testing.T) {
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+
+		_, err = tx.Exec(`SELECT 1 / 0`)
+		assert.Error(t, err)
+
+		_, err = tx.Exec(`SELECT 1`)
+		assert.EqualError(t, err, "pq: current transaction is aborted, commands ignored until end of transaction block")
+
+		err = tx.Rollback()
+		assert.NoError(t, err)
+	})
+
+	t.Run("begin with options", func(t *testing.T) {
+		tx, err := db.BeginTx(context.Background(), &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  true,
+		})
+		assert.NoError(t, err)
+
+		// The data node shard joins the transaction here, it should use the same options.
+		isolation := ""
+		err = tx.QueryRow(`SELECT current_setting('transaction_isolation')`).Scan(&isolation)
+		assert.NoError(t, err)
+		assert.Equal(t, "serializable", isolation)
+
+		err = tx.Rollback()
+		assert.NoError(t, err)
+	})
+}
@@ -1 +1,61 @@
 package sql
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/core"
+)
+
+type updateStmtPlanner struct {
+	tree ast.UpdateStmt
+}
+
+func newUpdateStatementPlan(tree ast.UpdateStmt) *updateStmtPlanner {
+	return &updateStmtPlanner{
+		tree: tree,
+	}
+}
+
+func (stmt *updateStmtPlanner) GetQueryPlan(s *session) (InitialPlan, bool, error) {
+	tables, err := s.getWriteTables(stmt.tree)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	// The tenant's rows are stored on the shard that the tenant lives on, so the shard key of a
+	// row can't be changed without moving the row to another shard.
+	for _, table := range tables {
+		if table.TableType != core.TableType_Sharded || table.TableName != *stmt.tree.Relation.Relname {
+			continue
+		}
+
+		metadataSpan := s.startMetadataSpan("GetShardKeyColumnForTable")
+		shardKeyColumn, err := s.Colony().Tables().GetShardKeyColumnForTable(table.TableID)
+		endSpan(metadataSpan, err)
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+
+		for _, item := range stmt.tree.TargetList.Items {
+			if target, ok := item.(ast.ResTarget); ok && target.Name != nil && *target.Name == shardKeyColumn.ColumnName {
+				return InitialPlan{}, false, fmt.Errorf("cannot change the shard key [%s] of table [%s]", shardKeyColumn.ColumnName, table.TableName)
+			}
+		}
+	}
+
+	query, err := stmt.tree.Deparse(ast.Context_None)
+	if err != nil {
+		return InitialPlan{}, false, err
+	}
+
+	writeQuery := ""
+	if len(stmt.tree.ReturningList.Items) > 0 {
+		tree := stmt.tree
+		tree.ReturningList.Items = []ast.Node{}
+		if writeQuery, err = tree.Deparse(ast.Context_None); err != nil {
+			return InitialPlan{}, false, err
+		}
+	}
+
+	return s.getTableWritePlan(stmt.tree, tables, query, writeQuery)
+}
@@ -0,0 +1,119 @@
+package sql_test
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/elliotcourant/noahdb/testutils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUpdateAndDelete(t *testing.T) {
+	colony, cleanup := testutils.NewPgTestColony(t)
+	defer cleanup()
+
+	db, err := sql.Open("postgres", testutils.ConnectionString(colony.Addr()))
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE accounts (id BIGSERIAL PRIMARY KEY, name TEXT) TABLESPACE "noah.tenants"`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE products (id BIGSERIAL PRIMARY KEY, account_id BIGINT NOT NULL REFERENCES accounts (id), sku TEXT) TABLESPACE "noah.sharded"`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO accounts (name) VALUES ('account one'), ('account two')`)
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+
+	tenants, err := colony.Tenants().GetTenants()
+	if !assert.NoError(t, err) {
+		panic(err)
+	}
+	assert.Len(t, tenants, 2)
+
+	for _, tenant := range tenants {
+		_, err = db.Exec(fmt.Sprintf(`INSERT INTO products (account_id, sku) VALUES (%d, 'one'), (%d, 'two')`, tenant.TenantID, tenant.TenantID))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+	}
+	tenant, other := tenants[0], tenants[1]
+
+	t.Run("update sharded table", func(t *testing.T) {
+		result, err := db.Exec(fmt.Sprintf(`UPDATE products SET sku = 'updated' WHERE account_id = %d AND sku = 'one'`, tenant.TenantID))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		affected, err := result.RowsAffected()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), affected)
+
+		// The other tenant's products were not changed.
+		updated := 0
+		err = db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM products WHERE account_id = %d AND sku = 'updated'`, other.TenantID)).Scan(&updated)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, updated)
+	})
+
+	t.Run("update with returning", func(t *testing.T) {
+		sku := ""
+		err := db.QueryRow(`UPDATE products SET sku = 'returned' WHERE account_id = $1 AND sku = 'two' RETURNING sku`, tenant.TenantID).Scan(&sku)
+		assert.NoError(t, err)
+		assert.Equal(t, "returned", sku)
+	})
+
+	t.Run("update shard key", func(t *testing.T) {
+		_, err := db.Exec(fmt.Sprintf(`UPDATE products SET account_id = %d WHERE account_id = %d`, other.TenantID, tenant.TenantID))
+		assert.Error(t, err)
+	})
+
+	t.Run("update without tenant", func(t *testing.T) {
+		_, err := db.Exec(`UPDATE products SET sku = 'all'`)
+		assert.Error(t, err)
+	})
+
+	t.Run("update multiple tenants", func(t *testing.T) {
+		_, err := db.Exec(fmt.Sprintf(`UPDATE products SET sku = 'all' WHERE account_id IN (%d, %d)`, tenant.TenantID, other.TenantID))
+		assert.Error(t, err)
+	})
+
+	t.Run("update tenant table", func(t *testing.T) {
+		_, err := db.Exec(fmt.Sprintf(`UPDATE accounts SET name = 'renamed' WHERE id = %d`, tenant.TenantID))
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+
+		name := ""
+		err = db.QueryRow(fmt.Sprintf(`SELECT name FROM accounts WHERE id = %d`, tenant.TenantID)).Scan(&name)
+		assert.NoError(t, err)
+		assert.Equal(t, "renamed", name)
+	})
+
+	t.Run("delete sharded table", func(t *testing.T) {
+		result, err := db.Exec(`DELETE FROM products WHERE account_id = $1`, tenant.TenantID)
+		if !assert.NoError(t, err) {
+			panic(err)
+		}
+		affected, err := result.RowsAffected()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), affected)
+
+		remaining := 0
+		err = db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM products WHERE account_id = %d`, other.TenantID)).Scan(&remaining)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, remaining)
+	})
+
+	t.Run("delete without tenant", func(t *testing.T) {
+		_, err := db.Exec(`DELETE FROM products`)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,73 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/tracing"
+	"github.com/elliotcourant/noahdb/pkg/util/queryutil"
+	"strings"
+)
+
+type variableSetStmtPlanner struct {
+	tree ast.VariableSetStmt
+}
+
+func newVariableSetStatementPlan(tree ast.VariableSetStmt) *variableSetStmtPlanner {
+	return &variableSetStmtPlanner{
+		tree: tree,
+	}
+}
+
+// getNoahQueryPlan changes a variable on the current session. Only the variables that noahdb
+// itself uses can be set at the moment, so the statement is never sent to the data nodes.
+func (stmt *variableSetStmtPlanner) getNoahQueryPlan(s *session) (InitialPlan, bool, error) {
+	if stmt.tree.IsLocal {
+		return InitialPlan{}, false, fmt.Errorf("SET LOCAL is not supported")
+	}
+
+	switch stmt.tree.Kind {
+	case ast.VAR_RESET_ALL:
+		s.traceParent = tracing.SpanContext{}
+	case ast.VAR_SET_VALUE, ast.VAR_SET_DEFAULT, ast.VAR_RESET:
+		if stmt.tree.Name == nil {
+			return InitialPlan{}, false, fmt.Errorf("SET requires a variable")
+		}
+
+		name := strings.ToLower(*stmt.tree.Name)
+		if name != traceParentVariable {
+			return InitialPlan{}, false, fmt.Errorf("unrecognized configuration parameter \"%s\"", name)
+		}
+
+		if stmt.tree.Kind != ast.VAR_SET_VALUE {
+			s.traceParent = tracing.SpanContext{}
+			break
+		}
+
+		if len(stmt.tree.Args.Items) != 1 {
+			return InitialPlan{}, false, fmt.Errorf("SET %s takes only one argument", name)
+		}
+
+		text, err := queryutil.GetStringValue(stmt.tree.Args.Items[0], s.arguments.values())
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+
+		traceParent, err := tracing.ParseTraceParent(text)
+		if err != nil {
+			return InitialPlan{}, false, err
+		}
+		s.traceParent = traceParent
+	default:
+		return InitialPlan{}, false, fmt.Errorf("only SET and RESET are supported")
+	}
+
+	commandTag := stmt.tree.StatementTag()
+	if stmt.tree.Kind == ast.VAR_RESET || stmt.tree.Kind == ast.VAR_RESET_ALL {
+		commandTag = "RESET"
+	}
+
+	return InitialPlan{
+		Target:     PlanTarget_COORDINATOR,
+		CommandTag: commandTag,
+	}, true, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/elliotcourant/noahdb/pkg/core"
 	"github.com/elliotcourant/noahdb/pkg/kube"
+	"github.com/elliotcourant/noahdb/pkg/metrics"
 	"github.com/elliotcourant/noahdb/pkg/pgwire"
 	"github.com/elliotcourant/noahdb/pkg/rpcwire"
 	"github.com/elliotcourant/noahdb/pkg/tcp"
@@ -20,7 +21,7 @@ import (
 	"time"
 )
 
-func NoahMain(dataDirectory, joinAddresses, listenAddr string, autoDataNode, autoJoin bool) {
+func NoahMain(dataDirectory, joinAddresses, listenAddr, metricsAddr, traceFile, traceCollector string, autoDataNode, autoJoin bool) {
 	log := timber.New()
 
 	log.Debugf("starting noahdb")
@@ -129,16 +130,19 @@ func NoahMain(dataDirectory, joinAddresses, listenAddr string, autoDataNode, aut
 	}
 
 	config := core.ColonyConfig{
-		DataDirectory: dataDirectory,
-		JoinAddresses: joins,
-		Transport:     trans,
-		AutoJoin:      autoJoin,
+		DataDirectory:  dataDirectory,
+		JoinAddresses:  joins,
+		Transport:      trans,
+		AutoJoin:       autoJoin,
+		TraceFile:      traceFile,
+		TraceCollector: traceCollector,
 	}
 
 	switch autoDataNode {
 	case true:
 		strPgPort, pgUser, pgPassword :=
 			os.Getenv("PGPORT"), os.Getenv("PGUSER"), os.Getenv("PGPASSWORD")
+		pgSSLMode, pgSSLRootCert := os.Getenv("PGSSLMODE"), os.Getenv("PGSSLROOTCERT")
 
 		if strPgPort == "" || pgUser == "" {
 			log.Infof("no auto data node could be found")
@@ -161,6 +165,8 @@ func NoahMain(dataDirectory, joinAddresses, listenAddr string, autoDataNode, aut
 		config.LocalPostgresAddress = addr
 		config.LocalPostgresPassword = pgPassword
 		config.LocalPostgresUser = pgUser
+		config.LocalPostgresSSLMode = pgSSLMode
+		config.LocalPostgresSSLRootCert = pgSSLRootCert
 	case false:
 		timber.Verbosef("not using auto data node")
 	}
@@ -178,5 +184,14 @@ func NoahMain(dataDirectory, joinAddresses, listenAddr string, autoDataNode, aut
 
 	log.Debugf("colony initialized, coordinator [%d]", colony.CoordinatorID())
 
+	if metricsAddr != "" {
+		go func() {
+			log.Infof("serving metrics at: %s", metricsAddr)
+			if err := metrics.Serve(metricsAddr, colony.Metrics().Registry()); err != nil {
+				log.Errorf("could not serve metrics: %v", err)
+			}
+		}()
+	}
+
 	tasks.Wait()
 }
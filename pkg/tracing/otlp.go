@@ -0,0 +1,224 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	scopeName = "github.com/elliotcourant/noahdb"
+
+	// otlpStatusError is the status code of a span that failed.
+	otlpStatusError = 2
+
+	collectorTracesPath = "/v1/traces"
+	collectorTimeout    = 5 * time.Second
+)
+
+// Exporter sends encoded traces somewhere they can be viewed, each payload is a single
+// OTLP/JSON ExportTraceServiceRequest.
+type Exporter interface {
+	Export(payload []byte) error
+	Close() error
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Flags             uint32          `json:"flags"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue, 64 bit integers are encoded as strings in OTLP/JSON.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+// encodeOTLP encodes the spans as an OTLP/JSON ExportTraceServiceRequest.
+func encodeOTLP(resource []Attribute, spans []SpanData) ([]byte, error) {
+	encoded := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		encoded[i] = otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			Flags:             uint32(span.Context.Flags),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(span.Attributes),
+		}
+		if span.Parent.IsValid() {
+			encoded[i].ParentSpanID = span.Parent.String()
+		}
+		if span.Error != "" {
+			encoded[i].Status = &otlpStatus{
+				Code:    otlpStatusError,
+				Message: span.Error,
+			}
+		}
+	}
+
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: encodeAttributes(resource),
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{
+							Name: scopeName,
+						},
+						Spans: encoded,
+					},
+				},
+			},
+		},
+	})
+}
+
+func encodeAttributes(attributes []Attribute) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attributes))
+	for _, attribute := range attributes {
+		value := otlpValue{}
+		switch v := attribute.Value.(type) {
+		case string:
+			value.StringValue = &v
+		case int64:
+			text := strconv.FormatInt(v, 10)
+			value.IntValue = &text
+		case float64:
+			value.DoubleValue = &v
+		case bool:
+			value.BoolValue = &v
+		default:
+			text := fmt.Sprint(v)
+			value.StringValue = &text
+		}
+		encoded = append(encoded, otlpAttribute{
+			Key:   attribute.Key,
+			Value: value,
+		})
+	}
+	return encoded
+}
+
+type fileExporter struct {
+	w io.WriteCloser
+}
+
+// NewFileExporter creates an exporter that writes each trace to the writer as a single line of
+// OTLP/JSON.
+func NewFileExporter(w io.WriteCloser) Exporter {
+	return &fileExporter{
+		w: w,
+	}
+}
+
+func (e *fileExporter) Export(payload []byte) error {
+	_, err := e.w.Write(append(payload, '\n'))
+	return err
+}
+
+func (e *fileExporter) Close() error {
+	return e.w.Close()
+}
+
+type collectorExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewCollectorExporter creates an exporter that sends each trace to an OpenTelemetry collector
+// using OTLP/HTTP with a JSON body. If the endpoint does not have a path then the traces are
+// sent to /v1/traces.
+func NewCollectorExporter(endpoint string) (Exporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("collector endpoint [%s] must be an http or https url", endpoint)
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = collectorTracesPath
+	}
+
+	return &collectorExporter{
+		endpoint: u.String(),
+		client: &http.Client{
+			Timeout: collectorTimeout,
+		},
+	}, nil
+}
+
+func (e *collectorExporter) Export(payload []byte) error {
+	response, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// The body needs to be read for the connection to be reused.
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %s: %s", response.Status, string(body))
+	}
+
+	return nil
+}
+
+func (e *collectorExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,230 @@
+package tracing
+
+import (
+	"sync"
+	"time"
+)
+
+// SpanKind describes how a span relates to the other spans in a trace, the values are the same
+// as the ones used by OTLP.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Attribute is a key and value recorded on a span, values can be a string, int64, float64 or
+// bool.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String creates a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int creates an integer attribute.
+func Int(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool creates a boolean attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanData is a span that has ended.
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+
+	// Error is the message of the error that caused the span to fail, this is blank if the span
+	// succeeded.
+	Error string
+}
+
+// recorder collects the spans of a trace as they end so they can be exported together once the
+// local root span has ended.
+type recorder struct {
+	sync.Mutex
+	tracer   *Tracer
+	sampled  bool
+	spans    []SpanData
+	exported bool
+}
+
+func (r *recorder) record(data SpanData, root bool) {
+	// Spans in traces that are not sampled are dropped, but their context is still valid so
+	// that the trace can be passed on.
+	if !r.sampled {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.spans = append(r.spans, data)
+
+	// Any span that ends after the root span is exported on its own.
+	if root || r.exported {
+		r.tracer.export(r.spans)
+		r.spans, r.exported = nil, true
+	}
+}
+
+// Span is a single unit of work in a trace. Every method can be called on a nil span, that way
+// callers don't need to check if tracing is enabled.
+type Span struct {
+	sync.Mutex
+	recorder *recorder
+	root     bool
+	data     SpanData
+	ended    bool
+}
+
+// StartSpan starts a new span now. If the parent is valid then the span is added to the
+// parent's trace, otherwise it starts a new trace.
+func (t *Tracer) StartSpan(name string, parent SpanContext, kind SpanKind) *Span {
+	return t.StartSpanAt(name, parent, kind, time.Now())
+}
+
+// StartSpanAt starts a new span at the provided time. The span is the local root of its trace,
+// the trace is exported once this span has ended. If the parent is valid but was not sampled
+// then none of the spans in the trace are exported.
+func (t *Tracer) StartSpanAt(name string, parent SpanContext, kind SpanKind, start time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+
+	data := SpanData{
+		Name:  name,
+		Kind:  kind,
+		Start: start,
+		Context: SpanContext{
+			TraceID: newTraceID(),
+			SpanID:  newSpanID(),
+			Flags:   flagSampled,
+		},
+	}
+	if parent.IsValid() {
+		data.Context.TraceID = parent.TraceID
+		data.Context.Flags = parent.Flags
+		data.Parent = parent.SpanID
+	}
+
+	return &Span{
+		recorder: &recorder{
+			tracer:  t,
+			sampled: data.Context.IsSampled(),
+		},
+		root: true,
+		data: data,
+	}
+}
+
+// StartChild starts a span now that is a child of this span.
+func (s *Span) StartChild(name string, kind SpanKind) *Span {
+	return s.StartChildAt(name, kind, time.Now())
+}
+
+// StartChildAt starts a span at the provided time that is a child of this span.
+func (s *Span) StartChildAt(name string, kind SpanKind, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+
+	parent := s.Context()
+	return &Span{
+		recorder: s.recorder,
+		data: SpanData{
+			Name:  name,
+			Kind:  kind,
+			Start: start,
+			Context: SpanContext{
+				TraceID: parent.TraceID,
+				SpanID:  newSpanID(),
+				Flags:   parent.Flags,
+			},
+			Parent: parent.SpanID,
+		},
+	}
+}
+
+// RecordChild adds a child span for work that has already finished.
+func (s *Span) RecordChild(name string, kind SpanKind, start, end time.Time, attributes ...Attribute) {
+	child := s.StartChildAt(name, kind, start)
+	child.SetAttributes(attributes...)
+	child.EndAt(end)
+}
+
+// Context returns the span context that can be passed to other processes.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.data.Context
+}
+
+// SetAttributes adds the attributes to the span, any attribute with the same key is replaced.
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, attribute := range attributes {
+		replaced := false
+		for i, existing := range s.data.Attributes {
+			if existing.Key == attribute.Key {
+				s.data.Attributes[i], replaced = attribute, true
+				break
+			}
+		}
+		if !replaced {
+			s.data.Attributes = append(s.data.Attributes, attribute)
+		}
+	}
+}
+
+// SetError marks the span as failed, nothing is changed if the error is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End finishes the span now.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt finishes the span at the provided time, a span can only be ended once.
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = end
+	data := s.data
+	s.Unlock()
+
+	s.recorder.record(data, s.root)
+}
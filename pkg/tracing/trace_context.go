@@ -0,0 +1,191 @@
+// Package tracing records spans for the statements a coordinator runs and exports them in the
+// OTLP/JSON format. Traces can be joined to an application's trace with a W3C traceparent.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	traceParentVersion = "00"
+
+	// flagSampled is the only trace flag defined by the W3C trace context. Traces that noahdb
+	// starts are always sampled, but a trace that is continued from a traceparent is only
+	// exported if the caller sampled it.
+	flagSampled byte = 0x01
+)
+
+var (
+	// traceParentComment matches a traceparent in a SQL comment, either as a key and value the
+	// way sqlcommenter writes it (traceparent='...') or as traceparent: ...
+	traceParentComment = regexp.MustCompile(`(?i)traceparent\s*[=:]\s*'?([0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2})'?`)
+)
+
+// TraceID identifies every span in a single trace.
+type TraceID [16]byte
+
+// SpanID identifies a single span within a trace.
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid returns false if every byte of the trace ID is zero.
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid returns false if every byte of the span ID is zero.
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext is the part of a span that is passed to other processes so that their spans can
+// be added to the same trace.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// IsValid returns true if the span context has both a trace ID and a span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// IsSampled returns true if the spans in the trace should be exported.
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// TraceParent formats the span context as a W3C traceparent header.
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("%s-%s-%s-%02x", traceParentVersion, sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceParent parses a W3C traceparent header, which looks like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceParent(traceParent string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent [%s]", traceParent)
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff {
+		return SpanContext{}, fmt.Errorf("invalid traceparent version [%s]", parts[0])
+	}
+
+	// Future versions may add fields to the end, but version 00 has exactly four.
+	if parts[0] == traceParentVersion && len(parts) != 4 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent [%s]", traceParent)
+	}
+
+	sc := SpanContext{}
+	if err := decodeHex(parts[1], sc.TraceID[:]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid trace id [%s]: %v", parts[1], err)
+	}
+
+	if err := decodeHex(parts[2], sc.SpanID[:]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid parent id [%s]: %v", parts[2], err)
+	}
+
+	flags := [1]byte{}
+	if err := decodeHex(parts[3], flags[:]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid trace flags [%s]: %v", parts[3], err)
+	}
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("trace id and parent id cannot be zero")
+	}
+
+	return sc, nil
+}
+
+// TraceParentFromComment looks for a traceparent in the comments of a query. If there is not
+// a valid traceparent in the query then false is returned.
+func TraceParentFromComment(query string) (SpanContext, bool) {
+	for _, comment := range sqlComments(query) {
+		match := traceParentComment.FindStringSubmatch(comment)
+		if match == nil {
+			continue
+		}
+
+		if sc, err := ParseTraceParent(match[1]); err == nil {
+			return sc, true
+		}
+	}
+
+	return SpanContext{}, false
+}
+
+// sqlComments returns the text of each -- and /* */ comment in the query. Anything inside of
+// a string literal or a quoted identifier is skipped.
+func sqlComments(query string) []string {
+	comments := make([]string, 0)
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == '\'' || query[i] == '"':
+			quote := query[i]
+			for i++; i < len(query) && query[i] != quote; i++ {
+			}
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			comments = append(comments, query[i+2:i+end])
+			i += end
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				comments = append(comments, query[i+2:])
+				return comments
+			}
+			comments = append(comments, query[i+2:i+2+end])
+			i += end + 3
+		}
+	}
+
+	return comments
+}
+
+func decodeHex(text string, dst []byte) error {
+	if len(text) != hex.EncodedLen(len(dst)) {
+		return fmt.Errorf("expected %d hex characters", hex.EncodedLen(len(dst)))
+	}
+
+	// Uppercase hex is not allowed by the W3C trace context.
+	if strings.ToLower(text) != text {
+		return fmt.Errorf("hex must be lowercase")
+	}
+
+	_, err := hex.Decode(dst, []byte(text))
+	return err
+}
+
+func newTraceID() TraceID {
+	id := TraceID{}
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	id := SpanID{}
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"github.com/elliotcourant/timber"
+	"sync"
+)
+
+const (
+	// exportQueueSize is the number of traces that can be waiting to be exported, traces are
+	// dropped once the queue is full so that a slow collector never slows down statements.
+	exportQueueSize = 1024
+)
+
+// Tracer starts spans and exports each trace once its root span has ended. Traces are exported
+// in the background. A nil tracer is valid and does not record anything.
+type Tracer struct {
+	sync.Mutex
+	exporter Exporter
+	resource []Attribute
+	queue    chan []SpanData
+	done     chan struct{}
+	closed   bool
+}
+
+// NewTracer creates a tracer that sends traces to the exporter. The resource attributes describe
+// the process that is recording the spans.
+func NewTracer(exporter Exporter, resource ...Attribute) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		resource: resource,
+		queue:    make(chan []SpanData, exportQueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *Tracer) export(spans []SpanData) {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		return
+	}
+
+	select {
+	case t.queue <- spans:
+	default:
+		timber.Warningf("trace export queue is full, dropping %d span(s)", len(spans))
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	for spans := range t.queue {
+		payload, err := encodeOTLP(t.resource, spans)
+		if err != nil {
+			timber.Warningf("could not encode trace: %v", err)
+			continue
+		}
+
+		if err := t.exporter.Export(payload); err != nil {
+			timber.Warningf("could not export trace: %v", err)
+		}
+	}
+}
+
+// Close exports any traces that are waiting in the queue and then closes the exporter. Spans
+// that end after the tracer has been closed are discarded.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+
+	t.Lock()
+	if t.closed {
+		t.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.queue)
+	t.Unlock()
+
+	<-t.done
+	return t.exporter.Close()
+}
@@ -0,0 +1,177 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func TestParseTraceParent(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		sc, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		assert.NoError(t, err)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+		assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+		assert.Equal(t, byte(1), sc.Flags)
+		assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.TraceParent())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, traceParent := range []string{
+			"",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-00",
+			"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+			"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		} {
+			_, err := ParseTraceParent(traceParent)
+			assert.Error(t, err, traceParent)
+		}
+	})
+}
+
+func TestTraceParentFromComment(t *testing.T) {
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, query := range []string{
+		"SELECT 1 /*traceparent='00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01'*/",
+		"/* app='test', traceparent='00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01' */ SELECT 1",
+		"SELECT 1 -- traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		sc, ok := TraceParentFromComment(query)
+		assert.True(t, ok, query)
+		assert.Equal(t, traceId, sc.TraceID.String(), query)
+	}
+
+	for _, query := range []string{
+		"SELECT 1",
+		"SELECT 'traceparent=''00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01'''",
+		"SELECT 1 /* traceparent='00-not-a-traceparent' */",
+	} {
+		_, ok := TraceParentFromComment(query)
+		assert.False(t, ok, query)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	buf := &bufferCloser{}
+	tracer := NewTracer(NewFileExporter(buf), String("service.name", "noahdb"))
+
+	parent, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+
+	root := tracer.StartSpan("statement", parent, SpanKindServer)
+	root.SetAttributes(String("db.statement", "SELECT 1"), Int("db.rows", 1))
+	child := root.StartChild("dispatch", SpanKindClient)
+	child.SetError(errors.New("failed"))
+	child.End()
+	root.End()
+	root.End()
+	assert.NoError(t, tracer.Close())
+
+	// The whole trace is exported as a single line once the root span has ended.
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if !assert.Len(t, lines, 1) {
+		return
+	}
+
+	request := otlpRequest{}
+	assert.NoError(t, json.Unmarshal(lines[0], &request))
+	if !assert.Len(t, request.ResourceSpans, 1) {
+		return
+	}
+	assert.Equal(t, "service.name", request.ResourceSpans[0].Resource.Attributes[0].Key)
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+
+	dispatch, statement := spans[0], spans[1]
+	assert.Equal(t, "statement", statement.Name)
+	assert.Equal(t, parent.TraceID.String(), statement.TraceID)
+	assert.Equal(t, parent.SpanID.String(), statement.ParentSpanID)
+	assert.Equal(t, SpanKindServer, statement.Kind)
+	assert.Equal(t, "1", *statement.Attributes[1].Value.IntValue)
+	assert.Nil(t, statement.Status)
+
+	assert.Equal(t, "dispatch", dispatch.Name)
+	assert.Equal(t, statement.TraceID, dispatch.TraceID)
+	assert.Equal(t, statement.SpanID, dispatch.ParentSpanID)
+	assert.Equal(t, otlpStatusError, dispatch.Status.Code)
+	assert.Equal(t, "failed", dispatch.Status.Message)
+}
+
+func TestTracer_NotSampled(t *testing.T) {
+	buf := &bufferCloser{}
+	tracer := NewTracer(NewFileExporter(buf))
+
+	parent, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.NoError(t, err)
+
+	root := tracer.StartSpan("statement", parent, SpanKindServer)
+	root.StartChild("dispatch", SpanKindClient).End()
+	root.End()
+	assert.NoError(t, tracer.Close())
+
+	// The trace is still passed on, but nothing is exported.
+	assert.Equal(t, parent.TraceID, root.Context().TraceID)
+	assert.False(t, root.Context().IsSampled())
+	assert.Empty(t, buf.String())
+
+	// Traces that are started by noahdb are always sampled.
+	assert.True(t, tracer.StartSpan("statement", SpanContext{}, SpanKindServer).Context().IsSampled())
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.StartSpan("statement", SpanContext{}, SpanKindServer)
+	assert.Nil(t, span)
+	span.StartChild("child", SpanKindInternal).End()
+	span.SetAttributes(String("key", "value"))
+	span.End()
+	assert.False(t, span.Context().IsValid())
+	assert.NoError(t, tracer.Close())
+}
+
+func TestCollectorExporter(t *testing.T) {
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- body
+	}))
+	defer server.Close()
+
+	exporter, err := NewCollectorExporter(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tracer := NewTracer(exporter)
+	tracer.StartSpan("statement", SpanContext{}, SpanKindServer).End()
+	assert.NoError(t, tracer.Close())
+
+	body := <-received
+	request := otlpRequest{}
+	assert.NoError(t, json.Unmarshal(body, &request))
+	assert.Equal(t, "statement", request.ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+
+	_, err = NewCollectorExporter("localhost:4318")
+	assert.Error(t, err)
+}
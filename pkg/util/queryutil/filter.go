@@ -12,11 +12,24 @@ func FindAccountIdsEx(
 	stmt interface{},
 	shardColumnNames map[string]string,
 	columnsAndTables map[string][]string,
+) ([]uint64, error) {
+	return FindAccountIdsWithArguments(stmt, shardColumnNames, columnsAndTables, nil)
+}
+
+// FindAccountIdsWithArguments behaves the same as FindAccountIdsEx, but if the shard column is
+// compared to a placeholder then the value of that placeholder will be read from the provided
+// arguments.
+func FindAccountIdsWithArguments(
+	stmt interface{},
+	shardColumnNames map[string]string,
+	columnsAndTables map[string][]string,
+	args QueryArguments,
 ) ([]uint64, error) {
 	f := &findAccounts{
 		shardColumnNames: shardColumnNames,
 		aliases:          map[string]string{},
 		columnsAndTables: columnsAndTables,
+		arguments:        args,
 	}
 	return f.findAccountIdsEx(stmt)
 }
@@ -29,6 +42,7 @@ type findAccounts struct {
 	aliases          map[string]string
 	shardColumnNames map[string]string
 	columnsAndTables map[string][]string
+	arguments        QueryArguments
 }
 
 func (f *findAccounts) findAccountIdsEx(value interface{}) ([]uint64, error) {
@@ -78,7 +92,7 @@ func (f *findAccounts) findAccountIdsEx(value interface{}) ([]uint64, error) {
 			return nil, nil
 		}
 
-		return getNumericValues(expr.Rexpr)
+		return getNumericValues(expr.Rexpr, f.arguments)
 	}
 
 	t := reflect.TypeOf(value)
@@ -112,14 +126,64 @@ func (f *findAccounts) findAccountIdsEx(value interface{}) ([]uint64, error) {
 	return args, nil
 }
 
-func getNumericValues(node ast.Node) ([]uint64, error) {
+// GetNumericValue returns the integer value of the provided node, if the node is a placeholder
+// then the value will be read from the provided arguments.
+func GetNumericValue(node ast.Node, args QueryArguments) (uint64, error) {
+	values, err := getNumericValues(node, args)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) != 1 {
+		return 0, fmt.Errorf("expected a single numeric value, found %d", len(values))
+	}
+	return values[0], nil
+}
+
+// GetStringValue returns the text of the provided constant node, if the node is a placeholder then
+// the value will be read from the provided arguments.
+func GetStringValue(node ast.Node, args QueryArguments) (string, error) {
+	switch item := node.(type) {
+	case ast.ParamRef:
+		if item.Number < 1 || item.Number > len(args) {
+			return "", fmt.Errorf("no value provided for placeholder $%d", item.Number)
+		}
+		if args[item.Number-1] == nil {
+			return "", fmt.Errorf("placeholder $%d cannot be null", item.Number)
+		}
+		return GetStringValue(ReplaceArguments(item, args).(ast.Node), args)
+	case ast.TypeCast:
+		return GetStringValue(item.Arg, args)
+	case ast.A_Const:
+		return GetStringValue(item.Val, args)
+	case ast.String:
+		return item.Str, nil
+	case ast.Integer:
+		return strconv.FormatInt(item.Ival, 10), nil
+	case ast.Float:
+		return item.Str, nil
+	default:
+		return "", fmt.Errorf("could not handle value type [%T]", item)
+	}
+}
+
+func getNumericValues(node ast.Node, args QueryArguments) ([]uint64, error) {
 	switch item := node.(type) {
+	case ast.ParamRef:
+		if item.Number < 1 || item.Number > len(args) {
+			return nil, fmt.Errorf("no value provided for placeholder $%d", item.Number)
+		}
+		if args[item.Number-1] == nil {
+			return nil, fmt.Errorf("placeholder $%d cannot be null", item.Number)
+		}
+		return getNumericValues(ReplaceArguments(item, args).(ast.Node), args)
+	case ast.TypeCast:
+		return getNumericValues(item.Arg, args)
 	case ast.A_Const:
-		return getNumericValues(item.Val)
+		return getNumericValues(item.Val, args)
 	case ast.List:
 		ids := make([]uint64, 0)
 		for _, listItem := range item.Items {
-			if values, err := getNumericValues(listItem); err != nil {
+			if values, err := getNumericValues(listItem, args); err != nil {
 				return nil, err
 			} else if values != nil {
 				ids = append(ids, values...)
@@ -2,6 +2,7 @@ package queryutil
 
 import (
 	"github.com/elliotcourant/noahdb/pkg/ast"
+	"github.com/elliotcourant/noahdb/pkg/types"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -56,3 +57,53 @@ func Test_FindAccountIdsEx(t *testing.T) {
 		assert.Empty(t, ids)
 	})
 }
+
+func Test_FindAccountIdsWithArguments(t *testing.T) {
+	t.Run("placeholder account id", func(t *testing.T) {
+		query := `SELECT p.id, p.account_id, p.sku FROM products p WHERE p.id = $1 AND p.account_id = $2;`
+		tree, _ := ast.Parse(query)
+		ids, err := FindAccountIdsWithArguments(tree, map[string]string{
+			"products": "account_id",
+		}, map[string][]string{
+			"id":         {"product"},
+			"account_id": {"product"},
+			"sku":        {"sku"},
+		}, QueryArguments{
+			&types.Int8{Int: 1234, Status: types.Present},
+			&types.Int8{Int: 123421, Status: types.Present},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{123421}, ids, "the returned ids do not match expected values")
+	})
+
+	t.Run("missing placeholder", func(t *testing.T) {
+		query := `SELECT p.id FROM products p WHERE p.account_id = $1;`
+		tree, _ := ast.Parse(query)
+		_, err := FindAccountIdsWithArguments(tree, map[string]string{
+			"products": "account_id",
+		}, map[string][]string{
+			"id":         {"product"},
+			"account_id": {"product"},
+		}, nil)
+		assert.EqualError(t, err, "no value provided for placeholder $1")
+	})
+}
+
+func Test_GetStringValue(t *testing.T) {
+	t.Run("string constant", func(t *testing.T) {
+		value, err := GetStringValue(ast.A_Const{Val: ast.String{Str: "verify-full"}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "verify-full", value)
+	})
+
+	t.Run("integer constant", func(t *testing.T) {
+		value, err := GetStringValue(ast.A_Const{Val: ast.Integer{Ival: 5432}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "5432", value)
+	})
+
+	t.Run("missing placeholder", func(t *testing.T) {
+		_, err := GetStringValue(ast.ParamRef{Number: 1}, nil)
+		assert.Error(t, err)
+	})
+}
@@ -14,6 +14,12 @@ func GetTables(stmt interface{}) []string {
 	return tables
 }
 
+// GetRangeVars returns every table reference in the provided statement. The returned range vars
+// are copies, but their names point to the same strings as the statement.
+func GetRangeVars(stmt interface{}) []ast.RangeVar {
+	return examineRangeVars(stmt)
+}
+
 func GetExtendedTables(stmt interface{}) map[string]string {
 	tables := map[string]string{}
 	for _, item := range extendendExamineTables(stmt, 0) {
@@ -74,6 +80,88 @@ func examineTables(value interface{}, depth int) []string {
 	return args
 }
 
+func examineRangeVars(value interface{}) []ast.RangeVar {
+	rangeVars := make([]ast.RangeVar, 0)
+	if value == nil {
+		return rangeVars
+	}
+
+	t := reflect.TypeOf(value)
+	v := reflect.ValueOf(value)
+
+	if rangeVar, ok := value.(ast.RangeVar); ok {
+		rangeVars = append(rangeVars, rangeVar)
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		if v.Elem().IsValid() {
+			rangeVars = append(rangeVars, examineRangeVars(v.Elem().Interface())...)
+		}
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			rangeVars = append(rangeVars, examineRangeVars(v.Index(i).Interface())...)
+		}
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			rangeVars = append(rangeVars, examineRangeVars(v.Field(i).Interface())...)
+		}
+	}
+	return rangeVars
+}
+
+// ReplaceRangeVars returns a copy of the statement where each range var has been replaced with
+// the result of the replace func. The statement that is passed is not changed, the replace func is
+// given a copy of each range var that it is free to change.
+func ReplaceRangeVars(stmt interface{}, replace func(ast.RangeVar) ast.RangeVar) interface{} {
+	return replaceRangeVars(stmt, replace)
+}
+
+func replaceRangeVars(value interface{}, replace func(ast.RangeVar) ast.RangeVar) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	typ := reflect.TypeOf(value)
+	val := reflect.ValueOf(value)
+
+	switch typ.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			return value
+		}
+		copy := reflect.New(typ.Elem())
+		if result := replaceRangeVars(val.Elem().Interface(), replace); result != nil {
+			copy.Elem().Set(reflect.ValueOf(result))
+		}
+		return copy.Interface()
+	case reflect.Slice:
+		if val.IsNil() {
+			return value
+		}
+		copySlice := reflect.MakeSlice(typ, val.Len(), val.Len())
+		for i := 0; i < val.Len(); i++ {
+			if result := replaceRangeVars(val.Index(i).Interface(), replace); result != nil {
+				copySlice.Index(i).Set(reflect.ValueOf(result))
+			}
+		}
+		return copySlice.Interface()
+	case reflect.Struct:
+		copy := reflect.New(typ).Elem()
+		for i := 0; i < copy.NumField(); i++ {
+			if result := replaceRangeVars(val.Field(i).Interface(), replace); result != nil {
+				copy.Field(i).Set(reflect.ValueOf(result))
+			}
+		}
+		if rangeVar, ok := copy.Interface().(ast.RangeVar); ok {
+			return replace(rangeVar)
+		}
+		return copy.Interface()
+	default:
+		return value
+	}
+}
+
 type tableAliasItem struct {
 	Alias  string
 	Actual string
@@ -139,3 +139,51 @@ func Test_GetExtendedTables(t *testing.T) {
 		})
 	}
 }
+
+func Test_GetRangeVars(t *testing.T) {
+	parsed, err := ast.Parse("SELECT * FROM noah.data_nodes JOIN noah.data_node_shards ON data_node_shards.data_node_id = data_nodes.data_node_id")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	stmt := parsed.Statements[0].(ast.RawStmt).Stmt
+
+	rangeVars := GetRangeVars(stmt)
+	if !assert.Len(t, rangeVars, 2) {
+		t.FailNow()
+	}
+	assert.Equal(t, "noah", *rangeVars[0].Schemaname)
+	assert.Equal(t, "data_nodes", *rangeVars[0].Relname)
+	assert.Equal(t, "noah", *rangeVars[1].Schemaname)
+	assert.Equal(t, "data_node_shards", *rangeVars[1].Relname)
+
+	// The names are shared with the statement, so changing them changes the statement.
+	*rangeVars[0].Relname = "data_nodes_renamed"
+	assert.Equal(t, "data_nodes_renamed", *GetRangeVars(stmt)[0].Relname)
+}
+
+func Test_ReplaceRangeVars(t *testing.T) {
+	parsed, err := ast.Parse("SELECT * FROM noah.shards WHERE shard_id IN (SELECT shard_id FROM noah.tenants)")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	stmt := parsed.Statements[0].(ast.RawStmt).Stmt
+
+	replaced := ReplaceRangeVars(stmt, func(rangeVar ast.RangeVar) ast.RangeVar {
+		relation := "noah_" + *rangeVar.Relname
+		rangeVar.Schemaname, rangeVar.Relname = nil, &relation
+		return rangeVar
+	})
+
+	assert.Equal(t, []string{"noah_shards", "noah_tenants"}, GetTables(replaced))
+
+	// The original statement is left alone.
+	assert.Equal(t, []string{"shards", "tenants"}, GetTables(stmt))
+	for _, rangeVar := range GetRangeVars(stmt) {
+		if assert.NotNil(t, rangeVar.Schemaname) {
+			assert.Equal(t, "noah", *rangeVar.Schemaname)
+		}
+	}
+}
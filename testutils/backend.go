@@ -20,6 +20,15 @@ func CreateTestBackend(t *testing.T) *pgproto.Backend {
 	return CreateTextBackendEx(t, BufferHealthy)
 }
 
+// CreateTestBackendWithOutput returns a backend along with the buffer that its messages are
+// written to, so that tests can read back what would have been sent to the client.
+func CreateTestBackendWithOutput(t *testing.T) (*pgproto.Backend, *bytes.Buffer) {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	b, err := pgproto.NewBackend(buffer, buffer)
+	assert.NoError(t, err)
+	return b, buffer
+}
+
 func CreateTextBackendEx(t *testing.T, health BufferHealth) *pgproto.Backend {
 	var buffer io.ReadWriter
 	switch health {
@@ -18,6 +18,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -253,6 +254,7 @@ func NewTestColonyEx(t *testing.T, listenAddr string, spawnPg bool, joinAddresse
 		LocalPostgresAddress:  tempPostgresAddress,
 		LocalPostgresPassword: tempPostgresPassword,
 		LocalPostgresPort:     tempPostgresPort,
+		TraceFile:             filepath.Join(tempdir, "traces.json"),
 	}
 
 	err = colony.InitColony(config, log)